@@ -0,0 +1,129 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageMirrorSpec defines the image copy to perform.
+type ImageMirrorSpec struct {
+	// Source is the image reference to copy from, as it appeared in the pod spec.
+	// +kubebuilder:validation:MinLength=1
+	Source string `json:"source"`
+
+	// Target is the image reference on the mirror registry to copy to.
+	// +kubebuilder:validation:MinLength=1
+	Target string `json:"target"`
+}
+
+// ImageMirrorPhase is the lifecycle phase of an ImageMirror.
+// +kubebuilder:validation:Enum=Pending;Copying;Succeeded;Failed
+type ImageMirrorPhase string
+
+const (
+	// ImageMirrorPending means the copy has not started yet.
+	ImageMirrorPending ImageMirrorPhase = "Pending"
+	// ImageMirrorCopying means a copy attempt is in progress or will be retried.
+	ImageMirrorCopying ImageMirrorPhase = "Copying"
+	// ImageMirrorSucceeded means the target holds the image.
+	ImageMirrorSucceeded ImageMirrorPhase = "Succeeded"
+	// ImageMirrorFailed means all attempts failed.
+	ImageMirrorFailed ImageMirrorPhase = "Failed"
+)
+
+// ImageMirrorStatus defines the observed state of ImageMirror.
+type ImageMirrorStatus struct {
+	// Phase summarizes the state of the copy.
+	// +optional
+	Phase ImageMirrorPhase `json:"phase,omitempty"`
+
+	// TotalManifests is the number of manifests to copy, including those of each platform of an index.
+	// +optional
+	TotalManifests int32 `json:"totalManifests,omitempty"`
+
+	// CopiedManifests is the number of manifests present on the target.
+	// +optional
+	CopiedManifests int32 `json:"copiedManifests,omitempty"`
+
+	// TotalBlobs is the number of distinct layer and config blobs to copy.
+	// +optional
+	TotalBlobs int32 `json:"totalBlobs,omitempty"`
+
+	// CopiedBlobs is the number of blobs present on the target.
+	// +optional
+	CopiedBlobs int32 `json:"copiedBlobs,omitempty"`
+
+	// CopiedBytes is the number of bytes transferred during the last attempt.
+	// +optional
+	CopiedBytes int64 `json:"copiedBytes,omitempty"`
+
+	// Attempts is the number of copy attempts made.
+	// +optional
+	Attempts int32 `json:"attempts,omitempty"`
+
+	// LastError is the error of the last failed attempt.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+
+	// CompletionTime is when the copy succeeded.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// SourceDigest is the manifest digest the source resolved to when it was last copied. A mirror of
+	// a tag is copied again once the tag resolves to another digest.
+	// +optional
+	SourceDigest string `json:"sourceDigest,omitempty"`
+
+	// Conditions represent the current state of the ImageMirror resource.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Source",type=string,JSONPath=`.spec.source`
+// +kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.spec.target`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Blobs",type=string,JSONPath=`.status.copiedBlobs`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ImageMirror is the Schema for the imagemirrors API. It requests that an image be copied from its
+// source registry to a mirror.
+type ImageMirror struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageMirrorSpec   `json:"spec"`
+	Status ImageMirrorStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageMirrorList contains a list of ImageMirror.
+type ImageMirrorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageMirror `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageMirror{}, &ImageMirrorList{})
+}
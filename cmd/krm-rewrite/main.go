@@ -0,0 +1,215 @@
+// PURPOSE: KRM function that rewrites the container images of Pods and workloads in a kustomize or kpt ResourceList
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/yaml"
+
+	"mutating-registry-hook/internal/manifest"
+	"mutating-registry-hook/internal/registry"
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const (
+	resourceListAPIVersion = "config.kubernetes.io/v1"
+	resourceListKind       = "ResourceList"
+
+	// FunctionConfigKind is the kind of the typed functionConfig. A ConfigMap with the same keys
+	// in its data is accepted as well.
+	FunctionConfigKind = "ImageRewrite"
+)
+
+// ResourceList is the KRM function input and output.
+type ResourceList struct {
+	APIVersion     string                       `json:"apiVersion"`
+	Kind           string                       `json:"kind"`
+	Items          []*unstructured.Unstructured `json:"items"`
+	FunctionConfig *unstructured.Unstructured   `json:"functionConfig,omitempty"`
+	Results        []Result                     `json:"results,omitempty"`
+}
+
+// Result is a KRM function result entry.
+type Result struct {
+	Message     string       `json:"message"`
+	Severity    string       `json:"severity,omitempty"`
+	ResourceRef *ResourceRef `json:"resourceRef,omitempty"`
+	Field       *Field       `json:"field,omitempty"`
+}
+
+// ResourceRef identifies the resource a result is about.
+type ResourceRef struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace,omitempty"`
+}
+
+// Field identifies the field a result is about.
+type Field struct {
+	Path          string `json:"path"`
+	CurrentValue  string `json:"currentValue,omitempty"`
+	ProposedValue string `json:"proposedValue,omitempty"`
+}
+
+// Config holds the functionConfig settings.
+type Config struct {
+	// Policy is applied to every pod spec, as the webhook applies a namespace's policy. It is built
+	// from either a targetRegistry shorthand or a policy in the format of the rewrite CLI's --policy file.
+	Policy webhookv1.Policy
+	// Namespaces, when set, limits rewriting to resources in these namespaces.
+	Namespaces []string
+}
+
+func main() {
+	// The webhook's decision log would otherwise end up in the orchestrator's output
+	logf.SetLogger(logr.Discard())
+	if err := run(os.Stdin, os.Stdout); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "krm-rewrite:", err)
+		os.Exit(1)
+	}
+}
+
+// run processes one ResourceList. The output ResourceList is written even when processing fails, so
+// the orchestrator can show the error results.
+func run(stdin io.Reader, stdout io.Writer) error {
+	input, err := io.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	list := &ResourceList{}
+	if err := yaml.Unmarshal(input, list); err != nil {
+		return fmt.Errorf("decoding ResourceList: %w", err)
+	}
+	if list.Kind != resourceListKind {
+		return fmt.Errorf("expected a %s, got kind %q", resourceListKind, list.Kind)
+	}
+	list.APIVersion = resourceListAPIVersion
+
+	processErr := process(list)
+	if processErr != nil {
+		list.Results = append(list.Results, Result{Message: processErr.Error(), Severity: "error"})
+	}
+
+	output, err := yaml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if _, err := stdout.Write(output); err != nil {
+		return err
+	}
+	return processErr
+}
+
+// process rewrites the images of every item through the webhook's pipeline and records a result per
+// rewritten image.
+func process(list *ResourceList) error {
+	config, err := parseConfig(list.FunctionConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	defaulter := &webhookv1.PodCustomDefaulter{}
+	for _, item := range list.Items {
+		if len(config.Namespaces) > 0 && !slices.Contains(config.Namespaces, item.GetNamespace()) {
+			continue
+		}
+
+		changes, err := manifest.MutatePodSpecs(item, func(pod *corev1.Pod) error {
+			return defaulter.ApplyPolicy(ctx, pod, config.Policy)
+		})
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", item.GetKind(), item.GetName(), err)
+		}
+
+		for _, change := range changes {
+			list.Results = append(list.Results, Result{
+				Message: fmt.Sprintf("rewrote image of container %s from %s to %s",
+					change.Container, change.Original, change.Image),
+				Severity: "info",
+				ResourceRef: &ResourceRef{
+					APIVersion: change.APIVersion, Kind: change.Kind, Name: change.Name, Namespace: change.Namespace,
+				},
+				Field: &Field{Path: change.Field, CurrentValue: change.Original, ProposedValue: change.Image},
+			})
+		}
+	}
+	return nil
+}
+
+// parseConfig reads the settings from a typed ImageRewrite functionConfig or from a ConfigMap's data.
+func parseConfig(functionConfig *unstructured.Unstructured) (Config, error) {
+	if functionConfig == nil {
+		return Config{}, errors.New("functionConfig is required")
+	}
+
+	var config Config
+	var targetRegistry string
+	var policy []byte
+	switch functionConfig.GetKind() {
+	case "ConfigMap":
+		data, _, _ := unstructured.NestedStringMap(functionConfig.Object, "data")
+		targetRegistry = data["targetRegistry"]
+		for _, namespace := range strings.Split(data["namespaces"], ",") {
+			if namespace = strings.TrimSpace(namespace); namespace != "" {
+				config.Namespaces = append(config.Namespaces, namespace)
+			}
+		}
+		if data["policy"] != "" {
+			policy = []byte(data["policy"])
+		}
+	case FunctionConfigKind:
+		var err error
+		targetRegistry, _, err = unstructured.NestedString(functionConfig.Object, "spec", "targetRegistry")
+		if err != nil {
+			return Config{}, fmt.Errorf("functionConfig: %w", err)
+		}
+		config.Namespaces, _, err = unstructured.NestedStringSlice(functionConfig.Object, "spec", "namespaces")
+		if err != nil {
+			return Config{}, fmt.Errorf("functionConfig: %w", err)
+		}
+		if spec, found, _ := unstructured.NestedMap(functionConfig.Object, "spec", "policy"); found {
+			if policy, err = yaml.Marshal(spec); err != nil {
+				return Config{}, fmt.Errorf("functionConfig: %w", err)
+			}
+		}
+	default:
+		return Config{}, fmt.Errorf("unsupported functionConfig kind %q, expected %s or ConfigMap",
+			functionConfig.GetKind(), FunctionConfigKind)
+	}
+
+	switch {
+	case targetRegistry != "" && policy != nil:
+		return Config{}, errors.New("functionConfig: targetRegistry and policy are mutually exclusive")
+	case policy != nil:
+		parsed, err := webhookv1.ParsePolicyFile(policy)
+		if err != nil {
+			return Config{}, fmt.Errorf("functionConfig: %w", err)
+		}
+		config.Policy = parsed
+	case targetRegistry != "":
+		target, err := registry.NormalizeTarget(targetRegistry)
+		if err != nil {
+			return Config{}, fmt.Errorf("functionConfig: targetRegistry: %w", err)
+		}
+		config.Policy = webhookv1.Policy{TargetRegistries: []string{target}}
+	default:
+		return Config{}, errors.New("functionConfig: targetRegistry or policy is required")
+	}
+
+	// A function runs hermetically, so images are not looked up on the target; with several targets
+	// the first is used
+	config.Policy.Verify = false
+	return config, nil
+}
@@ -0,0 +1,213 @@
+// PURPOSE: Tests the KRM function on ResourceLists as kustomize and kpt send them
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+const resourceList = `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: fn.image-rewriter.example.com/v1alpha1
+  kind: ImageRewrite
+  metadata:
+    name: rewrite
+  spec:
+    targetRegistry: myregistry.io
+items:
+- apiVersion: apps/v1
+  kind: StatefulSet
+  metadata:
+    name: db
+    namespace: team-a
+    annotations:
+      config.kubernetes.io/index: "0"
+  spec:
+    template:
+      spec:
+        containers:
+        - name: postgres
+          image: postgres:16
+        - name: exporter
+          image: myregistry.io/exporter:v1
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: db
+`
+
+func TestRun_RewritesItemsAndReportsResults(t *testing.T) {
+	var stdout bytes.Buffer
+	if err := run(strings.NewReader(resourceList), &stdout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := &ResourceList{}
+	if err := yaml.Unmarshal(stdout.Bytes(), out); err != nil {
+		t.Fatalf("invalid output: %v", err)
+	}
+	if len(out.Items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(out.Items))
+	}
+	if !strings.Contains(stdout.String(), "image: myregistry.io/postgres:16") {
+		t.Errorf("expected the postgres image to be rewritten:\n%s", stdout.String())
+	}
+	if out.Items[0].GetAnnotations()["config.kubernetes.io/index"] != "0" {
+		t.Error("expected item annotations to be preserved")
+	}
+
+	if len(out.Results) != 1 {
+		t.Fatalf("expected one result for the rewritten container, got %+v", out.Results)
+	}
+	result := out.Results[0]
+	if result.Severity != "info" || result.ResourceRef.Name != "db" || result.ResourceRef.Kind != "StatefulSet" ||
+		result.Field.Path != "spec.template.spec.containers[0].image" ||
+		result.Field.ProposedValue != "myregistry.io/postgres:16" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+func TestRun_ConfigMapFunctionConfigWithNamespaces(t *testing.T) {
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: rewrite
+  data:
+    targetRegistry: myregistry.io
+    namespaces: team-b
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: app
+    namespace: team-a
+  spec:
+    containers:
+    - name: app
+      image: app:v1
+`
+	var stdout bytes.Buffer
+	if err := run(strings.NewReader(input), &stdout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "image: app:v1") {
+		t.Errorf("expected the pod outside the configured namespaces to be left alone:\n%s", stdout.String())
+	}
+}
+
+func TestRun_MissingTargetRegistryIsAnErrorResult(t *testing.T) {
+	input := strings.Replace(resourceList, "targetRegistry: myregistry.io", "targetRegistry: \"\"", 1)
+
+	var stdout bytes.Buffer
+	if err := run(strings.NewReader(input), &stdout); err == nil {
+		t.Fatal("expected an error for a missing target registry")
+	}
+	if !strings.Contains(stdout.String(), "severity: error") {
+		t.Errorf("expected an error result in the output:\n%s", stdout.String())
+	}
+}
+
+func TestRun_PolicyAppliesTheWebhookPipeline(t *testing.T) {
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: fn.image-rewriter.example.com/v1alpha1
+  kind: ImageRewrite
+  metadata:
+    name: rewrite
+  spec:
+    policy:
+      targetRegistries: [myregistry.io]
+      preserveRegistries: [quay.io]
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: app
+    namespace: team-a
+  spec:
+    containers:
+    - name: app
+      image: app:v1
+    - name: broken
+      image: "Not A Valid Image"
+    - name: sidecar
+      image: quay.io/team/sidecar:v1
+    volumes:
+    - name: data
+      image:
+        reference: data:v1
+`
+	var stdout bytes.Buffer
+	if err := run(strings.NewReader(input), &stdout); err != nil {
+		t.Fatalf("expected an unparsable image to be skipped, got %v", err)
+	}
+
+	out := stdout.String()
+	for _, want := range []string{"image: myregistry.io/app:v1", "image: Not A Valid Image",
+		"image: quay.io/team/sidecar:v1", "reference: myregistry.io/data:v1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRun_ListItemResultsReferToTheListedObject(t *testing.T) {
+	input := `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+functionConfig:
+  apiVersion: fn.image-rewriter.example.com/v1alpha1
+  kind: ImageRewrite
+  metadata:
+    name: rewrite
+  spec:
+    targetRegistry: myregistry.io
+items:
+- apiVersion: v1
+  kind: List
+  items:
+  - apiVersion: apps/v1
+    kind: Deployment
+    metadata:
+      name: web
+      namespace: team-a
+    spec:
+      template:
+        spec:
+          containers:
+          - name: web
+            image: nginx:1.25
+`
+	var stdout bytes.Buffer
+	if err := run(strings.NewReader(input), &stdout); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	out := &ResourceList{}
+	if err := yaml.Unmarshal(stdout.Bytes(), out); err != nil {
+		t.Fatalf("invalid output: %v", err)
+	}
+	if len(out.Results) != 1 {
+		t.Fatalf("expected one result for the rewritten container, got %+v", out.Results)
+	}
+	if ref := out.Results[0].ResourceRef; *ref != (ResourceRef{APIVersion: "apps/v1", Kind: "Deployment", Name: "web",
+		Namespace: "team-a"}) {
+		t.Errorf("expected the result to refer to the Deployment in the List, got %+v", ref)
+	}
+}
+
+func TestRun_TargetRegistryAndPolicyAreExclusive(t *testing.T) {
+	input := strings.Replace(resourceList, "targetRegistry: myregistry.io",
+		"targetRegistry: myregistry.io\n    policy: {targetRegistries: [other.io]}", 1)
+
+	if err := run(strings.NewReader(input), &bytes.Buffer{}); err == nil {
+		t.Error("expected an error when both targetRegistry and policy are set")
+	}
+}
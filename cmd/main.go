@@ -17,24 +17,45 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	mirrorv1alpha1 "mutating-registry-hook/api/v1alpha1"
+	"mutating-registry-hook/internal/config"
+	"mutating-registry-hook/internal/controller"
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
 	webhookv1 "mutating-registry-hook/internal/webhook/v1"
 	// +kubebuilder:scaffold:imports
 )
@@ -46,20 +67,38 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(mirrorv1alpha1.AddToScheme(scheme))
 
 	// +kubebuilder:scaffold:scheme
 }
 
 // nolint:gocyclo
 func main() {
+	var configFile string
 	var metricsAddr string
 	var metricsCertPath, metricsCertName, metricsCertKey string
+	var webhookPort int
 	var webhookCertPath, webhookCertName, webhookCertKey string
 	var enableLeaderElection bool
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var registryCredentialsSecret string
+	var defaultsConfigMap string
+	var pullSecrets []webhookv1.PullSecret
+	var enableImageMirroring bool
+	var mirrorConcurrency int
+	var enableDriftReport bool
+	var enableTenantLimits bool
+	var driftRestartInterval time.Duration
+	var auditSinks []config.AuditSink
+	var otlpEndpoint string
+	var otlpInsecure bool
+	var traceSampleRatio float64
 	var tlsOpts []func(*tls.Config)
+	flag.StringVar(&configFile, "config", "",
+		"A "+config.Kind+" file. Flags given on the command line take precedence over its settings. "+
+			"Its rules and audit sinks are reloaded when the file changes.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
@@ -68,6 +107,7 @@ func main() {
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.BoolVar(&secureMetrics, "metrics-secure", true,
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
+	flag.IntVar(&webhookPort, "webhook-port", 9443, "The port the webhook server listens on.")
 	flag.StringVar(&webhookCertPath, "webhook-cert-path", "", "The directory that contains the webhook certificate.")
 	flag.StringVar(&webhookCertName, "webhook-cert-name", "tls.crt", "The name of the webhook certificate file.")
 	flag.StringVar(&webhookCertKey, "webhook-cert-key", "tls.key", "The name of the webhook key file.")
@@ -77,6 +117,47 @@ func main() {
 	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&registryCredentialsSecret, "registry-credentials-secret", "",
+		"A dockerconfigjson Secret, as <namespace>/<name>, used to authenticate registry lookups "+
+			"in addition to the pods' own pull secrets.")
+	flag.StringVar(&defaultsConfigMap, "defaults-configmap", "",
+		"A ConfigMap, as <namespace>/<name>, holding cluster-wide rewrite defaults under the "+
+			webhookv1.DefaultsKey+" key. Edits are validated and applied without a restart.")
+	flag.Func("target-pull-secret", "A pull Secret for a target registry, as <registry>=<namespace>/<name>. "+
+		"The Secret is replicated into namespaces with rewriting enabled and added to the imagePullSecrets "+
+		"of pods rewritten to that registry. May be repeated.", func(value string) error {
+		pullSecret, err := webhookv1.ParsePullSecret(value)
+		if err != nil {
+			return err
+		}
+		pullSecrets = append(pullSecrets, pullSecret)
+		return nil
+	})
+	flag.BoolVar(&enableImageMirroring, "enable-image-mirroring", false,
+		"If set, images the webhook rewrites are copied to the target registry by ImageMirror objects. "+
+			"Requires the ImageMirror CRD and credentials able to push to the target registry.")
+	flag.IntVar(&mirrorConcurrency, "image-mirror-concurrency", 2, "The number of images copied at once.")
+	flag.BoolVar(&enableDriftReport, "enable-drift-report", false,
+		"If set, running pods whose images the current policy would change are reported as metrics and "+
+			"Namespace events, and restarted in namespaces that opt in.")
+	flag.BoolVar(&enableTenantLimits, "enable-tenant-limits", false,
+		"If set, the validating webhook on Namespaces holds their settings to the tenants of the defaults. "+
+			"Requires --defaults-configmap or the rules of a configuration file, and config/tenant-limits.")
+	flag.DurationVar(&driftRestartInterval, "drift-restart-interval", time.Minute,
+		"The minimum time between two workload restarts caused by drift, across the cluster.")
+	flag.Func("audit-sink", "A destination of rewrite decisions as JSON lines besides the log: stdout or "+
+		"file:<path>. May be repeated.", func(value string) error {
+		sink, err := config.ParseAuditSink(value)
+		if err != nil {
+			return err
+		}
+		auditSinks = append(auditSinks, sink)
+		return nil
+	})
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "",
+		"The host:port of an OTLP gRPC collector to export admission spans to. Tracing is off if empty.")
+	flag.BoolVar(&otlpInsecure, "otlp-insecure", false, "Connect to the OTLP collector without TLS.")
+	flag.Float64Var(&traceSampleRatio, "trace-sample-ratio", 1, "The fraction of admission requests traced.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -85,6 +166,69 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	var rewriteConfig *config.RewriteConfig
+	explicitFlags := config.ExplicitFlags(flag.CommandLine)
+	if configFile != "" {
+		var err error
+		if rewriteConfig, err = config.Load(configFile); err != nil {
+			setupLog.Error(err, "invalid configuration file", "path", configFile)
+			os.Exit(1)
+		}
+		if err := rewriteConfig.ApplyFlags(flag.CommandLine); err != nil {
+			setupLog.Error(err, "unable to apply configuration file", "path", configFile)
+			os.Exit(1)
+		}
+		if !explicitFlags["audit-sink"] {
+			auditSinks = rewriteConfig.Audit.Sinks
+		}
+		if rewriteConfig.Rules != nil && defaultsConfigMap != "" {
+			setupLog.Error(nil, "the rules of the configuration file cannot be combined with --defaults-configmap")
+			os.Exit(1)
+		}
+	}
+	sinks, auditFiles, err := config.OpenAuditSinks(auditSinks)
+	if err != nil {
+		setupLog.Error(err, "unable to open audit sinks")
+		os.Exit(1)
+	}
+	webhookv1.SetAuditSinks(sinks...)
+
+	ctx := ctrl.SetupSignalHandler()
+	shutdownTracing := func(context.Context) error { return nil }
+	if otlpEndpoint != "" {
+		if shutdownTracing, err = setupTracing(ctx, otlpEndpoint, otlpInsecure, traceSampleRatio); err != nil {
+			setupLog.Error(err, "unable to set up tracing")
+			os.Exit(1)
+		}
+		setupLog.Info("exporting admission spans", "endpoint", otlpEndpoint, "sample-ratio", traceSampleRatio)
+	}
+
+	webhookOptions := webhookv1.WebhookOptions{}
+	if registryCredentialsSecret != "" {
+		secretNamespace, secretName, ok := strings.Cut(registryCredentialsSecret, "/")
+		if !ok || secretNamespace == "" || secretName == "" {
+			setupLog.Error(nil, "invalid --registry-credentials-secret, expected <namespace>/<name>",
+				"value", registryCredentialsSecret)
+			os.Exit(1)
+		}
+		webhookOptions.RegistryCredentialsSecret = types.NamespacedName{Namespace: secretNamespace, Name: secretName}
+	}
+	webhookOptions.PullSecrets = pullSecrets
+	var defaultsKey types.NamespacedName
+	if defaultsConfigMap != "" {
+		configMapNamespace, configMapName, ok := strings.Cut(defaultsConfigMap, "/")
+		if !ok || configMapNamespace == "" || configMapName == "" {
+			setupLog.Error(nil, "invalid --defaults-configmap, expected <namespace>/<name>",
+				"value", defaultsConfigMap)
+			os.Exit(1)
+		}
+		defaultsKey = types.NamespacedName{Namespace: configMapNamespace, Name: configMapName}
+	}
+	if enableTenantLimits && defaultsConfigMap == "" && (rewriteConfig == nil || rewriteConfig.Rules == nil) {
+		setupLog.Error(nil, "--enable-tenant-limits requires --defaults-configmap or the rules of a configuration file")
+		os.Exit(1)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -103,6 +247,7 @@ func main() {
 	// Initial webhook TLS options
 	webhookTLSOpts := tlsOpts
 	webhookServerOptions := webhook.Options{
+		Port:    webhookPort,
 		TLSOpts: webhookTLSOpts,
 	}
 
@@ -152,13 +297,23 @@ func main() {
 		metricsServerOptions.KeyName = metricsCertKey
 	}
 
+	cacheByObject := map[client.Object]cache.ByObject{
+		&corev1.Secret{}: controller.PullSecretCacheOptions(pullSecrets),
+	}
+	if defaultsConfigMap != "" {
+		cacheByObject[&corev1.ConfigMap{}] = controller.DefaultsCacheOptions(defaultsKey)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "d90d85b7.example.com",
+		Cache: cache.Options{
+			ByObject: cacheByObject,
+		},
+		LeaderElection:   enableLeaderElection,
+		LeaderElectionID: "d90d85b7.example.com",
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -176,12 +331,99 @@ func main() {
 		os.Exit(1)
 	}
 
+	// The webhook, the drift report and the defaults share one namespace policy map.
+	webhookOptions.Policies = webhookv1.NewPolicyResolver(mgr.GetCache())
+	if err := mgr.Add(webhookOptions.Policies); err != nil {
+		setupLog.Error(err, "unable to add namespace policy resolver")
+		os.Exit(1)
+	}
+	if rewriteConfig != nil {
+		if defaultsConfigMap == "" {
+			webhookOptions.Policies.SetDefaults(rewriteConfig.Rules)
+		}
+		watcher, err := config.NewWatcher(configFile,
+			reloadConfig(rewriteConfig, webhookOptions.Policies, defaultsConfigMap == "", !explicitFlags["audit-sink"],
+				auditFiles))
+		if err != nil {
+			setupLog.Error(err, "unable to watch configuration file", "path", configFile)
+			os.Exit(1)
+		}
+		if err := mgr.Add(watcher); err != nil {
+			setupLog.Error(err, "unable to add configuration watcher")
+			os.Exit(1)
+		}
+	}
+	if defaultsConfigMap != "" {
+		if err := (&controller.DefaultsReconciler{
+			Client:    mgr.GetClient(),
+			ConfigMap: defaultsKey,
+			Policies:  webhookOptions.Policies,
+			Recorder:  mgr.GetEventRecorderFor("image-rewriter-defaults"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Defaults")
+			os.Exit(1)
+		}
+	}
+
+	if enableImageMirroring {
+		queue := controller.NewMirrorQueue(mgr.GetClient(), 1000)
+		if err := mgr.Add(queue); err != nil {
+			setupLog.Error(err, "unable to add image mirror queue")
+			os.Exit(1)
+		}
+		webhookOptions.Mirrors = queue
+
+		if err := (&controller.ImageMirrorReconciler{
+			Client: mgr.GetClient(),
+			Copier: &registry.Copier{Client: &http.Client{Transport: auth.NewTransport(nil)}},
+			Credentials: &auth.Provider{
+				Reader:         mgr.GetAPIReader(),
+				OperatorSecret: webhookOptions.RegistryCredentialsSecret,
+			},
+			MaxConcurrentReconciles: mirrorConcurrency,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ImageMirror")
+			os.Exit(1)
+		}
+	}
+
 	// nolint:goconst
 	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
-		if err := webhookv1.SetupPodWebhookWithManager(mgr); err != nil {
+		if err := webhookv1.SetupPodWebhookWithManager(mgr, webhookOptions); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
 			os.Exit(1)
 		}
+		if enableTenantLimits {
+			if err := webhookv1.SetupNamespaceWebhookWithManager(mgr, webhookOptions); err != nil {
+				setupLog.Error(err, "unable to create webhook", "webhook", "Namespace")
+				os.Exit(1)
+			}
+		}
+	}
+	if enableDriftReport {
+		defaulter, err := webhookv1.NewPodCustomDefaulter(mgr, webhookOptions)
+		if err != nil {
+			setupLog.Error(err, "unable to create drift defaulter")
+			os.Exit(1)
+		}
+		if err := (&controller.DriftReconciler{
+			Client:          mgr.GetClient(),
+			Defaulter:       defaulter,
+			Recorder:        mgr.GetEventRecorderFor("image-rewriter-drift"),
+			RestartInterval: driftRestartInterval,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Drift")
+			os.Exit(1)
+		}
+	}
+	if len(pullSecrets) > 0 {
+		if err := (&controller.PullSecretReconciler{
+			Client:      mgr.GetClient(),
+			PullSecrets: pullSecrets,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "PullSecret")
+			os.Exit(1)
+		}
 	}
 	// +kubebuilder:scaffold:builder
 
@@ -195,8 +437,64 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+
+	// Flush the spans still queued for export
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		setupLog.Error(err, "unable to flush spans")
+	}
+}
+
+// setupTracing installs a global tracer provider exporting spans to the OTLP gRPC collector at endpoint.
+// Admission requests are sampled at ratio. The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string, insecure bool, ratio float64,
+) (func(context.Context) error, error) {
+	if ratio < 0 || ratio > 1 {
+		return nil, fmt.Errorf("--trace-sample-ratio must be between 0 and 1, got %g", ratio)
+	}
+	exporterOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		exporterOpts = append(exporterOpts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "mutating-registry-hook"))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// reloadConfig returns the handler of configuration file changes. Rules, unless a defaults ConfigMap is
+// used, and audit sinks, unless given as flags, are applied at once. Other settings need a restart.
+func reloadConfig(running *config.RewriteConfig, policies *webhookv1.PolicyResolver, applyRules, applyAudit bool,
+	auditFiles io.Closer) func(*config.RewriteConfig) {
+	return func(next *config.RewriteConfig) {
+		if changed := config.RestartRequired(running, next); len(changed) > 0 {
+			setupLog.Info("configuration changes take effect on restart", "settings", changed)
+		}
+		if applyRules {
+			policies.SetDefaults(next.Rules)
+		}
+		if !applyAudit {
+			return
+		}
+		sinks, files, err := config.OpenAuditSinks(next.Audit.Sinks)
+		if err != nil {
+			setupLog.Error(err, "unable to open audit sinks, keeping the current sinks")
+			return
+		}
+		webhookv1.SetAuditSinks(sinks...)
+		_ = auditFiles.Close()
+		auditFiles = files
+	}
 }
@@ -0,0 +1,148 @@
+// PURPOSE: The explain subcommand, which prints how the webhook decides what to do with one image
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const explainUsage = `Usage: rewrite explain --namespace NAMESPACE --image IMAGE [flags]
+
+Prints each step of the rewrite decision for an image: namespace label, policy, exclusions,
+local-registry rules, idempotency, candidate targets and the result. The namespace, and the global
+defaults ConfigMap given as for the manager's --defaults-configmap, are read from the cluster in the
+current kubeconfig context, unless --policy or --target-registry supplies the policy.
+
+Flags:
+`
+
+// runExplain executes the explain subcommand and returns its exit status.
+func runExplain(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, explainUsage)
+		flags.PrintDefaults()
+	}
+
+	var opts options
+	var namespace, image, defaultsConfigMap string
+	var asJSON bool
+	flags.StringVar(&namespace, "namespace", "default", "The namespace the pod would be created in.")
+	flags.StringVar(&image, "image", "", "The container image to explain.")
+	flags.StringVar(&opts.policyFile, "policy", "", "A policy file to use instead of the cluster's namespace.")
+	flags.StringVar(&opts.targetRegistry, "target-registry", "",
+		"A single target registry to use instead of the cluster's namespace.")
+	flags.StringVar(&defaultsConfigMap, "defaults-configmap", "",
+		"The global defaults ConfigMap, as <namespace>/<name>, that the manager's --defaults-configmap names.")
+	flags.BoolVar(&asJSON, "json", false, "Print the trace as JSON.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if image == "" {
+		_, _ = fmt.Fprintln(stderr, "rewrite explain: --image is required")
+		return 2
+	}
+	setLogger(false, stderr)
+
+	trace, err := explain(ctx, opts, defaultsConfigMap, namespace, image)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite explain:", err)
+		return 2
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(trace)
+	} else {
+		err = trace.WriteText(stdout)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite explain:", err)
+		return 2
+	}
+	return 0
+}
+
+func explain(ctx context.Context, opts options, defaultsConfigMap, namespace, image string) (*webhookv1.Trace, error) {
+	if opts.policyFile != "" || opts.targetRegistry != "" {
+		policy, err := loadPolicy(opts)
+		if err != nil {
+			return nil, err
+		}
+		return newDefaulter(policy).ExplainPolicy(ctx, namespace, image, policy)
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	return explainInCluster(ctx, c, defaultsConfigMap, namespace, image)
+}
+
+// explainInCluster traces the decision the webhook makes for image in namespace, with the global
+// defaults read from defaultsConfigMap.
+func explainInCluster(ctx context.Context, c client.Client, defaultsConfigMap, namespace, image string) (*webhookv1.Trace, error) {
+	defaults, err := loadDefaults(ctx, c, defaultsConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	// An unsynced resolver compiles the namespace it reads with the defaults, as the webhook does
+	policies := webhookv1.NewPolicyResolver(nil)
+	policies.SetDefaults(defaults)
+
+	// Verification settings come from the namespace, so the defaulter is always able to verify
+	defaulter := newDefaulter(webhookv1.Policy{Verify: true})
+	defaulter.Client = c
+	defaulter.Policies = policies
+	return defaulter.Explain(ctx, namespace, image)
+}
+
+// loadDefaults reads the defaults ConfigMap named <namespace>/<name> by key. It returns nil when key
+// is empty or the ConfigMap does not exist, which the webhook also treats as no defaults.
+func loadDefaults(ctx context.Context, c client.Reader, key string) (*webhookv1.Defaults, error) {
+	if key == "" {
+		return nil, nil
+	}
+	configMapNamespace, configMapName, ok := strings.Cut(key, "/")
+	if !ok || configMapNamespace == "" || configMapName == "" {
+		return nil, fmt.Errorf("invalid --defaults-configmap %q, expected <namespace>/<name>", key)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Namespace: configMapNamespace, Name: configMapName}, configMap)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading defaults ConfigMap %s: %w", key, err)
+	}
+	defaults, err := webhookv1.ParseDefaults([]byte(configMap.Data[webhookv1.DefaultsKey]))
+	if err != nil {
+		return nil, fmt.Errorf("defaults ConfigMap %s: %w", key, err)
+	}
+	return defaults, nil
+}
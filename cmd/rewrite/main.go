@@ -0,0 +1,252 @@
+// PURPOSE: Offline CLI that rewrites the images of Kubernetes manifests with the webhook's rewrite engine
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pmezard/go-difflib/difflib"
+	corev1 "k8s.io/api/core/v1"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"mutating-registry-hook/internal/manifest"
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const usage = `Usage: rewrite [flags] [FILE ...]
+       rewrite explain --namespace NAMESPACE --image IMAGE [flags]
+       rewrite simulate (--policy FILE | --target-registry REGISTRY) [--from FILE] [flags]
+       rewrite serve --policies FILE (--tls-cert-file FILE --tls-key-file FILE | --plain-http) [flags]
+
+Rewrites the container images of Pods and workloads in multi-document YAML or JSON manifests
+using the same rules as the admission webhook. Reads standard input when no FILE, or "-", is given.
+
+Flags:
+`
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// options are the command line settings of a run.
+type options struct {
+	policyFile     string
+	targetRegistry string
+	diff           bool
+	exitCode       bool
+	verbose        bool
+	files          []string
+}
+
+// run executes the CLI and returns its exit status: 0 on success, 1 when --exit-code is set and an
+// image changed, 2 on errors.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "explain" {
+		return runExplain(ctx, args[1:], stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "simulate" {
+		return runSimulate(ctx, args[1:], stdin, stdout, stderr)
+	}
+	if len(args) > 0 && args[0] == "serve" {
+		return runServe(ctx, args[1:], stderr)
+	}
+
+	flags := flag.NewFlagSet("rewrite", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	var opts options
+	flags.StringVar(&opts.policyFile, "policy", "",
+		"A policy file with the fields of a namespace policy, see \"Rewriting manifests offline\" in the README.")
+	flags.StringVar(&opts.targetRegistry, "target-registry", "",
+		"The target registry, as an alternative to --policy for a single target without verification.")
+	flags.BoolVar(&opts.diff, "diff", false, "Print a unified diff instead of the rewritten manifests.")
+	flags.BoolVar(&opts.exitCode, "exit-code", false, "Exit with status 1 when any image would be rewritten.")
+	flags.BoolVar(&opts.verbose, "v", false, "Log every rewrite decision to standard error.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	opts.files = flags.Args()
+	if len(opts.files) == 0 {
+		opts.files = []string{"-"}
+	}
+
+	setLogger(opts.verbose, stderr)
+
+	policy, err := loadPolicy(opts)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite:", err)
+		return 2
+	}
+
+	changed := false
+	defaulter := newDefaulter(policy)
+	for i, file := range opts.files {
+		// Manifests of several files form one stream
+		if i > 0 && !opts.diff {
+			_, _ = io.WriteString(stdout, "---\n")
+		}
+		fileChanged, err := rewriteFile(ctx, defaulter, policy, file, opts.diff, stdin, stdout)
+		if err != nil {
+			_, _ = fmt.Fprintf(stderr, "rewrite: %s: %v\n", displayName(file), err)
+			return 2
+		}
+		changed = changed || fileChanged
+	}
+
+	if opts.exitCode && changed {
+		return 1
+	}
+	return 0
+}
+
+// setLogger sends the webhook's decision log to stderr when verbose and discards it otherwise.
+func setLogger(verbose bool, stderr io.Writer) {
+	if verbose {
+		logf.SetLogger(zap.New(zap.WriteTo(stderr)))
+	} else {
+		logf.SetLogger(logr.Discard())
+	}
+}
+
+func loadPolicy(opts options) (webhookv1.Policy, error) {
+	switch {
+	case opts.policyFile != "" && opts.targetRegistry != "":
+		return webhookv1.Policy{}, fmt.Errorf("--policy and --target-registry are mutually exclusive")
+	case opts.policyFile != "":
+		data, err := os.ReadFile(opts.policyFile)
+		if err != nil {
+			return webhookv1.Policy{}, err
+		}
+		return webhookv1.ParsePolicyFile(data)
+	case opts.targetRegistry != "":
+		target, err := registry.NormalizeTarget(opts.targetRegistry)
+		if err != nil {
+			return webhookv1.Policy{}, fmt.Errorf("--target-registry: %w", err)
+		}
+		return webhookv1.Policy{TargetRegistries: []string{target}}, nil
+	default:
+		return webhookv1.Policy{}, fmt.Errorf("one of --policy or --target-registry is required")
+	}
+}
+
+// newDefaulter returns the webhook defaulter used outside the cluster. Verification authenticates
+// with the local Docker credentials, the closest equivalent of a pod's pull secrets.
+func newDefaulter(policy webhookv1.Policy) *webhookv1.PodCustomDefaulter {
+	defaulter := &webhookv1.PodCustomDefaulter{}
+	if policy.Verify {
+		transport := auth.NewTransport(nil)
+		transport.Keyring = dockerKeyring()
+		defaulter.Rewriter = &registry.Rewriter{
+			Verifier: registry.NewVerifier(registry.VerifierOptions{
+				Client: &http.Client{Transport: transport, Timeout: registry.DefaultVerifyTimeout},
+			}),
+		}
+		// Offline runs are not bound by the admission deadline
+		defaulter.VerifyBudget = time.Minute
+	}
+	return defaulter
+}
+
+// dockerKeyring reads $DOCKER_CONFIG/config.json, or ~/.docker/config.json, when present.
+func dockerKeyring() auth.Keyring {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return nil
+	}
+	keyring, err := auth.ParseDockerConfigJSON(data)
+	if err != nil {
+		return nil
+	}
+	return keyring
+}
+
+// rewriteFile rewrites the manifests of one file and writes them, or their diff, to stdout. It
+// reports whether any image changed.
+func rewriteFile(ctx context.Context, defaulter *webhookv1.PodCustomDefaulter, policy webhookv1.Policy,
+	file string, diff bool, stdin io.Reader, stdout io.Writer) (bool, error) {
+	input := stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return false, err
+		}
+		defer func() { _ = f.Close() }()
+		input = f
+	}
+
+	documents, err := manifest.ReadDocuments(input)
+	if err != nil {
+		return false, err
+	}
+	var before bytes.Buffer
+	if diff {
+		if err := manifest.WriteDocuments(&before, documents); err != nil {
+			return false, err
+		}
+	}
+
+	var changes []manifest.ImageChange
+	for _, document := range documents {
+		for _, obj := range document.Objects {
+			objChanges, err := manifest.MutatePodSpecs(obj, func(pod *corev1.Pod) error {
+				return defaulter.ApplyPolicy(ctx, pod, policy)
+			})
+			if err != nil {
+				return false, err
+			}
+			changes = append(changes, objChanges...)
+		}
+	}
+
+	if !diff {
+		return len(changes) > 0, manifest.WriteDocuments(stdout, documents)
+	}
+
+	var after bytes.Buffer
+	if err := manifest.WriteDocuments(&after, documents); err != nil {
+		return false, err
+	}
+	text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(before.String()),
+		B:        difflib.SplitLines(after.String()),
+		FromFile: "a/" + displayName(file),
+		ToFile:   "b/" + displayName(file),
+		Context:  3,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = io.WriteString(stdout, text)
+	return len(changes) > 0, err
+}
+
+func displayName(file string) string {
+	if file == "-" {
+		return "stdin"
+	}
+	return strings.TrimPrefix(filepath.ToSlash(file), "./")
+}
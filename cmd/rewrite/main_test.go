@@ -0,0 +1,130 @@
+// PURPOSE: Tests the rewrite CLI end to end on manifests from standard input
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const deployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+      - image: nginx:1.25
+        name: nginx
+      - image: myregistry.io/sidecar:v1
+        name: sidecar
+`
+
+func TestRun_WritesRewrittenManifests(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"--target-registry", "myregistry.io"},
+		strings.NewReader(deployment), &stdout, &stderr)
+
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "image: myregistry.io/nginx:1.25") {
+		t.Errorf("expected the nginx image to be rewritten:\n%s", stdout.String())
+	}
+	if !strings.Contains(stdout.String(), "image: myregistry.io/sidecar:v1") {
+		t.Errorf("expected the image already on the target to be kept:\n%s", stdout.String())
+	}
+}
+
+func TestRun_DiffWithPolicyFile(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(policy, []byte("targetRegistries: [myregistry.io/hub]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"--policy", policy, "--diff", "--exit-code", "-"},
+		strings.NewReader(deployment), &stdout, &stderr)
+
+	if code != 1 {
+		t.Fatalf("expected exit code 1 for changed images, got %d: %s", code, stderr.String())
+	}
+	want := "-      - image: nginx:1.25\n+      - image: myregistry.io/hub/nginx:1.25\n"
+	if !strings.Contains(stdout.String(), want) || !strings.HasPrefix(stdout.String(), "--- a/stdin\n+++ b/stdin\n") {
+		t.Errorf("unexpected diff:\n%s", stdout.String())
+	}
+}
+
+func TestRun_RequiresPolicy(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run(context.Background(), nil, strings.NewReader(deployment), &stdout, &stderr); code != 2 {
+		t.Errorf("expected exit code 2 without a policy, got %d", code)
+	}
+}
+
+func TestRun_ExplainWithPolicy(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), []string{"explain", "--target-registry", "myregistry.io", "--image", "nginx:1.25"},
+		strings.NewReader(""), &stdout, &stderr)
+
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", code, stderr.String())
+	}
+	for _, want := range []string{"exclusions", "local-registry", "idempotency", "result", "myregistry.io/nginx:1.25"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("expected the trace to mention %q:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestExplainInCluster_AppliesTheDefaultsConfigMap(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "team-a",
+			Labels: map[string]string{webhookv1.LabelRegistryRewrite: webhookv1.LabelValueEnabled},
+		}},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "mutating-registry-hook-system", Name: "rewrite-defaults"},
+			Data: map[string]string{webhookv1.DefaultsKey: "targetRegistries: [mirror.corp.io]\n" +
+				"mappings:\n  ghcr.io: ghcr-mirror.corp.io\n"},
+		},
+	).Build()
+
+	for image, want := range map[string]string{
+		"nginx:1.25":         "mirror.corp.io/nginx:1.25",
+		"ghcr.io/org/app:v1": "ghcr-mirror.corp.io/org/app:v1",
+	} {
+		trace, err := explainInCluster(context.Background(), c, "mutating-registry-hook-system/rewrite-defaults",
+			"team-a", image)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if trace.Result != want {
+			t.Errorf("expected %s to be rewritten to %s with the defaults, got %s", image, want, trace.Result)
+		}
+	}
+
+	trace, err := explainInCluster(context.Background(), c, "", "team-a", "nginx:1.25")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if trace.Rewritten {
+		t.Errorf("expected no rewrite without defaults, got %s", trace.Result)
+	}
+	if _, err := explainInCluster(context.Background(), c, "rewrite-defaults", "team-a", "nginx:1.25"); err == nil {
+		t.Error("expected an error for a ConfigMap name without a namespace")
+	}
+}
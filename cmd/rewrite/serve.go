@@ -0,0 +1,169 @@
+// PURPOSE: The serve subcommand, which hosts the pod mutating webhook on a plain net/http server with static policies
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const serveUsage = `Usage: rewrite serve --policies FILE (--tls-cert-file FILE --tls-key-file FILE | --plain-http)
+       [flags]
+
+Serves the pod mutating webhook at ` + mutatePodPath + ` without a Kubernetes client. Namespace policies
+come from a file instead of Namespace labels and annotations:
+
+  namespaces:
+    team-a:
+      targetRegistries: [mirror.corp.io]
+  default:
+    targetRegistries: [mirror.corp.io]
+
+Namespaces not listed use the default policy, or are not rewritten without one. The certificate and
+key are reloaded when the files change.
+
+Flags:
+`
+
+// mutatePodPath is the path the manager registers the pod webhook at.
+const mutatePodPath = "/mutate--v1-pod"
+
+// serveOptions are the command line settings of the serve subcommand.
+type serveOptions struct {
+	policiesFile string
+	listen       string
+	certFile     string
+	keyFile      string
+	plainHTTP    bool
+	verbose      bool
+}
+
+// runServe executes the serve subcommand and returns its exit status once interrupted.
+func runServe(ctx context.Context, args []string, stderr io.Writer) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, serveUsage)
+		flags.PrintDefaults()
+	}
+
+	var opts serveOptions
+	flags.StringVar(&opts.policiesFile, "policies", "", "The file assigning policies to namespaces.")
+	flags.StringVar(&opts.listen, "listen", ":9443", "The address to listen on.")
+	flags.StringVar(&opts.certFile, "tls-cert-file", "", "The serving certificate, in PEM.")
+	flags.StringVar(&opts.keyFile, "tls-key-file", "", "The key of the serving certificate, in PEM.")
+	flags.BoolVar(&opts.plainHTTP, "plain-http", false,
+		"Serve plain HTTP, behind a proxy that terminates TLS. API servers only call webhooks over HTTPS.")
+	flags.BoolVar(&opts.verbose, "v", false, "Log every rewrite decision to standard error.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	setLogger(opts.verbose, stderr)
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := serve(ctx, opts, stderr); err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite serve:", err)
+		return 2
+	}
+	return 0
+}
+
+// serve listens on opts.listen and serves admission until ctx is done.
+func serve(ctx context.Context, opts serveOptions, stderr io.Writer) error {
+	if opts.policiesFile == "" {
+		return errors.New("--policies is required")
+	}
+	if opts.plainHTTP == (opts.certFile != "" || opts.keyFile != "") {
+		return errors.New("either --tls-cert-file and --tls-key-file, or --plain-http, is required")
+	}
+	data, err := os.ReadFile(opts.policiesFile)
+	if err != nil {
+		return err
+	}
+	policies, err := webhookv1.ParseStaticPolicies(data)
+	if err != nil {
+		return err
+	}
+	handler, err := newServeHandler(policies)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", opts.listen)
+	if err != nil {
+		return err
+	}
+	if !opts.plainHTTP {
+		watcher, err := certwatcher.New(opts.certFile, opts.keyFile)
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+		go func() { _ = watcher.Start(ctx) }()
+		listener = tls.NewListener(listener, &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"http/1.1"},
+		})
+	}
+	_, _ = fmt.Fprintf(stderr, "serving %s on %s\n", mutatePodPath, listener.Addr())
+	return serveListener(ctx, listener, handler)
+}
+
+// serveListener serves handler on listener until ctx is done, then drains in-flight requests.
+func serveListener(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	errs := make(chan error, 1)
+	go func() { errs <- server.Serve(listener) }()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// newServeHandler returns the mux serving the pod webhook, with the same admission handler the
+// manager registers, and a health endpoint.
+func newServeHandler(policies webhookv1.StaticPolicies) (http.Handler, error) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+
+	verify := policies.Default != nil && policies.Default.Verify
+	for _, policy := range policies.Namespaces {
+		verify = verify || policy.Verify
+	}
+	defaulter := newDefaulter(webhookv1.Policy{Verify: verify})
+	// Admission is bound by the API server's deadline, unlike offline runs
+	defaulter.VerifyBudget = 0
+	defaulter.Policies = webhookv1.NewStaticPolicyResolver(policies)
+
+	mux := http.NewServeMux()
+	mux.Handle(mutatePodPath, admission.WithCustomDefaulter(scheme, &corev1.Pod{}, defaulter))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})
+	return mux, nil
+}
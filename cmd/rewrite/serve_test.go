@@ -0,0 +1,211 @@
+// PURPOSE: End-to-end tests of the serve subcommand with raw AdmissionReview JSON over HTTP and HTTPS
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+// admissionReview returns a raw AdmissionReview creating a pod with image in namespace, serialized
+// with the empty fields an API server sends.
+func admissionReview(namespace, image string) []byte {
+	return []byte(`{
+  "apiVersion": "admission.k8s.io/v1",
+  "kind": "AdmissionReview",
+  "request": {
+    "uid": "705ab4f5-6393-11e8-b7cc-42010a800002",
+    "kind": {"group": "", "version": "v1", "kind": "Pod"},
+    "resource": {"group": "", "version": "v1", "resource": "pods"},
+    "namespace": "` + namespace + `",
+    "operation": "CREATE",
+    "userInfo": {"username": "admin"},
+    "object": {
+      "apiVersion": "v1",
+      "kind": "Pod",
+      "metadata": {"generateName": "web-", "namespace": "` + namespace + `"},
+      "spec": {"containers": [{"name": "app", "image": "` + image + `", "resources": {}}]},
+      "status": {}
+    }
+  }
+}`)
+}
+
+func postReview(t *testing.T, client *http.Client, url string, body []byte) admissionv1.AdmissionReview {
+	t.Helper()
+	resp, err := client.Post(url+mutatePodPath, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post AdmissionReview: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&review); err != nil {
+		t.Fatalf("Failed to decode AdmissionReview: %v", err)
+	}
+	return review
+}
+
+func newTestServeHandler(t *testing.T) http.Handler {
+	t.Helper()
+	data, err := os.ReadFile("testdata/serve-policies.yaml")
+	if err != nil {
+		t.Fatalf("Failed to read policies: %v", err)
+	}
+	policies, err := webhookv1.ParseStaticPolicies(data)
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	handler, err := newServeHandler(policies)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return handler
+}
+
+func TestServe_AdmissionReviewOverHTTP(t *testing.T) {
+	server := httptest.NewServer(newTestServeHandler(t))
+	defer server.Close()
+
+	review := postReview(t, server.Client(), server.URL, admissionReview("team-a", "nginx:1.25"))
+	if review.Response == nil || !review.Response.Allowed ||
+		review.Response.UID != "705ab4f5-6393-11e8-b7cc-42010a800002" {
+		t.Fatalf("Expected an allowed response for the request UID, got %+v", review.Response)
+	}
+	if !strings.Contains(string(review.Response.Patch), `"value":"mirror.corp.io/nginx:1.25"`) {
+		t.Errorf("Expected a patch rewriting the image, got %s", review.Response.Patch)
+	}
+
+	for _, namespace := range []string{"team-b", "unlisted"} {
+		review = postReview(t, server.Client(), server.URL, admissionReview(namespace, "nginx:1.25"))
+		if review.Response == nil || !review.Response.Allowed || len(review.Response.Patch) != 0 {
+			t.Errorf("Expected %s to be allowed without a patch, got %+v", namespace, review.Response)
+		}
+	}
+
+	review = postReview(t, server.Client(), server.URL, []byte(`{"apiVersion": "admission.k8s.io/v1"`))
+	if review.Response == nil || review.Response.Allowed || review.Response.Result.Code != http.StatusBadRequest {
+		t.Errorf("Expected a malformed review to be rejected with 400, got %+v", review.Response)
+	}
+}
+
+func TestServe_TLSFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeServingCert(t, dir)
+	policiesFile, err := filepath.Abs("testdata/serve-policies.yaml")
+	if err != nil {
+		t.Fatalf("Failed to locate policies: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to pick a port: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	var stderr bytes.Buffer
+	go func() {
+		done <- serve(ctx, serveOptions{policiesFile: policiesFile, listen: addr, certFile: certFile,
+			keyFile: keyFile}, &stderr)
+	}()
+
+	pool := x509.NewCertPool()
+	certPEM, _ := os.ReadFile(certFile)
+	pool.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	waitForServer(t, client, "https://"+addr+"/healthz")
+
+	review := postReview(t, client, "https://"+addr, admissionReview("team-a", "nginx:1.25"))
+	if !strings.Contains(string(review.Response.Patch), "mirror.corp.io/nginx:1.25") {
+		t.Errorf("Expected a patch rewriting the image, got %s", review.Response.Patch)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, got: %v", err)
+	}
+}
+
+func TestServe_RequiresTLSOrPlainHTTP(t *testing.T) {
+	err := serve(context.Background(), serveOptions{policiesFile: "testdata/serve-policies.yaml", listen: ":0"},
+		&bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "--plain-http") {
+		t.Errorf("Expected an error naming the TLS flags, got: %v", err)
+	}
+}
+
+func waitForServer(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if resp, err := client.Get(url); err == nil {
+			_ = resp.Body.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("Server at %s did not start", url)
+}
+
+// writeServingCert writes a self-signed certificate for 127.0.0.1 and its key to dir.
+func writeServingCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rewrite-serve"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
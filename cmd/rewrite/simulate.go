@@ -0,0 +1,461 @@
+// PURPOSE: The simulate subcommand, which reports what a candidate policy would do to a cluster's workloads
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"mutating-registry-hook/internal/manifest"
+	"mutating-registry-hook/internal/registry"
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const simulateUsage = `Usage: rewrite simulate (--policy FILE | --target-registry REGISTRY) [--from FILE] [flags]
+
+Applies a candidate policy to every Pod and workload template and reports, per namespace, how many
+images would change, the target registries they map to, the images that would collide on the same
+target and the images excluded from rewriting. Objects are listed from the cluster in the current
+kubeconfig context, or read from a saved "kubectl get -o json" dump with --from. Pods and workloads
+controlled by another workload are counted through their owner.
+
+Flags:
+`
+
+// Decisions about a single image.
+const (
+	decisionChanged   = "changed"
+	decisionUnchanged = "unchanged"
+	decisionExcluded  = "excluded"
+)
+
+// Output formats.
+const (
+	formatTable    = "table"
+	formatJSON     = "json"
+	formatMarkdown = "markdown"
+)
+
+// simulatedKinds are the kinds listed from the cluster, which are the kinds with a pod spec.
+var simulatedKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "Pod"},
+	{Version: "v1", Kind: "PodTemplate"},
+	{Version: "v1", Kind: "ReplicationController"},
+	{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+	{Group: "batch", Version: "v1", Kind: "Job"},
+	{Group: "batch", Version: "v1", Kind: "CronJob"},
+}
+
+// SimulationReport is the outcome of applying a policy to a snapshot of workloads.
+type SimulationReport struct {
+	Policy     webhookv1.Policy  `json:"policy"`
+	Namespaces []NamespaceReport `json:"namespaces"`
+	Collisions []Collision       `json:"collisions"`
+}
+
+// NamespaceReport summarizes the decisions for the images of one namespace.
+type NamespaceReport struct {
+	Namespace string `json:"namespace"`
+	Workloads int    `json:"workloads"`
+	Images    int    `json:"images"`
+	Changed   int    `json:"changed"`
+	Unchanged int    `json:"unchanged"`
+	Excluded  int    `json:"excluded"`
+	Colliding int    `json:"colliding"`
+	// Targets counts the changed images per target registry.
+	Targets   map[string]int  `json:"targets"`
+	Decisions []ImageDecision `json:"decisions"`
+}
+
+// ImageDecision is the decision for the image of one container.
+type ImageDecision struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	Decision  string `json:"decision"`
+	Result    string `json:"result"`
+	Target    string `json:"target,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Collision is a rewritten image that different original images would map to.
+type Collision struct {
+	Image      string   `json:"image"`
+	Sources    []string `json:"sources"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// runSimulate executes the simulate subcommand and returns its exit status.
+func runSimulate(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		_, _ = fmt.Fprint(stderr, simulateUsage)
+		flags.PrintDefaults()
+	}
+
+	var opts options
+	var from, output string
+	flags.StringVar(&opts.policyFile, "policy", "", "The candidate policy file.")
+	flags.StringVar(&opts.targetRegistry, "target-registry", "",
+		"The target registry, as an alternative to --policy for a single target without verification.")
+	flags.StringVar(&from, "from", "", `A "kubectl get -o json" dump, or "-" for standard input, instead of the cluster.`)
+	flags.StringVar(&output, "output", formatTable, "The report format: table, json or markdown.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if output != formatTable && output != formatJSON && output != formatMarkdown {
+		_, _ = fmt.Fprintf(stderr, "rewrite simulate: unknown output format %q\n", output)
+		return 2
+	}
+	setLogger(false, stderr)
+
+	policy, err := loadPolicy(opts)
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite simulate:", err)
+		return 2
+	}
+	// The simulation reports what the policy would do, so dry run does not apply
+	policy.DryRun = false
+
+	var objects []*unstructured.Unstructured
+	if from != "" {
+		objects, err = readSnapshot(from, stdin)
+	} else {
+		objects, err = listCluster(ctx)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite simulate:", err)
+		return 2
+	}
+
+	report, err := simulate(ctx, newDefaulter(policy), policy, objects)
+	if err == nil {
+		err = writeReport(stdout, report, output)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, "rewrite simulate:", err)
+		return 2
+	}
+	return 0
+}
+
+// readSnapshot decodes a saved dump, flattening Lists into their items.
+func readSnapshot(file string, stdin io.Reader) ([]*unstructured.Unstructured, error) {
+	input := stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		input = f
+	}
+
+	decoded, err := manifest.Decode(input)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", displayName(file), err)
+	}
+	var objects []*unstructured.Unstructured
+	for _, obj := range decoded {
+		if !obj.IsList() {
+			objects = append(objects, obj)
+			continue
+		}
+		err := obj.EachListItem(func(item runtime.Object) error {
+			objects = append(objects, item.(*unstructured.Unstructured))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", displayName(file), err)
+		}
+	}
+	return objects, nil
+}
+
+// listCluster lists the objects of every simulated kind in all namespaces.
+func listCluster(ctx context.Context) ([]*unstructured.Unstructured, error) {
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(config, client.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*unstructured.Unstructured
+	for _, gvk := range simulatedKinds {
+		list := &unstructured.UnstructuredList{}
+		list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := c.List(ctx, list); err != nil {
+			return nil, fmt.Errorf("listing %s: %w", gvk.Kind, err)
+		}
+		for i := range list.Items {
+			list.Items[i].SetGroupVersionKind(gvk)
+			objects = append(objects, &list.Items[i])
+		}
+	}
+	return objects, nil
+}
+
+// simulate decides every image of objects under policy. Each distinct image is decided once, through
+// the same pipeline as admission, and without side effects.
+func simulate(ctx context.Context, defaulter *webhookv1.PodCustomDefaulter, policy webhookv1.Policy,
+	objects []*unstructured.Unstructured) (*SimulationReport, error) {
+	namespaces := map[string]*NamespaceReport{}
+	traces := map[string]*webhookv1.Trace{}
+
+	for _, obj := range objects {
+		if _, ok := manifest.PodSpecPath(obj.GroupVersionKind().GroupKind()); !ok || controlledByWorkload(obj) {
+			continue
+		}
+		report := namespaces[obj.GetNamespace()]
+		if report == nil {
+			report = &NamespaceReport{Namespace: obj.GetNamespace(), Targets: map[string]int{}}
+			namespaces[obj.GetNamespace()] = report
+		}
+		report.Workloads++
+
+		var containers []ImageDecision
+		_, err := manifest.MutatePodSpecs(obj, func(pod *corev1.Pod) error {
+			containers = podImages(pod)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, decision := range containers {
+			trace, ok := traces[decision.Image]
+			if !ok {
+				trace, err = defaulter.ExplainPolicy(ctx, obj.GetNamespace(), decision.Image, policy)
+				if err != nil {
+					return nil, err
+				}
+				traces[decision.Image] = trace
+			}
+
+			decision.Kind, decision.Name = obj.GetKind(), obj.GetName()
+			decision.Result, decision.Reason = trace.Result, trace.Reason()
+			switch reason, excluded := trace.Exclusion(); {
+			case excluded:
+				decision.Decision, decision.Reason = decisionExcluded, reason
+				report.Excluded++
+			case trace.Rewritten:
+				decision.Decision, decision.Target = decisionChanged, trace.Target
+				report.Changed++
+				report.Targets[trace.Target]++
+			default:
+				decision.Decision = decisionUnchanged
+				report.Unchanged++
+			}
+			report.Images++
+			report.Decisions = append(report.Decisions, decision)
+		}
+	}
+
+	result := &SimulationReport{Policy: policy, Collisions: []Collision{}}
+	for _, name := range slices.Sorted(maps.Keys(namespaces)) {
+		result.Namespaces = append(result.Namespaces, *namespaces[name])
+	}
+	findCollisions(result)
+	return result, nil
+}
+
+// controlledByWorkload reports whether obj is managed by an owner with a pod spec, such as the Pods
+// of a ReplicaSet or the Jobs of a CronJob. Its images are counted through the owner's template.
+func controlledByWorkload(obj *unstructured.Unstructured) bool {
+	owner := metav1.GetControllerOfNoCopy(obj)
+	if owner == nil {
+		return false
+	}
+	_, ok := manifest.PodSpecPath(schema.FromAPIVersionAndKind(owner.APIVersion, owner.Kind).GroupKind())
+	return ok
+}
+
+// podImages returns a decision stub for every container and image volume of pod, in the order the
+// webhook visits them.
+func podImages(pod *corev1.Pod) []ImageDecision {
+	var images []ImageDecision
+	for location := range webhookv1.ImageLocations(pod) {
+		images = append(images, ImageDecision{Container: location.Name, Image: *location.Image})
+	}
+	return images
+}
+
+// findCollisions records every rewritten image that more than one distinct original image maps to,
+// and counts the colliding images of each namespace.
+func findCollisions(report *SimulationReport) {
+	sources := map[string]map[string]bool{}
+	namespaces := map[string]map[string]bool{}
+	for _, ns := range report.Namespaces {
+		for _, decision := range ns.Decisions {
+			if decision.Decision != decisionChanged {
+				continue
+			}
+			if sources[decision.Result] == nil {
+				sources[decision.Result] = map[string]bool{}
+				namespaces[decision.Result] = map[string]bool{}
+			}
+			sources[decision.Result][registry.CanonicalImage(decision.Image)] = true
+			namespaces[decision.Result][ns.Namespace] = true
+		}
+	}
+
+	for _, image := range slices.Sorted(maps.Keys(sources)) {
+		if len(sources[image]) > 1 {
+			report.Collisions = append(report.Collisions, Collision{
+				Image:      image,
+				Sources:    slices.Sorted(maps.Keys(sources[image])),
+				Namespaces: slices.Sorted(maps.Keys(namespaces[image])),
+			})
+		}
+	}
+	for i := range report.Namespaces {
+		ns := &report.Namespaces[i]
+		for _, decision := range ns.Decisions {
+			if decision.Decision == decisionChanged && len(sources[decision.Result]) > 1 {
+				ns.Colliding++
+			}
+		}
+	}
+}
+
+func writeReport(w io.Writer, report *SimulationReport, format string) error {
+	switch format {
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case formatMarkdown:
+		return writeMarkdown(w, report)
+	default:
+		return writeTable(w, report)
+	}
+}
+
+func writeTable(w io.Writer, report *SimulationReport) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(table, "NAMESPACE\tWORKLOADS\tIMAGES\tCHANGED\tUNCHANGED\tEXCLUDED\tCOLLIDING\tTARGETS")
+	for _, ns := range report.Namespaces {
+		_, _ = fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", namespaceName(ns.Namespace), ns.Workloads,
+			ns.Images, ns.Changed, ns.Unchanged, ns.Excluded, ns.Colliding, formatTargets(ns.Targets))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	if len(report.Collisions) > 0 {
+		_, _ = fmt.Fprintln(w, "\nCollisions:")
+		for _, collision := range report.Collisions {
+			_, _ = fmt.Fprintf(w, "  %s <- %s (%s)\n", collision.Image,
+				strings.Join(collision.Sources, ", "), strings.Join(collision.Namespaces, ", "))
+		}
+	}
+	if excluded := excludedDecisions(report); len(excluded) > 0 {
+		_, _ = fmt.Fprintln(w, "\nExcluded:")
+		for _, line := range excluded {
+			_, _ = fmt.Fprintf(w, "  %s %s/%s %s: %s\n", line.namespace, line.Kind, line.Name, line.Image, line.Reason)
+		}
+	}
+	return nil
+}
+
+func writeMarkdown(w io.Writer, report *SimulationReport) error {
+	var b strings.Builder
+	b.WriteString("| Namespace | Workloads | Images | Changed | Unchanged | Excluded | Colliding | Targets |\n")
+	b.WriteString("|---|---:|---:|---:|---:|---:|---:|---|\n")
+	for _, ns := range report.Namespaces {
+		fmt.Fprintf(&b, "| %s | %d | %d | %d | %d | %d | %d | %s |\n", namespaceName(ns.Namespace), ns.Workloads,
+			ns.Images, ns.Changed, ns.Unchanged, ns.Excluded, ns.Colliding, formatTargets(ns.Targets))
+	}
+
+	if len(report.Collisions) > 0 {
+		b.WriteString("\n### Collisions\n\n| Rewritten image | Sources | Namespaces |\n|---|---|---|\n")
+		for _, collision := range report.Collisions {
+			fmt.Fprintf(&b, "| `%s` | %s | %s |\n", collision.Image,
+				codeList(collision.Sources), strings.Join(collision.Namespaces, ", "))
+		}
+	}
+	if excluded := excludedDecisions(report); len(excluded) > 0 {
+		b.WriteString("\n### Excluded\n\n| Namespace | Workload | Image | Reason |\n|---|---|---|---|\n")
+		for _, line := range excluded {
+			fmt.Fprintf(&b, "| %s | %s/%s | `%s` | %s |\n", line.namespace, line.Kind, line.Name, line.Image, line.Reason)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type excludedLine struct {
+	namespace string
+	ImageDecision
+}
+
+func excludedDecisions(report *SimulationReport) []excludedLine {
+	var lines []excludedLine
+	for _, ns := range report.Namespaces {
+		for _, decision := range ns.Decisions {
+			if decision.Decision == decisionExcluded {
+				lines = append(lines, excludedLine{namespace: namespaceName(ns.Namespace), ImageDecision: decision})
+			}
+		}
+	}
+	return lines
+}
+
+// formatTargets lists target registries by descending image count.
+func formatTargets(targets map[string]int) string {
+	if len(targets) == 0 {
+		return "-"
+	}
+	names := slices.Collect(maps.Keys(targets))
+	sort.Slice(names, func(i, j int) bool {
+		if targets[names[i]] != targets[names[j]] {
+			return targets[names[i]] > targets[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s (%d)", name, targets[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func codeList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = "`" + item + "`"
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// namespaceName names objects without a namespace, such as manifests not yet applied.
+func namespaceName(namespace string) string {
+	if namespace == "" {
+		return "-"
+	}
+	return namespace
+}
@@ -0,0 +1,102 @@
+// PURPOSE: Tests the simulate subcommand on a saved cluster snapshot
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const simulatePolicy = `targetRegistries: [myregistry.io]
+preserveRegistries: [gcr.io/distroless]
+rewriteLocalRegistries: false
+`
+
+func runSimulateSnapshot(t *testing.T, output string) (string, int) {
+	t.Helper()
+	policy := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(policy, []byte(simulatePolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(),
+		[]string{"simulate", "--policy", policy, "--from", "testdata/snapshot.json", "--output", output},
+		strings.NewReader(""), &stdout, &stderr)
+	if stderr.Len() > 0 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestSimulate_JSONReport(t *testing.T) {
+	out, code := runSimulateSnapshot(t, "json")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+
+	report := &SimulationReport{}
+	if err := json.Unmarshal([]byte(out), report); err != nil {
+		t.Fatalf("expected a JSON report, got: %v\n%s", err, out)
+	}
+	if len(report.Namespaces) != 2 {
+		t.Fatalf("expected reports for team-a and team-b, got %+v", report.Namespaces)
+	}
+
+	teamA, teamB := report.Namespaces[0], report.Namespaces[1]
+	// The ReplicaSet and Pod of the Deployment are counted through the Deployment
+	if teamA.Namespace != "team-a" || teamA.Workloads != 1 || teamA.Images != 3 || teamA.Changed != 2 ||
+		teamA.Unchanged != 1 || teamA.Targets["myregistry.io"] != 2 {
+		t.Errorf("unexpected team-a report: %+v", teamA)
+	}
+	if teamB.Namespace != "team-b" || teamB.Workloads != 1 || teamB.Images != 3 || teamB.Changed != 1 ||
+		teamB.Excluded != 2 {
+		t.Errorf("unexpected team-b report: %+v", teamB)
+	}
+
+	if len(report.Collisions) != 1 {
+		t.Fatalf("expected one collision, got %+v", report.Collisions)
+	}
+	collision := report.Collisions[0]
+	if collision.Image != "myregistry.io/team/app:v1" || len(collision.Sources) != 2 ||
+		strings.Join(collision.Namespaces, ",") != "team-a,team-b" {
+		t.Errorf("unexpected collision: %+v", collision)
+	}
+	if teamA.Colliding != 1 || teamB.Colliding != 1 {
+		t.Errorf("expected one colliding image per namespace, got %d and %d", teamA.Colliding, teamB.Colliding)
+	}
+}
+
+func TestSimulate_TableAndMarkdown(t *testing.T) {
+	table, code := runSimulateSnapshot(t, "table")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	for _, want := range []string{"NAMESPACE", "team-a", "myregistry.io (2)", "Collisions:",
+		"myregistry.io/team/app:v1 <- docker.io/team/app:v1, quay.io/team/app:v1", "registry localhost:5000 is local"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("expected the table to contain %q:\n%s", want, table)
+		}
+	}
+
+	markdown, code := runSimulateSnapshot(t, "markdown")
+	if code != 0 {
+		t.Fatalf("expected exit code 0, got %d", code)
+	}
+	for _, want := range []string{"| team-b | 1 | 3 | 1 | 0 | 2 | 1 | myregistry.io (1) |", "### Collisions",
+		"### Excluded", "registry gcr.io/distroless is preserved"} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("expected the markdown to contain %q:\n%s", want, markdown)
+		}
+	}
+}
+
+func TestSimulate_RejectsUnknownFormat(t *testing.T) {
+	if _, code := runSimulateSnapshot(t, "yaml"); code != 2 {
+		t.Errorf("expected exit code 2 for an unknown format, got %d", code)
+	}
+}
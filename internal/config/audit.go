@@ -0,0 +1,42 @@
+// PURPOSE: Opens the configured audit sinks for the webhook's rewrite decisions
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+// OpenAuditSinks opens the destinations of sinks. Closing the returned Closer closes the files opened.
+func OpenAuditSinks(sinks []AuditSink) ([]webhookv1.AuditSink, io.Closer, error) {
+	var opened []webhookv1.AuditSink
+	var files closers
+	for _, sink := range sinks {
+		switch sink.Type {
+		case AuditSinkStdout:
+			opened = append(opened, webhookv1.NewJSONAuditSink(os.Stdout))
+		case AuditSinkFile:
+			file, err := os.OpenFile(sink.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+			if err != nil {
+				_ = files.Close()
+				return nil, nil, err
+			}
+			files = append(files, file)
+			opened = append(opened, webhookv1.NewJSONAuditSink(file))
+		}
+	}
+	return opened, files, nil
+}
+
+// closers closes all of its elements.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
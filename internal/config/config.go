@@ -0,0 +1,392 @@
+// PURPOSE: Versioned file configuration of the operator, decoded strictly, defaulted and validated with field paths
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/json"
+	"sigs.k8s.io/yaml"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const (
+	// APIVersion is the only configuration version understood.
+	APIVersion = "image-rewriter.example.com/v1alpha1"
+	// Kind is the kind of the configuration document.
+	Kind = "RewriteConfig"
+
+	// AuditSinkStdout writes decisions as JSON lines to standard output.
+	AuditSinkStdout = "stdout"
+	// AuditSinkFile appends decisions as JSON lines to a file.
+	AuditSinkFile = "file"
+)
+
+// RewriteConfig configures the operator from a file. Every setting except Rules and Audit has a flag
+// of the same meaning, and flags given on the command line take precedence.
+type RewriteConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Rules are the cluster-wide rewrite defaults, as in the defaults ConfigMap. They cannot be combined
+	// with DefaultsConfigMap.
+	Rules *webhookv1.Defaults `json:"rules,omitempty"`
+	// DefaultsConfigMap names a ConfigMap, as <namespace>/<name>, holding the rewrite defaults.
+	DefaultsConfigMap string `json:"defaultsConfigMap,omitempty"`
+	// RegistryCredentialsSecret names a dockerconfigjson Secret, as <namespace>/<name>, for lookups.
+	RegistryCredentialsSecret string `json:"registryCredentialsSecret,omitempty"`
+	// TargetPullSecrets are pull Secrets of target registries, as <registry>=<namespace>/<name>.
+	TargetPullSecrets []string `json:"targetPullSecrets,omitempty"`
+
+	Webhook Webhook `json:"webhook,omitempty"`
+	Metrics Metrics `json:"metrics,omitempty"`
+	// HealthProbeBindAddress is the address of the health probe endpoint. Defaults to :8081.
+	HealthProbeBindAddress string `json:"healthProbeBindAddress,omitempty"`
+	// LeaderElection ensures only one replica runs the controllers.
+	LeaderElection bool     `json:"leaderElection,omitempty"`
+	Audit          Audit    `json:"audit,omitempty"`
+	Tracing        Tracing  `json:"tracing,omitempty"`
+	Features       Features `json:"features,omitempty"`
+
+	// ImageMirrorConcurrency is the number of images copied at once. Defaults to 2.
+	ImageMirrorConcurrency int `json:"imageMirrorConcurrency,omitempty"`
+	// DriftRestartInterval is the minimum time between two drift restarts. Defaults to 1m.
+	DriftRestartInterval metav1.Duration `json:"driftRestartInterval,omitempty"`
+}
+
+// Webhook configures the admission webhook server.
+type Webhook struct {
+	// Port the webhook server listens on. Defaults to 9443.
+	Port int `json:"port,omitempty"`
+	TLS  TLS `json:"tls,omitempty"`
+}
+
+// Metrics configures the metrics server.
+type Metrics struct {
+	// BindAddress is the address of the metrics endpoint, or 0 to disable it. Defaults to 0.
+	BindAddress string `json:"bindAddress,omitempty"`
+	// Secure serves metrics over HTTPS with authentication and authorization. Defaults to true.
+	Secure *bool `json:"secure,omitempty"`
+	TLS    TLS   `json:"tls,omitempty"`
+}
+
+// TLS locates a certificate and key. Without CertDir, a generated or default certificate is used.
+type TLS struct {
+	CertDir string `json:"certDir,omitempty"`
+	// CertName defaults to tls.crt.
+	CertName string `json:"certName,omitempty"`
+	// KeyName defaults to tls.key.
+	KeyName string `json:"keyName,omitempty"`
+}
+
+// Audit configures where rewrite decisions are recorded besides the log.
+type Audit struct {
+	Sinks []AuditSink `json:"sinks,omitempty"`
+}
+
+// AuditSink is a destination of audit records.
+type AuditSink struct {
+	// Type is stdout or file.
+	Type string `json:"type"`
+	// Path is the file records are appended to, for the file type.
+	Path string `json:"path,omitempty"`
+}
+
+// String returns the sink in the form of the --audit-sink flag.
+func (s AuditSink) String() string {
+	if s.Type == AuditSinkFile {
+		return AuditSinkFile + ":" + s.Path
+	}
+	return s.Type
+}
+
+// ParseAuditSink reads a sink given as stdout or file:<path>.
+func ParseAuditSink(value string) (AuditSink, error) {
+	sinkType, path, _ := strings.Cut(value, ":")
+	sink := AuditSink{Type: sinkType, Path: path}
+	if errs := sink.validate(nil); len(errs) > 0 {
+		return AuditSink{}, fmt.Errorf("invalid audit sink %q: %w", value, errs.ToAggregate())
+	}
+	return sink, nil
+}
+
+// Tracing exports spans of the admission path to an OpenTelemetry collector.
+type Tracing struct {
+	// Endpoint is the host:port of an OTLP gRPC collector. Spans are not exported without it.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Insecure connects to the collector without TLS.
+	Insecure bool `json:"insecure,omitempty"`
+	// SampleRatio is the fraction of admission requests traced, between 0 and 1. Defaults to 1.
+	SampleRatio *float64 `json:"sampleRatio,omitempty"`
+}
+
+// Features toggles optional parts of the operator.
+type Features struct {
+	// HTTP2 enables HTTP/2 for the webhook and metrics servers.
+	HTTP2 bool `json:"http2,omitempty"`
+	// ImageMirroring copies rewritten images to their target registry.
+	ImageMirroring bool `json:"imageMirroring,omitempty"`
+	// DriftReport reports running pods whose images the policy would change.
+	DriftReport bool `json:"driftReport,omitempty"`
+	// TenantLimits serves the validating webhook that holds Namespace settings to the tenants of Rules
+	// or the defaults ConfigMap.
+	TenantLimits bool `json:"tenantLimits,omitempty"`
+}
+
+// Load reads, defaults and validates the configuration file at path.
+func Load(path string) (*RewriteConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes, defaults and validates a configuration document. Unknown and duplicate fields are
+// rejected with their path.
+func Parse(data []byte) (*RewriteConfig, error) {
+	config := &RewriteConfig{}
+	jsonData, err := yaml.YAMLToJSONStrict(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing configuration: %w", err)
+	}
+	strictErrs, err := json.UnmarshalStrict(jsonData, config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing configuration: %w", err)
+	}
+	if len(strictErrs) > 0 {
+		return nil, fmt.Errorf("parsing configuration: %w", errors.Join(strictErrs...))
+	}
+	config.Default()
+	if errs := config.Validate(); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	return config, nil
+}
+
+// Default fills in the settings left empty with the defaults of the matching flags.
+func (c *RewriteConfig) Default() {
+	if c.Webhook.Port == 0 {
+		c.Webhook.Port = 9443
+	}
+	c.Webhook.TLS.setDefaults()
+	if c.Metrics.BindAddress == "" {
+		c.Metrics.BindAddress = "0"
+	}
+	if c.Metrics.Secure == nil {
+		secure := true
+		c.Metrics.Secure = &secure
+	}
+	c.Metrics.TLS.setDefaults()
+	if c.HealthProbeBindAddress == "" {
+		c.HealthProbeBindAddress = ":8081"
+	}
+	if c.Tracing.SampleRatio == nil {
+		ratio := 1.0
+		c.Tracing.SampleRatio = &ratio
+	}
+	if c.ImageMirrorConcurrency == 0 {
+		c.ImageMirrorConcurrency = 2
+	}
+	if c.DriftRestartInterval.Duration == 0 {
+		c.DriftRestartInterval.Duration = time.Minute
+	}
+	if c.Rules != nil {
+		c.Rules.Normalize()
+	}
+}
+
+func (t *TLS) setDefaults() {
+	if t.CertName == "" {
+		t.CertName = "tls.crt"
+	}
+	if t.KeyName == "" {
+		t.KeyName = "tls.key"
+	}
+}
+
+// Validate returns the invalid settings of a defaulted configuration.
+func (c *RewriteConfig) Validate() field.ErrorList {
+	var errs field.ErrorList
+	if c.APIVersion != APIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{APIVersion}))
+	}
+	if c.Kind != Kind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{Kind}))
+	}
+
+	if c.Rules != nil {
+		errs = append(errs, c.Rules.Validate(field.NewPath("rules"))...)
+		if c.DefaultsConfigMap != "" {
+			errs = append(errs, field.Forbidden(field.NewPath("rules"), "cannot be combined with defaultsConfigMap"))
+		}
+	}
+	errs = append(errs, validateObjectName(field.NewPath("defaultsConfigMap"), c.DefaultsConfigMap)...)
+	errs = append(errs, validateObjectName(field.NewPath("registryCredentialsSecret"), c.RegistryCredentialsSecret)...)
+	for i, value := range c.TargetPullSecrets {
+		if _, err := webhookv1.ParsePullSecret(value); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("targetPullSecrets").Index(i), value, err.Error()))
+		}
+	}
+
+	if c.Webhook.Port < 1 || c.Webhook.Port > 65535 {
+		errs = append(errs, field.Invalid(field.NewPath("webhook", "port"), c.Webhook.Port, "must be between 1 and 65535"))
+	}
+	if c.Metrics.BindAddress != "0" {
+		errs = append(errs, validateAddress(field.NewPath("metrics", "bindAddress"), c.Metrics.BindAddress)...)
+	}
+	errs = append(errs, validateAddress(field.NewPath("healthProbeBindAddress"), c.HealthProbeBindAddress)...)
+
+	for i, sink := range c.Audit.Sinks {
+		errs = append(errs, sink.validate(field.NewPath("audit", "sinks").Index(i))...)
+	}
+
+	if c.Tracing.Endpoint != "" {
+		errs = append(errs, validateAddress(field.NewPath("tracing", "endpoint"), c.Tracing.Endpoint)...)
+	}
+	if ratio := c.Tracing.SampleRatio; ratio != nil && (*ratio < 0 || *ratio > 1) {
+		errs = append(errs, field.Invalid(field.NewPath("tracing", "sampleRatio"), *ratio, "must be between 0 and 1"))
+	}
+
+	if c.ImageMirrorConcurrency < 1 {
+		errs = append(errs, field.Invalid(field.NewPath("imageMirrorConcurrency"), c.ImageMirrorConcurrency,
+			"must be at least 1"))
+	}
+	if c.DriftRestartInterval.Duration < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("driftRestartInterval"), c.DriftRestartInterval.String(),
+			"must not be negative"))
+	}
+	return errs
+}
+
+func (s AuditSink) validate(fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	switch s.Type {
+	case AuditSinkStdout:
+		if s.Path != "" {
+			errs = append(errs, field.Forbidden(fldPath.Child("path"), "only allowed for the file type"))
+		}
+	case AuditSinkFile:
+		if s.Path == "" {
+			errs = append(errs, field.Required(fldPath.Child("path"), "the file to append records to"))
+		}
+	default:
+		errs = append(errs, field.NotSupported(fldPath.Child("type"), s.Type,
+			[]string{AuditSinkStdout, AuditSinkFile}))
+	}
+	return errs
+}
+
+// validateObjectName checks an optional <namespace>/<name> reference.
+func validateObjectName(fldPath *field.Path, value string) field.ErrorList {
+	if value == "" {
+		return nil
+	}
+	namespace, name, ok := strings.Cut(value, "/")
+	if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return field.ErrorList{field.Invalid(fldPath, value, "must be <namespace>/<name>")}
+	}
+	return nil
+}
+
+func validateAddress(fldPath *field.Path, address string) field.ErrorList {
+	if _, port, err := net.SplitHostPort(address); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, address, "must be [host]:port")}
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return field.ErrorList{field.Invalid(fldPath, address, "port must be a number up to 65535")}
+	}
+	return nil
+}
+
+// Flag is a command-line flag and the value the configuration gives it.
+type Flag struct {
+	Name  string
+	Value string
+}
+
+// Flags returns the flag values equivalent to the configuration, in order. Repeated flags appear once
+// per value. Rules and Audit are not included, as they are reloaded from the file.
+func (c *RewriteConfig) Flags() []Flag {
+	sampleRatio := 1.0
+	if c.Tracing.SampleRatio != nil {
+		sampleRatio = *c.Tracing.SampleRatio
+	}
+	flags := []Flag{
+		{"metrics-bind-address", c.Metrics.BindAddress},
+		{"metrics-secure", strconv.FormatBool(c.Metrics.Secure == nil || *c.Metrics.Secure)},
+		{"metrics-cert-path", c.Metrics.TLS.CertDir},
+		{"metrics-cert-name", c.Metrics.TLS.CertName},
+		{"metrics-cert-key", c.Metrics.TLS.KeyName},
+		{"health-probe-bind-address", c.HealthProbeBindAddress},
+		{"leader-elect", strconv.FormatBool(c.LeaderElection)},
+		{"enable-http2", strconv.FormatBool(c.Features.HTTP2)},
+		{"webhook-port", strconv.Itoa(c.Webhook.Port)},
+		{"webhook-cert-path", c.Webhook.TLS.CertDir},
+		{"webhook-cert-name", c.Webhook.TLS.CertName},
+		{"webhook-cert-key", c.Webhook.TLS.KeyName},
+		{"registry-credentials-secret", c.RegistryCredentialsSecret},
+		{"defaults-configmap", c.DefaultsConfigMap},
+		{"otlp-endpoint", c.Tracing.Endpoint},
+		{"otlp-insecure", strconv.FormatBool(c.Tracing.Insecure)},
+		{"trace-sample-ratio", strconv.FormatFloat(sampleRatio, 'g', -1, 64)},
+		{"enable-image-mirroring", strconv.FormatBool(c.Features.ImageMirroring)},
+		{"image-mirror-concurrency", strconv.Itoa(c.ImageMirrorConcurrency)},
+		{"enable-drift-report", strconv.FormatBool(c.Features.DriftReport)},
+		{"drift-restart-interval", c.DriftRestartInterval.Duration.String()},
+		{"enable-tenant-limits", strconv.FormatBool(c.Features.TenantLimits)},
+	}
+	for _, pullSecret := range c.TargetPullSecrets {
+		flags = append(flags, Flag{"target-pull-secret", pullSecret})
+	}
+	return flags
+}
+
+// ApplyFlags sets the flags of fs from the configuration, except the flags given on the command line,
+// which take precedence, and flags fs does not define. Empty values leave the flag default in place.
+func (c *RewriteConfig) ApplyFlags(fs *flag.FlagSet) error {
+	explicit := ExplicitFlags(fs)
+	for _, f := range c.Flags() {
+		if explicit[f.Name] || f.Value == "" || fs.Lookup(f.Name) == nil {
+			continue
+		}
+		if err := fs.Set(f.Name, f.Value); err != nil {
+			return fmt.Errorf("applying configuration to --%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// ExplicitFlags returns the names of the flags of fs given on the command line.
+func ExplicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// RestartRequired returns the top-level settings that differ between two configurations and only take
+// effect on restart, that is all but rules and audit.
+func RestartRequired(current, next *RewriteConfig) []string {
+	a, b := *current, *next
+	a.Rules, b.Rules = nil, nil
+	a.Audit, b.Audit = Audit{}, Audit{}
+
+	var changed []string
+	typ := reflect.TypeOf(a)
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := range typ.NumField() {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
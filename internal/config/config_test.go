@@ -0,0 +1,223 @@
+// PURPOSE: Unit tests for decoding, defaulting, validating, applying and reloading the configuration file
+package config
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const validConfig = `
+apiVersion: image-rewriter.example.com/v1alpha1
+kind: RewriteConfig
+rules:
+  targetRegistries: [mirror.corp.io]
+webhook:
+  port: 10250
+  tls:
+    certDir: /etc/webhook/certs
+metrics:
+  bindAddress: :8443
+audit:
+  sinks:
+  - type: stdout
+features:
+  driftReport: true
+targetPullSecrets:
+- mirror.corp.io=image-rewriter-system/mirror-pull
+`
+
+func TestParse_Defaults(t *testing.T) {
+	config, err := Parse([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if config.Rules.TargetRegistries[0] != "mirror.corp.io" || config.Webhook.Port != 10250 {
+		t.Errorf("Unexpected configuration: %+v", config)
+	}
+	if config.Webhook.TLS.CertName != "tls.crt" || config.Webhook.TLS.KeyName != "tls.key" ||
+		!*config.Metrics.Secure || config.HealthProbeBindAddress != ":8081" ||
+		config.ImageMirrorConcurrency != 2 || config.DriftRestartInterval.Duration != time.Minute {
+		t.Errorf("Expected defaults for the unset settings, got %+v", config)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "unknown field",
+			data: "apiVersion: image-rewriter.example.com/v1alpha1\nkind: RewriteConfig\nwebhook:\n  prot: 9443\n",
+			want: []string{`unknown field "webhook.prot"`},
+		},
+		{
+			name: "version and kind",
+			data: "apiVersion: v1\nkind: ConfigMap\n",
+			want: []string{`apiVersion: Unsupported value: "v1"`, `kind: Unsupported value: "ConfigMap"`},
+		},
+		{
+			name: "field paths",
+			data: `apiVersion: image-rewriter.example.com/v1alpha1
+kind: RewriteConfig
+rules:
+  targetRegistries: ['https://mirror.corp.io']
+defaultsConfigMap: rewrite-defaults
+webhook:
+  port: 70000
+metrics:
+  bindAddress: localhost
+audit:
+  sinks:
+  - type: file
+  - type: syslog
+tracing:
+  endpoint: collector
+  sampleRatio: 2
+`,
+			want: []string{
+				`rules.targetRegistries[0]: Invalid value: "https://mirror.corp.io"`,
+				"rules: Forbidden: cannot be combined with defaultsConfigMap",
+				`defaultsConfigMap: Invalid value: "rewrite-defaults": must be <namespace>/<name>`,
+				"webhook.port: Invalid value: 70000",
+				`metrics.bindAddress: Invalid value: "localhost"`,
+				"audit.sinks[0].path: Required value",
+				`audit.sinks[1].type: Unsupported value: "syslog"`,
+				`tracing.endpoint: Invalid value: "collector"`,
+				"tracing.sampleRatio: Invalid value: 2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error to contain %q, got: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyFlags_CommandLineTakesPrecedence(t *testing.T) {
+	config, err := Parse([]byte(validConfig))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("webhook-port", 9443, "")
+	metricsAddr := fs.String("metrics-bind-address", "0", "")
+	drift := fs.Bool("enable-drift-report", false, "")
+	var pullSecrets []string
+	fs.Func("target-pull-secret", "", func(value string) error {
+		pullSecrets = append(pullSecrets, value)
+		return nil
+	})
+	if err := fs.Parse([]string{"--webhook-port=9999"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	if err := config.ApplyFlags(fs); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if *port != 9999 {
+		t.Errorf("Expected the command line port to win, got %d", *port)
+	}
+	if *metricsAddr != ":8443" || !*drift {
+		t.Errorf("Expected the file settings to apply, got %q, %t", *metricsAddr, *drift)
+	}
+	if !slices.Equal(pullSecrets, []string{"mirror.corp.io=image-rewriter-system/mirror-pull"}) {
+		t.Errorf("Expected the pull secrets of the file, got %v", pullSecrets)
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	current, _ := Parse([]byte(validConfig))
+	next, _ := Parse([]byte(strings.Replace(validConfig, "mirror.corp.io]", "other.corp.io]", 1) +
+		"leaderElection: true\n"))
+	if got := RestartRequired(current, next); !slices.Equal(got, []string{"leaderElection"}) {
+		t.Errorf("Expected only leaderElection to need a restart, got %v", got)
+	}
+}
+
+func TestWatcher_ReloadKeepsCurrentOnInvalidEdit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(validConfig), 0o600); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	var applied []*RewriteConfig
+	watcher, err := NewWatcher(path, func(config *RewriteConfig) { applied = append(applied, config) })
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	watcher.Reload(context.Background())
+	if len(applied) != 0 {
+		t.Fatal("Expected an unchanged file not to be applied")
+	}
+
+	if err := os.WriteFile(path, []byte(validConfig+"webhook: {port: 0x}\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	watcher.Reload(context.Background())
+	if len(applied) != 0 {
+		t.Fatal("Expected an invalid file not to be applied")
+	}
+
+	edited := strings.Replace(validConfig, "mirror.corp.io]", "other.corp.io]", 1)
+	if err := os.WriteFile(path, []byte(edited), 0o600); err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	watcher.Reload(context.Background())
+	if len(applied) != 1 || applied[0].Rules.TargetRegistries[0] != "other.corp.io" {
+		t.Errorf("Expected the edited configuration to be applied, got %v", applied)
+	}
+}
+
+func TestOpenAuditSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := ParseAuditSink("file:" + path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, err := ParseAuditSink("file"); err == nil {
+		t.Error("Expected a file sink without a path to be rejected")
+	}
+
+	sinks, closer, err := OpenAuditSinks([]AuditSink{sink})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	sinks[0].Write(webhookv1.AuditRecord{Namespace: "team-a", Result: "rewritten"})
+	if err := closer.Close(); err != nil {
+		t.Fatalf("Failed to close sinks: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read audit file: %v", err)
+	}
+	if !strings.Contains(string(data), `"namespace":"team-a"`) || !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("Expected one JSON line, got %q", data)
+	}
+}
+
+func TestLoad_Example(t *testing.T) {
+	if _, err := Load("../../examples/rewrite-config.yaml"); err != nil {
+		t.Errorf("Expected the example configuration to be valid, got: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+// PURPOSE: Reloads the configuration file when it changes, keeping the current configuration on invalid edits
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const defaultPollInterval = 10 * time.Second
+
+// configReloadsTotal counts reloads of the configuration file by result.
+var configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "image_rewrite_config_reloads_total",
+	Help: "Number of times the configuration file was reloaded, by result (applied or rejected).",
+}, []string{"result"})
+
+func init() {
+	metrics.Registry.MustRegister(configReloadsTotal)
+}
+
+// Watcher reloads a configuration file when its content changes. It watches the file's directory, so
+// editors that replace the file and the symlink swaps of mounted ConfigMaps are seen, and also polls
+// every Interval in case events are lost.
+type Watcher struct {
+	// Path is the configuration file.
+	Path string
+	// Interval between polls. Defaults to 10s.
+	Interval time.Duration
+	// OnChange receives each valid new configuration.
+	OnChange func(*RewriteConfig)
+
+	content []byte
+}
+
+// NewWatcher returns a watcher of the file at path, whose content was loaded as current.
+func NewWatcher(path string, onChange func(*RewriteConfig)) (*Watcher, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{Path: path, OnChange: onChange, content: content}, nil
+}
+
+// Start watches the file until ctx is done. It satisfies manager.Runnable.
+func (w *Watcher) Start(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = watcher.Close() }()
+	if err := watcher.Add(filepath.Dir(w.Path)); err != nil {
+		return err
+	}
+
+	interval := w.Interval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-watcher.Events:
+			w.Reload(ctx)
+		case <-ticker.C:
+			w.Reload(ctx)
+		case err := <-watcher.Errors:
+			logf.FromContext(ctx).Error(err, "error watching configuration file", "path", w.Path)
+		}
+	}
+}
+
+// NeedLeaderElection returns false so every replica follows the file.
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+// Reload reads the file and passes it to OnChange when its content changed and is valid. An invalid
+// file is logged and the current configuration stays in effect.
+func (w *Watcher) Reload(ctx context.Context) {
+	log := logf.FromContext(ctx).WithValues("path", w.Path)
+
+	content, err := os.ReadFile(w.Path)
+	if err != nil {
+		log.Error(err, "failed to read configuration file, keeping the current configuration")
+		return
+	}
+	if bytes.Equal(content, w.content) {
+		return
+	}
+	w.content = content
+
+	config, err := Parse(content)
+	if err != nil {
+		log.Error(err, "rejected invalid configuration, keeping the current configuration")
+		configReloadsTotal.WithLabelValues("rejected").Inc()
+		return
+	}
+	log.Info("reloaded configuration")
+	configReloadsTotal.WithLabelValues("applied").Inc()
+	if w.OnChange != nil {
+		w.OnChange(config)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// PURPOSE: Loads the global defaults ConfigMap into the webhook's policy resolver, keeping the last valid version
+package controller
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+// Event reasons for defaults reloads.
+const (
+	EventReasonDefaultsApplied = "DefaultsApplied"
+	EventReasonDefaultsInvalid = "InvalidDefaults"
+)
+
+// initialDefaultsRetry is the wait between attempts to load the defaults at startup.
+const initialDefaultsRetry = 5 * time.Second
+
+// DefaultsReconciler validates the global defaults ConfigMap on every change and swaps the compiled
+// defaults the webhook uses. An invalid edit leaves the last valid defaults in place.
+type DefaultsReconciler struct {
+	client.Client
+	// ConfigMap names the defaults ConfigMap. Its DefaultsKey entry holds the defaults document.
+	ConfigMap types.NamespacedName
+	Policies  *webhookv1.PolicyResolver
+	Recorder  record.EventRecorder
+}
+
+// DefaultsCacheOptions limits the ConfigMap informer to the defaults ConfigMap.
+func DefaultsCacheOptions(key types.NamespacedName) cache.ByObject {
+	return cache.ByObject{Namespaces: map[string]cache.Config{
+		key.Namespace: {FieldSelector: fields.OneTermEqualSelector("metadata.name", key.Name)},
+	}}
+}
+
+// Reconcile loads the defaults ConfigMap. A deleted ConfigMap removes the defaults.
+func (r *DefaultsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := logf.FromContext(ctx)
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(ctx, r.ConfigMap, configMap); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		log.Info("defaults ConfigMap not found, using no defaults", "configMap", r.ConfigMap.String())
+		r.Policies.SetDefaults(nil)
+		defaultsInvalid.Set(0)
+		return ctrl.Result{}, nil
+	}
+
+	defaults, err := webhookv1.ParseDefaults([]byte(configMap.Data[webhookv1.DefaultsKey]))
+	if err != nil {
+		log.Error(err, "rejected invalid defaults, keeping the last valid defaults", "configMap", r.ConfigMap.String())
+		defaultsReloadsTotal.WithLabelValues(reloadRejected).Inc()
+		defaultsInvalid.Set(1)
+		if r.Recorder != nil {
+			r.Recorder.Eventf(configMap, corev1.EventTypeWarning, EventReasonDefaultsInvalid,
+				"Keeping the last valid defaults: %v", err)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	r.Policies.SetDefaults(defaults)
+	log.Info("applied defaults", "configMap", r.ConfigMap.String(), "resourceVersion", configMap.ResourceVersion)
+	defaultsReloadsTotal.WithLabelValues(reloadApplied).Inc()
+	defaultsInvalid.Set(0)
+	if r.Recorder != nil {
+		r.Recorder.Event(configMap, corev1.EventTypeNormal, EventReasonDefaultsApplied, "Applied the defaults")
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager. It runs on every replica, not only the
+// leader, since each replica serving admission needs the defaults.
+func (r *DefaultsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isDefaults := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return client.ObjectKeyFromObject(obj) == r.ConfigMap
+	})
+	if err := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isDefaults)).
+		WithOptions(controller.Options{NeedLeaderElection: ptr.To(false)}).
+		Named("defaults").
+		Complete(r); err != nil {
+		return err
+	}
+	return mgr.Add(&initialDefaults{reconciler: r, cache: mgr.GetCache()})
+}
+
+// initialDefaults reconciles the defaults once the cache has synced. Without it a ConfigMap missing at
+// startup triggers no event, and the defaults would never be marked loaded.
+type initialDefaults struct {
+	reconciler *DefaultsReconciler
+	cache      cache.Cache
+}
+
+// Start loads the defaults once, retrying until it succeeds or ctx is done, and returns.
+func (l *initialDefaults) Start(ctx context.Context) error {
+	if !l.cache.WaitForCacheSync(ctx) {
+		return nil
+	}
+	request := ctrl.Request{NamespacedName: l.reconciler.ConfigMap}
+	// The condition never fails, so polling only ends early when ctx is done
+	_ = wait.PollUntilContextCancel(ctx, initialDefaultsRetry, true, func(ctx context.Context) (bool, error) {
+		if _, err := l.reconciler.Reconcile(ctx, request); err != nil {
+			logf.FromContext(ctx).Error(err, "failed to load the defaults, retrying",
+				"configMap", request.String())
+			return false, nil
+		}
+		return true, nil
+	})
+	return nil
+}
+
+// NeedLeaderElection returns false so every replica loads its own defaults.
+func (l *initialDefaults) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,219 @@
+// PURPOSE: Unit tests for validated reloads of the global defaults ConfigMap using fake clients
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache/informertest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/config"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllertest"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+var defaultsKey = types.NamespacedName{Namespace: "image-rewriter-system", Name: "rewrite-defaults"}
+
+func defaultsConfigMap(data string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: defaultsKey.Namespace, Name: defaultsKey.Name},
+		Data:       map[string]string{webhookv1.DefaultsKey: data},
+	}
+}
+
+func reconcileDefaults(t *testing.T, r *DefaultsReconciler) {
+	t.Helper()
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: defaultsKey}); err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+}
+
+func TestDefaultsReconciler_KeepsLastValidDefaults(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	configMap := defaultsConfigMap("targetRegistries: [mirror.corp.io]\n")
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(configMap).Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &DefaultsReconciler{
+		Client:    c,
+		ConfigMap: defaultsKey,
+		Policies:  webhookv1.NewPolicyResolver(nil),
+		Recorder:  recorder,
+	}
+
+	reconcileDefaults(t, r)
+	if defaults := r.Policies.Defaults(); defaults == nil || defaults.TargetRegistries[0] != "mirror.corp.io" {
+		t.Fatalf("Expected the defaults to be applied, got %+v", defaults)
+	}
+	drainEvents(recorder)
+
+	configMap.Data[webhookv1.DefaultsKey] = "targetRegistries: [mirror.corp.io]\nfailureMode: Reject\n"
+	if err := c.Update(context.Background(), configMap); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	reconcileDefaults(t, r)
+	if defaults := r.Policies.Defaults(); defaults == nil || defaults.FailureMode != "" {
+		t.Errorf("Expected the last valid defaults to stay in use, got %+v", defaults)
+	}
+	if got := testutil.ToFloat64(defaultsInvalid); got != 1 {
+		t.Errorf("Expected the invalid gauge to be 1, got %v", got)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.HasPrefix(events[0], "Warning "+EventReasonDefaultsInvalid) ||
+		!strings.Contains(events[0], "failureMode") {
+		t.Errorf("Expected one InvalidDefaults warning naming the field, got %v", events)
+	}
+
+	if err := c.Delete(context.Background(), configMap); err != nil {
+		t.Fatalf("Failed to delete ConfigMap: %v", err)
+	}
+	reconcileDefaults(t, r)
+	if defaults := r.Policies.Defaults(); defaults != nil {
+		t.Errorf("Expected deleting the ConfigMap to remove the defaults, got %+v", defaults)
+	}
+	if got := testutil.ToFloat64(defaultsInvalid); got != 0 {
+		t.Errorf("Expected the invalid gauge to be reset, got %v", got)
+	}
+}
+
+// heldLock is a leader election lock another replica holds for the whole test.
+type heldLock struct{}
+
+func (heldLock) Get(context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	record := &resourcelock.LeaderElectionRecord{
+		HolderIdentity: "other-replica", LeaseDurationSeconds: 3600,
+		AcquireTime: metav1.Now(), RenewTime: metav1.Now(),
+	}
+	raw, err := json.Marshal(record)
+	return record, raw, err
+}
+func (heldLock) Create(context.Context, resourcelock.LeaderElectionRecord) error { return nil }
+func (heldLock) Update(context.Context, resourcelock.LeaderElectionRecord) error { return nil }
+func (heldLock) RecordEvent(string)                                              {}
+func (heldLock) Identity() string                                                { return "this-replica" }
+func (heldLock) Describe() string                                                { return "held-lock" }
+
+// notifyingInformer signals once the controller has registered its event handler.
+type notifyingInformer struct {
+	*controllertest.FakeInformer
+	registered chan struct{}
+}
+
+func (i notifyingInformer) AddEventHandlerWithOptions(handler toolscache.ResourceEventHandler,
+	options toolscache.HandlerOptions) (toolscache.ResourceEventHandlerRegistration, error) {
+	registration, err := i.FakeInformer.AddEventHandlerWithOptions(handler, options)
+	close(i.registered)
+	return registration, err
+}
+
+// startNonLeaderManager starts a manager that never becomes leader, with the defaults controller
+// reading objects through fake informers, whose ConfigMap informer is returned to send events.
+func startNonLeaderManager(t *testing.T, objects ...client.Object) (*DefaultsReconciler, notifyingInformer,
+	client.Client, ctrl.Manager) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	informer := notifyingInformer{FakeInformer: &controllertest.FakeInformer{Synced: true}, registered: make(chan struct{})}
+	informers := &informertest.FakeInformers{Scheme: scheme, InformersByGVK: map[schema.GroupVersionKind]toolscache.SharedIndexInformer{
+		corev1.SchemeGroupVersion.WithKind("ConfigMap"): informer,
+	}}
+
+	mgr, err := ctrl.NewManager(&rest.Config{Host: "https://127.0.0.1:1"}, ctrl.Options{
+		Scheme:                              scheme,
+		Metrics:                             metricsserver.Options{BindAddress: "0"},
+		LeaderElection:                      true,
+		LeaderElectionID:                    "image-rewriter-test",
+		LeaderElectionResourceLockInterface: heldLock{},
+		NewCache: func(*rest.Config, cache.Options) (cache.Cache, error) {
+			return informers, nil
+		},
+		NewClient: func(*rest.Config, client.Options) (client.Client, error) {
+			return c, nil
+		},
+		Controller: config.Controller{SkipNameValidation: ptr.To(true)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	r := &DefaultsReconciler{Client: c, ConfigMap: defaultsKey, Policies: webhookv1.NewPolicyResolver(nil)}
+	if err := r.SetupWithManager(mgr); err != nil {
+		t.Fatalf("Failed to set up the controller: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = mgr.Start(ctx) }()
+	return r, informer, c, mgr
+}
+
+// eventually polls condition for up to ten seconds.
+func eventually(condition func() bool) bool {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestDefaultsReconciler_FollowsDefaultsWithoutLeadership(t *testing.T) {
+	configMap := defaultsConfigMap("targetRegistries: [mirror.corp.io]\n")
+	r, informer, c, mgr := startNonLeaderManager(t, configMap)
+
+	select {
+	case <-informer.registered:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the defaults controller to start on a replica that is not the leader")
+	}
+	if !eventually(func() bool { return r.Policies.Defaults() != nil }) {
+		t.Fatal("Expected the defaults to be loaded at startup without leadership")
+	}
+
+	// An edit reaches the controller through its informer
+	configMap.Data[webhookv1.DefaultsKey] = "targetRegistries: [other.corp.io]\n"
+	if err := c.Update(context.Background(), configMap); err != nil {
+		t.Fatalf("Failed to update ConfigMap: %v", err)
+	}
+	informer.Add(configMap)
+	if !eventually(func() bool {
+		defaults := r.Policies.Defaults()
+		return defaults != nil && defaults.TargetRegistries[0] == "other.corp.io"
+	}) {
+		t.Fatalf("Expected the edit to be applied without leadership, got %+v", r.Policies.Defaults())
+	}
+	select {
+	case <-mgr.Elected():
+		t.Error("Expected the replica not to be elected")
+	default:
+	}
+}
+
+func TestDefaultsReconciler_MissingConfigMapMarksDefaultsLoaded(t *testing.T) {
+	r, _, _, _ := startNonLeaderManager(t)
+
+	if !eventually(r.Policies.DefaultsLoaded) {
+		t.Fatal("Expected a missing ConfigMap to mark the defaults loaded without any event")
+	}
+	if defaults := r.Policies.Defaults(); defaults != nil {
+		t.Errorf("Expected no defaults, got %+v", defaults)
+	}
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// PURPOSE: Reports running pods whose images the current rewrite policy would change, and optionally restarts their workloads
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const (
+	// AnnotationRestartDrifted on a namespace opts its Deployments, StatefulSets and DaemonSets into
+	// a rolling restart when their pods drift from the rewrite policy.
+	AnnotationRestartDrifted = "image-rewriter.example.com/restart-drifted"
+	// AnnotationRestartedAt is set on the pod template of a workload restarted because of drift.
+	AnnotationRestartedAt = "image-rewriter.example.com/restarted-at"
+
+	// Event reasons.
+	EventReasonImageDrift         = "ImageDrift"
+	EventReasonImageDriftResolved = "ImageDriftResolved"
+	EventReasonDriftRestart       = "ImageDriftRestart"
+
+	defaultDriftResync     = 10 * time.Minute
+	defaultRestartInterval = time.Minute
+	defaultRestartCooldown = time.Hour
+	// driftExamples is the number of drifted containers named in an event.
+	driftExamples = 3
+)
+
+// DriftReconciler compares the running pods of each namespace with rewriting enabled against the
+// current policy. Zero values are replaced by defaults.
+type DriftReconciler struct {
+	client.Client
+	// Defaulter makes the same decisions as the admission webhook.
+	Defaulter *webhookv1.PodCustomDefaulter
+	Recorder  record.EventRecorder
+	// ResyncInterval is how often a namespace with drift is checked again, since the images available
+	// on verified targets change without any event.
+	ResyncInterval time.Duration
+	// RestartInterval is the minimum time between two workload restarts across the cluster.
+	RestartInterval time.Duration
+	// RestartCooldown is the minimum time between two restarts of the same workload, so pods that
+	// keep drifting after a restart do not restart forever.
+	RestartCooldown time.Duration
+
+	mu       sync.Mutex
+	reported map[string]int
+	limiter  *rate.Limiter
+}
+
+// driftedPod is a pod with at least one drifted container.
+type driftedPod struct {
+	pod   *corev1.Pod
+	drift []webhookv1.Drift
+}
+
+// Reconcile recomputes the drift of one namespace.
+func (r *DriftReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := logf.FromContext(ctx)
+
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, req.NamespacedName, namespace); err != nil {
+		r.forget(req.Name)
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	compiled, err := r.Defaulter.ResolveNamespace(ctx, namespace.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !compiled.Enabled || !compiled.Configured || !namespace.DeletionTimestamp.IsZero() {
+		r.forget(namespace.Name)
+		return ctrl.Result{}, nil
+	}
+	policy := compiled.Policy
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(namespace.Name)); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var drifted []driftedPod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed ||
+			!pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		drift, err := r.Defaulter.DriftOf(ctx, pod, policy)
+		if err != nil {
+			log.Error(err, "failed to compute drift", "pod", pod.Name)
+			continue
+		}
+		if len(drift) > 0 {
+			drifted = append(drifted, driftedPod{pod: pod, drift: drift})
+		}
+	}
+
+	driftedPods.WithLabelValues(namespace.Name).Set(float64(len(drifted)))
+	r.report(namespace, drifted)
+	if len(drifted) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	restart := namespace.Annotations[AnnotationRestartDrifted] == "true"
+	if restart && policy.DryRun {
+		// Admission leaves the images of dry-run namespaces alone, so restarted pods would drift again
+		log.V(1).Info("not restarting drifted workloads of a dry-run namespace", "namespace", namespace.Name)
+		restart = false
+	}
+	if restart {
+		if err := r.restartWorkloads(ctx, drifted); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: r.resyncInterval()}, nil
+}
+
+// report emits a Namespace event when the number of drifted pods changes.
+func (r *DriftReconciler) report(namespace *corev1.Namespace, drifted []driftedPod) {
+	r.mu.Lock()
+	if r.reported == nil {
+		r.reported = map[string]int{}
+	}
+	previous := r.reported[namespace.Name]
+	r.reported[namespace.Name] = len(drifted)
+	r.mu.Unlock()
+
+	if r.Recorder == nil || previous == len(drifted) {
+		return
+	}
+	if len(drifted) == 0 {
+		r.Recorder.Event(namespace, corev1.EventTypeNormal, EventReasonImageDriftResolved,
+			"All running pods match the image rewrite policy")
+		return
+	}
+
+	var examples []string
+	for _, pod := range drifted {
+		for _, drift := range pod.drift {
+			if len(examples) < driftExamples {
+				examples = append(examples, fmt.Sprintf("%s/%s: %s -> %s", pod.pod.Name, drift.Container, drift.Image,
+					drift.Expected))
+			}
+		}
+	}
+	r.Recorder.Eventf(namespace, corev1.EventTypeWarning, EventReasonImageDrift,
+		"%d running pods have images the rewrite policy would change, e.g. %s", len(drifted),
+		strings.Join(examples, ", "))
+}
+
+// forget clears the state of a namespace that no longer has rewriting enabled.
+func (r *DriftReconciler) forget(namespace string) {
+	r.mu.Lock()
+	delete(r.reported, namespace)
+	r.mu.Unlock()
+	driftedPods.DeleteLabelValues(namespace)
+}
+
+// restartWorkloads restarts the workload of every drifted pod, within the restart rate limit.
+func (r *DriftReconciler) restartWorkloads(ctx context.Context, drifted []driftedPod) error {
+	log := logf.FromContext(ctx)
+
+	seen := map[types.UID]bool{}
+	for _, pod := range drifted {
+		workload, template, err := r.workloadOf(ctx, pod.pod)
+		if err != nil {
+			return err
+		}
+		if workload == nil || seen[workload.GetUID()] {
+			continue
+		}
+		seen[workload.GetUID()] = true
+
+		if restartedAt, err := time.Parse(time.RFC3339, template.Annotations[AnnotationRestartedAt]); err == nil &&
+			time.Since(restartedAt) < r.restartCooldown() {
+			continue
+		}
+		if !r.restartLimiter().Allow() {
+			log.Info("drift restart rate limit reached, deferring restarts")
+			return nil
+		}
+
+		kind := workload.GetObjectKind().GroupVersionKind().Kind
+		patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[AnnotationRestartedAt] = time.Now().UTC().Format(time.RFC3339)
+		if err := r.Patch(ctx, workload, patch); err != nil {
+			return err
+		}
+
+		log.Info("restarted workload with drifted images", "kind", kind, "name", workload.GetName())
+		driftRestartsTotal.WithLabelValues(workload.GetNamespace(), kind).Inc()
+		if r.Recorder != nil {
+			r.Recorder.Eventf(workload, corev1.EventTypeNormal, EventReasonDriftRestart,
+				"Restarted because pod %s runs images the rewrite policy would change", pod.pod.Name)
+		}
+	}
+	return nil
+}
+
+// workloadOf returns the Deployment, StatefulSet or DaemonSet controlling pod, and its pod template.
+// It returns nil for pods of other owners, which cannot be restarted by changing a template.
+func (r *DriftReconciler) workloadOf(ctx context.Context, pod *corev1.Pod) (client.Object, *corev1.PodTemplateSpec, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil, nil
+	}
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		replicaSet := &appsv1.ReplicaSet{}
+		if err := r.Get(ctx, key, replicaSet); err != nil {
+			return nil, nil, client.IgnoreNotFound(err)
+		}
+		owner = metav1.GetControllerOf(replicaSet)
+		if owner == nil || owner.Kind != "Deployment" {
+			return nil, nil, nil
+		}
+		deployment := &appsv1.Deployment{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: pod.Namespace, Name: owner.Name}, deployment); err != nil {
+			return nil, nil, client.IgnoreNotFound(err)
+		}
+		deployment.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("Deployment"))
+		return deployment, &deployment.Spec.Template, nil
+	case "StatefulSet":
+		statefulSet := &appsv1.StatefulSet{}
+		if err := r.Get(ctx, key, statefulSet); err != nil {
+			return nil, nil, client.IgnoreNotFound(err)
+		}
+		statefulSet.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("StatefulSet"))
+		return statefulSet, &statefulSet.Spec.Template, nil
+	case "DaemonSet":
+		daemonSet := &appsv1.DaemonSet{}
+		if err := r.Get(ctx, key, daemonSet); err != nil {
+			return nil, nil, client.IgnoreNotFound(err)
+		}
+		daemonSet.SetGroupVersionKind(appsv1.SchemeGroupVersion.WithKind("DaemonSet"))
+		return daemonSet, &daemonSet.Spec.Template, nil
+	}
+	return nil, nil, nil
+}
+
+func (r *DriftReconciler) resyncInterval() time.Duration {
+	if r.ResyncInterval > 0 {
+		return r.ResyncInterval
+	}
+	return defaultDriftResync
+}
+
+func (r *DriftReconciler) restartCooldown() time.Duration {
+	if r.RestartCooldown > 0 {
+		return r.RestartCooldown
+	}
+	return defaultRestartCooldown
+}
+
+func (r *DriftReconciler) restartLimiter() *rate.Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limiter == nil {
+		interval := r.RestartInterval
+		if interval <= 0 {
+			interval = defaultRestartInterval
+		}
+		r.limiter = rate.NewLimiter(rate.Every(interval), 1)
+	}
+	return r.limiter
+}
+
+// podToNamespace maps a pod to its namespace.
+func podToNamespace(_ context.Context, obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DriftReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Namespace{}).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(podToNamespace)).
+		Named("drift").
+		Complete(r)
+}
@@ -0,0 +1,211 @@
+// PURPOSE: Unit tests for drift reporting and opt-in workload restarts using fake clients
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+func newDriftReconciler(objects ...client.Object) (*DriftReconciler, *record.FakeRecorder) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = appsv1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	recorder := record.NewFakeRecorder(10)
+	return &DriftReconciler{
+		Client:          c,
+		Defaulter:       &webhookv1.PodCustomDefaulter{Client: c},
+		Recorder:        recorder,
+		RestartInterval: time.Hour,
+	}, recorder
+}
+
+func driftNamespace(name string, annotations map[string]string) *corev1.Namespace {
+	namespace := enabledNamespace(name)
+	namespace.Annotations = map[string]string{webhookv1.AnnotationTargetRegistry: "myregistry.io"}
+	for key, value := range annotations {
+		namespace.Annotations[key] = value
+	}
+	return namespace
+}
+
+func driftPod(namespace, name, image string, owner *metav1.OwnerReference) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	if owner != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*owner}
+	}
+	return pod
+}
+
+func controllerRef(kind, name string) *metav1.OwnerReference {
+	isController := true
+	return &metav1.OwnerReference{APIVersion: "apps/v1", Kind: kind, Name: name, UID: types.UID(name), Controller: &isController}
+}
+
+// deploymentPod returns a Deployment, its ReplicaSet and one of its pods running image.
+func deploymentPod(namespace, name, image string) []client.Object {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(name)}}
+	replicaSet := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Namespace: namespace, Name: name + "-5d4f8", UID: types.UID(name + "-5d4f8"),
+		OwnerReferences: []metav1.OwnerReference{*controllerRef("Deployment", name)},
+	}}
+	pod := driftPod(namespace, name+"-5d4f8-x7k2p", image, controllerRef("ReplicaSet", replicaSet.Name))
+	return []client.Object{deployment, replicaSet, pod}
+}
+
+func reconcileDrift(t *testing.T, r *DriftReconciler, name string) ctrl.Result {
+	t.Helper()
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+	if err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+	return result
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestDriftReconciler_ReportsDriftedPods(t *testing.T) {
+	completed := driftPod("team-a", "job-run", "busybox:1.36", nil)
+	completed.Status.Phase = corev1.PodSucceeded
+	r, recorder := newDriftReconciler(driftNamespace("team-a", nil),
+		driftPod("team-a", "old", "nginx:1.25", nil),
+		driftPod("team-a", "new", "myregistry.io/nginx:1.25", nil),
+		completed)
+
+	result := reconcileDrift(t, r, "team-a")
+
+	if got := testutil.ToFloat64(driftedPods.WithLabelValues("team-a")); got != 1 {
+		t.Errorf("expected 1 drifted pod, got %v", got)
+	}
+	if result.RequeueAfter != defaultDriftResync {
+		t.Errorf("expected a resync while pods drift, got %+v", result)
+	}
+	events := drainEvents(recorder)
+	if len(events) != 1 || !strings.Contains(events[0], "Warning ImageDrift 1 running pods") ||
+		!strings.Contains(events[0], "old/app: nginx:1.25 -> myregistry.io/nginx:1.25") {
+		t.Errorf("expected one drift event, got %v", events)
+	}
+
+	// An unchanged count is not reported again
+	reconcileDrift(t, r, "team-a")
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no new events, got %v", events)
+	}
+
+	pod := &corev1.Pod{}
+	_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "old"}, pod)
+	_ = r.Delete(context.Background(), pod)
+	reconcileDrift(t, r, "team-a")
+	if events := drainEvents(recorder); len(events) != 1 || !strings.Contains(events[0], "Normal ImageDriftResolved") {
+		t.Errorf("expected a resolved event, got %v", events)
+	}
+	if got := testutil.ToFloat64(driftedPods.WithLabelValues("team-a")); got != 0 {
+		t.Errorf("expected no drifted pods, got %v", got)
+	}
+}
+
+func TestDriftReconciler_IgnoresDisabledNamespace(t *testing.T) {
+	namespace := driftNamespace("team-b", nil)
+	namespace.Labels = nil
+	r, recorder := newDriftReconciler(namespace, driftPod("team-b", "old", "nginx:1.25", nil))
+
+	if result := reconcileDrift(t, r, "team-b"); result.RequeueAfter != 0 {
+		t.Errorf("expected no resync for a disabled namespace, got %+v", result)
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+}
+
+func TestDriftReconciler_RestartsOptedInWorkloads(t *testing.T) {
+	objects := []client.Object{driftNamespace("team-c", map[string]string{AnnotationRestartDrifted: "true"})}
+	objects = append(objects, deploymentPod("team-c", "web", "nginx:1.25")...)
+	objects = append(objects, deploymentPod("team-c", "api", "team/api:v2")...)
+	r, _ := newDriftReconciler(objects...)
+
+	reconcileDrift(t, r, "team-c")
+
+	restarted := 0
+	for _, name := range []string{"web", "api"} {
+		deployment := &appsv1.Deployment{}
+		_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-c", Name: name}, deployment)
+		if deployment.Spec.Template.Annotations[AnnotationRestartedAt] != "" {
+			restarted++
+		}
+	}
+	// The rate limit allows one restart per RestartInterval
+	if restarted != 1 {
+		t.Errorf("expected exactly one restarted Deployment, got %d", restarted)
+	}
+
+	// Once the limit allows it again, the Deployment restarted within the cooldown is skipped
+	r.limiter = nil
+	reconcileDrift(t, r, "team-c")
+	for _, name := range []string{"web", "api"} {
+		deployment := &appsv1.Deployment{}
+		_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-c", Name: name}, deployment)
+		if deployment.Spec.Template.Annotations[AnnotationRestartedAt] == "" {
+			t.Errorf("expected Deployment %s to be restarted", name)
+		}
+	}
+}
+
+func TestDriftReconciler_DoesNotRestartWithoutOptIn(t *testing.T) {
+	objects := append([]client.Object{driftNamespace("team-d", nil)}, deploymentPod("team-d", "web", "nginx:1.25")...)
+	r, _ := newDriftReconciler(objects...)
+
+	reconcileDrift(t, r, "team-d")
+
+	deployment := &appsv1.Deployment{}
+	_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-d", Name: "web"}, deployment)
+	if deployment.Spec.Template.Annotations[AnnotationRestartedAt] != "" {
+		t.Error("expected no restart without the namespace opt-in")
+	}
+}
+
+func TestDriftReconciler_ReportsButDoesNotRestartDryRunNamespace(t *testing.T) {
+	objects := append([]client.Object{driftNamespace("team-e", map[string]string{
+		AnnotationRestartDrifted: "true", webhookv1.AnnotationDryRun: "true",
+	})}, deploymentPod("team-e", "web", "nginx:1.25")...)
+	r, _ := newDriftReconciler(objects...)
+
+	reconcileDrift(t, r, "team-e")
+
+	if got := testutil.ToFloat64(driftedPods.WithLabelValues("team-e")); got != 1 {
+		t.Errorf("expected the drift of a dry-run namespace to be reported, got %v", got)
+	}
+	deployment := &appsv1.Deployment{}
+	_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-e", Name: "web"}, deployment)
+	if deployment.Spec.Template.Annotations[AnnotationRestartedAt] != "" {
+		t.Error("expected no restart in a dry-run namespace, whose pods would drift again")
+	}
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// PURPOSE: Copies the image of each ImageMirror from its source registry to the mirror, reporting progress in status
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	mirrorv1alpha1 "mutating-registry-hook/api/v1alpha1"
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
+)
+
+const (
+	// ConditionReady reports whether the image is available on the mirror.
+	ConditionReady = "Ready"
+
+	defaultMirrorAttempts         = 5
+	defaultMirrorConcurrency      = 2
+	defaultMirrorProgressInterval = 5 * time.Second
+	defaultMirrorResyncInterval   = time.Hour
+	mirrorRetryBase               = 30 * time.Second
+	mirrorRetryMax                = 10 * time.Minute
+)
+
+// ImageMirrorReconciler copies images requested by ImageMirror objects. Zero values are replaced by defaults.
+type ImageMirrorReconciler struct {
+	client.Client
+	Copier *registry.Copier
+	// Credentials, when set, authenticates the copy with the operator's registry credentials, which
+	// must allow pulling from the sources and pushing to the mirror.
+	Credentials *auth.Provider
+	// MaxAttempts is the number of copy attempts before an ImageMirror is marked Failed.
+	MaxAttempts int
+	// MaxConcurrentReconciles is the number of images copied at once.
+	MaxConcurrentReconciles int
+	// ProgressInterval is the minimum time between status updates during a copy.
+	ProgressInterval time.Duration
+	// ResyncInterval is how often a Succeeded mirror of a tag is checked against its source. When
+	// the tag has moved the image is copied again.
+	ResyncInterval time.Duration
+}
+
+// Reconcile makes one copy attempt for a pending ImageMirror and records the result. A Succeeded
+// mirror of a tag is re-checked every ResyncInterval and copied again when the tag has moved.
+func (r *ImageMirrorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := logf.FromContext(ctx)
+
+	mirror := &mirrorv1alpha1.ImageMirror{}
+	if err := r.Get(ctx, req.NamespacedName, mirror); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if mirror.Status.Phase == mirrorv1alpha1.ImageMirrorFailed {
+		return ctrl.Result{}, nil
+	}
+
+	if r.Credentials != nil {
+		ctx = auth.WithKeyring(ctx, r.Credentials.OperatorKeyring(ctx))
+	}
+
+	if mirror.Status.Phase == mirrorv1alpha1.ImageMirrorSucceeded {
+		moved, result := r.sourceMoved(ctx, mirror)
+		if !moved {
+			return result, nil
+		}
+		log.Info("source image moved, copying it again", "source", mirror.Spec.Source,
+			"previous_digest", mirror.Status.SourceDigest)
+		mirror.Status.Attempts = 0
+	}
+
+	mirror.Status.Phase = mirrorv1alpha1.ImageMirrorCopying
+	mirror.Status.Attempts++
+	mirror.Status.CopiedBytes = 0
+	if err := r.Status().Update(ctx, mirror); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// Resolved before the copy; should the tag move in between, the next resync copies it again
+	digest, err := r.Copier.Digest(ctx, mirror.Spec.Source)
+	if err != nil {
+		log.V(1).Info("could not resolve source digest", "source", mirror.Spec.Source, "error", err.Error())
+	}
+
+	log.Info("copying image", "source", mirror.Spec.Source, "target", mirror.Spec.Target,
+		"attempt", mirror.Status.Attempts)
+	reporter := &progressReporter{interval: r.progressInterval(), last: time.Now()}
+	copyErr := r.Copier.Copy(ctx, mirror.Spec.Source, mirror.Spec.Target, func(p registry.CopyProgress) {
+		reporter.report(p, func(p registry.CopyProgress) {
+			setProgress(&mirror.Status, p)
+			if err := r.Status().Update(ctx, mirror); err != nil {
+				log.Error(err, "failed to report copy progress")
+			}
+		})
+	})
+	setProgress(&mirror.Status, reporter.latest)
+
+	var result ctrl.Result
+	switch {
+	case copyErr == nil:
+		now := metav1.Now()
+		mirror.Status.Phase = mirrorv1alpha1.ImageMirrorSucceeded
+		mirror.Status.LastError = ""
+		mirror.Status.CompletionTime = &now
+		mirror.Status.SourceDigest = digest
+		meta.SetStatusCondition(&mirror.Status.Conditions, metav1.Condition{
+			Type: ConditionReady, Status: metav1.ConditionTrue, Reason: "Copied",
+			Message: "image is available on the target registry",
+		})
+		log.Info("image copied", "source", mirror.Spec.Source, "target", mirror.Spec.Target,
+			"blobs", mirror.Status.CopiedBlobs, "bytes", mirror.Status.CopiedBytes)
+	case int(mirror.Status.Attempts) >= r.maxAttempts():
+		mirror.Status.Phase = mirrorv1alpha1.ImageMirrorFailed
+		mirror.Status.LastError = copyErr.Error()
+		meta.SetStatusCondition(&mirror.Status.Conditions, metav1.Condition{
+			Type: ConditionReady, Status: metav1.ConditionFalse, Reason: "CopyFailed", Message: copyErr.Error(),
+		})
+		log.Error(copyErr, "giving up copying image", "source", mirror.Spec.Source, "target", mirror.Spec.Target)
+	default:
+		mirror.Status.LastError = copyErr.Error()
+		meta.SetStatusCondition(&mirror.Status.Conditions, metav1.Condition{
+			Type: ConditionReady, Status: metav1.ConditionFalse, Reason: "Retrying", Message: copyErr.Error(),
+		})
+		result.RequeueAfter = retryDelay(mirror.Status.Attempts)
+		log.Error(copyErr, "failed to copy image, will retry", "source", mirror.Spec.Source,
+			"target", mirror.Spec.Target, "retry_after", result.RequeueAfter)
+	}
+
+	return result, r.Status().Update(ctx, mirror)
+}
+
+// sourceMoved reports whether the source of a Succeeded mirror now resolves to another digest than
+// the one copied. Mirrors of a digest never move. Otherwise the source is checked at most once per
+// ResyncInterval after the copy completed, and result schedules the next check.
+func (r *ImageMirrorReconciler) sourceMoved(ctx context.Context, mirror *mirrorv1alpha1.ImageMirror) (bool, ctrl.Result) {
+	ref, err := registry.ParseReference(mirror.Spec.Source)
+	if err != nil || ref.Digest != "" {
+		return false, ctrl.Result{}
+	}
+
+	interval := r.resyncInterval()
+	if mirror.Status.CompletionTime != nil {
+		if wait := interval - time.Since(mirror.Status.CompletionTime.Time); wait > 0 {
+			return false, ctrl.Result{RequeueAfter: wait}
+		}
+	}
+
+	digest, err := r.Copier.Digest(ctx, mirror.Spec.Source)
+	if err != nil {
+		logf.FromContext(ctx).Error(err, "failed to check source image for changes", "source", mirror.Spec.Source)
+		return false, ctrl.Result{RequeueAfter: interval}
+	}
+	if digest == mirror.Status.SourceDigest {
+		return false, ctrl.Result{RequeueAfter: interval}
+	}
+	return true, ctrl.Result{}
+}
+
+// progressReporter throttles copy progress reports to one per interval. The copier calls it from
+// concurrent transfers; the status write happens outside its lock and one at a time, so a slow API
+// server delays reports rather than transfers.
+type progressReporter struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	latest  registry.CopyProgress
+	last    time.Time
+	writing bool
+}
+
+// report records p and, when a report is due and none is in flight, passes the most advanced
+// progress seen so far to write.
+func (p *progressReporter) report(progress registry.CopyProgress, write func(registry.CopyProgress)) {
+	p.mu.Lock()
+	// Snapshots from concurrent transfers may arrive out of order
+	if progress.CopiedBlobs+progress.CopiedManifests >= p.latest.CopiedBlobs+p.latest.CopiedManifests {
+		p.latest = progress
+	}
+	if p.writing || time.Since(p.last) < p.interval {
+		p.mu.Unlock()
+		return
+	}
+	p.writing = true
+	snapshot := p.latest
+	p.mu.Unlock()
+
+	write(snapshot)
+
+	p.mu.Lock()
+	p.writing = false
+	p.last = time.Now()
+	p.mu.Unlock()
+}
+
+// setProgress copies copier progress into the ImageMirror status.
+func setProgress(status *mirrorv1alpha1.ImageMirrorStatus, p registry.CopyProgress) {
+	status.TotalManifests = int32(p.TotalManifests)
+	status.CopiedManifests = int32(p.CopiedManifests)
+	status.TotalBlobs = int32(p.TotalBlobs)
+	status.CopiedBlobs = int32(p.CopiedBlobs)
+	status.CopiedBytes = p.CopiedBytes
+}
+
+// retryDelay doubles the wait after each failed attempt, up to mirrorRetryMax.
+func retryDelay(attempts int32) time.Duration {
+	delay := mirrorRetryBase
+	for i := int32(1); i < attempts && delay < mirrorRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, mirrorRetryMax)
+}
+
+func (r *ImageMirrorReconciler) maxAttempts() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts
+	}
+	return defaultMirrorAttempts
+}
+
+func (r *ImageMirrorReconciler) resyncInterval() time.Duration {
+	if r.ResyncInterval > 0 {
+		return r.ResyncInterval
+	}
+	return defaultMirrorResyncInterval
+}
+
+func (r *ImageMirrorReconciler) progressInterval() time.Duration {
+	if r.ProgressInterval > 0 {
+		return r.ProgressInterval
+	}
+	return defaultMirrorProgressInterval
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ImageMirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	concurrency := r.MaxConcurrentReconciles
+	if concurrency <= 0 {
+		concurrency = defaultMirrorConcurrency
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&mirrorv1alpha1.ImageMirror{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: concurrency}).
+		Named("imagemirror").
+		Complete(r)
+}
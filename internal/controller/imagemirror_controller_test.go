@@ -0,0 +1,215 @@
+// PURPOSE: Tests copying ImageMirror images between two registry stand-ins and submitting mirrors from the queue
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	mirrorv1alpha1 "mutating-registry-hook/api/v1alpha1"
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/registrytest"
+)
+
+func newMirrorClient(objects ...client.Object) client.Client {
+	scheme := runtime.NewScheme()
+	_ = mirrorv1alpha1.AddToScheme(scheme)
+	return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).
+		WithStatusSubresource(&mirrorv1alpha1.ImageMirror{}).Build()
+}
+
+func newImageMirror(source, target string) *mirrorv1alpha1.ImageMirror {
+	return &mirrorv1alpha1.ImageMirror{
+		ObjectMeta: metav1.ObjectMeta{Name: MirrorName(source, target)},
+		Spec:       mirrorv1alpha1.ImageMirrorSpec{Source: source, Target: target},
+	}
+}
+
+func reconcileMirror(t *testing.T, r *ImageMirrorReconciler, name string) (ctrl.Result, *mirrorv1alpha1.ImageMirror) {
+	t.Helper()
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: name}})
+	if err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+	mirror := &mirrorv1alpha1.ImageMirror{}
+	if err := r.Get(context.Background(), types.NamespacedName{Name: name}, mirror); err != nil {
+		t.Fatalf("failed to get ImageMirror: %v", err)
+	}
+	return result, mirror
+}
+
+func TestImageMirrorReconciler_CopiesMultiArchImage(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushImage("team/app", "v1", "linux/amd64", "linux/arm64")
+
+	// Mirror the image the webhook rewrote team/app:v1 to
+	mirror := newImageMirror(source.Host()+"/team/app:v1", target.Host()+"/team/app:v1")
+	r := &ImageMirrorReconciler{
+		Client: newMirrorClient(mirror),
+		Copier: &registry.Copier{Client: source.Client()},
+	}
+
+	_, got := reconcileMirror(t, r, mirror.Name)
+
+	if got.Status.Phase != mirrorv1alpha1.ImageMirrorSucceeded {
+		t.Fatalf("expected phase Succeeded, got %q (%s)", got.Status.Phase, got.Status.LastError)
+	}
+	if got.Status.CopiedManifests != 3 || got.Status.TotalManifests != 3 {
+		t.Errorf("expected 3 of 3 manifests copied, got %d of %d", got.Status.CopiedManifests, got.Status.TotalManifests)
+	}
+	if got.Status.CopiedBlobs != 4 || got.Status.CompletionTime == nil {
+		t.Errorf("unexpected status: %+v", got.Status)
+	}
+	if !target.HasManifest("team/app", "v1") {
+		t.Error("expected the image on the target registry")
+	}
+
+	// A finished mirror is not copied again
+	before := len(source.Requests())
+	reconcileMirror(t, r, mirror.Name)
+	if len(source.Requests()) != before {
+		t.Error("expected no registry requests for a succeeded ImageMirror")
+	}
+}
+
+func TestImageMirrorReconciler_CopiesAgainWhenTagMoves(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	first := source.PushImage("team/app", "v1")
+
+	mirror := newImageMirror(source.Host()+"/team/app:v1", target.Host()+"/team/app:v1")
+	r := &ImageMirrorReconciler{
+		Client:         newMirrorClient(mirror),
+		Copier:         &registry.Copier{Client: source.Client()},
+		ResyncInterval: time.Nanosecond,
+	}
+
+	_, got := reconcileMirror(t, r, mirror.Name)
+	if got.Status.Phase != mirrorv1alpha1.ImageMirrorSucceeded || got.Status.SourceDigest != first {
+		t.Fatalf("expected the first digest to be recorded, got %+v", got.Status)
+	}
+
+	// Unchanged: checked, not copied, and checked again later
+	result, _ := reconcileMirror(t, r, mirror.Name)
+	if result.RequeueAfter == 0 {
+		t.Error("expected a Succeeded mirror of a tag to be re-checked periodically")
+	}
+
+	moved := source.PushImage("team/app", "v1", "linux/arm64")
+	_, got = reconcileMirror(t, r, mirror.Name)
+	if got.Status.Phase != mirrorv1alpha1.ImageMirrorSucceeded || got.Status.SourceDigest != moved {
+		t.Errorf("expected the moved tag to be copied again, got %+v", got.Status)
+	}
+	if !target.HasManifest("team/app", moved) {
+		t.Error("expected the new manifest on the target registry")
+	}
+}
+
+func TestProgressReporter_WritesOutsideLockAndKeepsLatest(t *testing.T) {
+	reporter := &progressReporter{}
+	var writes []registry.CopyProgress
+	reporter.report(registry.CopyProgress{CopiedBlobs: 2}, func(p registry.CopyProgress) {
+		// A report arriving during the write is recorded without blocking on it
+		reporter.report(registry.CopyProgress{CopiedBlobs: 3}, func(registry.CopyProgress) {
+			t.Error("expected no second write while one is in flight")
+		})
+		writes = append(writes, p)
+	})
+	reporter.report(registry.CopyProgress{CopiedBlobs: 1}, func(p registry.CopyProgress) { writes = append(writes, p) })
+
+	if len(writes) != 2 || writes[1].CopiedBlobs != 3 || reporter.latest.CopiedBlobs != 3 {
+		t.Errorf("expected the most advanced progress to be reported, got %+v", writes)
+	}
+}
+
+func TestImageMirrorReconciler_RetriesThenFails(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	// The source image does not exist
+	mirror := newImageMirror(source.Host()+"/team/app:v1", target.Host()+"/team/app:v1")
+	r := &ImageMirrorReconciler{
+		Client:      newMirrorClient(mirror),
+		Copier:      &registry.Copier{Client: source.Client()},
+		MaxAttempts: 2,
+	}
+
+	result, got := reconcileMirror(t, r, mirror.Name)
+	if got.Status.Phase != mirrorv1alpha1.ImageMirrorCopying || result.RequeueAfter == 0 || got.Status.LastError == "" {
+		t.Fatalf("expected a retry after the first failure, got %+v (result %+v)", got.Status, result)
+	}
+
+	result, got = reconcileMirror(t, r, mirror.Name)
+	if got.Status.Phase != mirrorv1alpha1.ImageMirrorFailed || result.RequeueAfter != 0 {
+		t.Errorf("expected phase Failed after the last attempt, got %+v", got.Status)
+	}
+	if got.Status.Attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", got.Status.Attempts)
+	}
+}
+
+func TestRetryDelay_IsCapped(t *testing.T) {
+	if got := retryDelay(1); got != mirrorRetryBase {
+		t.Errorf("expected first retry after %s, got %s", mirrorRetryBase, got)
+	}
+	if got := retryDelay(20); got != mirrorRetryMax {
+		t.Errorf("expected retries capped at %s, got %s", mirrorRetryMax, got)
+	}
+}
+
+func TestMirrorQueue_CreatesImageMirrorOnce(t *testing.T) {
+	c := newMirrorClient()
+	queue := NewMirrorQueue(c, 10)
+
+	queue.Enqueue("nginx:1.25", "mirror.example.com/nginx:1.25")
+	queue.Enqueue("nginx:1.25", "mirror.example.com/nginx:1.25")
+	if got := len(queue.pending); got != 1 {
+		t.Fatalf("expected duplicate pairs to be queued once, got %d", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = queue.Start(ctx) }()
+
+	name := MirrorName("nginx:1.25", "mirror.example.com/nginx:1.25")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mirror := &mirrorv1alpha1.ImageMirror{}
+		err := c.Get(context.Background(), types.NamespacedName{Name: name}, mirror)
+		if err == nil {
+			if mirror.Spec.Target != "mirror.example.com/nginx:1.25" {
+				t.Errorf("unexpected spec: %+v", mirror.Spec)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ImageMirror was not created: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirrorQueue_DropsWhenFull(t *testing.T) {
+	queue := NewMirrorQueue(newMirrorClient(), 1)
+
+	queue.Enqueue("a:1", "mirror.example.com/a:1")
+	queue.Enqueue("b:1", "mirror.example.com/b:1")
+
+	if got := len(queue.pending); got != 1 {
+		t.Errorf("expected the queue to hold 1 pair, got %d", got)
+	}
+	// A dropped pair can be enqueued again later
+	<-queue.pending
+	queue.Enqueue("b:1", "mirror.example.com/b:1")
+	if got := len(queue.pending); got != 1 {
+		t.Errorf("expected the dropped pair to be accepted, got %d", got)
+	}
+}
@@ -0,0 +1,111 @@
+// PURPOSE: Turns rewrite decisions from the webhook into ImageMirror objects without blocking admission
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	mirrorv1alpha1 "mutating-registry-hook/api/v1alpha1"
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+// maxRememberedMirrors bounds the set of pairs the queue skips as already submitted.
+const maxRememberedMirrors = 10000
+
+var mirrorQueueLog = logf.Log.WithName("mirror-queue")
+
+type mirrorPair struct {
+	source string
+	target string
+}
+
+// MirrorQueue buffers image pairs from the webhook and creates an ImageMirror for each one.
+type MirrorQueue struct {
+	client  client.Client
+	pending chan mirrorPair
+
+	mu   sync.Mutex
+	seen map[mirrorPair]bool
+}
+
+var (
+	_ webhookv1.MirrorEnqueuer       = &MirrorQueue{}
+	_ manager.LeaderElectionRunnable = &MirrorQueue{}
+)
+
+// NewMirrorQueue returns a queue holding up to size pairs waiting to be submitted.
+func NewMirrorQueue(c client.Client, size int) *MirrorQueue {
+	return &MirrorQueue{client: c, pending: make(chan mirrorPair, size), seen: map[mirrorPair]bool{}}
+}
+
+// Enqueue submits a pair unless it was submitted before. When the buffer is full the pair is dropped;
+// the next pod using the image enqueues it again.
+func (q *MirrorQueue) Enqueue(source, target string) {
+	pair := mirrorPair{source: source, target: target}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.seen[pair] {
+		return
+	}
+	select {
+	case q.pending <- pair:
+		if len(q.seen) >= maxRememberedMirrors {
+			clear(q.seen)
+		}
+		q.seen[pair] = true
+	default:
+		mirrorQueueLog.Info("mirror queue full, dropping image", "source", source, "target", target)
+	}
+}
+
+// Start creates ImageMirror objects until ctx is done.
+func (q *MirrorQueue) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case pair := <-q.pending:
+			if err := q.submit(ctx, pair); err != nil {
+				mirrorQueueLog.Error(err, "failed to create ImageMirror", "source", pair.source, "target", pair.target)
+				q.mu.Lock()
+				delete(q.seen, pair)
+				q.mu.Unlock()
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false: every replica serves the webhook and submits its own decisions.
+func (q *MirrorQueue) NeedLeaderElection() bool {
+	return false
+}
+
+func (q *MirrorQueue) submit(ctx context.Context, pair mirrorPair) error {
+	mirror := &mirrorv1alpha1.ImageMirror{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   MirrorName(pair.source, pair.target),
+			Labels: map[string]string{LabelManagedBy: ManagedByValue},
+		},
+		Spec: mirrorv1alpha1.ImageMirrorSpec{Source: pair.source, Target: pair.target},
+	}
+	if err := q.client.Create(ctx, mirror); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// MirrorName derives a stable object name from an image pair, so that replicas and repeated
+// decisions share one ImageMirror.
+func MirrorName(source, target string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + target))
+	return "m-" + hex.EncodeToString(sum[:])[:20]
+}
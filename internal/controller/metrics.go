@@ -0,0 +1,42 @@
+// PURPOSE: Registers Prometheus metrics describing drifted pods and reloads of the global defaults
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	reloadApplied  = "applied"
+	reloadRejected = "rejected"
+)
+
+var (
+	// driftedPods is the number of running pods per namespace with an image the policy would rewrite.
+	driftedPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_rewrite_drifted_pods",
+		Help: "Number of running pods with an image the current rewrite policy would change, by namespace.",
+	}, []string{"namespace"})
+
+	// driftRestartsTotal counts workloads restarted to pick up rewritten images.
+	driftRestartsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_rewrite_drift_restarts_total",
+		Help: "Number of workloads restarted because their pods drifted from the rewrite policy, by namespace and kind.",
+	}, []string{"namespace", "kind"})
+
+	// defaultsReloadsTotal counts loads of the global defaults ConfigMap by result.
+	defaultsReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_rewrite_defaults_reloads_total",
+		Help: "Number of times the global defaults ConfigMap was loaded, by result (applied or rejected).",
+	}, []string{"result"})
+
+	// defaultsInvalid is 1 while the latest defaults edit was rejected and older defaults remain in use.
+	defaultsInvalid = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "image_rewrite_defaults_invalid",
+		Help: "1 when the latest edit of the global defaults ConfigMap is invalid and the last valid defaults are in use.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(driftedPods, driftRestartsTotal, defaultsReloadsTotal, defaultsInvalid)
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// PURPOSE: Replicates the configured registry pull Secrets into namespaces that have registry rewriting enabled
+package controller
+
+import (
+	"context"
+	"maps"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+const (
+	// LabelManagedBy marks Secrets created by the operator.
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	// ManagedByValue is the LabelManagedBy value used by the operator.
+	ManagedByValue = "mutating-registry-hook"
+	// AnnotationSourceSecret records the <namespace>/<name> a replicated Secret was copied from.
+	AnnotationSourceSecret = "image-rewriter.example.com/source-secret"
+)
+
+// PullSecretReconciler keeps a copy of every configured pull Secret in each namespace labeled
+// registry-rewrite=enabled, and removes the copies when a namespace opts out.
+type PullSecretReconciler struct {
+	client.Client
+	PullSecrets []webhookv1.PullSecret
+}
+
+// PullSecretCacheOptions limits the Secret informer to the source namespaces and to Secrets the
+// operator manages, so the cache does not hold every Secret in the cluster.
+func PullSecretCacheOptions(secrets []webhookv1.PullSecret) cache.ByObject {
+	namespaces := map[string]cache.Config{
+		cache.AllNamespaces: {LabelSelector: labels.SelectorFromSet(labels.Set{LabelManagedBy: ManagedByValue})},
+	}
+	for _, secret := range secrets {
+		namespaces[secret.Source.Namespace] = cache.Config{LabelSelector: labels.Everything()}
+	}
+	return cache.ByObject{Namespaces: namespaces}
+}
+
+// Reconcile brings the replicated Secrets of one namespace up to date.
+func (r *PullSecretReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := logf.FromContext(ctx)
+
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, req.NamespacedName, namespace); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !namespace.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	enabled := namespace.Labels[webhookv1.LabelRegistryRewrite] == webhookv1.LabelValueEnabled
+
+	for _, pullSecret := range r.PullSecrets {
+		if pullSecret.Source.Namespace == namespace.Name {
+			continue
+		}
+		key := types.NamespacedName{Namespace: namespace.Name, Name: pullSecret.Source.Name}
+
+		if !enabled {
+			if err := r.removeReplica(ctx, key); err != nil {
+				return ctrl.Result{}, err
+			}
+			continue
+		}
+
+		source := &corev1.Secret{}
+		if err := r.Get(ctx, pullSecret.Source, source); err != nil {
+			if apierrors.IsNotFound(err) {
+				log.Info("source pull secret not found", "secret", pullSecret.Source.String())
+				continue
+			}
+			return ctrl.Result{}, err
+		}
+		if err := r.replicate(ctx, source, key); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// replicate creates or updates the copy of source at key. A Secret the operator did not create is left alone.
+func (r *PullSecretReconciler) replicate(ctx context.Context, source *corev1.Secret, key types.NamespacedName) error {
+	log := logf.FromContext(ctx)
+
+	existing := &corev1.Secret{}
+	err := r.Get(ctx, key, existing)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		return err
+	case existing.Labels[LabelManagedBy] != ManagedByValue:
+		log.Info("not replacing pull secret the operator does not manage", "secret", key.String())
+		return nil
+	}
+
+	replica := &corev1.Secret{}
+	replica.Namespace, replica.Name = key.Namespace, key.Name
+	result, err := controllerutil.CreateOrUpdate(ctx, r.Client, replica, func() error {
+		if replica.Labels == nil {
+			replica.Labels = map[string]string{}
+		}
+		replica.Labels[LabelManagedBy] = ManagedByValue
+		if replica.Annotations == nil {
+			replica.Annotations = map[string]string{}
+		}
+		replica.Annotations[AnnotationSourceSecret] = client.ObjectKeyFromObject(source).String()
+		replica.Type = source.Type
+		replica.Data = maps.Clone(source.Data)
+		return nil
+	})
+	if apierrors.IsAlreadyExists(err) {
+		// Outside the source namespaces the cache only holds Secrets the operator manages (see
+		// PullSecretCacheOptions), so one the API server has but the cache does not is someone else's
+		log.Info("not replacing pull secret the operator does not manage", "secret", key.String())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if result != controllerutil.OperationResultNone {
+		log.Info("replicated pull secret", "secret", key.String(), "operation", result)
+	}
+	return nil
+}
+
+// removeReplica deletes the copy at key if the operator created it.
+func (r *PullSecretReconciler) removeReplica(ctx context.Context, key types.NamespacedName) error {
+	existing := &corev1.Secret{}
+	if err := r.Get(ctx, key, existing); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if existing.Labels[LabelManagedBy] != ManagedByValue {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, existing))
+}
+
+// secretToNamespaces maps a source Secret to every opted-in namespace, and a replica to its own namespace.
+func (r *PullSecretReconciler) secretToNamespaces(ctx context.Context, obj client.Object) []reconcile.Request {
+	if obj.GetLabels()[LabelManagedBy] == ManagedByValue {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+	}
+
+	for _, pullSecret := range r.PullSecrets {
+		if pullSecret.Source != client.ObjectKeyFromObject(obj) {
+			continue
+		}
+		namespaces := &corev1.NamespaceList{}
+		if err := r.List(ctx, namespaces,
+			client.MatchingLabels{webhookv1.LabelRegistryRewrite: webhookv1.LabelValueEnabled}); err != nil {
+			logf.FromContext(ctx).Error(err, "failed to list namespaces for pull secret", "secret", pullSecret.Source.String())
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(namespaces.Items))
+		for _, namespace := range namespaces.Items {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: namespace.Name}})
+		}
+		return requests
+	}
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PullSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Namespace{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.secretToNamespaces)).
+		Named("pullsecret").
+		Complete(r)
+}
@@ -0,0 +1,182 @@
+// PURPOSE: Unit tests for pull Secret replication using fake clients
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	webhookv1 "mutating-registry-hook/internal/webhook/v1"
+)
+
+var testPullSecret = webhookv1.PullSecret{
+	Registry: "mirror.example.com",
+	Source:   types.NamespacedName{Namespace: "operator", Name: "mirror-pull"},
+}
+
+func newPullSecretReconciler(objects ...client.Object) *PullSecretReconciler {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	return &PullSecretReconciler{
+		Client:      fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build(),
+		PullSecrets: []webhookv1.PullSecret{testPullSecret},
+	}
+}
+
+// newCachedPullSecretReconciler reads Secrets the way the manager's cache does with
+// PullSecretCacheOptions: a Secret outside the selector of its namespace is not found, while
+// writes still reach the whole fake API server, which is returned alongside.
+func newCachedPullSecretReconciler(objects ...client.Object) (*PullSecretReconciler, client.WithWatch) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	options := PullSecretCacheOptions([]webhookv1.PullSecret{testPullSecret})
+	selectorFor := func(namespace string) labels.Selector {
+		if config, ok := options.Namespaces[namespace]; ok {
+			return config.LabelSelector
+		}
+		return options.Namespaces[cache.AllNamespaces].LabelSelector
+	}
+
+	api := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	cached := interceptor.NewClient(api, interceptor.Funcs{
+		Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+			if _, ok := obj.(*corev1.Secret); ok {
+				stored := &corev1.Secret{}
+				if err := c.Get(ctx, key, stored, opts...); err != nil {
+					return err
+				}
+				if !selectorFor(key.Namespace).Matches(labels.Set(stored.Labels)) {
+					return apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+				}
+			}
+			return c.Get(ctx, key, obj, opts...)
+		},
+	})
+	return &PullSecretReconciler{Client: cached, PullSecrets: []webhookv1.PullSecret{testPullSecret}}, api
+}
+
+func sourceSecret(data string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "operator", Name: "mirror-pull"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(data)},
+	}
+}
+
+func enabledNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{webhookv1.LabelRegistryRewrite: webhookv1.LabelValueEnabled},
+	}}
+}
+
+func reconcileNamespace(t *testing.T, r *PullSecretReconciler, name string) {
+	t.Helper()
+	if _, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: name}}); err != nil {
+		t.Fatalf("Reconcile returned error: %v", err)
+	}
+}
+
+func TestPullSecretReconciler_ReplicatesIntoEnabledNamespace(t *testing.T) {
+	r := newPullSecretReconciler(sourceSecret(`{"auths":{}}`), enabledNamespace("team-a"))
+
+	reconcileNamespace(t, r, "team-a")
+
+	replica := &corev1.Secret{}
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "mirror-pull"}, replica); err != nil {
+		t.Fatalf("expected replica to exist: %v", err)
+	}
+	if replica.Type != corev1.SecretTypeDockerConfigJson || string(replica.Data[corev1.DockerConfigJsonKey]) != `{"auths":{}}` {
+		t.Errorf("replica does not match source: %v", replica)
+	}
+	if replica.Labels[LabelManagedBy] != ManagedByValue || replica.Annotations[AnnotationSourceSecret] != "operator/mirror-pull" {
+		t.Errorf("replica is missing ownership metadata: %v", replica.ObjectMeta)
+	}
+}
+
+func TestPullSecretReconciler_UpdatesReplicaWhenSourceChanges(t *testing.T) {
+	r := newPullSecretReconciler(sourceSecret(`{"auths":{}}`), enabledNamespace("team-a"))
+	reconcileNamespace(t, r, "team-a")
+
+	source := &corev1.Secret{}
+	_ = r.Get(context.Background(), testPullSecret.Source, source)
+	source.Data[corev1.DockerConfigJsonKey] = []byte(`{"auths":{"mirror.example.com":{}}}`)
+	if err := r.Update(context.Background(), source); err != nil {
+		t.Fatalf("updating source: %v", err)
+	}
+
+	requests := r.secretToNamespaces(context.Background(), source)
+	if len(requests) != 1 || requests[0].Name != "team-a" {
+		t.Fatalf("expected the source change to enqueue team-a, got %v", requests)
+	}
+	reconcileNamespace(t, r, "team-a")
+
+	replica := &corev1.Secret{}
+	_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "mirror-pull"}, replica)
+	if string(replica.Data[corev1.DockerConfigJsonKey]) != `{"auths":{"mirror.example.com":{}}}` {
+		t.Errorf("replica was not updated: %s", replica.Data[corev1.DockerConfigJsonKey])
+	}
+}
+
+func TestPullSecretReconciler_LeavesUnmanagedSecretAlone(t *testing.T) {
+	userSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "mirror-pull"},
+		Data:       map[string][]byte{"user": []byte("data")},
+	}
+	r := newPullSecretReconciler(sourceSecret(`{"auths":{}}`), enabledNamespace("team-a"), userSecret)
+
+	reconcileNamespace(t, r, "team-a")
+
+	existing := &corev1.Secret{}
+	_ = r.Get(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "mirror-pull"}, existing)
+	if string(existing.Data["user"]) != "data" {
+		t.Errorf("unmanaged secret was modified: %v", existing.Data)
+	}
+}
+
+func TestPullSecretReconciler_LeavesUnmanagedSecretOutsideTheCacheAlone(t *testing.T) {
+	userSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "mirror-pull"},
+		Data:       map[string][]byte{"user": []byte("data")},
+	}
+	r, api := newCachedPullSecretReconciler(sourceSecret(`{"auths":{}}`), enabledNamespace("team-a"), userSecret)
+
+	for range 2 {
+		reconcileNamespace(t, r, "team-a")
+	}
+
+	existing := &corev1.Secret{}
+	_ = api.Get(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "mirror-pull"}, existing)
+	if existing.Labels[LabelManagedBy] == ManagedByValue || string(existing.Data["user"]) != "data" {
+		t.Errorf("unmanaged secret was modified: %v", existing)
+	}
+}
+
+func TestPullSecretReconciler_RemovesReplicaWhenNamespaceOptsOut(t *testing.T) {
+	r := newPullSecretReconciler(sourceSecret(`{"auths":{}}`), enabledNamespace("team-a"))
+	reconcileNamespace(t, r, "team-a")
+
+	namespace := &corev1.Namespace{}
+	_ = r.Get(context.Background(), types.NamespacedName{Name: "team-a"}, namespace)
+	namespace.Labels = nil
+	if err := r.Update(context.Background(), namespace); err != nil {
+		t.Fatalf("updating namespace: %v", err)
+	}
+	reconcileNamespace(t, r, "team-a")
+
+	err := r.Get(context.Background(), types.NamespacedName{Namespace: "team-a", Name: "mirror-pull"}, &corev1.Secret{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected replica to be deleted, got %v", err)
+	}
+}
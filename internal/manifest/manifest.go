@@ -0,0 +1,312 @@
+// PURPOSE: Reads multi-document manifests and locates the pod specs of Pods and workload kinds
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// podSpecPaths maps each built-in group and kind carrying a pod spec to the field path of that
+// spec. Custom resources that reuse these kind names in other groups are not matched.
+var podSpecPaths = map[schema.GroupKind][]string{
+	{Kind: "Pod"}:                        {"spec"},
+	{Kind: "PodTemplate"}:                {"template", "spec"},
+	{Kind: "ReplicationController"}:      {"spec", "template", "spec"},
+	{Group: "apps", Kind: "ReplicaSet"}:  {"spec", "template", "spec"},
+	{Group: "apps", Kind: "Deployment"}:  {"spec", "template", "spec"},
+	{Group: "apps", Kind: "StatefulSet"}: {"spec", "template", "spec"},
+	{Group: "apps", Kind: "DaemonSet"}:   {"spec", "template", "spec"},
+	{Group: "batch", Kind: "Job"}:        {"spec", "template", "spec"},
+	{Group: "batch", Kind: "CronJob"}:    {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// containerFields are the pod spec fields holding containers, in the order the webhook visits them.
+var containerFields = []string{"containers", "initContainers", "ephemeralContainers"}
+
+// PodSpecPath returns the field path of the pod spec in objects of the group and kind gk.
+func PodSpecPath(gk schema.GroupKind) ([]string, bool) {
+	path, ok := podSpecPaths[gk]
+	return path, ok
+}
+
+// Document is one document of a manifest stream: the objects decoded from it, usually one, and its
+// source text, so a document whose objects were not changed is written back byte-for-byte.
+type Document struct {
+	Objects []*unstructured.Unstructured
+
+	raw       []byte
+	originals []map[string]any
+}
+
+// Changed reports whether any object of d differs from what was read.
+func (d *Document) Changed() bool {
+	if len(d.Objects) != len(d.originals) {
+		return true
+	}
+	for i, obj := range d.Objects {
+		if !reflect.DeepEqual(obj.Object, d.originals[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadDocuments reads every document of a multi-document YAML or JSON stream, keeping the source of
+// each. Documents holding only comments are kept, with no objects.
+func ReadDocuments(r io.Reader) ([]*Document, error) {
+	reader := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	var documents []*Document
+	for {
+		raw, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return documents, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading document %d: %w", len(documents)+1, err)
+		}
+
+		document := &Document{raw: raw}
+		decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(raw), 4096)
+		for {
+			var content map[string]any
+			if err := decoder.Decode(&content); err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return nil, fmt.Errorf("decoding document %d: %w", len(documents)+1, err)
+			}
+			if len(content) == 0 {
+				continue
+			}
+			document.Objects = append(document.Objects, &unstructured.Unstructured{Object: content})
+			document.originals = append(document.originals, runtime.DeepCopyJSON(content))
+		}
+		documents = append(documents, document)
+	}
+}
+
+// WriteDocuments writes documents as a multi-document YAML stream. Unchanged documents are written as
+// they were read, comments and key order included; changed ones are re-serialized.
+func WriteDocuments(w io.Writer, documents []*Document) error {
+	for i, document := range documents {
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if document.Changed() {
+			if err := Encode(w, document.Objects); err != nil {
+				return err
+			}
+			continue
+		}
+		raw := document.raw
+		if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+			raw = append(raw, '\n')
+		}
+		if _, err := w.Write(raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode reads every object of a multi-document YAML or JSON stream. Empty documents are skipped.
+func Decode(r io.Reader) ([]*unstructured.Unstructured, error) {
+	documents, err := ReadDocuments(r)
+	if err != nil {
+		return nil, err
+	}
+	var objects []*unstructured.Unstructured
+	for _, document := range documents {
+		objects = append(objects, document.Objects...)
+	}
+	return objects, nil
+}
+
+// Encode writes objects as a multi-document YAML stream.
+func Encode(w io.Writer, objects []*unstructured.Unstructured) error {
+	for i, obj := range objects {
+		data, err := yaml.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, "---\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeString returns the YAML of objects.
+func EncodeString(objects []*unstructured.Unstructured) (string, error) {
+	var buf bytes.Buffer
+	err := Encode(&buf, objects)
+	return buf.String(), err
+}
+
+// ImageChange records an image rewritten in a manifest.
+type ImageChange struct {
+	// APIVersion, Kind, Namespace and Name identify the object holding the pod spec.
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+	// Container is the name of the container, or of the volume for image volumes.
+	Container string
+	// Field is the path of the image field within the object, such as spec.containers[0].image.
+	Field    string
+	Original string
+	Image    string
+}
+
+// MutatePodSpecs calls fn with a Pod built from every pod spec in obj, including the items of a List,
+// and writes the images fn chose for containers and image volumes back into obj. Other changes fn makes to the Pod are discarded.
+// Objects of kinds without a pod spec are left untouched.
+func MutatePodSpecs(obj *unstructured.Unstructured, fn func(pod *corev1.Pod) error) ([]ImageChange, error) {
+	if obj.IsList() {
+		var changes []ImageChange
+		err := obj.EachListItem(func(item runtime.Object) error {
+			itemChanges, err := MutatePodSpecs(item.(*unstructured.Unstructured), fn)
+			changes = append(changes, itemChanges...)
+			return err
+		})
+		return changes, err
+	}
+
+	path, ok := PodSpecPath(obj.GroupVersionKind().GroupKind())
+	if !ok {
+		return nil, nil
+	}
+	specMap, found, err := unstructured.NestedMap(obj.Object, path...)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	pod, err := podFor(obj, path, specMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(pod); err != nil {
+		return nil, err
+	}
+
+	var changes []ImageChange
+	rewritten := map[string][]string{
+		"containers":          containerImages(pod.Spec.Containers),
+		"initContainers":      containerImages(pod.Spec.InitContainers),
+		"ephemeralContainers": ephemeralImages(pod.Spec.EphemeralContainers),
+	}
+	for _, field := range containerFields {
+		containers, _ := specMap[field].([]any)
+		for i, item := range containers {
+			container, ok := item.(map[string]any)
+			if !ok || i >= len(rewritten[field]) {
+				continue
+			}
+			original, _ := container["image"].(string)
+			if image := rewritten[field][i]; image != original {
+				container["image"] = image
+				name, _ := container["name"].(string)
+				changes = append(changes, ImageChange{
+					APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(),
+					Container: name, Field: fmt.Sprintf("%s.%s[%d].image", strings.Join(path, "."), field, i),
+					Original: original, Image: image,
+				})
+			}
+		}
+	}
+
+	volumes, _ := specMap["volumes"].([]any)
+	for i, item := range volumes {
+		volume, ok := item.(map[string]any)
+		if !ok || i >= len(pod.Spec.Volumes) || pod.Spec.Volumes[i].Image == nil {
+			continue
+		}
+		source, ok := volume["image"].(map[string]any)
+		if !ok {
+			continue
+		}
+		original, _ := source["reference"].(string)
+		if image := pod.Spec.Volumes[i].Image.Reference; image != original {
+			source["reference"] = image
+			changes = append(changes, ImageChange{
+				APIVersion: obj.GetAPIVersion(), Kind: obj.GetKind(), Namespace: obj.GetNamespace(), Name: obj.GetName(),
+				Container: pod.Spec.Volumes[i].Name,
+				Field:     fmt.Sprintf("%s.volumes[%d].image.reference", strings.Join(path, "."), i),
+				Original:  original, Image: image,
+			})
+		}
+	}
+
+	if len(changes) > 0 {
+		if err := unstructured.SetNestedMap(obj.Object, specMap, path...); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// podFor builds the Pod the webhook would see for the pod spec at path. Pods created from a template
+// carry the template's labels and annotations and a generated name.
+func podFor(obj *unstructured.Unstructured, path []string, specMap map[string]any) (*corev1.Pod, error) {
+	pod := &corev1.Pod{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(specMap, &pod.Spec); err != nil {
+		return nil, fmt.Errorf("%s %s: invalid pod spec: %w", obj.GetKind(), obj.GetName(), err)
+	}
+	pod.Namespace = obj.GetNamespace()
+
+	if obj.GroupVersionKind().GroupKind() == (schema.GroupKind{Kind: "Pod"}) {
+		pod.Name = obj.GetName()
+		pod.GenerateName = obj.GetGenerateName()
+		pod.Labels = obj.GetLabels()
+		pod.Annotations = obj.GetAnnotations()
+		return pod, nil
+	}
+
+	template, _, _ := unstructured.NestedMap(obj.Object, append(path[:len(path)-1:len(path)-1], "metadata")...)
+	meta := metav1.ObjectMeta{}
+	if template != nil {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(template, &meta); err != nil {
+			return nil, fmt.Errorf("%s %s: invalid pod template metadata: %w", obj.GetKind(), obj.GetName(), err)
+		}
+	}
+	pod.GenerateName = obj.GetName() + "-"
+	pod.Labels = meta.Labels
+	pod.Annotations = meta.Annotations
+	return pod, nil
+}
+
+func containerImages(containers []corev1.Container) []string {
+	images := make([]string, len(containers))
+	for i, container := range containers {
+		images[i] = container.Image
+	}
+	return images
+}
+
+func ephemeralImages(containers []corev1.EphemeralContainer) []string {
+	images := make([]string, len(containers))
+	for i, container := range containers {
+		images[i] = container.Image
+	}
+	return images
+}
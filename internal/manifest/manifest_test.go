@@ -0,0 +1,222 @@
+// PURPOSE: Test suite for decoding manifests and rewriting the images of their pod specs
+package manifest
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const workloads = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+data:
+  image: nginx:1.25
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  namespace: team-a
+spec:
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      initContainers:
+      - name: migrate
+        image: migrate:v1
+      containers:
+      - name: nginx
+        image: nginx:1.25
+---
+{"apiVersion": "batch/v1", "kind": "CronJob", "metadata": {"name": "backup"},
+ "spec": {"jobTemplate": {"spec": {"template": {"spec": {"containers": [{"name": "backup", "image": "backup:v2"}]}}}}}}
+`
+
+// prefixImages rewrites every container image to mirror.example.com.
+func prefixImages(pod *corev1.Pod) error {
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Image = "mirror.example.com/" + pod.Spec.Containers[i].Image
+	}
+	for i := range pod.Spec.InitContainers {
+		pod.Spec.InitContainers[i].Image = "mirror.example.com/" + pod.Spec.InitContainers[i].Image
+	}
+	return nil
+}
+
+func TestDecode_MultiDocumentYAMLAndJSON(t *testing.T) {
+	objects, err := Decode(strings.NewReader(workloads + "---\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(objects) != 3 {
+		t.Fatalf("expected 3 documents, got %d", len(objects))
+	}
+	if objects[2].GetKind() != "CronJob" {
+		t.Errorf("expected the JSON document to decode as a CronJob, got %q", objects[2].GetKind())
+	}
+}
+
+func TestMutatePodSpecs_RewritesWorkloadTemplates(t *testing.T) {
+	objects, err := Decode(strings.NewReader(workloads))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var changes []ImageChange
+	for _, obj := range objects {
+		objChanges, err := MutatePodSpecs(obj, prefixImages)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		changes = append(changes, objChanges...)
+	}
+
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 image changes, got %+v", changes)
+	}
+	if changes[0].Container != "nginx" || changes[1].Container != "migrate" ||
+		changes[1].Field != "spec.template.spec.initContainers[0].image" {
+		t.Errorf("expected containers before init containers, got %+v", changes)
+	}
+
+	out, err := EncodeString(objects)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{"image: mirror.example.com/nginx:1.25", "image: mirror.example.com/migrate:v1",
+		"image: mirror.example.com/backup:v2", "  image: nginx:1.25"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestMutatePodSpecs_TemplateMetadataReachesPod(t *testing.T) {
+	objects, _ := Decode(strings.NewReader(workloads))
+
+	var seen *corev1.Pod
+	if _, err := MutatePodSpecs(objects[1], func(pod *corev1.Pod) error {
+		seen = pod
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if seen.Namespace != "team-a" || seen.GenerateName != "web-" || seen.Labels["app"] != "web" {
+		t.Errorf("unexpected pod metadata: %+v", seen.ObjectMeta)
+	}
+}
+
+func TestMutatePodSpecs_ListItems(t *testing.T) {
+	objects, err := Decode(strings.NewReader(`{"apiVersion": "v1", "kind": "List", "items": [
+		{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "a"}, "spec": {"containers": [{"name": "c", "image": "redis"}]}}
+	]}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changes, err := MutatePodSpecs(objects[0], prefixImages)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Image != "mirror.example.com/redis" {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	out, _ := EncodeString(objects)
+	if !strings.Contains(out, "image: mirror.example.com/redis") {
+		t.Errorf("expected the list item to be rewritten:\n%s", out)
+	}
+}
+
+func TestMutatePodSpecs_ImageVolumes(t *testing.T) {
+	objects, err := Decode(strings.NewReader(`{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "a"}, "spec": {
+		"containers": [{"name": "c", "image": "redis"}],
+		"volumes": [{"name": "scratch", "emptyDir": {}}, {"name": "models", "image": {"reference": "models:v3"}}]}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changes, err := MutatePodSpecs(objects[0], func(pod *corev1.Pod) error {
+		pod.Spec.Volumes[1].Image.Reference = "mirror.example.com/models:v3"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Container != "models" || changes[0].Field != "spec.volumes[1].image.reference" {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	out, _ := EncodeString(objects)
+	if !strings.Contains(out, "reference: mirror.example.com/models:v3") {
+		t.Errorf("expected the image volume to be rewritten:\n%s", out)
+	}
+}
+
+func TestMutatePodSpecs_MatchesGroupAndKind(t *testing.T) {
+	objects, err := Decode(strings.NewReader(`apiVersion: example.com/v1
+kind: Deployment
+metadata:
+  name: custom
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: app:v1
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	changes, err := MutatePodSpecs(objects[0], prefixImages)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("expected a Deployment of another group to be left alone, got %+v, %v", changes, err)
+	}
+}
+
+func TestWriteDocuments_KeepsUnchangedDocumentsVerbatim(t *testing.T) {
+	const input = `# settings for the web app
+apiVersion: v1
+kind: ConfigMap
+metadata: {name: settings}   # flow style
+data:
+  zeta: "1"
+  alpha: "2"
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: web
+spec:
+  containers:
+  - name: nginx
+    image: nginx:1.25
+`
+	documents, err := ReadDocuments(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, document := range documents {
+		for _, obj := range document.Objects {
+			if _, err := MutatePodSpecs(obj, prefixImages); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	var out strings.Builder
+	if err := WriteDocuments(&out, documents); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	configMap, pod, _ := strings.Cut(out.String(), "---\n")
+	if want, _, _ := strings.Cut(input, "---\n"); configMap != want {
+		t.Errorf("expected the unchanged ConfigMap verbatim, got:\n%s", configMap)
+	}
+	if !strings.Contains(pod, "image: mirror.example.com/nginx:1.25") {
+		t.Errorf("expected the Pod to be rewritten, got:\n%s", pod)
+	}
+}
@@ -0,0 +1,145 @@
+// PURPOSE: Parses dockerconfigjson credentials into a keyring keyed by registry host
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Credential holds the secret material for one registry. Its String and GoString methods
+// redact the contents so a Credential can never end up in a log line (NFR-004).
+type Credential struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token exchanged at the registry's token endpoint.
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as-is.
+	RegistryToken string
+}
+
+// String implements fmt.Stringer without revealing the credential.
+func (c Credential) String() string {
+	return "<redacted>"
+}
+
+// GoString implements fmt.GoStringer without revealing the credential.
+func (c Credential) GoString() string {
+	return "auth.Credential{<redacted>}"
+}
+
+// fingerprint identifies the secret material of c without revealing it, so caches can keep what
+// one credential obtained apart from what another did.
+func (c Credential) fingerprint() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{c.Username, c.Password, c.IdentityToken, c.RegistryToken}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Keyring maps normalized registry hosts to credentials.
+type Keyring map[string]Credential
+
+// Lookup returns the credential for a registry host.
+func (k Keyring) Lookup(host string) (Credential, bool) {
+	cred, ok := k[NormalizeHost(host)]
+	return cred, ok
+}
+
+// Merge adds the entries of other that are not already present, so earlier sources take precedence.
+func (k Keyring) Merge(other Keyring) {
+	for host, cred := range other {
+		if _, ok := k[host]; !ok {
+			k[host] = cred
+		}
+	}
+}
+
+// dockerConfigEntry is a single registry entry in a docker config file.
+type dockerConfigEntry struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+// ParseDockerConfigJSON parses the contents of a .dockerconfigjson file.
+func ParseDockerConfigJSON(data []byte) (Keyring, error) {
+	var config dockerConfigJSON
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing docker config: %w", err)
+	}
+	return keyringFromEntries(config.Auths)
+}
+
+// ParseDockerCfg parses the contents of a legacy .dockercfg file.
+func ParseDockerCfg(data []byte) (Keyring, error) {
+	var entries map[string]dockerConfigEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parsing docker config: %w", err)
+	}
+	return keyringFromEntries(entries)
+}
+
+// KeyringFromSecret reads a kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg Secret.
+func KeyringFromSecret(secret *corev1.Secret) (Keyring, error) {
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		return ParseDockerConfigJSON(secret.Data[corev1.DockerConfigJsonKey])
+	case corev1.SecretTypeDockercfg:
+		return ParseDockerCfg(secret.Data[corev1.DockerConfigKey])
+	default:
+		return nil, fmt.Errorf("secret %s/%s has unsupported type %q", secret.Namespace, secret.Name, secret.Type)
+	}
+}
+
+func keyringFromEntries(entries map[string]dockerConfigEntry) (Keyring, error) {
+	keyring := Keyring{}
+	for server, entry := range entries {
+		cred := Credential{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				// The value is secret material, so only the registry is reported
+				return nil, fmt.Errorf("invalid auth field for registry %s", server)
+			}
+			user, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth field for registry %s", server)
+			}
+			cred.Username, cred.Password = user, password
+		}
+		keyring[NormalizeHost(server)] = cred
+	}
+	return keyring, nil
+}
+
+// NormalizeHost reduces a docker config server key or registry name to a bare host, treating the
+// Docker Hub aliases as one registry.
+func NormalizeHost(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host, _, _ = strings.Cut(host, "/")
+	host = strings.ToLower(host)
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,87 @@
+// PURPOSE: Test suite for parsing docker config credentials
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestParseDockerConfigJSON(t *testing.T) {
+	data := []byte(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViLXVzZXI6aHViLXBhc3M="},
+		"mirror.example.com": {"username": "mirror-user", "password": "mirror-pass"},
+		"GCR.io": {"identitytoken": "refresh"}
+	}}`)
+
+	keyring, err := ParseDockerConfigJSON(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		host string
+		want Credential
+	}{
+		{"registry-1.docker.io", Credential{Username: "hub-user", Password: "hub-pass"}},
+		{"mirror.example.com", Credential{Username: "mirror-user", Password: "mirror-pass"}},
+		{"gcr.io", Credential{IdentityToken: "refresh"}},
+	}
+	for _, tt := range tests {
+		got, ok := keyring.Lookup(tt.host)
+		if !ok || got != tt.want {
+			t.Errorf("Lookup(%q) = %#v, %v; want a match", tt.host, got, ok)
+		}
+	}
+}
+
+func TestParseDockerConfigJSON_InvalidAuthDoesNotLeakSecret(t *testing.T) {
+	_, err := ParseDockerConfigJSON([]byte(`{"auths": {"mirror.example.com": {"auth": "bm8tY29sb24tc2VjcmV0"}}}`))
+	if err == nil {
+		t.Fatal("expected an error for an auth field without a colon")
+	}
+	if strings.Contains(err.Error(), "no-colon-secret") || strings.Contains(err.Error(), "bm8tY29sb24tc2VjcmV0") {
+		t.Errorf("error message leaks the credential: %v", err)
+	}
+}
+
+func TestKeyringFromSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		Type: corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{
+			corev1.DockerConfigKey: []byte(`{"mirror.example.com": {"username": "u", "password": "p"}}`),
+		},
+	}
+	keyring, err := KeyringFromSecret(secret)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := keyring.Lookup("mirror.example.com"); !ok {
+		t.Error("expected credentials for mirror.example.com")
+	}
+
+	if _, err := KeyringFromSecret(&corev1.Secret{Type: corev1.SecretTypeOpaque}); err == nil {
+		t.Error("expected an error for an Opaque secret")
+	}
+}
+
+func TestKeyring_MergeKeepsEarlierEntries(t *testing.T) {
+	keyring := Keyring{"a.io": {Username: "first"}}
+	keyring.Merge(Keyring{"a.io": {Username: "second"}, "b.io": {Username: "other"}})
+
+	if keyring["a.io"].Username != "first" || keyring["b.io"].Username != "other" {
+		t.Errorf("unexpected merge result: %v", keyring)
+	}
+}
+
+func TestCredential_FormattingIsRedacted(t *testing.T) {
+	cred := Credential{Username: "user", Password: "hunter2", RegistryToken: "tok"}
+
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		if out := fmt.Sprintf(format, cred); strings.Contains(out, "hunter2") || strings.Contains(out, "tok") {
+			t.Errorf("format %s leaks the credential: %s", format, out)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// PURPOSE: Collects registry credentials for a pod from its imagePullSecrets, its service account and an operator Secret
+package auth
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var authlog = logf.Log.WithName("registry-auth")
+
+const (
+	// defaultKeyringTTL is how long resolved credentials are reused when Provider.TTL is unset.
+	defaultKeyringTTL = time.Minute
+	// maxCachedKeyrings bounds the number of resolved keyrings a Provider remembers.
+	maxCachedKeyrings = 1024
+)
+
+type cachedKeyring struct {
+	keyring Keyring
+	expires time.Time
+}
+
+// Provider resolves the keyring used for registry lookups made on behalf of a pod.
+type Provider struct {
+	// Reader reads Secrets and ServiceAccounts.
+	Reader client.Reader
+	// OperatorSecret names a dockerconfigjson Secret consulted after the pod's own secrets.
+	// It is ignored when Name is empty.
+	OperatorSecret types.NamespacedName
+	// TTL is how long a resolved keyring is reused for pods with the same namespace, service account
+	// and imagePullSecrets, so admission does not read Secrets for every pod. Defaults to one minute;
+	// a negative TTL disables the cache.
+	TTL time.Duration
+
+	mu       sync.Mutex
+	keyrings map[string]cachedKeyring
+	now      func() time.Time
+}
+
+// Resolve merges credentials in order of precedence: the pod's imagePullSecrets, the imagePullSecrets
+// of its service account, then the operator Secret. Secrets that are missing or unreadable are skipped
+// so a lookup can still proceed anonymously; only their names are logged, never their contents.
+// Results are cached for TTL, so a rotated Secret takes effect within TTL.
+func (p *Provider) Resolve(ctx context.Context, pod *corev1.Pod) Keyring {
+	if p.TTL < 0 {
+		return p.resolve(ctx, pod)
+	}
+
+	key := resolveKey(pod)
+	now := p.clock()
+	p.mu.Lock()
+	cached, ok := p.keyrings[key]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return maps.Clone(cached.keyring)
+	}
+
+	keyring := p.resolve(ctx, pod)
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = defaultKeyringTTL
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keyrings == nil {
+		p.keyrings = map[string]cachedKeyring{}
+	}
+	if len(p.keyrings) >= maxCachedKeyrings {
+		for k, entry := range p.keyrings {
+			if !now.Before(entry.expires) {
+				delete(p.keyrings, k)
+			}
+		}
+		if len(p.keyrings) >= maxCachedKeyrings {
+			clear(p.keyrings)
+		}
+	}
+	p.keyrings[key] = cachedKeyring{keyring: maps.Clone(keyring), expires: now.Add(ttl)}
+	return keyring
+}
+
+func (p *Provider) clock() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// resolveKey identifies the inputs of Resolve: the pod's namespace, service account and
+// imagePullSecrets. The operator Secret is the same for every pod.
+func resolveKey(pod *corev1.Pod) string {
+	names := make([]string, 0, len(pod.Spec.ImagePullSecrets))
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	// Order matters, since earlier secrets take precedence
+	return strings.Join(slices.Concat([]string{pod.Namespace, serviceAccountName}, names), "/")
+}
+
+func (p *Provider) resolve(ctx context.Context, pod *corev1.Pod) Keyring {
+	keyring := Keyring{}
+
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		p.mergeSecret(ctx, keyring, types.NamespacedName{Namespace: pod.Namespace, Name: ref.Name})
+	}
+
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	serviceAccount := &corev1.ServiceAccount{}
+	key := types.NamespacedName{Namespace: pod.Namespace, Name: serviceAccountName}
+	if err := p.Reader.Get(ctx, key, serviceAccount); err == nil {
+		for _, ref := range serviceAccount.ImagePullSecrets {
+			p.mergeSecret(ctx, keyring, types.NamespacedName{Namespace: pod.Namespace, Name: ref.Name})
+		}
+	} else if !apierrors.IsNotFound(err) {
+		authlog.Error(err, "failed to read service account", "serviceAccount", key.String())
+	}
+
+	if p.OperatorSecret.Name != "" {
+		p.mergeSecret(ctx, keyring, p.OperatorSecret)
+	}
+
+	return keyring
+}
+
+// OperatorKeyring returns the credentials of the operator secret alone, for requests made on the
+// operator's own behalf rather than a pod's.
+func (p *Provider) OperatorKeyring(ctx context.Context) Keyring {
+	keyring := Keyring{}
+	if p.OperatorSecret.Name != "" {
+		p.mergeSecret(ctx, keyring, p.OperatorSecret)
+	}
+	return keyring
+}
+
+func (p *Provider) mergeSecret(ctx context.Context, keyring Keyring, key types.NamespacedName) {
+	secret := &corev1.Secret{}
+	if err := p.Reader.Get(ctx, key, secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			authlog.Error(err, "failed to read pull secret", "secret", key.String())
+		}
+		return
+	}
+
+	secretKeyring, err := KeyringFromSecret(secret)
+	if err != nil {
+		authlog.Error(err, "ignoring unusable pull secret", "secret", key.String())
+		return
+	}
+	keyring.Merge(secretKeyring)
+}
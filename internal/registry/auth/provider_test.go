@@ -0,0 +1,122 @@
+// PURPOSE: Test suite for resolving a pod's registry credentials from Secrets
+package auth
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// countingReader counts the reads that reach the API.
+type countingReader struct {
+	client.Reader
+	gets atomic.Int32
+}
+
+func (r *countingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	r.gets.Add(1)
+	return r.Reader.Get(ctx, key, obj, opts...)
+}
+
+func pullSecret(namespace, name, config string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(config)},
+	}
+}
+
+func TestProvider_ResolvePrecedence(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		pullSecret("team-a", "pod-secret", `{"auths": {"a.io": {"username": "from-pod", "password": "x"}}}`),
+		pullSecret("team-a", "sa-secret", `{"auths": {"a.io": {"username": "from-sa", "password": "x"},
+			"b.io": {"username": "from-sa", "password": "x"}}}`),
+		pullSecret("operator", "mirror", `{"auths": {"b.io": {"username": "from-operator", "password": "x"},
+			"c.io": {"username": "from-operator", "password": "x"}}}`),
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Namespace: "team-a", Name: "builder"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "sa-secret"}},
+		},
+	).Build()
+
+	provider := &Provider{Reader: fakeClient, OperatorSecret: types.NamespacedName{Namespace: "operator", Name: "mirror"}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "app"},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "builder",
+			ImagePullSecrets:   []corev1.LocalObjectReference{{Name: "pod-secret"}, {Name: "missing"}},
+		},
+	}
+
+	keyring := provider.Resolve(context.Background(), pod)
+
+	want := map[string]string{"a.io": "from-pod", "b.io": "from-sa", "c.io": "from-operator"}
+	for host, user := range want {
+		if cred, ok := keyring.Lookup(host); !ok || cred.Username != user {
+			t.Errorf("credential for %s: got %q, want %q", host, cred.Username, user)
+		}
+	}
+}
+
+func TestProvider_ResolveWithoutSecrets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	provider := &Provider{Reader: fake.NewClientBuilder().WithScheme(scheme).Build()}
+
+	keyring := provider.Resolve(context.Background(), &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a"}})
+	if len(keyring) != 0 {
+		t.Errorf("expected an empty keyring, got %d entries", len(keyring))
+	}
+}
+
+func TestProvider_OperatorKeyring(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		pullSecret("operator", "mirror", `{"auths": {"mirror.io": {"username": "pusher", "password": "x"}}}`),
+	).Build()
+	provider := &Provider{Reader: fakeClient, OperatorSecret: types.NamespacedName{Namespace: "operator", Name: "mirror"}}
+
+	keyring := provider.OperatorKeyring(context.Background())
+	if cred, ok := keyring.Lookup("mirror.io"); !ok || cred.Username != "pusher" {
+		t.Errorf("expected the operator credential for mirror.io, got %q", cred.Username)
+	}
+}
+
+func TestProvider_ResolveCachesPerServiceAccountAndSecrets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	reader := &countingReader{Reader: fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		pullSecret("team-a", "pod-secret", `{"auths": {"a.io": {"username": "from-pod", "password": "x"}}}`),
+	).Build()}
+	provider := &Provider{Reader: reader}
+	pod := func(secrets ...string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a"}}
+		for _, name := range secrets {
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+		return pod
+	}
+
+	for range 3 {
+		if _, ok := provider.Resolve(context.Background(), pod("pod-secret")).Lookup("a.io"); !ok {
+			t.Fatal("expected the pod's pull secret credential")
+		}
+	}
+	if got := reader.gets.Load(); got != 2 {
+		t.Errorf("expected one read of the secret and service account, got %d", got)
+	}
+
+	if _, ok := provider.Resolve(context.Background(), pod()).Lookup("a.io"); ok {
+		t.Error("expected a pod without the pull secret not to get its credential from the cache")
+	}
+}
@@ -0,0 +1,353 @@
+// PURPOSE: Implements the distribution spec basic and bearer token authentication flows as an http.RoundTripper
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientID identifies this operator to registry token endpoints.
+const clientID = "mutating-registry-hook"
+
+// defaultTokenLifetime is assumed when a token endpoint does not report expires_in.
+const defaultTokenLifetime = 60 * time.Second
+
+type keyringKey struct{}
+
+// WithKeyring returns a context whose registry requests authenticate with keyring.
+func WithKeyring(ctx context.Context, keyring Keyring) context.Context {
+	return context.WithValue(ctx, keyringKey{}, keyring)
+}
+
+// KeyringFromContext returns the keyring stored by WithKeyring, if any.
+func KeyringFromContext(ctx context.Context) Keyring {
+	keyring, _ := ctx.Value(keyringKey{}).(Keyring)
+	return keyring
+}
+
+// CredentialKey identifies the credential a request to host made with ctx would carry, for caches
+// whose entries must not be shared between credentials. Requests without one share the empty key.
+func CredentialKey(ctx context.Context, host string) string {
+	if cred, ok := KeyringFromContext(ctx).Lookup(host); ok {
+		return cred.fingerprint()
+	}
+	return ""
+}
+
+// challenge is a parsed WWW-Authenticate header.
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+type cachedToken struct {
+	value   string
+	expires time.Time
+}
+
+// Transport answers registry authentication challenges. Credentials come from the keyring in the
+// request context, falling back to Keyring. Bearer tokens are cached until they expire, and the
+// challenge each registry returned is remembered so later requests authenticate up front.
+type Transport struct {
+	// Base performs the requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+	// Keyring is used for requests whose context carries no keyring.
+	Keyring Keyring
+
+	mu         sync.Mutex
+	challenges map[string]challenge
+	tokens     map[string]cachedToken
+	now        func() time.Time
+}
+
+var _ http.RoundTripper = &Transport{}
+
+// NewTransport wraps base with registry authentication.
+func NewTransport(base http.RoundTripper) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{
+		Base:       base,
+		challenges: map[string]challenge{},
+		tokens:     map[string]cachedToken{},
+		now:        time.Now,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cred, hasCred := t.credential(req)
+	host := req.URL.Host
+
+	if hasCred && cred.RegistryToken != "" {
+		authed := req.Clone(req.Context())
+		authed.Header.Set("Authorization", "Bearer "+cred.RegistryToken)
+		return t.Base.RoundTrip(authed)
+	}
+
+	t.mu.Lock()
+	known, ok := t.challenges[host]
+	t.mu.Unlock()
+
+	attempt := req
+	if ok {
+		authed, err := t.authorize(req, known, cred, hasCred)
+		if err != nil {
+			return nil, err
+		}
+		attempt = authed
+	}
+
+	resp, err := t.Base.RoundTrip(attempt)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	ch, ok := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	t.mu.Lock()
+	t.challenges[host] = ch
+	t.mu.Unlock()
+
+	// The token sent with the first attempt, if any, was rejected
+	t.forget(ch, scopeFor(req), cred)
+
+	retry, err := t.authorize(req, ch, cred, hasCred)
+	if err != nil {
+		_ = resp.Body.Close()
+		return nil, err
+	}
+	if retry == req {
+		return resp, nil
+	}
+	_ = resp.Body.Close()
+	return t.Base.RoundTrip(retry)
+}
+
+func (t *Transport) credential(req *http.Request) (Credential, bool) {
+	keyring := KeyringFromContext(req.Context())
+	if keyring == nil {
+		keyring = t.Keyring
+	}
+	return keyring.Lookup(req.URL.Host)
+}
+
+// authorize returns a copy of req carrying credentials for ch, or req itself when there are none to add.
+func (t *Transport) authorize(req *http.Request, ch challenge, cred Credential, hasCred bool) (*http.Request, error) {
+	var header string
+	switch ch.scheme {
+	case "basic":
+		if !hasCred || cred.Username == "" {
+			return req, nil
+		}
+		r := &http.Request{Header: http.Header{}}
+		r.SetBasicAuth(cred.Username, cred.Password)
+		header = r.Header.Get("Authorization")
+	case "bearer":
+		token, err := t.token(req.Context(), ch, scopeFor(req), cred, hasCred)
+		if err != nil {
+			return nil, err
+		}
+		header = "Bearer " + token
+	default:
+		return req, nil
+	}
+
+	authed := req.Clone(req.Context())
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		authed.Body = body
+	}
+	authed.Header.Set("Authorization", header)
+	return authed, nil
+}
+
+// tokenKey scopes a cached token to the whole credential that obtained it, so a token is never
+// handed to a request with other, or no, credentials.
+func tokenKey(ch challenge, scope string, cred Credential) string {
+	return strings.Join([]string{ch.params["realm"], ch.params["service"], scope, cred.fingerprint()}, "|")
+}
+
+func (t *Transport) forget(ch challenge, scope string, cred Credential) {
+	t.mu.Lock()
+	delete(t.tokens, tokenKey(ch, scope, cred))
+	t.mu.Unlock()
+}
+
+// token returns a cached bearer token or fetches a new one from the challenge's realm.
+func (t *Transport) token(ctx context.Context, ch challenge, scope string, cred Credential, hasCred bool) (string, error) {
+	key := tokenKey(ch, scope, cred)
+
+	t.mu.Lock()
+	cached, ok := t.tokens[key]
+	t.mu.Unlock()
+	if ok && t.now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	realm := ch.params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+
+	req, err := tokenRequest(ctx, realm, ch.params["service"], scope, cred, hasCred)
+	if err != nil {
+		return "", err
+	}
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting token from %s: %w", realm, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint %s returned %s", realm, resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding token response from %s: %w", realm, err)
+	}
+	value := body.Token
+	if value == "" {
+		value = body.AccessToken
+	}
+	if value == "" {
+		return "", fmt.Errorf("token endpoint %s returned no token", realm)
+	}
+
+	lifetime := defaultTokenLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+	// Refresh slightly early so a token does not expire in flight
+	expires := t.now().Add(lifetime - lifetime/10)
+
+	t.mu.Lock()
+	t.pruneTokens()
+	t.tokens[key] = cachedToken{value: value, expires: expires}
+	t.mu.Unlock()
+
+	return value, nil
+}
+
+// pruneTokens drops expired tokens, whose scopes and credentials may never be requested again.
+// Callers hold t.mu.
+func (t *Transport) pruneTokens() {
+	now := t.now()
+	for key, cached := range t.tokens {
+		if !now.Before(cached.expires) {
+			delete(t.tokens, key)
+		}
+	}
+}
+
+// tokenRequest builds the token request: an OAuth2 refresh-token POST when the credential holds an
+// identity token, otherwise a GET with optional basic auth.
+func tokenRequest(ctx context.Context, realm, service, scope string, cred Credential, hasCred bool) (*http.Request, error) {
+	if hasCred && cred.IdentityToken != "" {
+		form := url.Values{
+			"grant_type":    {"refresh_token"},
+			"refresh_token": {cred.IdentityToken},
+			"service":       {service},
+			"client_id":     {clientID},
+		}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, realm, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+
+	query := url.Values{}
+	if service != "" {
+		query.Set("service", service)
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token realm %q: %w", realm, err)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if hasCred && cred.Username != "" {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	return req, nil
+}
+
+// scopeFor derives the repository scope a distribution API request needs.
+func scopeFor(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for _, marker := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.Index(path, marker); i > 0 {
+			actions := "pull"
+			if req.Method != http.MethodGet && req.Method != http.MethodHead {
+				actions = "pull,push"
+			}
+			return fmt.Sprintf("repository:%s:%s", path[:i], actions)
+		}
+	}
+	return ""
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.example.com/token",service="registry.example.com"`.
+func parseChallenge(header string) (challenge, bool) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if scheme == "" {
+		return challenge{}, false
+	}
+
+	ch := challenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				return challenge{}, false
+			}
+			ch.params[key] = value[1 : end+1]
+			value = value[end+2:]
+		} else {
+			v, _, _ := strings.Cut(value, ",")
+			ch.params[key] = strings.TrimSpace(v)
+			value = value[len(v):]
+		}
+		rest = strings.TrimPrefix(strings.TrimSpace(value), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return ch, true
+}
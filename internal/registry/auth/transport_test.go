@@ -0,0 +1,215 @@
+// PURPOSE: Test suite for the registry authentication transport
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newBearerRegistry starts a registry stand-in that requires a bearer token from its own /token endpoint,
+// which in turn requires basic auth with user:pass.
+func newBearerRegistry(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var tokenRequests atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests.Add(1)
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "user" || pass != "pass" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:team/app:pull" || r.URL.Query().Get("service") != "test-registry" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"token": "good-token", "expires_in": 300})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer good-token" {
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+server.URL+`/token",service="test-registry",scope="repository:team/app:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+	return server, &tokenRequests
+}
+
+func head(t *testing.T, client *http.Client, ctx context.Context, url string) int {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		t.Fatalf("building request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestTransport_BearerTokenFlow(t *testing.T) {
+	server, tokenRequests := newBearerRegistry(t)
+	host := strings.TrimPrefix(server.URL, "https://")
+	client := &http.Client{Transport: NewTransport(server.Client().Transport)}
+	ctx := WithKeyring(context.Background(), Keyring{host: {Username: "user", Password: "pass"}})
+
+	for range 3 {
+		if status := head(t, client, ctx, server.URL+"/v2/team/app/manifests/v1"); status != http.StatusOK {
+			t.Fatalf("expected 200, got %d", status)
+		}
+	}
+
+	if got := tokenRequests.Load(); got != 1 {
+		t.Errorf("expected the token to be fetched once and cached, got %d token requests", got)
+	}
+}
+
+func TestTransport_TokensAreNotSharedBetweenCredentials(t *testing.T) {
+	server, tokenRequests := newBearerRegistry(t)
+	host := strings.TrimPrefix(server.URL, "https://")
+	client := &http.Client{Transport: NewTransport(server.Client().Transport)}
+	url := server.URL + "/v2/team/app/manifests/v1"
+
+	good := WithKeyring(context.Background(), Keyring{host: {Username: "user", Password: "pass"}})
+	if status := head(t, client, good, url); status != http.StatusOK {
+		t.Fatalf("expected 200, got %d", status)
+	}
+
+	// Same username, other password: the cached token must not be reused
+	wrong := WithKeyring(context.Background(), Keyring{host: {Username: "user", Password: "wrong"}})
+	req, _ := http.NewRequestWithContext(wrong, http.MethodHead, url, nil)
+	if resp, err := client.Do(req); err == nil {
+		_ = resp.Body.Close()
+		t.Errorf("expected the token endpoint to reject the other password, got %s", resp.Status)
+	}
+	if got := tokenRequests.Load(); got != 2 {
+		t.Errorf("expected a token request per credential, got %d", got)
+	}
+
+	ch := challenge{scheme: "bearer", params: map[string]string{"realm": "r", "service": "s"}}
+	if tokenKey(ch, "scope", Credential{IdentityToken: "refresh"}) == tokenKey(ch, "scope", Credential{}) {
+		t.Error("expected an identity token credential not to share a token with anonymous requests")
+	}
+}
+
+func TestCredentialKey(t *testing.T) {
+	ctx := WithKeyring(context.Background(), Keyring{"a.io": {Username: "user", Password: "pass"}})
+
+	if CredentialKey(ctx, "a.io") == "" {
+		t.Error("expected a key for a host with a credential")
+	}
+	if CredentialKey(ctx, "b.io") != "" || CredentialKey(context.Background(), "a.io") != "" {
+		t.Error("expected anonymous requests to share the empty key")
+	}
+	other := WithKeyring(context.Background(), Keyring{"a.io": {Username: "user", Password: "other"}})
+	if CredentialKey(ctx, "a.io") == CredentialKey(other, "a.io") {
+		t.Error("expected different passwords to give different keys")
+	}
+}
+
+func TestTransport_AnonymousRequestFailsWithoutCredentials(t *testing.T) {
+	server, _ := newBearerRegistry(t)
+	client := &http.Client{Transport: NewTransport(server.Client().Transport)}
+
+	_, err := client.Head(server.URL + "/v2/team/app/manifests/v1")
+	if err == nil || !strings.Contains(err.Error(), "token endpoint") {
+		t.Errorf("expected a token endpoint error, got %v", err)
+	}
+}
+
+func TestTransport_BasicChallenge(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	transport := NewTransport(server.Client().Transport)
+	transport.Keyring = Keyring{host: {Username: "user", Password: "pass"}}
+	client := &http.Client{Transport: transport}
+
+	if status := head(t, client, context.Background(), server.URL+"/v2/app/manifests/v1"); status != http.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	ch, ok := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",` +
+		`scope="repository:a/b:pull,push"`)
+	if !ok {
+		t.Fatal("expected challenge to parse")
+	}
+	if ch.scheme != "bearer" {
+		t.Errorf("scheme = %q", ch.scheme)
+	}
+	want := map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:a/b:pull,push",
+	}
+	for key, value := range want {
+		if ch.params[key] != value {
+			t.Errorf("param %s = %q; want %q", key, ch.params[key], value)
+		}
+	}
+}
+
+func TestScopeFor(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{http.MethodHead, "/v2/library/nginx/manifests/latest", "repository:library/nginx:pull"},
+		{http.MethodGet, "/v2/a/b/c/blobs/sha256:abc", "repository:a/b/c:pull"},
+		{http.MethodPut, "/v2/app/manifests/v1", "repository:app:pull,push"},
+		{http.MethodGet, "/v2/", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "https://registry.example.com"+tt.path, nil)
+		if got := scopeFor(req); got != tt.want {
+			t.Errorf("scopeFor(%s %s) = %q; want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTransport_PrunesExpiredTokens(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"token": "token-" + r.URL.Query().Get("scope"), "expires_in": 60})
+	}))
+	defer server.Close()
+	transport := NewTransport(server.Client().Transport)
+	now := time.Now()
+	transport.now = func() time.Time { return now }
+	ch := challenge{scheme: "bearer", params: map[string]string{"realm": server.URL + "/token", "service": "s"}}
+
+	for _, scope := range []string{"repository:team/a:pull", "repository:team/b:pull"} {
+		if _, err := transport.token(context.Background(), ch, scope, Credential{}, false); err != nil {
+			t.Fatalf("fetching a token: %v", err)
+		}
+	}
+	now = now.Add(time.Hour)
+	if _, err := transport.token(context.Background(), ch, "repository:team/c:pull", Credential{}, false); err != nil {
+		t.Fatalf("fetching a token: %v", err)
+	}
+
+	if len(transport.tokens) != 1 {
+		t.Errorf("expected the expired tokens to be dropped, got %d cached tokens", len(transport.tokens))
+	}
+}
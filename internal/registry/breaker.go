@@ -0,0 +1,118 @@
+// PURPOSE: Implements a per-registry circuit breaker so an unhealthy registry is not queried on every admission
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker opens after a run of consecutive failures and lets a single trial request
+// through once the open period has elapsed.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Allow reports whether a request may be sent.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A trial request is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// Success records a successful request and closes the breaker.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+// Failure records a failed request, opening the breaker once the threshold is reached.
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
+
+// Abandon records a request that ended without an answer from the registry, such as one whose
+// caller gave up. It does not count as a failure; a half-open trial is handed back so the next
+// request may try again.
+func (b *circuitBreaker) Abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// breakerSet hands out one breaker per registry host.
+type breakerSet struct {
+	mu        sync.Mutex
+	breakers  map[string]*circuitBreaker
+	threshold int
+	cooldown  time.Duration
+}
+
+func newBreakerSet(threshold int, cooldown time.Duration) *breakerSet {
+	return &breakerSet{breakers: map[string]*circuitBreaker{}, threshold: threshold, cooldown: cooldown}
+}
+
+func (s *breakerSet) For(host string) *circuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[host]
+	if !ok {
+		b = newCircuitBreaker(s.threshold, s.cooldown)
+		s.breakers[host] = b
+	}
+	return b
+}
+
+// recordFailure counts a failed request against b, unless ctx was cancelled or ran out of time:
+// that is the caller's verification budget running out, not the registry failing.
+func recordFailure(ctx context.Context, b *circuitBreaker) {
+	if ctx.Err() != nil {
+		b.Abandon()
+		return
+	}
+	b.Failure()
+}
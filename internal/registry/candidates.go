@@ -0,0 +1,132 @@
+// PURPOSE: Chooses a rewrite among ordered candidate target registries, optionally verifying the image exists
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Outcome describes what happened to a single image reference.
+type Outcome struct {
+	// Image is the reference to use: a rewritten image or the original one.
+	Image string
+	// Target is the registry the image was rewritten to, empty when the original was kept.
+	Target string
+	// Fallback is set when verification rejected at least one candidate.
+	Fallback bool
+	// Reason explains the last rejected candidate when Fallback is set.
+	Reason string
+	// Rejections explains every rejected candidate, in the order they were tried.
+	Rejections []string
+}
+
+// Rewriter applies RewriteImage over a list of candidate targets.
+type Rewriter struct {
+	// Verifier confirms the rewritten image exists. Required when verification is requested.
+	Verifier ManifestVerifier
+	// Health, when set, lets verification skip targets whose registry is down without
+	// issuing a manifest request.
+	Health HealthChecker
+}
+
+// Rewrite returns the first candidate rewrite whose registry is healthy and has the image.
+// Without verification the first target is used. When no candidate passes, the original image is kept.
+func (r *Rewriter) Rewrite(ctx context.Context, image string, targets []string, verify bool) (Outcome, error) {
+	return r.RewriteWithTemplate(ctx, image, targets, verify, nil)
+}
+
+// RewriteWithTemplate is Rewrite with candidates laid out by layout, or as by RewriteImage when nil.
+func (r *Rewriter) RewriteWithTemplate(ctx context.Context, image string, targets []string, verify bool,
+	layout *PathTemplate) (Outcome, error) {
+	if len(targets) == 0 {
+		return Outcome{}, errors.New("no target registries configured")
+	}
+	candidates := make([]Candidate, 0, len(targets))
+	for _, target := range targets {
+		rewritten, err := layout.Rewrite(image, target)
+		if err != nil {
+			return Outcome{}, err
+		}
+		candidates = append(candidates, Candidate{Target: target, Image: rewritten})
+	}
+	return r.Choose(ctx, image, candidates, verify)
+}
+
+// Candidate is a rewrite of an image to one target.
+type Candidate struct {
+	// Target is the target registry, which may carry a path prefix.
+	Target string
+	// Image is the rewritten image.
+	Image string
+}
+
+// Choose returns the first candidate whose registry is healthy and has the image. Without verification
+// the first candidate is used. When no candidate passes, the original image is kept. With architectures
+// required by WithArchitectures and a PlatformVerifier, a candidate must also be available for each of them.
+func (r *Rewriter) Choose(ctx context.Context, image string, candidates []Candidate, verify bool) (Outcome, error) {
+	if len(candidates) == 0 {
+		return Outcome{}, errors.New("no target registries configured")
+	}
+	if verify && r.Verifier == nil {
+		return Outcome{}, errors.New("verification requested but no verifier configured")
+	}
+
+	required := ArchitecturesFrom(ctx)
+	var reason string
+	var rejections []string
+	for i, candidate := range candidates {
+		target, rewritten := candidate.Target, candidate.Image
+
+		// An image already on the target needs no verification
+		if !verify || rewritten == image {
+			return Outcome{Image: rewritten, Target: target, Fallback: i > 0, Reason: reason, Rejections: rejections}, nil
+		}
+
+		if r.Health != nil && !r.Health.Healthy(ctx, TargetHost(target)) {
+			reason = fmt.Sprintf("target registry %s is unhealthy", target)
+			rejections = append(rejections, reason)
+			continue
+		}
+
+		rejection, ok := r.verify(ctx, rewritten, required)
+		if ok {
+			return Outcome{Image: rewritten, Target: target, Fallback: i > 0, Reason: reason, Rejections: rejections}, nil
+		}
+		reason = rejection
+		rejections = append(rejections, reason)
+	}
+
+	return Outcome{Image: image, Fallback: true, Reason: reason, Rejections: rejections}, nil
+}
+
+// verify reports whether rewritten exists on its registry for every required architecture, or why not.
+func (r *Rewriter) verify(ctx context.Context, rewritten string, required []string) (string, bool) {
+	var exists bool
+	var missing []string
+	var err error
+	if platforms, ok := r.Verifier.(PlatformVerifier); ok && len(required) > 0 {
+		var available []string
+		available, exists, err = platforms.ManifestArchitectures(ctx, rewritten)
+		missing = MissingArchitectures(available, required)
+	} else {
+		exists, err = r.Verifier.ManifestExists(ctx, rewritten)
+	}
+
+	switch {
+	case err != nil:
+		return fmt.Sprintf("verifying %s: %v", rewritten, err), false
+	case !exists:
+		return fmt.Sprintf("%s not found on target registry", rewritten), false
+	case len(missing) > 0:
+		return fmt.Sprintf("%s on target registry lacks architecture %s", rewritten, strings.Join(missing, ", ")), false
+	}
+	return "", true
+}
+
+// TargetHost returns the registry host of a target, which may carry a repository prefix.
+func TargetHost(target string) string {
+	host, _, _ := strings.Cut(target, "/")
+	return host
+}
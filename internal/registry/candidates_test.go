@@ -0,0 +1,135 @@
+// PURPOSE: Test suite for choosing a rewrite among candidate target registries
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeVerifier reports the images in existing as present and fails for the images in failing.
+type fakeVerifier struct {
+	existing map[string]bool
+	failing  map[string]bool
+}
+
+func (f *fakeVerifier) ManifestExists(_ context.Context, image string) (bool, error) {
+	if f.failing[image] {
+		return false, errors.New("registry unavailable")
+	}
+	return f.existing[image], nil
+}
+
+func TestRewriter_WithoutVerificationUsesFirstTarget(t *testing.T) {
+	rewriter := &Rewriter{}
+
+	outcome, err := rewriter.Rewrite(context.Background(), "nginx:1.25", []string{"a.example.com", "b.example.com"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Image != "a.example.com/nginx:1.25" || outcome.Target != "a.example.com" || outcome.Fallback {
+		t.Errorf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestRewriter_VerifiedImageIsUsed(t *testing.T) {
+	rewriter := &Rewriter{Verifier: &fakeVerifier{existing: map[string]bool{"a.example.com/nginx:1.25": true}}}
+
+	outcome, err := rewriter.Rewrite(context.Background(), "nginx:1.25", []string{"a.example.com"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Image != "a.example.com/nginx:1.25" || outcome.Fallback {
+		t.Errorf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestRewriter_MissingImageTriesNextTarget(t *testing.T) {
+	rewriter := &Rewriter{Verifier: &fakeVerifier{existing: map[string]bool{"b.example.com/nginx:1.25": true}}}
+
+	outcome, err := rewriter.Rewrite(context.Background(), "nginx:1.25", []string{"a.example.com", "b.example.com"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Image != "b.example.com/nginx:1.25" || outcome.Target != "b.example.com" || !outcome.Fallback {
+		t.Errorf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestRewriter_KeepsOriginalWhenNoTargetHasImage(t *testing.T) {
+	rewriter := &Rewriter{Verifier: &fakeVerifier{failing: map[string]bool{"b.example.com/nginx:1.25": true}}}
+
+	outcome, err := rewriter.Rewrite(context.Background(), "nginx:1.25", []string{"a.example.com", "b.example.com"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Image != "nginx:1.25" || outcome.Target != "" || !outcome.Fallback || outcome.Reason == "" {
+		t.Errorf("unexpected outcome: %+v", outcome)
+	}
+	if len(outcome.Rejections) != 2 || outcome.Rejections[1] != outcome.Reason {
+		t.Errorf("expected one rejection per target, got %q", outcome.Rejections)
+	}
+}
+
+func TestRewriter_ImageAlreadyOnTargetSkipsVerification(t *testing.T) {
+	rewriter := &Rewriter{Verifier: &fakeVerifier{}}
+
+	outcome, err := rewriter.Rewrite(context.Background(), "a.example.com/nginx:1.25", []string{"a.example.com"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Image != "a.example.com/nginx:1.25" || outcome.Fallback {
+		t.Errorf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestRewriter_VerificationRequiresVerifier(t *testing.T) {
+	rewriter := &Rewriter{}
+
+	if _, err := rewriter.Rewrite(context.Background(), "nginx:1.25", []string{"a.example.com"}, true); err == nil {
+		t.Error("expected an error when verification is requested without a verifier")
+	}
+}
+
+// fakeHealth reports the hosts in down as unhealthy.
+type fakeHealth struct {
+	down map[string]bool
+}
+
+func (f *fakeHealth) Healthy(_ context.Context, host string) bool {
+	return !f.down[host]
+}
+
+func TestRewriter_SkipsUnhealthyTargets(t *testing.T) {
+	verifier := &fakeVerifier{existing: map[string]bool{
+		"eu.example.com/nginx:1.25":         true,
+		"global.example.com/hub/nginx:1.25": true,
+	}}
+	rewriter := &Rewriter{Verifier: verifier, Health: &fakeHealth{down: map[string]bool{"eu.example.com": true}}}
+
+	outcome, err := rewriter.Rewrite(context.Background(), "nginx:1.25",
+		[]string{"eu.example.com", "global.example.com/hub"}, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Image != "global.example.com/hub/nginx:1.25" || !outcome.Fallback {
+		t.Errorf("unexpected outcome: %+v", outcome)
+	}
+}
+
+func TestRewriter_LaysOutCandidatesWithTemplate(t *testing.T) {
+	layout, err := ParsePathTemplate("{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	verifier := &fakeVerifier{existing: map[string]bool{"b.io/gcr.io/team/app:v1": true}}
+	r := &Rewriter{Verifier: verifier}
+
+	outcome, err := r.RewriteWithTemplate(context.Background(), "gcr.io/team/app:v1", []string{"a.io", "b.io"}, true, layout)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if outcome.Image != "b.io/gcr.io/team/app:v1" || outcome.Target != "b.io" {
+		t.Errorf("Expected the templated image on the second target, got %+v", outcome)
+	}
+}
@@ -0,0 +1,494 @@
+// PURPOSE: Copies an image, including every platform of a multi-arch index, between registries using the OCI distribution API
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	defaultCopyConcurrency  = 4
+	defaultCopyRetries      = 3
+	defaultCopyRetryBackoff = 500 * time.Millisecond
+	maxManifestSize         = 4 << 20
+)
+
+// CopyProgress reports how much of an image has been copied.
+type CopyProgress struct {
+	TotalManifests  int
+	CopiedManifests int
+	TotalBlobs      int
+	CopiedBlobs     int
+	CopiedBytes     int64
+}
+
+// Copier copies images from a source registry to a target registry. Zero values are replaced
+// by defaults.
+type Copier struct {
+	// Client is used for registry requests. Defaults to http.DefaultClient.
+	Client *http.Client
+	// Concurrency is the number of blobs transferred at once.
+	Concurrency int
+	// Retries is the number of times a failed registry request is retried.
+	Retries int
+	// RetryBackoff is the delay before the first retry; it doubles with each further retry.
+	RetryBackoff time.Duration
+	// TempDir is where blobs are staged between download and upload. Defaults to os.TempDir().
+	TempDir string
+}
+
+// descriptor is the part of an OCI content descriptor the copier needs.
+type descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// manifest holds the fields of an image manifest or index that reference other content.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *descriptor  `json:"config,omitempty"`
+	Layers    []descriptor `json:"layers,omitempty"`
+	Manifests []descriptor `json:"manifests,omitempty"`
+}
+
+// fetchedManifest is a manifest as served by the source registry.
+type fetchedManifest struct {
+	mediaType string
+	digest    string
+	body      []byte
+	parsed    manifest
+}
+
+// Copy copies the source image to the target reference. Blobs already present on the target are
+// skipped, and the manifests are pushed once all the content they reference is in place. progress,
+// when set, is called after every copied manifest and blob, from concurrent transfers; it receives a
+// snapshot and is never called with the copier's own lock held.
+func (c *Copier) Copy(ctx context.Context, source, target string, progress func(CopyProgress)) error {
+	src, err := ParseReference(source)
+	if err != nil {
+		return err
+	}
+	src = canonicalReference(src)
+	dst, err := ParseReference(target)
+	if err != nil {
+		return err
+	}
+	if dst.Registry == "" {
+		return fmt.Errorf("target image %q does not name a registry", target)
+	}
+
+	root, err := c.fetchManifest(ctx, src, src.Identifier())
+	if err != nil {
+		return err
+	}
+
+	// Resolve every manifest of an index before copying so progress totals are known up front
+	children := []fetchedManifest{}
+	if isIndex(root.mediaType) {
+		for _, child := range root.parsed.Manifests {
+			fetched, err := c.fetchManifest(ctx, src, child.Digest)
+			if err != nil {
+				return err
+			}
+			children = append(children, fetched)
+		}
+	}
+
+	var blobs []descriptor
+	seen := map[string]bool{}
+	for _, m := range append([]fetchedManifest{root}, children...) {
+		refs := m.parsed.Layers
+		if m.parsed.Config != nil {
+			refs = append([]descriptor{*m.parsed.Config}, refs...)
+		}
+		for _, blob := range refs {
+			if !seen[blob.Digest] {
+				seen[blob.Digest] = true
+				blobs = append(blobs, blob)
+			}
+		}
+	}
+
+	tracker := &progressTracker{
+		report: progress,
+		state:  CopyProgress{TotalManifests: 1 + len(children), TotalBlobs: len(blobs)},
+	}
+
+	if err := c.copyBlobs(ctx, src, dst, blobs, tracker); err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if err := c.putManifest(ctx, dst, child.digest, child); err != nil {
+			return err
+		}
+		tracker.manifestCopied()
+	}
+	if err := c.putManifest(ctx, dst, dst.Identifier(), root); err != nil {
+		return err
+	}
+	tracker.manifestCopied()
+	return nil
+}
+
+// Digest returns the digest of the manifest image currently resolves to, so a caller can tell when
+// a tag has moved.
+func (c *Copier) Digest(ctx context.Context, image string) (string, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	ref = canonicalReference(ref)
+	root, err := c.fetchManifest(ctx, ref, ref.Identifier())
+	if err != nil {
+		return "", err
+	}
+	return root.digest, nil
+}
+
+// copyBlobs transfers blobs with at most Concurrency transfers in flight, returning the first error.
+func (c *Copier) copyBlobs(ctx context.Context, src, dst Reference, blobs []descriptor, tracker *progressTracker) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultCopyConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for _, blob := range blobs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(blob descriptor) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			var copied int64
+			err := c.retry(ctx, func() error {
+				var err error
+				copied, err = c.copyBlob(ctx, src, dst, blob)
+				return err
+			})
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			tracker.blobCopied(copied)
+		}(blob)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// copyBlob stages one blob from the source in a temporary file and uploads it to the target,
+// returning the number of bytes sent. Staging lets the upload be replayed when the target answers
+// it with an authentication challenge.
+func (c *Copier) copyBlob(ctx context.Context, src, dst Reference, blob descriptor) (int64, error) {
+	exists, err := c.blobExists(ctx, dst, blob.Digest)
+	if err != nil || exists {
+		return 0, err
+	}
+
+	staged, size, err := c.stageBlob(ctx, src, blob)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = staged.Close()
+		_ = os.Remove(staged.Name())
+	}()
+
+	location, err := c.startUpload(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	query := location.Query()
+	query.Set("digest", blob.Digest)
+	location.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location.String(), io.NewSectionReader(staged, 0, size))
+	if err != nil {
+		return 0, err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(io.NewSectionReader(staged, 0, size)), nil
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	putResp, err := c.client().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = putResp.Body.Close() }()
+	if putResp.StatusCode != http.StatusCreated {
+		return 0, statusError(putResp, "uploading blob "+blob.Digest)
+	}
+	return size, nil
+}
+
+// stageBlob downloads blob into a temporary file, checking its digest, and returns the file and its size.
+func (c *Copier) stageBlob(ctx context.Context, src Reference, blob descriptor) (*os.File, int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, repositoryURL(src, "blobs/"+blob.Digest), nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, statusError(resp, "fetching blob "+blob.Digest)
+	}
+
+	file, err := os.CreateTemp(c.TempDir, "blob-")
+	if err != nil {
+		return nil, 0, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if err == nil && strings.HasPrefix(blob.Digest, "sha256:") && "sha256:"+hex.EncodeToString(hash.Sum(nil)) != blob.Digest {
+		err = fmt.Errorf("blob %s does not match its digest", blob.Digest)
+	}
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+func (c *Copier) blobExists(ctx context.Context, ref Reference, digest string) (bool, error) {
+	resp, err := c.do(ctx, http.MethodHead, repositoryURL(ref, "blobs/"+digest), nil, nil)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, statusError(resp, "checking blob "+digest)
+	}
+}
+
+// startUpload opens a blob upload session and returns its absolute location.
+func (c *Copier) startUpload(ctx context.Context, ref Reference) (*url.URL, error) {
+	endpoint := repositoryURL(ref, "blobs/uploads/")
+	resp, err := c.do(ctx, http.MethodPost, endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return nil, statusError(resp, "starting blob upload")
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	location, err := base.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location: %w", err)
+	}
+	return location, nil
+}
+
+// fetchManifest downloads a manifest, checking its digest when it was requested by digest.
+func (c *Copier) fetchManifest(ctx context.Context, ref Reference, identifier string) (fetchedManifest, error) {
+	var fetched fetchedManifest
+	err := c.retry(ctx, func() error {
+		resp, err := c.do(ctx, http.MethodGet, repositoryURL(ref, "manifests/"+identifier),
+			map[string]string{"Accept": manifestAcceptHeader}, nil)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.StatusCode != http.StatusOK {
+			return statusError(resp, "fetching manifest "+identifier)
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+		if err != nil {
+			return err
+		}
+		fetched = fetchedManifest{mediaType: resp.Header.Get("Content-Type"), digest: digestOf(body), body: body}
+		return nil
+	})
+	if err != nil {
+		return fetchedManifest{}, err
+	}
+
+	if strings.HasPrefix(identifier, "sha256:") && fetched.digest != identifier {
+		return fetchedManifest{}, fmt.Errorf("manifest %s has digest %s", identifier, fetched.digest)
+	}
+	if err := json.Unmarshal(fetched.body, &fetched.parsed); err != nil {
+		return fetchedManifest{}, fmt.Errorf("decoding manifest %s: %w", identifier, err)
+	}
+	if fetched.mediaType == "" {
+		fetched.mediaType = fetched.parsed.MediaType
+	}
+	return fetched, nil
+}
+
+func (c *Copier) putManifest(ctx context.Context, ref Reference, identifier string, m fetchedManifest) error {
+	return c.retry(ctx, func() error {
+		resp, err := c.do(ctx, http.MethodPut, repositoryURL(ref, "manifests/"+identifier),
+			map[string]string{"Content-Type": m.mediaType}, m.body)
+		if err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+			return statusError(resp, "pushing manifest "+identifier)
+		}
+		return nil
+	})
+}
+
+// retry runs fn until it succeeds, Retries is exhausted or ctx is done.
+func (c *Copier) retry(ctx context.Context, fn func() error) error {
+	retries := c.Retries
+	if retries <= 0 {
+		retries = defaultCopyRetries
+	}
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultCopyRetryBackoff
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil || attempt == retries || errors.Is(err, errNotRetryable) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff << attempt):
+		}
+	}
+}
+
+// do issues a request with a replayable body, so that an auth.Transport may retry it after a challenge.
+func (c *Copier) do(ctx context.Context, method, endpoint string, header map[string]string,
+	body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	return c.client().Do(req)
+}
+
+func (c *Copier) client() *http.Client {
+	if c.Client != nil {
+		return c.Client
+	}
+	return http.DefaultClient
+}
+
+// errNotRetryable marks registry answers that a retry cannot change.
+var errNotRetryable = errors.New("not retryable")
+
+// statusError describes an unexpected registry answer. Client errors other than throttling are
+// not retried.
+func statusError(resp *http.Response, action string) error {
+	err := fmt.Errorf("%s: registry returned %s", action, resp.Status)
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return fmt.Errorf("%w (%w)", err, errNotRetryable)
+	}
+	return err
+}
+
+// canonicalReference fills in the registry and library/ namespace Docker Hub implies for short names.
+func canonicalReference(ref Reference) Reference {
+	if ref.Registry == "" {
+		ref.Registry = "docker.io"
+	}
+	if (ref.Registry == "docker.io" || ref.Registry == "index.docker.io") && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	return ref
+}
+
+func repositoryURL(ref Reference, suffix string) string {
+	return fmt.Sprintf("https://%s/v2/%s/%s", apiHost(ref.Registry), ref.Repository, suffix)
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == mediaTypeOCIIndex || mediaType == mediaTypeDockerList
+}
+
+func digestOf(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// progressTracker serializes progress updates from concurrent transfers.
+type progressTracker struct {
+	mu     sync.Mutex
+	state  CopyProgress
+	report func(CopyProgress)
+}
+
+func (p *progressTracker) blobCopied(n int64) {
+	p.update(func(s *CopyProgress) {
+		s.CopiedBlobs++
+		s.CopiedBytes += n
+	})
+}
+
+func (p *progressTracker) manifestCopied() {
+	p.update(func(s *CopyProgress) { s.CopiedManifests++ })
+}
+
+func (p *progressTracker) update(fn func(*CopyProgress)) {
+	p.mu.Lock()
+	fn(&p.state)
+	snapshot := p.state
+	p.mu.Unlock()
+
+	// Reported outside the lock, so a slow report does not hold up other transfers
+	if p.report != nil {
+		p.report(snapshot)
+	}
+}
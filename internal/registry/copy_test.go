@@ -0,0 +1,126 @@
+// PURPOSE: Test suite for copying single- and multi-arch images between two registry stand-ins
+package registry_test
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
+	"mutating-registry-hook/internal/registry/registrytest"
+)
+
+func TestCopier_CopiesMultiArchIndex(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	digest := source.PushImage("library/nginx", "1.25", "linux/amd64", "linux/arm64")
+
+	// Reports come from concurrent transfers and may arrive out of order
+	var mu sync.Mutex
+	var last registry.CopyProgress
+	copier := &registry.Copier{Client: source.Client(), Concurrency: 2}
+	err := copier.Copy(context.Background(), source.Host()+"/library/nginx:1.25",
+		target.Host()+"/library/nginx:1.25", func(p registry.CopyProgress) {
+			mu.Lock()
+			defer mu.Unlock()
+			if p.CopiedBlobs+p.CopiedManifests >= last.CopiedBlobs+last.CopiedManifests {
+				last = p
+			}
+		})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !target.HasManifest("library/nginx", "1.25") || !target.HasManifest("library/nginx", digest) {
+		t.Error("expected the index to be pushed under its tag and digest")
+	}
+	if got := target.BlobCount(); got != 4 {
+		t.Errorf("expected 4 blobs on the target, got %d", got)
+	}
+	want := registry.CopyProgress{TotalManifests: 3, CopiedManifests: 3, TotalBlobs: 4, CopiedBlobs: 4}
+	if last.CopiedBytes == 0 {
+		t.Error("expected copied bytes to be reported")
+	}
+	last.CopiedBytes = 0
+	if last != want {
+		t.Errorf("expected final progress %+v, got %+v", want, last)
+	}
+}
+
+func TestCopier_SkipsBlobsAlreadyOnTarget(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushImage("app", "v1")
+	target.PushImage("app", "v1")
+
+	copier := &registry.Copier{Client: source.Client()}
+	if err := copier.Copy(context.Background(), source.Host()+"/app:v1", target.Host()+"/app:v1", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, request := range target.Requests() {
+		if strings.HasPrefix(request, "POST ") {
+			t.Errorf("expected no uploads for blobs already present, got %q", request)
+		}
+	}
+}
+
+func TestCopier_RetriesTransientFailures(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushImage("app", "v1")
+	source.FailNext(2)
+
+	copier := &registry.Copier{Client: source.Client(), Retries: 3, RetryBackoff: time.Millisecond}
+	if err := copier.Copy(context.Background(), source.Host()+"/app:v1", target.Host()+"/mirror/app:v1", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !target.HasManifest("mirror/app", "v1") {
+		t.Error("expected the image to be copied after retries")
+	}
+}
+
+func TestCopier_MissingSourceIsNotRetried(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+
+	copier := &registry.Copier{Client: source.Client(), Retries: 3, RetryBackoff: time.Millisecond}
+	if err := copier.Copy(context.Background(), source.Host()+"/app:v1", target.Host()+"/app:v1", nil); err == nil {
+		t.Fatal("expected an error for a missing source image")
+	}
+	if got := len(source.Requests()); got != 1 {
+		t.Errorf("expected a single manifest request, got %d", got)
+	}
+}
+
+func TestCopier_ReplaysUploadAfterChallenge(t *testing.T) {
+	source := registrytest.New(t)
+	target := registrytest.New(t)
+	source.PushImage("app", "v1")
+	target.ChallengeUploads("pusher", "secret")
+
+	transport := auth.NewTransport(source.Client().Transport)
+	transport.Keyring = auth.Keyring{target.Host(): {Username: "pusher", Password: "secret"}}
+	copier := &registry.Copier{Client: &http.Client{Transport: transport}, TempDir: t.TempDir()}
+	if err := copier.Copy(context.Background(), source.Host()+"/app:v1", target.Host()+"/app:v1", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := target.BlobCount(); got != 2 {
+		t.Errorf("expected both blobs uploaded after the challenge, got %d", got)
+	}
+}
+
+func TestCopier_Digest(t *testing.T) {
+	source := registrytest.New(t)
+	digest := source.PushImage("app", "v1")
+
+	copier := &registry.Copier{Client: source.Client()}
+	got, err := copier.Digest(context.Background(), source.Host()+"/app:v1")
+	if err != nil || got != digest {
+		t.Errorf("Digest() = %q, %v; want %q", got, err, digest)
+	}
+}
@@ -0,0 +1,225 @@
+// PURPOSE: Probes target registries for availability so unhealthy mirrors are skipped during admission
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthChecker reports whether a registry host is currently able to serve images.
+type HealthChecker interface {
+	Healthy(ctx context.Context, host string) bool
+}
+
+// HealthProberOptions configures a HealthProber. Zero values are replaced by defaults.
+type HealthProberOptions struct {
+	// Client is used for probe requests. Defaults to a client with Timeout.
+	Client *http.Client
+	// Timeout bounds a single probe.
+	Timeout time.Duration
+	// Interval is how often known registries are probed in the background, and how long a
+	// result is trusted when the background loop is not running.
+	Interval time.Duration
+	// Expiry is how long a registry nobody asks about stays known. Defaults to 20 Intervals.
+	Expiry time.Duration
+	// MaxHosts bounds the number of registries known at once; the least recently asked about
+	// is forgotten first.
+	MaxHosts int
+}
+
+const (
+	defaultProbeTimeout  = 300 * time.Millisecond
+	defaultProbeInterval = 15 * time.Second
+	defaultProbeMaxHosts = 256
+	// probeConcurrency bounds the probes of a background round. With the defaults, a round of
+	// unreachable registries takes 16 Timeouts, about 5s, well within an Interval
+	probeConcurrency = 16
+)
+
+type probeResult struct {
+	healthy bool
+	checked time.Time
+	// used is when admission last asked about the host.
+	used time.Time
+	// probing is set while a probe of the host is in flight.
+	probing bool
+}
+
+// HealthProber checks the distribution API base endpoint (GET /v2/) of each registry it is asked about.
+// A 200 or 401 answer means the registry is up. Admission never waits on a probe: a registry seen for
+// the first time counts as healthy while it is probed in the background, and a stale result is served
+// while it is refreshed. Start also refreshes every known registry each Interval and forgets those
+// nobody has asked about for Expiry.
+type HealthProber struct {
+	client   *http.Client
+	interval time.Duration
+	expiry   time.Duration
+	maxHosts int
+
+	mu      sync.RWMutex
+	results map[string]probeResult
+	now     func() time.Time
+
+	// inflight tracks background probes so tests can wait for them.
+	inflight sync.WaitGroup
+}
+
+var _ HealthChecker = &HealthProber{}
+
+// NewHealthProber builds a HealthProber from opts.
+func NewHealthProber(opts HealthProberOptions) *HealthProber {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultProbeTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultProbeInterval
+	}
+	if opts.Expiry <= 0 {
+		opts.Expiry = 20 * opts.Interval
+	}
+	if opts.MaxHosts <= 0 {
+		opts.MaxHosts = defaultProbeMaxHosts
+	}
+	return &HealthProber{
+		client:   opts.Client,
+		interval: opts.Interval,
+		expiry:   opts.Expiry,
+		maxHosts: opts.MaxHosts,
+		results:  map[string]probeResult{},
+		now:      time.Now,
+	}
+}
+
+// Healthy returns the cached state of host. An unknown host is reported healthy; it and a host
+// whose state is stale are probed in the background rather than on the caller's time.
+func (p *HealthProber) Healthy(ctx context.Context, host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	result, ok := p.results[host]
+	if !ok {
+		p.evictLocked()
+		result = probeResult{healthy: true}
+	}
+	result.used = now
+	if !result.probing && now.Sub(result.checked) >= p.interval {
+		result.probing = true
+		p.inflight.Add(1)
+		go func() {
+			defer p.inflight.Done()
+			p.probe(context.WithoutCancel(ctx), host)
+		}()
+	}
+	p.results[host] = result
+	return result.healthy
+}
+
+// evictLocked makes room for one more host by forgetting the one least recently asked about.
+func (p *HealthProber) evictLocked() {
+	if len(p.results) < p.maxHosts {
+		return
+	}
+	var oldest string
+	var oldestUsed time.Time
+	for host, result := range p.results {
+		if oldest == "" || result.used.Before(oldestUsed) {
+			oldest, oldestUsed = host, result.used
+		}
+	}
+	delete(p.results, oldest)
+}
+
+// Start re-probes every known registry each Interval until ctx is done, forgetting registries not
+// asked about for Expiry. It satisfies manager.Runnable.
+func (p *HealthProber) Start(ctx context.Context) error {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			p.probeAll(ctx, p.hosts())
+		}
+	}
+}
+
+// probeAll probes hosts with at most probeConcurrency probes in flight and returns once all are done.
+func (p *HealthProber) probeAll(ctx context.Context, hosts []string) {
+	slots := make(chan struct{}, probeConcurrency)
+
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			p.probe(ctx, host)
+		}(host)
+	}
+	wg.Wait()
+}
+
+// hosts prunes expired registries and returns those still known.
+func (p *HealthProber) hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	hosts := make([]string, 0, len(p.results))
+	for host, result := range p.results {
+		if now.Sub(result.used) >= p.expiry {
+			delete(p.results, host)
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+func (p *HealthProber) probe(ctx context.Context, host string) bool {
+	healthy := p.check(ctx, host) == nil
+
+	p.mu.Lock()
+	// A host forgotten while it was being probed stays forgotten
+	if result, ok := p.results[host]; ok {
+		result.healthy, result.checked, result.probing = healthy, p.now(), false
+		p.results[host] = result
+	}
+	p.mu.Unlock()
+
+	return healthy
+}
+
+func (p *HealthProber) check(ctx context.Context, host string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s/v2/", apiHost(host)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("registry %s returned %s", host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// PURPOSE: Test suite for registry health probing
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newProbeServer(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var probes atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			probes.Add(1)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, &probes
+}
+
+// settle asks prober about host and waits for the background probe it starts.
+func settle(prober *HealthProber, host string) {
+	prober.Healthy(context.Background(), host)
+	prober.inflight.Wait()
+}
+
+func TestHealthProber_StatusCodes(t *testing.T) {
+	tests := []struct {
+		status  int
+		healthy bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusNotFound, false},
+	}
+
+	for _, tt := range tests {
+		server, _ := newProbeServer(t, tt.status)
+		prober := NewHealthProber(HealthProberOptions{Client: server.Client()})
+		settle(prober, serverHost(server))
+
+		if got := prober.Healthy(context.Background(), serverHost(server)); got != tt.healthy {
+			t.Errorf("status %d: Healthy() = %v; want %v", tt.status, got, tt.healthy)
+		}
+	}
+}
+
+func TestHealthProber_UnreachableRegistryIsUnhealthy(t *testing.T) {
+	server, _ := newProbeServer(t, http.StatusOK)
+	host := serverHost(server)
+	server.Close()
+
+	prober := NewHealthProber(HealthProberOptions{Timeout: 100 * time.Millisecond})
+	settle(prober, host)
+	if prober.Healthy(context.Background(), host) {
+		t.Error("expected an unreachable registry to be unhealthy")
+	}
+}
+
+func TestHealthProber_CachesResultForInterval(t *testing.T) {
+	server, probes := newProbeServer(t, http.StatusOK)
+	prober := NewHealthProber(HealthProberOptions{Client: server.Client(), Interval: time.Minute})
+	now := time.Now()
+	prober.now = func() time.Time { return now }
+
+	settle(prober, serverHost(server))
+	settle(prober, serverHost(server))
+	if got := probes.Load(); got != 1 {
+		t.Errorf("expected 1 probe within the interval, got %d", got)
+	}
+
+	now = now.Add(2 * time.Minute)
+	settle(prober, serverHost(server))
+	if got := probes.Load(); got != 2 {
+		t.Errorf("expected a stale result to be re-probed, got %d probes", got)
+	}
+}
+
+func TestHealthProber_StartRefreshesKnownRegistries(t *testing.T) {
+	server, probes := newProbeServer(t, http.StatusOK)
+	prober := NewHealthProber(HealthProberOptions{Client: server.Client(), Interval: 10 * time.Millisecond})
+	settle(prober, serverHost(server))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		_ = prober.Start(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for probes.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if got := probes.Load(); got < 3 {
+		t.Errorf("expected background probes, got %d", got)
+	}
+}
+
+func TestHealthProber_UnknownHostIsHealthyWhileProbed(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	prober := NewHealthProber(HealthProberOptions{Client: server.Client(), Timeout: time.Second})
+	if !prober.Healthy(context.Background(), serverHost(server)) {
+		t.Error("expected an unknown registry to count as healthy without waiting for its probe")
+	}
+	close(release)
+	prober.inflight.Wait()
+
+	if prober.Healthy(context.Background(), serverHost(server)) {
+		t.Error("expected the background probe result to be used once it lands")
+	}
+}
+
+func TestHealthProber_ForgetsUnusedHosts(t *testing.T) {
+	server, _ := newProbeServer(t, http.StatusOK)
+	prober := NewHealthProber(HealthProberOptions{Client: server.Client(), Interval: time.Minute, MaxHosts: 2})
+	now := time.Now()
+	prober.now = func() time.Time { return now }
+
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		settle(prober, host)
+		now = now.Add(time.Second)
+	}
+	if _, ok := prober.results["a.example.com"]; ok || len(prober.results) != 2 {
+		t.Errorf("expected the least recently used host to be evicted, got %v", prober.results)
+	}
+
+	now = now.Add(time.Hour)
+	if hosts := prober.hosts(); len(hosts) != 0 {
+		t.Errorf("expected hosts unused past the expiry to be forgotten, got %v", hosts)
+	}
+}
+
+func TestHealthProber_ProbesRoundConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	inflight, peak := 0, 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inflight++
+		peak = max(peak, inflight)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	})
+	var hosts []string
+	var client *http.Client
+	for range probeConcurrency + 4 {
+		server := httptest.NewTLSServer(handler)
+		t.Cleanup(server.Close)
+		hosts, client = append(hosts, serverHost(server)), server.Client()
+	}
+	prober := NewHealthProber(HealthProberOptions{Client: client})
+
+	prober.probeAll(context.Background(), hosts)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak < 2 || peak > probeConcurrency {
+		t.Errorf("expected between 2 and %d probes in flight, got %d", probeConcurrency, peak)
+	}
+}
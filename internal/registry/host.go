@@ -0,0 +1,137 @@
+// PURPOSE: Registry host grammar for image references and normalization of configured target registries
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// domainLabelRE matches one label of a DNS name. Internationalized names appear in punycode.
+var domainLabelRE = regexp.MustCompile(`^[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+const maxDomainLength = 253
+
+// isRegistryComponent reports whether the first path component of an image reference names a registry
+// rather than a repository: it has a "." or a ":", is a bracketed IPv6 address, or is localhost.
+func isRegistryComponent(component string) bool {
+	return strings.ContainsAny(component, ".:") || strings.HasPrefix(component, "[") || component == "localhost"
+}
+
+// splitHostPort splits host into its name or address and its port, which may be empty. IPv6 addresses
+// must be bracketed; the brackets are kept.
+func splitHostPort(host string) (string, string, error) {
+	if strings.HasPrefix(host, "[") {
+		end := strings.Index(host, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("host %q has an unterminated IPv6 address", host)
+		}
+		name, rest := host[:end+1], host[end+1:]
+		if rest == "" {
+			return name, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("host %q has characters after the IPv6 address", host)
+		}
+		return name, rest[1:], nil
+	}
+	switch strings.Count(host, ":") {
+	case 0:
+		return host, "", nil
+	case 1:
+		name, port, _ := strings.Cut(host, ":")
+		return name, port, nil
+	default:
+		return "", "", fmt.Errorf("host %q must bracket an IPv6 address", host)
+	}
+}
+
+// ValidateHost checks a registry host, which may carry a port: a DNS name, an IPv4 address or a
+// bracketed IPv6 address.
+func ValidateHost(host string) error {
+	if host == "" {
+		return errors.New("registry host cannot be empty")
+	}
+	name, port, err := splitHostPort(host)
+	if err != nil {
+		return err
+	}
+	if port != "" || strings.HasSuffix(host, ":") {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || port[0] == '0' {
+			return fmt.Errorf("host %q has an invalid port %q", host, port)
+		}
+	}
+
+	if strings.HasPrefix(name, "[") {
+		ip := net.ParseIP(strings.Trim(name, "[]"))
+		if ip == nil || !strings.Contains(name, ":") {
+			return fmt.Errorf("host %q is not a valid IPv6 address", host)
+		}
+		return nil
+	}
+	if len(name) > maxDomainLength {
+		return fmt.Errorf("host %q is longer than %d characters", host, maxDomainLength)
+	}
+	labels := strings.Split(name, ".")
+	numeric := true
+	for _, label := range labels {
+		if !domainLabelRE.MatchString(label) {
+			return fmt.Errorf("host %q is not a valid DNS name or IP address", host)
+		}
+		if strings.Trim(label, "0123456789") != "" {
+			numeric = false
+		}
+	}
+	// All-numeric names are IPv4 addresses and must be well formed
+	if numeric && (len(labels) != 4 || net.ParseIP(name) == nil) {
+		return fmt.Errorf("host %q is not a valid IPv4 address", host)
+	}
+	return nil
+}
+
+// NormalizeTarget returns a target registry, a host optionally followed by a repository path prefix,
+// in canonical form: the host lowercase, an internationalized name in punycode, and no surrounding
+// whitespace or slashes. Schemes, and paths that are not valid repository components, are rejected.
+func NormalizeTarget(target string) (string, error) {
+	normalized := strings.Trim(strings.TrimSpace(target), "/")
+	switch {
+	case normalized == "":
+		return "", errors.New("target must not be empty")
+	case strings.Contains(normalized, "://"):
+		return "", errors.New("target must not have a scheme")
+	}
+
+	host, path, _ := strings.Cut(normalized, "/")
+	name, port, err := splitHostPort(host)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(name, "[") {
+		name = strings.ToLower(name)
+	} else if name, err = idna.Lookup.ToASCII(name); err != nil {
+		return "", fmt.Errorf("host %q is not a valid domain name: %w", host, err)
+	}
+	host = name
+	if port != "" || strings.HasSuffix(normalized, ":") {
+		host += ":" + port
+	}
+	if err := ValidateHost(host); err != nil {
+		return "", err
+	}
+
+	if path == "" {
+		return host, nil
+	}
+	for _, component := range strings.Split(path, "/") {
+		if !pathComponentRE.MatchString(component) {
+			return "", fmt.Errorf("target path component %q must be lowercase alphanumerics separated by . _ __ or -",
+				component)
+		}
+	}
+	return host + "/" + path, nil
+}
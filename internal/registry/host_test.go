@@ -0,0 +1,161 @@
+// PURPOSE: Conformance tests for the registry host grammar of image references and target registries
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+// hostConformance lists registry hosts, the image references naming them, and their target form.
+// An empty target means the host is invalid everywhere.
+var hostConformance = []struct {
+	name   string
+	host   string
+	target string
+}{
+	{"domain", "registry.example.com", "registry.example.com"},
+	{"domain with port", "registry.example.com:5000", "registry.example.com:5000"},
+	{"single label with port", "mirror:5000", "mirror:5000"},
+	{"localhost", "localhost", "localhost"},
+	{"localhost with port", "localhost:5000", "localhost:5000"},
+	{"uppercase", "Registry.Example.COM", "registry.example.com"},
+	{"hyphens", "my-registry.example-corp.io", "my-registry.example-corp.io"},
+	{"punycode", "xn--bcher-kva.example", "xn--bcher-kva.example"},
+	{"IPv4", "10.0.0.1", "10.0.0.1"},
+	{"IPv4 with port", "192.168.1.10:5000", "192.168.1.10:5000"},
+	{"IPv6", "[fd00::1]", "[fd00::1]"},
+	{"IPv6 with port", "[fd00::1]:5000", "[fd00::1]:5000"},
+	{"IPv6 uppercase", "[FD00::A]:5000", "[fd00::a]:5000"},
+	{"IPv6 loopback", "[::1]:5000", "[::1]:5000"},
+	{"unbracketed IPv6", "fd00::1", ""},
+	{"unterminated IPv6", "[fd00::1:5000", ""},
+	{"bracketed IPv4", "[10.0.0.1]", ""},
+	{"garbage after IPv6", "[fd00::1]x", ""},
+	{"invalid IPv6", "[fd00::g]:5000", ""},
+	{"IPv4 out of range", "10.0.0.256", ""},
+	{"IPv4 too short", "10.0.1:5000", ""},
+	{"empty port", "registry.example.com:", ""},
+	{"port out of range", "registry.example.com:65536", ""},
+	{"port zero", "registry.example.com:0", ""},
+	{"named port", "registry.example.com:http", ""},
+	{"leading hyphen", "-registry.example.com", ""},
+	{"trailing hyphen", "registry-.example.com", ""},
+	{"empty label", "registry..example.com", ""},
+	{"underscore", "my_registry.example.com", ""},
+	{"label too long", strings.Repeat("a", 64) + ".example.com", ""},
+}
+
+func TestValidateHost_Conformance(t *testing.T) {
+	for _, tt := range hostConformance {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateHost(tt.host)
+			if valid := tt.target != ""; valid != (err == nil) {
+				t.Errorf("ValidateHost(%q) = %v, want valid=%t", tt.host, err, valid)
+			}
+		})
+	}
+}
+
+func TestParseReference_HostConformance(t *testing.T) {
+	for _, tt := range hostConformance {
+		t.Run(tt.name, func(t *testing.T) {
+			image := tt.host + "/team/app:v1"
+			ref, err := ParseReference(image)
+			if tt.target == "" {
+				if err == nil {
+					t.Errorf("ParseReference(%q) = %+v, want an error", image, ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReference(%q) returned error: %v", image, err)
+			}
+			want := Reference{Registry: tt.host, Repository: "team/app", Tag: "v1"}
+			if ref != want || ref.String() != image {
+				t.Errorf("ParseReference(%q) = %+v, want %+v", image, ref, want)
+			}
+		})
+	}
+}
+
+func TestNormalizeTarget_Conformance(t *testing.T) {
+	for _, tt := range hostConformance {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeTarget(tt.host)
+			if tt.target == "" {
+				if err == nil {
+					t.Errorf("NormalizeTarget(%q) = %q, want an error", tt.host, got)
+				}
+				return
+			}
+			if err != nil || got != tt.target {
+				t.Errorf("NormalizeTarget(%q) = %q, %v, want %q", tt.host, got, err, tt.target)
+			}
+		})
+	}
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"  mirror.example.com  ", "mirror.example.com"},
+		{"mirror.example.com/", "mirror.example.com"},
+		{"/mirror.example.com/cache//", "mirror.example.com/cache"},
+		{"Mirror.Example.com/cache/docker-hub", "mirror.example.com/cache/docker-hub"},
+		{"[FD00::1]:5000/mirror", "[fd00::1]:5000/mirror"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example:5000/cache", "xn--bcher-kva.example:5000/cache"},
+	}
+	for _, tt := range tests {
+		if got, err := NormalizeTarget(tt.target); err != nil || got != tt.want {
+			t.Errorf("NormalizeTarget(%q) = %q, %v, want %q", tt.target, got, err, tt.want)
+		}
+	}
+
+	for target, want := range map[string]string{
+		"":                             "must not be empty",
+		" / ":                          "must not be empty",
+		"https://mirror.example.com":   "must not have a scheme",
+		"oci://mirror.example.com/x":   "must not have a scheme",
+		"mirror.example.com/Cache":     `path component "Cache"`,
+		"mirror.example.com/a//b":      `path component ""`,
+		"mirror.example.com/cache?x=1": `path component "cache?x=1"`,
+		"mirror.example.com/a b":       `path component "a b"`,
+		"mirror.example.com@sha256":    "not a valid",
+		"fd00::1/mirror":               "must bracket an IPv6 address",
+	} {
+		if _, err := NormalizeTarget(target); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("NormalizeTarget(%q) = %v, want an error containing %q", target, err, want)
+		}
+	}
+}
+
+func TestRewriteImage_UnusualHosts(t *testing.T) {
+	tests := []struct {
+		image  string
+		target string
+		want   string
+	}{
+		{"[fd00::1]:5000/app:v1", "mirror.example.com", "mirror.example.com/app:v1"},
+		{"localhost/app:v1", "mirror.example.com", "mirror.example.com/app:v1"},
+		{"10.0.0.1:5000/team/app", "[fd00::2]:5000/", "[fd00::2]:5000/team/app:latest"},
+		{"nginx:1.25", "Mirror.Example.com/Cache/", ""},
+		{"nginx:1.25", "Mirror.Example.com/cache/", "mirror.example.com/cache/nginx:1.25"},
+		{"nginx:1.25", "bücher.example", "xn--bcher-kva.example/nginx:1.25"},
+		{"nginx:1.25", "https://mirror.example.com", ""},
+	}
+	for _, tt := range tests {
+		got, err := RewriteImage(tt.image, tt.target)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("RewriteImage(%q, %q) = %q, want an error", tt.image, tt.target, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("RewriteImage(%q, %q) = %q, %v, want %q", tt.image, tt.target, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+// PURPOSE: Recognizes registries on the local machine or a private network, which are not mirrored
+package registry
+
+import (
+	"net"
+	"strings"
+)
+
+// IsLocalRegistry reports whether host, which may carry a port, names localhost or a loopback,
+// private or link-local address. Such registries usually serve local development builds that no
+// mirror holds.
+func IsLocalRegistry(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// ImageRegistry returns the registry host of an image reference, with Docker Hub for short names.
+func ImageRegistry(image string) string {
+	ref, err := ParseReference(image)
+	if err != nil || ref.Registry == "" {
+		return "docker.io"
+	}
+	return ref.Registry
+}
@@ -0,0 +1,42 @@
+// PURPOSE: Test suite for recognizing local and private-network registries
+package registry
+
+import "testing"
+
+func TestIsLocalRegistry(t *testing.T) {
+	tests := map[string]bool{
+		"localhost":                    true,
+		"localhost:5000":               true,
+		"kind-registry.localhost:5001": true,
+		"127.0.0.1:5000":               true,
+		"10.1.2.3":                     true,
+		"192.168.1.10:443":             true,
+		"172.16.0.1":                   true,
+		"[::1]:5000":                   true,
+		"[fd00::1]:5000":               true,
+		"169.254.1.1":                  true,
+		"docker.io":                    false,
+		"myregistry.io:5000":           false,
+		"8.8.8.8":                      false,
+		"[2001:db8::1]:5000":           false,
+	}
+	for host, want := range tests {
+		if got := IsLocalRegistry(host); got != want {
+			t.Errorf("IsLocalRegistry(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+func TestImageRegistry(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                       "docker.io",
+		"library/nginx:1.25":          "docker.io",
+		"gcr.io/project/app:v1":       "gcr.io",
+		"localhost:5000/app@sha256:0": "localhost:5000",
+	}
+	for image, want := range tests {
+		if got := ImageRegistry(image); got != want {
+			t.Errorf("ImageRegistry(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
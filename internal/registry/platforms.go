@@ -0,0 +1,174 @@
+// PURPOSE: Reads the CPU architectures an image is published for, from its index or its config blob
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// PlatformVerifier is a ManifestVerifier that can also tell which architectures an image is
+// available for. Rewriter uses it when the context carries required architectures.
+type PlatformVerifier interface {
+	ManifestVerifier
+	// ManifestArchitectures returns the architectures of image and whether its manifest exists. The
+	// architectures are empty when the registry does not say.
+	ManifestArchitectures(ctx context.Context, image string) ([]string, bool, error)
+}
+
+type architecturesKey struct{}
+
+// WithArchitectures returns a context asking verification to reject rewrites that are not available
+// for every one of architectures, such as amd64 and arm64.
+func WithArchitectures(ctx context.Context, architectures []string) context.Context {
+	return context.WithValue(ctx, architecturesKey{}, architectures)
+}
+
+// ArchitecturesFrom returns the architectures required by WithArchitectures, or nil.
+func ArchitecturesFrom(ctx context.Context) []string {
+	architectures, _ := ctx.Value(architecturesKey{}).([]string)
+	return architectures
+}
+
+// MissingArchitectures returns the required architectures absent from available. Nothing is missing
+// when available is empty, since the registry did not say.
+func MissingArchitectures(available, required []string) []string {
+	if len(available) == 0 {
+		return nil
+	}
+	var missing []string
+	for _, architecture := range required {
+		if !slices.Contains(available, architecture) {
+			missing = append(missing, architecture)
+		}
+	}
+	return missing
+}
+
+// platformResult is a cached ManifestArchitectures answer.
+type platformResult struct {
+	exists        bool
+	architectures []string
+}
+
+// platformManifest holds the fields of an image manifest or index that name its platforms.
+type platformManifest struct {
+	MediaType string      `json:"mediaType"`
+	Config    *descriptor `json:"config,omitempty"`
+	Manifests []struct {
+		Platform *struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform,omitempty"`
+	} `json:"manifests,omitempty"`
+}
+
+// ManifestArchitectures fetches the manifest of image. The architectures of an index are those of its
+// platform entries, skipping attestations, which have os "unknown"; a single manifest's architecture
+// is read from its config blob. Results are cached and failures count against the registry's breaker,
+// as with ManifestExists.
+func (v *Verifier) ManifestArchitectures(ctx context.Context, image string) ([]string, bool, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return nil, false, err
+	}
+	if ref.Registry == "" {
+		return nil, false, fmt.Errorf("image %q does not name a registry", image)
+	}
+
+	key := v.cacheKey(ctx, image, ref)
+	if result, ok := v.platforms.Get(key); ok {
+		return result.architectures, result.exists, nil
+	}
+
+	breaker := v.breakers.For(ref.Registry)
+	if !breaker.Allow() {
+		return nil, false, fmt.Errorf("%w: %s", ErrCircuitOpen, ref.Registry)
+	}
+
+	result, err := v.readPlatforms(ctx, ref)
+	if err != nil {
+		recordFailure(ctx, breaker)
+		return nil, false, err
+	}
+	breaker.Success()
+
+	ttl := v.negativeTTL
+	if result.exists {
+		ttl = v.positiveTTL
+	}
+	v.platforms.Add(key, result, ttl)
+	v.cache.Add(key, result.exists, ttl)
+	return result.architectures, result.exists, nil
+}
+
+func (v *Verifier) readPlatforms(ctx context.Context, ref Reference) (platformResult, error) {
+	var parsed platformManifest
+	found, err := v.getJSON(ctx, repositoryURL(ref, "manifests/"+ref.Identifier()), manifestAcceptHeader, &parsed)
+	if err != nil || !found {
+		return platformResult{}, err
+	}
+
+	if isIndex(parsed.MediaType) || len(parsed.Manifests) > 0 {
+		var architectures []string
+		for _, entry := range parsed.Manifests {
+			if entry.Platform == nil || entry.Platform.OS == "unknown" || entry.Platform.Architecture == "" {
+				continue
+			}
+			if !slices.Contains(architectures, entry.Platform.Architecture) {
+				architectures = append(architectures, entry.Platform.Architecture)
+			}
+		}
+		return platformResult{exists: true, architectures: architectures}, nil
+	}
+	if parsed.Config == nil {
+		return platformResult{exists: true}, nil
+	}
+
+	var config struct {
+		Architecture string `json:"architecture"`
+	}
+	found, err = v.getJSON(ctx, repositoryURL(ref, "blobs/"+parsed.Config.Digest), parsed.Config.MediaType, &config)
+	if err != nil {
+		return platformResult{}, err
+	}
+	if !found || config.Architecture == "" {
+		return platformResult{exists: true}, nil
+	}
+	return platformResult{exists: true, architectures: []string{config.Architecture}}, nil
+}
+
+// getJSON decodes the document at url into out. It returns false when the registry answers 404.
+func (v *Verifier) getJSON(ctx context.Context, url, accept string, out any) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return false, fmt.Errorf("decoding %s: %w", strings.TrimPrefix(url, "https://"), err)
+	}
+	return true, nil
+}
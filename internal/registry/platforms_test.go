@@ -0,0 +1,92 @@
+// PURPOSE: Test suite for reading image architectures and rejecting targets that lack a required one
+package registry_test
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/registrytest"
+)
+
+func TestVerifier_ManifestArchitectures(t *testing.T) {
+	target := registrytest.New(t)
+	target.PushImage("library/nginx", "1.25", "linux/amd64", "linux/arm64")
+	target.PushImage("app", "v1", "linux/arm64")
+	verifier := registry.NewVerifier(registry.VerifierOptions{Client: target.Client()})
+
+	for _, tt := range []struct {
+		image  string
+		want   []string
+		exists bool
+	}{
+		{"library/nginx:1.25", []string{"amd64", "arm64"}, true},
+		{"app:v1", []string{"arm64"}, true},
+		{"app:missing", nil, false},
+	} {
+		got, exists, err := verifier.ManifestArchitectures(context.Background(), target.Host()+"/"+tt.image)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", tt.image, err)
+		}
+		if exists != tt.exists || !slices.Equal(got, tt.want) {
+			t.Errorf("expected %s to have %v (exists=%t), got %v (exists=%t)", tt.image, tt.want, tt.exists, got, exists)
+		}
+	}
+}
+
+func TestVerifier_CachesArchitectures(t *testing.T) {
+	target := registrytest.New(t)
+	target.PushImage("app", "v1", "linux/amd64")
+	verifier := registry.NewVerifier(registry.VerifierOptions{Client: target.Client()})
+	image := target.Host() + "/app:v1"
+
+	for range 3 {
+		if _, _, err := verifier.ManifestArchitectures(context.Background(), image); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	before := len(target.Requests())
+	if exists, err := verifier.ManifestExists(context.Background(), image); err != nil || !exists {
+		t.Errorf("expected the existence check to be answered, got %v, %v", exists, err)
+	}
+	if got := len(target.Requests()); got != before || before != 2 {
+		t.Errorf("expected the manifest and config to be fetched once, got %d requests", got)
+	}
+}
+
+func TestMissingArchitectures(t *testing.T) {
+	if got := registry.MissingArchitectures([]string{"amd64"}, []string{"amd64", "arm64"}); !slices.Equal(got, []string{"arm64"}) {
+		t.Errorf("expected arm64 to be missing, got %v", got)
+	}
+	if got := registry.MissingArchitectures(nil, []string{"arm64"}); got != nil {
+		t.Errorf("expected nothing missing when the registry does not say, got %v", got)
+	}
+}
+
+func TestRewriter_FallsBackWhenTargetLacksArchitecture(t *testing.T) {
+	first := registrytest.New(t)
+	second := registrytest.New(t)
+	first.PushImage("nginx", "1.25", "linux/amd64")
+	second.PushImage("nginx", "1.25", "linux/amd64", "linux/arm64")
+	rewriter := &registry.Rewriter{Verifier: registry.NewVerifier(registry.VerifierOptions{Client: first.Client()})}
+	targets := []string{first.Host(), second.Host()}
+
+	ctx := registry.WithArchitectures(context.Background(), []string{"amd64", "arm64"})
+	outcome, err := rewriter.Rewrite(ctx, "nginx:1.25", targets, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Target != second.Host() || !outcome.Fallback || !strings.Contains(outcome.Reason, "lacks architecture arm64") {
+		t.Errorf("expected a fallback to the target with arm64, got %+v", outcome)
+	}
+
+	outcome, err = rewriter.Rewrite(context.Background(), "nginx:1.25", targets, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if outcome.Target != first.Host() || outcome.Fallback {
+		t.Errorf("expected the first target without required architectures, got %+v", outcome)
+	}
+}
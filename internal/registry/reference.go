@@ -0,0 +1,136 @@
+// PURPOSE: Splits container image references into registry, repository, tag and digest parts
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The grammar of the distribution reference format for the parts after the registry.
+var (
+	pathComponentRE = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRE           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRE        = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[A-Za-z0-9=_-]+$`)
+)
+
+// Reference is a container image reference broken into its components.
+// Registry is empty when the reference does not name one explicitly.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference splits an image reference. The first path component is a registry when it contains
+// a "." or ":", is a bracketed IPv6 address or is localhost, as in [fd00::1]:5000/app:v1.
+func ParseReference(image string) (Reference, error) {
+	if image == "" {
+		return Reference{}, errors.New("image reference cannot be empty")
+	}
+
+	var ref Reference
+	rest := image
+
+	if first, remainder, ok := strings.Cut(rest, "/"); ok && isRegistryComponent(first) {
+		ref.Registry = first
+		rest = remainder
+	}
+
+	if i := strings.Index(rest, "@"); i >= 0 {
+		ref.Digest = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	// A tag separator can only appear after the last path separator
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		ref.Tag = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	if rest == "" {
+		return Reference{}, errors.New("image reference has no repository")
+	}
+	ref.Repository = rest
+
+	if err := ref.validate(); err != nil {
+		return Reference{}, fmt.Errorf("invalid image reference %q: %w", image, err)
+	}
+	return ref, nil
+}
+
+// validate checks the registry, repository, tag and digest against the reference grammar.
+func (r Reference) validate() error {
+	if r.Registry != "" {
+		if err := ValidateHost(r.Registry); err != nil {
+			return err
+		}
+	}
+	for _, component := range strings.Split(r.Repository, "/") {
+		if !pathComponentRE.MatchString(component) {
+			return fmt.Errorf("repository component %q must be lowercase alphanumerics separated by . _ __ or -",
+				component)
+		}
+	}
+	if r.Tag != "" && !tagRE.MatchString(r.Tag) {
+		return fmt.Errorf("tag %q is not valid", r.Tag)
+	}
+	if r.Digest != "" && !digestRE.MatchString(r.Digest) {
+		return fmt.Errorf("digest %q is not valid", r.Digest)
+	}
+	return nil
+}
+
+// HasImplicitTag reports whether image is a valid reference with neither a tag nor a digest, which
+// runtimes pull as :latest.
+func HasImplicitTag(image string) bool {
+	ref, err := ParseReference(image)
+	return err == nil && ref.Tag == "" && ref.Digest == ""
+}
+
+// Identifier returns the digest if present, otherwise the tag, defaulting to "latest".
+func (r Reference) Identifier() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	if r.Tag != "" {
+		return r.Tag
+	}
+	return "latest"
+}
+
+// String reassembles the reference.
+func (r Reference) String() string {
+	var b strings.Builder
+	if r.Registry != "" {
+		b.WriteString(r.Registry)
+		b.WriteString("/")
+	}
+	b.WriteString(r.Repository)
+	if r.Tag != "" {
+		b.WriteString(":")
+		b.WriteString(r.Tag)
+	}
+	if r.Digest != "" {
+		b.WriteString("@")
+		b.WriteString(r.Digest)
+	}
+	return b.String()
+}
+
+// CanonicalImage returns image with the registry, library/ namespace and latest tag Docker Hub implies
+// made explicit, so that different spellings of one image compare equal. Unparseable references are
+// returned unchanged.
+func CanonicalImage(image string) string {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return image
+	}
+	ref = canonicalReference(ref)
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref.String()
+}
@@ -0,0 +1,66 @@
+// PURPOSE: Test suite for splitting image references into their components
+package registry
+
+import "testing"
+
+func TestParseReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  Reference
+	}{
+		{"nginx", Reference{Repository: "nginx"}},
+		{"nginx:1.25", Reference{Repository: "nginx", Tag: "1.25"}},
+		{"library/nginx:1.25", Reference{Repository: "library/nginx", Tag: "1.25"}},
+		{"gcr.io/project/app:v1", Reference{Registry: "gcr.io", Repository: "project/app", Tag: "v1"}},
+		{"localhost:5000/app", Reference{Registry: "localhost:5000", Repository: "app"}},
+		{"nginx@sha256:abc", Reference{Repository: "nginx", Digest: "sha256:abc"}},
+		{"gcr.io/app:v1@sha256:abc", Reference{Registry: "gcr.io", Repository: "app", Tag: "v1", Digest: "sha256:abc"}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseReference(tt.image)
+		if err != nil {
+			t.Errorf("ParseReference(%q) returned error: %v", tt.image, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseReference(%q) = %+v; want %+v", tt.image, got, tt.want)
+		}
+		if got.String() != tt.image {
+			t.Errorf("ParseReference(%q).String() = %q", tt.image, got.String())
+		}
+	}
+}
+
+func TestParseReference_Errors(t *testing.T) {
+	for _, image := range []string{"", "gcr.io/", "@sha256:abc", "::invalid::", "Team/App:v1", "app:-bad",
+		"app@sha256"} {
+		if _, err := ParseReference(image); err == nil {
+			t.Errorf("ParseReference(%q) should return an error", image)
+		}
+	}
+}
+
+func TestReference_Identifier(t *testing.T) {
+	if got := (Reference{Repository: "app"}).Identifier(); got != "latest" {
+		t.Errorf("expected latest, got %q", got)
+	}
+	if got := (Reference{Repository: "app", Tag: "v1", Digest: "sha256:abc"}).Identifier(); got != "sha256:abc" {
+		t.Errorf("expected digest, got %q", got)
+	}
+}
+
+func TestCanonicalImage(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                            "docker.io/library/nginx:latest",
+		"nginx:1.25":                       "docker.io/library/nginx:1.25",
+		"docker.io/library/nginx:1.25":     "docker.io/library/nginx:1.25",
+		"bitnami/redis@sha256:abc":         "docker.io/bitnami/redis@sha256:abc",
+		"quay.io/prometheus/node-exporter": "quay.io/prometheus/node-exporter:latest",
+	}
+	for image, want := range tests {
+		if got := CanonicalImage(image); got != want {
+			t.Errorf("CanonicalImage(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
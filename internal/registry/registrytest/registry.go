@@ -0,0 +1,328 @@
+// PURPOSE: In-memory OCI distribution registry stand-in for tests that push, pull and copy images
+package registrytest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Media types served by the stand-in.
+const (
+	MediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	mediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+type storedManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// Registry is a TLS server implementing the subset of the OCI distribution API used to copy images:
+// manifest and blob reads, monolithic blob uploads and manifest pushes.
+type Registry struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string]storedManifest // "<repository>@<tag or digest>"
+	blobs     map[string][]byte
+	uploads   int
+	failures  int
+	requests  []string
+	// uploadAuth, when set, is the user:pass blob upload PUTs must carry
+	uploadAuth [2]string
+}
+
+// New starts a registry stand-in that is stopped when the test ends.
+func New(t *testing.T) *Registry {
+	t.Helper()
+	r := &Registry{manifests: map[string]storedManifest{}, blobs: map[string][]byte{}}
+	r.server = httptest.NewTLSServer(http.HandlerFunc(r.serveHTTP))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// Host returns the host:port images on this registry are addressed by.
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "https://")
+}
+
+// Client returns an HTTP client trusting the registry's certificate. All stand-ins share one
+// certificate, so the client of one reaches every other.
+func (r *Registry) Client() *http.Client {
+	return r.server.Client()
+}
+
+// FailNext makes the next n requests answer 503 Service Unavailable.
+func (r *Registry) FailNext(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = n
+}
+
+// ChallengeUploads makes blob upload PUTs require basic auth with user and pass, answering a PUT
+// without it with a challenge, as registries that authorize each upload do.
+func (r *Registry) ChallengeUploads(user, pass string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.uploadAuth = [2]string{user, pass}
+}
+
+// Requests returns the "METHOD path" of every request served so far.
+func (r *Registry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.requests...)
+}
+
+// PushImage stores an image under repository:tag. With one platform a plain manifest is stored;
+// with several, an index referencing one manifest per platform ("os/arch"). It returns the digest
+// of the top-level manifest.
+func (r *Registry) PushImage(repository, tag string, platforms ...string) string {
+	if len(platforms) == 0 {
+		platforms = []string{"linux/amd64"}
+	}
+
+	var descriptors []map[string]any
+	for _, platform := range platforms {
+		os, arch, _ := strings.Cut(platform, "/")
+		config := r.putBlob([]byte(fmt.Sprintf(`{"architecture":%q,"os":%q}`, arch, os)))
+		layer := r.putBlob([]byte(repository + ":" + tag + " " + platform))
+		body, _ := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     MediaTypeManifest,
+			"config":        map[string]any{"mediaType": mediaTypeConfig, "digest": config.digest, "size": config.size},
+			"layers": []map[string]any{
+				{"mediaType": mediaTypeLayer, "digest": layer.digest, "size": layer.size},
+			},
+		})
+		digest := r.putManifest(repository, "", MediaTypeManifest, body)
+		descriptors = append(descriptors, map[string]any{
+			"mediaType": MediaTypeManifest, "digest": digest, "size": len(body),
+			"platform": map[string]string{"os": os, "architecture": arch},
+		})
+	}
+
+	if len(platforms) == 1 {
+		stored := r.lookupManifest(repository, descriptors[0]["digest"].(string))
+		return r.putManifest(repository, tag, MediaTypeManifest, stored.body)
+	}
+	body, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     MediaTypeIndex,
+		"manifests":     descriptors,
+	})
+	return r.putManifest(repository, tag, MediaTypeIndex, body)
+}
+
+// HasManifest reports whether repository holds a manifest under the tag or digest reference.
+func (r *Registry) HasManifest(repository, reference string) bool {
+	return r.manifestKnown(repository, reference)
+}
+
+// BlobCount returns the number of blobs stored.
+func (r *Registry) BlobCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.blobs)
+}
+
+func (r *Registry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	if r.failures > 0 {
+		r.failures--
+		r.mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	r.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case path == "" || path == "/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(path, "/blobs/uploads/"):
+		r.serveUpload(w, req, path)
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(w, req, path[i+len("/blobs/"):])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repository, reference string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if !r.manifestKnown(repository, reference) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		stored := r.lookupManifest(repository, reference)
+		w.Header().Set("Content-Type", stored.mediaType)
+		w.Header().Set("Docker-Content-Digest", digestOf(stored.body))
+		w.Header().Set("Content-Length", fmt.Sprint(len(stored.body)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(stored.body)
+		}
+	case http.MethodPut:
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !r.referencesPresent(repository, body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tag := reference
+		if strings.HasPrefix(reference, "sha256:") {
+			if digestOf(body) != reference {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			tag = ""
+		}
+		digest := r.putManifest(repository, tag, req.Header.Get("Content-Type"), body)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, digest string) {
+	r.mu.Lock()
+	blob, ok := r.blobs[digest]
+	r.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(blob)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(blob)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, path string) {
+	i := strings.Index(path, "/blobs/uploads/")
+	repository := path[:i]
+	switch req.Method {
+	case http.MethodPost:
+		r.mu.Lock()
+		r.uploads++
+		id := r.uploads
+		r.mu.Unlock()
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, id))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		r.mu.Lock()
+		want := r.uploadAuth
+		r.mu.Unlock()
+		if user, pass, _ := req.BasicAuth(); want[0] != "" && (user != want[0] || pass != want[1]) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="uploads"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if err != nil || digest != digestOf(body) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.putBlob(body)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// referencesPresent rejects manifests pushed before the content they reference, as real registries do.
+func (r *Registry) referencesPresent(repository string, body []byte) bool {
+	var m struct {
+		Config    *struct{ Digest string }  `json:"config"`
+		Layers    []struct{ Digest string } `json:"layers"`
+		Manifests []struct{ Digest string } `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if m.Config != nil {
+		if _, ok := r.blobs[m.Config.Digest]; !ok {
+			return false
+		}
+	}
+	for _, layer := range m.Layers {
+		if _, ok := r.blobs[layer.Digest]; !ok {
+			return false
+		}
+	}
+	for _, child := range m.Manifests {
+		if _, ok := r.manifests[repository+"@"+child.Digest]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type blobInfo struct {
+	digest string
+	size   int
+}
+
+func (r *Registry) putBlob(content []byte) blobInfo {
+	digest := digestOf(content)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.blobs[digest] = content
+	return blobInfo{digest: digest, size: len(content)}
+}
+
+// putManifest stores a manifest by digest and, when tag is set, by tag.
+func (r *Registry) putManifest(repository, tag, mediaType string, body []byte) string {
+	digest := digestOf(body)
+	stored := storedManifest{mediaType: mediaType, body: body}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.manifests[repository+"@"+digest] = stored
+	if tag != "" {
+		r.manifests[repository+"@"+tag] = stored
+	}
+	return digest
+}
+
+func (r *Registry) manifestKnown(repository, reference string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.manifests[repository+"@"+reference]
+	return ok
+}
+
+func (r *Registry) lookupManifest(repository, reference string) storedManifest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.manifests[repository+"@"+reference]
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -4,10 +4,10 @@ package registry
 import (
 	"errors"
 	"fmt"
-	"strings"
 )
 
-// RewriteImage takes an original container image reference and rewrites it to use the target registry
+// RewriteImage takes an original container image reference and rewrites it to use the target registry.
+// The target is normalized as by NormalizeTarget.
 func RewriteImage(originalImage string, targetRegistry string) (string, error) {
 	// Validate inputs
 	if originalImage == "" {
@@ -16,23 +16,22 @@ func RewriteImage(originalImage string, targetRegistry string) (string, error) {
 	if targetRegistry == "" {
 		return "", errors.New("target registry cannot be empty")
 	}
-
-	image := originalImage
-
-	// Strip existing registry if present
-	// A registry is present if there's a "/" and the part before it contains a "." or ":"
-	if strings.Contains(image, "/") {
-		parts := strings.SplitN(image, "/", 2)
-		if strings.Contains(parts[0], ".") || strings.Contains(parts[0], ":") {
-			// First part is a registry, strip it
-			image = parts[1]
-		}
+	ref, err := ParseReference(originalImage)
+	if err != nil {
+		return "", err
 	}
+	target, err := NormalizeTarget(targetRegistry)
+	if err != nil {
+		return "", fmt.Errorf("invalid target registry %q: %w", targetRegistry, err)
+	}
+
+	// Strip the existing registry, if any
+	ref.Registry = ""
 
 	// If the image doesn't have a tag or digest, add :latest
-	if !strings.Contains(image, ":") && !strings.Contains(image, "@") {
-		image = image + ":latest"
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
 	}
 
-	return fmt.Sprintf("%s/%s", targetRegistry, image), nil
+	return fmt.Sprintf("%s/%s", target, ref), nil
 }
@@ -0,0 +1,150 @@
+// PURPOSE: Ordered regular expression rules mapping whole image references to their mirror location
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// RewriteRule rewrites the images whose canonical reference matches a regular expression. Rules are
+// compiled and checked against their tests when configuration is read, so a bad rule never reaches
+// admission.
+type RewriteRule struct {
+	// Match is an RE2 expression that must match the whole canonical reference, such as
+	// docker.io/library/nginx:latest.
+	Match string `json:"match"`
+	// Replace is the rewritten image, referring to capture groups as $1 or ${name}.
+	Replace string `json:"replace,omitempty"`
+	// Keep leaves the images the rule matches as they are, rather than rewriting them. Keep rules have
+	// no Replace, and a matching test wants the image itself.
+	Keep bool `json:"keep,omitempty"`
+	// Tests are example images and the image each must be rewritten to, or an empty want for an
+	// image the rule must not match. At least one is required.
+	Tests []RuleTest `json:"tests"`
+
+	re *regexp.Regexp
+}
+
+// RuleTest is an example image of a rule and its expected rewrite.
+type RuleTest struct {
+	Image string `json:"image"`
+	// Want is the rewritten image, or empty when the rule must not match.
+	Want string `json:"want,omitempty"`
+}
+
+// rewriteRuleFields has the fields of RewriteRule, decoded without recursing into UnmarshalJSON.
+type rewriteRuleFields struct {
+	Match   string     `json:"match"`
+	Replace string     `json:"replace"`
+	Keep    bool       `json:"keep"`
+	Tests   []RuleTest `json:"tests"`
+}
+
+// CompileRewriteRule compiles a rule and runs its tests.
+func CompileRewriteRule(match, replace string, tests ...RuleTest) (RewriteRule, error) {
+	return compileRule(RewriteRule{Match: match, Replace: replace, Tests: tests})
+}
+
+// CompileKeepRule compiles a rule keeping the images it matches and runs its tests.
+func CompileKeepRule(match string, tests ...RuleTest) (RewriteRule, error) {
+	return compileRule(RewriteRule{Match: match, Keep: true, Tests: tests})
+}
+
+func compileRule(rule RewriteRule) (RewriteRule, error) {
+	match, tests := rule.Match, rule.Tests
+	if match == "" {
+		return RewriteRule{}, errors.New("rewrite rule has no match expression")
+	}
+	if rule.Keep && rule.Replace != "" {
+		return RewriteRule{}, fmt.Errorf("rewrite rule %q keeps images and cannot have a replacement", match)
+	}
+	re, err := regexp.Compile(`^(?:` + match + `)$`)
+	if err != nil {
+		return RewriteRule{}, fmt.Errorf("rewrite rule %q: %w", match, err)
+	}
+	rule.re = re
+
+	if len(tests) == 0 {
+		return RewriteRule{}, fmt.Errorf("rewrite rule %q has no tests", match)
+	}
+	for _, test := range tests {
+		got, ok, err := rule.Apply(test.Image)
+		switch {
+		case err != nil:
+			return RewriteRule{}, fmt.Errorf("rewrite rule %q: test %s: %w", match, test.Image, err)
+		case !ok && test.Want != "":
+			return RewriteRule{}, fmt.Errorf("rewrite rule %q: test %s: does not match, want %s",
+				match, test.Image, test.Want)
+		case ok && got != test.Want:
+			if test.Want == "" {
+				return RewriteRule{}, fmt.Errorf("rewrite rule %q: test %s: rewritten to %s, want no match",
+					match, test.Image, got)
+			}
+			return RewriteRule{}, fmt.Errorf("rewrite rule %q: test %s: rewritten to %s, want %s",
+				match, test.Image, got, test.Want)
+		}
+	}
+	return rule, nil
+}
+
+// Apply rewrites image when the rule matches its canonical reference. The result must be a valid
+// reference naming a registry. A keep rule returns image itself.
+func (r RewriteRule) Apply(image string) (string, bool, error) {
+	if r.re == nil {
+		return "", false, fmt.Errorf("rewrite rule %q is not compiled", r.Match)
+	}
+	canonical := CanonicalImage(image)
+	match := r.re.FindStringSubmatchIndex(canonical)
+	if match == nil {
+		return "", false, nil
+	}
+	if r.Keep {
+		return image, true, nil
+	}
+	rewritten := string(r.re.ExpandString(nil, r.Replace, canonical, match))
+	ref, err := ParseReference(rewritten)
+	if err != nil {
+		return "", false, err
+	}
+	if ref.Registry == "" {
+		return "", false, fmt.Errorf("rewritten image %s names no registry", rewritten)
+	}
+	return rewritten, true, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler, compiling the rule and running its tests.
+func (r *RewriteRule) UnmarshalJSON(data []byte) error {
+	var fields rewriteRuleFields
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+	rule, err := compileRule(RewriteRule{Match: fields.Match, Replace: fields.Replace, Keep: fields.Keep,
+		Tests: fields.Tests})
+	if err != nil {
+		return err
+	}
+	*r = rule
+	return nil
+}
+
+// RewriteRules are tried in order; the first match decides.
+type RewriteRules []RewriteRule
+
+// Apply returns the rewrite of the first rule matching image and the rule's index.
+func (rules RewriteRules) Apply(image string) (string, int, bool, error) {
+	for i, rule := range rules {
+		rewritten, ok, err := rule.Apply(image)
+		if err != nil {
+			return "", i, false, err
+		}
+		if ok {
+			return rewritten, i, true, nil
+		}
+	}
+	return "", -1, false, nil
+}
@@ -0,0 +1,129 @@
+// PURPOSE: Unit tests for compiling, checking and applying regular expression rewrite rules
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+const testQuayRule = `quay\.io/org/([^:@]+)(.*)`
+
+func TestRewriteRule_Apply(t *testing.T) {
+	rule, err := CompileRewriteRule(testQuayRule, "mirror.corp.io/quay-org-$1$2",
+		RuleTest{Image: "quay.io/org/x:1.0", Want: "mirror.corp.io/quay-org-x:1.0"},
+		RuleTest{Image: "quay.io/other/x:1.0"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	tests := map[string]string{
+		"quay.io/org/x":                    "mirror.corp.io/quay-org-x:latest",
+		"quay.io/org/x@sha256:abc":         "mirror.corp.io/quay-org-x@sha256:abc",
+		"quay.io/org/a/b:v2":               "mirror.corp.io/quay-org-a/b:v2",
+		"nginx":                            "",
+		"mirror.corp.io/quay.io/org/x:1.0": "",
+	}
+	for image, want := range tests {
+		got, ok, err := rule.Apply(image)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, got: %v", image, err)
+		}
+		if ok != (want != "") || got != want {
+			t.Errorf("Expected %s to be rewritten to %q, got %q, %t", image, want, got, ok)
+		}
+	}
+}
+
+func TestCompileRewriteRule_RejectsBadRules(t *testing.T) {
+	good := RuleTest{Image: "quay.io/org/x:1", Want: "mirror.corp.io/quay-org-x:1"}
+	tests := []struct {
+		name    string
+		match   string
+		replace string
+		tests   []RuleTest
+		want    string
+	}{
+		{"backreference", `quay\.io/(org)/\1`, "mirror.corp.io/$1", []RuleTest{good}, "invalid escape sequence"},
+		{"lookahead", `quay\.io/(?!org).*`, "mirror.corp.io/x", []RuleTest{good}, "invalid or unsupported Perl syntax"},
+		{"no tests", testQuayRule, "mirror.corp.io/quay-org-$1$2", nil, "has no tests"},
+		{"wrong rewrite", testQuayRule, "mirror.corp.io/$1$2", []RuleTest{good}, "rewritten to mirror.corp.io/x:1, want"},
+		{"no match", `gcr\.io/.*`, "mirror.corp.io/x", []RuleTest{good}, "does not match"},
+		{"unwanted match", testQuayRule, "mirror.corp.io/quay-org-$1$2",
+			[]RuleTest{{Image: "quay.io/org/y:1"}}, "want no match"},
+		{"no registry", testQuayRule, "quay-org-$1$2", []RuleTest{{Image: "quay.io/org/x:1", Want: "quay-org-x:1"}},
+			"names no registry"},
+		{"invalid reference", testQuayRule, "mirror.corp.io/Quay/$1$2",
+			[]RuleTest{{Image: "quay.io/org/x:1", Want: "mirror.corp.io/Quay/x:1"}}, "invalid image reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileRewriteRule(tt.match, tt.replace, tt.tests...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected an error containing %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestRewriteRules_FirstMatchWins(t *testing.T) {
+	var rules RewriteRules
+	err := yaml.UnmarshalStrict([]byte(`
+- match: 'quay\.io/org/special:(.*)'
+  replace: special.corp.io/special:$1
+  tests: [{image: quay.io/org/special:1, want: special.corp.io/special:1}]
+- match: 'quay\.io/org/([^:@]+)(.*)'
+  replace: mirror.corp.io/quay-org-$1$2
+  tests: [{image: quay.io/org/special:1, want: mirror.corp.io/quay-org-special:1}]
+`), &rules)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	got, index, ok, err := rules.Apply("quay.io/org/special:2")
+	if err != nil || !ok || index != 0 || got != "special.corp.io/special:2" {
+		t.Errorf("Expected the first rule to win, got %s, %d, %t, %v", got, index, ok, err)
+	}
+	got, index, ok, err = rules.Apply("quay.io/org/x:2")
+	if err != nil || !ok || index != 1 || got != "mirror.corp.io/quay-org-x:2" {
+		t.Errorf("Expected the second rule to match, got %s, %d, %t, %v", got, index, ok, err)
+	}
+	if _, index, ok, _ := rules.Apply("gcr.io/x:1"); ok || index != -1 {
+		t.Errorf("Expected no rule to match, got %d", index)
+	}
+}
+
+func TestRewriteRule_DecodingRejectsBadRules(t *testing.T) {
+	for data, want := range map[string]string{
+		"- match: 'a('\n  replace: x.io/a\n  tests: [{image: a}]\n":                        "missing closing )",
+		"- match: 'a'\n  replace: x.io/a\n  test: [{image: a}]\n":                          `unknown field "test"`,
+		"- match: 'quay\\.io/(.*)'\n  replace: m.io/$1\n  tests: [{image: quay.io/x:1}]\n": "want no match",
+	} {
+		var rules RewriteRules
+		if err := yaml.UnmarshalStrict([]byte(data), &rules); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestCompileKeepRule(t *testing.T) {
+	rule, err := CompileKeepRule(`docker\.io/vendor/.*`,
+		RuleTest{Image: "vendor/agent:1.2", Want: "vendor/agent:1.2"},
+		RuleTest{Image: "nginx"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if got, ok, err := rule.Apply("vendor/agent:2.0"); err != nil || !ok || got != "vendor/agent:2.0" {
+		t.Errorf("Expected the image to be kept, got %s, %t, %v", got, ok, err)
+	}
+
+	if _, err := CompileKeepRule(`docker\.io/vendor/.*`, RuleTest{Image: "vendor/agent:1.2", Want: "m.io/agent:1.2"}); err == nil {
+		t.Error("Expected a test wanting a rewrite to fail for a keep rule")
+	}
+	var rules RewriteRules
+	err = yaml.UnmarshalStrict([]byte("- match: '.*'\n  keep: true\n  replace: m.io/x\n  tests: [{image: a}]\n"), &rules)
+	if err == nil || !strings.Contains(err.Error(), "cannot have a replacement") {
+		t.Errorf("Expected a keep rule with a replacement to be rejected, got: %v", err)
+	}
+}
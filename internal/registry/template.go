@@ -0,0 +1,155 @@
+// PURPOSE: Renders rewritten image references from a template over the parsed source reference and target
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// TemplateData are the fields a path template is rendered with.
+type TemplateData struct {
+	// TargetRegistry is the target as configured, which may carry a path prefix.
+	TargetRegistry string
+	// SourceRegistry is the registry of the original image, docker.io when the image names none. It is
+	// lowercase and a port is separated by "_", since ":" cannot appear in a repository path; an IPv6
+	// address loses its brackets and has its colons replaced by "-".
+	SourceRegistry string
+	// Repository is the repository path of the original image, with Docker Hub's implicit library/
+	// namespace made explicit.
+	Repository string
+}
+
+// templateFuncs are the functions available to path templates, taking the piped value last.
+var templateFuncs = template.FuncMap{
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, replacement, s string) string { return strings.ReplaceAll(s, old, replacement) },
+	"lower":      strings.ToLower,
+}
+
+// templateSamples are rendered when a template is parsed. Every result must be a valid reference on
+// its target's registry.
+var templateSamples = []struct{ image, target string }{
+	{"nginx", "mirror.example.com"},
+	{"docker.io/library/nginx:1.25", "mirror.example.com"},
+	{"bitnami/redis:7.2", "mirror.example.com/cache"},
+	{"gcr.io/team/app:v1", "mirror.example.com:5000"},
+	{"ghcr.io/org/group/app@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", "10.0.0.1:5000"},
+	{"[fd00::1]:5000/team/app:v1", "[fd00::2]:5000/mirror"},
+	{"localhost:5000/app:dev", "mirror.example.com/a/b"},
+}
+
+// PathTemplate lays out rewritten images on the target, for mirrors that do not keep the original
+// repository path directly below their host. It renders the name of the rewritten image, for example
+// {{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}; the original tag and digest are appended.
+type PathTemplate struct {
+	text     string
+	template *template.Template
+}
+
+// ParsePathTemplate parses text and checks it by rendering a fixed set of sample images.
+func ParsePathTemplate(text string) (*PathTemplate, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, errors.New("path template must not be empty")
+	}
+	parsed, err := template.New("path").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing path template: %w", err)
+	}
+	t := &PathTemplate{text: text, template: parsed}
+
+	for _, sample := range templateSamples {
+		rendered, err := t.Rewrite(sample.image, sample.target)
+		if err != nil {
+			return nil, fmt.Errorf("path template %q: rendering %s for target %s: %w",
+				text, sample.image, sample.target, err)
+		}
+		ref, err := ParseReference(rendered)
+		if err != nil {
+			return nil, fmt.Errorf("path template %q renders %s for target %s: %w",
+				text, rendered, sample.target, err)
+		}
+		if ref.Registry != TargetHost(sample.target) {
+			return nil, fmt.Errorf("path template %q renders %s for target %s, which is not on registry %s",
+				text, rendered, sample.target, TargetHost(sample.target))
+		}
+	}
+	return t, nil
+}
+
+// String returns the template text.
+func (t *PathTemplate) String() string {
+	return t.text
+}
+
+// Rewrite returns image rewritten to target with the template's layout. A nil template uses the
+// layout of RewriteImage. The target is normalized as by NormalizeTarget, and an image already below
+// it is returned unchanged.
+func (t *PathTemplate) Rewrite(image, target string) (string, error) {
+	if t == nil {
+		return RewriteImage(image, target)
+	}
+	if target == "" {
+		return "", errors.New("target registry cannot be empty")
+	}
+	ref, err := ParseReference(image)
+	if err != nil {
+		return "", err
+	}
+	normalized, err := NormalizeTarget(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid target registry %q: %w", target, err)
+	}
+	target = normalized
+	if ref.Registry != "" && strings.HasPrefix(ref.Registry+"/"+ref.Repository, target+"/") {
+		return image, nil
+	}
+
+	source := canonicalReference(ref)
+	var name strings.Builder
+	if err := t.template.Execute(&name, TemplateData{
+		TargetRegistry: target,
+		SourceRegistry: sourcePathComponent(source.Registry),
+		Repository:     source.Repository,
+	}); err != nil {
+		return "", err
+	}
+
+	rewritten := Reference{Repository: name.String(), Tag: ref.Tag, Digest: ref.Digest}
+	if rewritten.Tag == "" && rewritten.Digest == "" {
+		rewritten.Tag = "latest"
+	}
+	return rewritten.String(), nil
+}
+
+// sourcePathComponent spells a registry host as a repository path component.
+func sourcePathComponent(host string) string {
+	name, port, err := splitHostPort(strings.ToLower(host))
+	if err != nil {
+		return strings.ReplaceAll(strings.ToLower(host), ":", "_")
+	}
+	if strings.HasPrefix(name, "[") {
+		name = strings.Trim(strings.ReplaceAll(strings.Trim(name, "[]"), ":", "-"), "-")
+	}
+	if port != "" {
+		name += "_" + port
+	}
+	return name
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t *PathTemplate) MarshalText() ([]byte, error) {
+	return []byte(t.text), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, so templates are checked when configuration is read.
+func (t *PathTemplate) UnmarshalText(text []byte) error {
+	parsed, err := ParsePathTemplate(string(text))
+	if err != nil {
+		return err
+	}
+	*t = *parsed
+	return nil
+}
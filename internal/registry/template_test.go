@@ -0,0 +1,100 @@
+// PURPOSE: Unit tests for laying out rewritten images with path templates
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPathTemplate_Rewrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		image    string
+		target   string
+		want     string
+	}{
+		{
+			name:     "source registry kept",
+			template: "{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}",
+			image:    "gcr.io/team/app:v1",
+			target:   "mirror.corp.io",
+			want:     "mirror.corp.io/gcr.io/team/app:v1",
+		},
+		{
+			name:     "docker hub made explicit",
+			template: "{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}",
+			image:    "nginx",
+			target:   "mirror.corp.io",
+			want:     "mirror.corp.io/docker.io/library/nginx:latest",
+		},
+		{
+			name:     "library stripped",
+			template: `{{.TargetRegistry}}/{{.Repository | trimPrefix "library/"}}`,
+			image:    "docker.io/library/nginx:1.25",
+			target:   "mirror.corp.io",
+			want:     "mirror.corp.io/nginx:1.25",
+		},
+		{
+			name:     "prefix added and digest kept",
+			template: `{{.TargetRegistry}}/proxy/{{.SourceRegistry | replace "." "-"}}/{{.Repository}}`,
+			image:    "ghcr.io/org/app:v2@sha256:abc",
+			target:   "harbor.corp.io:8443",
+			want:     "harbor.corp.io:8443/proxy/ghcr-io/org/app:v2@sha256:abc",
+		},
+		{
+			name:     "source port",
+			template: "{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}",
+			image:    "registry.corp.io:5000/app:v1",
+			target:   "mirror.corp.io",
+			want:     "mirror.corp.io/registry.corp.io_5000/app:v1",
+		},
+		{
+			name:     "already on target",
+			template: "{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}",
+			image:    "mirror.corp.io/docker.io/library/nginx:1.25",
+			target:   "mirror.corp.io",
+			want:     "mirror.corp.io/docker.io/library/nginx:1.25",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := ParsePathTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			got, err := layout.Rewrite(tt.image, tt.target)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPathTemplate_NilUsesRewriteImage(t *testing.T) {
+	var layout *PathTemplate
+	got, err := layout.Rewrite("gcr.io/team/app:v1", testTargetRegistry)
+	if err != nil || got != "target-registry.com/team/app:v1" {
+		t.Errorf("Expected the RewriteImage layout, got %s, %v", got, err)
+	}
+}
+
+func TestParsePathTemplate_RejectsBadTemplates(t *testing.T) {
+	tests := map[string]string{
+		"":                                     "must not be empty",
+		"{{.TargetRegistry}/{{.Repository}}":   "parsing path template",
+		"{{.TargetRegistry}}/{{.Image}}":       "can't evaluate field Image",
+		"{{.Repository}}":                      "is not on registry",
+		"mirror.corp.io/{{.Repository}}":       "is not on registry mirror.example.com",
+		"{{.TargetRegistry}}//{{.Repository}}": `repository component ""`,
+		"{{.TargetRegistry}}/{{.SourceRegistry | lower}}:{{.Repository}}": "invalid image reference",
+	}
+	for text, want := range tests {
+		if _, err := ParsePathTemplate(text); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q to be rejected with %q, got: %v", text, want, err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// PURPOSE: Checks whether an image manifest exists on a registry using the OCI distribution API
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrCircuitOpen is returned when a registry has failed too often recently to be queried.
+var ErrCircuitOpen = errors.New("registry circuit breaker is open")
+
+// manifestAcceptHeader lists the manifest media types a registry may answer with.
+var manifestAcceptHeader = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+// ManifestVerifier reports whether an image reference resolves on its registry.
+type ManifestVerifier interface {
+	ManifestExists(ctx context.Context, image string) (bool, error)
+}
+
+// VerifierOptions configures a Verifier. Zero values are replaced by the defaults below.
+type VerifierOptions struct {
+	// Client is used for registry requests. Defaults to a client with Timeout.
+	Client *http.Client
+	// Timeout bounds a single manifest request.
+	Timeout time.Duration
+	// CacheSize is the number of results remembered.
+	CacheSize int
+	// PositiveTTL is how long an existing manifest is remembered.
+	PositiveTTL time.Duration
+	// NegativeTTL is how long a missing manifest is remembered.
+	NegativeTTL time.Duration
+	// FailureThreshold is the number of consecutive failures that opens a registry's breaker.
+	FailureThreshold int
+	// OpenDuration is how long a breaker stays open before a trial request is allowed.
+	OpenDuration time.Duration
+	// CredentialKey identifies the credentials a request to a registry host made with ctx carries.
+	// Results are cached per image and key, so what one pod's pull secrets could see is never
+	// reported to a pod without them. Without it, results are shared by every caller.
+	CredentialKey func(ctx context.Context, host string) string
+}
+
+// DefaultVerifyTimeout bounds a single manifest request when VerifierOptions.Timeout is unset.
+const DefaultVerifyTimeout = 400 * time.Millisecond
+
+const (
+	defaultCacheSize        = 4096
+	defaultPositiveTTL      = 10 * time.Minute
+	defaultNegativeTTL      = 30 * time.Second
+	defaultFailureThreshold = 5
+	defaultOpenDuration     = 30 * time.Second
+)
+
+// Verifier issues manifest HEAD requests, caching results and tripping a circuit breaker
+// per registry host. It also reads the platforms of an image for PlatformVerifier.
+type Verifier struct {
+	client      *http.Client
+	cache       *lruCache[bool]
+	platforms   *lruCache[platformResult]
+	breakers    *breakerSet
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	credential  func(ctx context.Context, host string) string
+}
+
+var _ PlatformVerifier = &Verifier{}
+
+// NewVerifier builds a Verifier from opts.
+func NewVerifier(opts VerifierOptions) *Verifier {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultVerifyTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: opts.Timeout}
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = defaultCacheSize
+	}
+	if opts.PositiveTTL <= 0 {
+		opts.PositiveTTL = defaultPositiveTTL
+	}
+	if opts.NegativeTTL <= 0 {
+		opts.NegativeTTL = defaultNegativeTTL
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultFailureThreshold
+	}
+	if opts.OpenDuration <= 0 {
+		opts.OpenDuration = defaultOpenDuration
+	}
+
+	return &Verifier{
+		client:      opts.Client,
+		cache:       newLRUCache[bool](opts.CacheSize),
+		platforms:   newLRUCache[platformResult](opts.CacheSize),
+		breakers:    newBreakerSet(opts.FailureThreshold, opts.OpenDuration),
+		positiveTTL: opts.PositiveTTL,
+		negativeTTL: opts.NegativeTTL,
+		credential:  opts.CredentialKey,
+	}
+}
+
+// cacheKey scopes image to the credentials ctx carries for ref's registry.
+func (v *Verifier) cacheKey(ctx context.Context, image string, ref Reference) string {
+	if v.credential == nil {
+		return image
+	}
+	return image + "|" + v.credential(ctx, apiHost(ref.Registry))
+}
+
+// ManifestExists returns true when the registry answers the manifest HEAD with 200 and false on 404.
+// Any other outcome is returned as an error and counts against the registry's breaker, unless ctx
+// was cancelled or expired first.
+func (v *Verifier) ManifestExists(ctx context.Context, image string) (bool, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return false, err
+	}
+	if ref.Registry == "" {
+		return false, fmt.Errorf("image %q does not name a registry", image)
+	}
+
+	key := v.cacheKey(ctx, image, ref)
+	if exists, ok := v.cache.Get(key); ok {
+		return exists, nil
+	}
+
+	breaker := v.breakers.For(ref.Registry)
+	if !breaker.Allow() {
+		return false, fmt.Errorf("%w: %s", ErrCircuitOpen, ref.Registry)
+	}
+
+	exists, err := v.headManifest(ctx, ref)
+	if err != nil {
+		recordFailure(ctx, breaker)
+		return false, err
+	}
+	breaker.Success()
+
+	if exists {
+		v.cache.Add(key, true, v.positiveTTL)
+	} else {
+		v.cache.Add(key, false, v.negativeTTL)
+	}
+	return exists, nil
+}
+
+func (v *Verifier) headManifest(ctx context.Context, ref Reference) (bool, error) {
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", apiHost(ref.Registry), ref.Repository, ref.Identifier())
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", manifestAcceptHeader)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	_ = resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("manifest HEAD %s returned %s", url, resp.Status)
+	}
+}
+
+// apiHost maps registry names to the host serving their distribution API.
+func apiHost(registry string) string {
+	if registry == "docker.io" || registry == "index.docker.io" {
+		return "registry-1.docker.io"
+	}
+	return registry
+}
@@ -0,0 +1,235 @@
+// PURPOSE: Test suite for manifest existence checks, result caching and the per-registry circuit breaker
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRegistry starts a TLS registry stand-in that knows the given "repository:reference" manifests.
+func newTestRegistry(t *testing.T, manifests ...string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	known := map[string]bool{}
+	for _, m := range manifests {
+		known[m] = true
+	}
+
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		i := strings.LastIndex(path, "/manifests/")
+		if r.Method != http.MethodHead || i < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if known[path[:i]+":"+path[i+len("/manifests/"):]] {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func serverHost(server *httptest.Server) string {
+	return strings.TrimPrefix(server.URL, "https://")
+}
+
+func TestVerifier_ManifestExists(t *testing.T) {
+	server, _ := newTestRegistry(t, "library/nginx:1.25")
+	verifier := NewVerifier(VerifierOptions{Client: server.Client()})
+	host := serverHost(server)
+
+	exists, err := verifier.ManifestExists(context.Background(), host+"/library/nginx:1.25")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exists {
+		t.Error("expected manifest to exist")
+	}
+
+	exists, err = verifier.ManifestExists(context.Background(), host+"/library/nginx:missing")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists {
+		t.Error("expected manifest to be missing")
+	}
+}
+
+func TestVerifier_CachesPositiveAndNegativeResults(t *testing.T) {
+	server, requests := newTestRegistry(t, "app:v1")
+	verifier := NewVerifier(VerifierOptions{Client: server.Client()})
+	host := serverHost(server)
+
+	for range 3 {
+		_, _ = verifier.ManifestExists(context.Background(), host+"/app:v1")
+		_, _ = verifier.ManifestExists(context.Background(), host+"/app:v2")
+	}
+
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expected 2 registry requests, got %d", got)
+	}
+}
+
+func TestVerifier_CachesPerCredential(t *testing.T) {
+	server, requests := newTestRegistry(t, "app:v1")
+	type credentialKey struct{}
+	verifier := NewVerifier(VerifierOptions{
+		Client: server.Client(),
+		CredentialKey: func(ctx context.Context, _ string) string {
+			key, _ := ctx.Value(credentialKey{}).(string)
+			return key
+		},
+	})
+	image := serverHost(server) + "/app:v1"
+
+	podA := context.WithValue(context.Background(), credentialKey{}, "a")
+	podB := context.WithValue(context.Background(), credentialKey{}, "b")
+	for _, ctx := range []context.Context{podA, podA, podB} {
+		_, _ = verifier.ManifestExists(ctx, image)
+	}
+
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expected a registry request per credential, got %d", got)
+	}
+}
+
+func TestVerifier_CircuitBreakerOpensAfterFailures(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	verifier := NewVerifier(VerifierOptions{Client: server.Client(), FailureThreshold: 2, OpenDuration: time.Hour})
+	image := serverHost(server) + "/app:v1"
+
+	for range 2 {
+		if _, err := verifier.ManifestExists(context.Background(), image); err == nil {
+			t.Fatal("expected an error from an unavailable registry")
+		}
+	}
+
+	_, err := verifier.ManifestExists(context.Background(), image)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("expected the open breaker to stop requests, got %d requests", got)
+	}
+}
+
+func TestVerifier_CancelledCallerDoesNotOpenBreaker(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	verifier := NewVerifier(VerifierOptions{Client: server.Client(), FailureThreshold: 1, OpenDuration: time.Hour})
+	image := serverHost(server) + "/app:v1"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := verifier.ManifestExists(ctx, image); err == nil {
+		t.Fatal("expected an error once the caller's budget ran out")
+	}
+
+	if !verifier.breakers.For(serverHost(server)).Allow() {
+		t.Error("expected the caller's deadline not to open the registry's breaker")
+	}
+}
+
+func TestVerifier_RequiresRegistry(t *testing.T) {
+	verifier := NewVerifier(VerifierOptions{})
+
+	if _, err := verifier.ManifestExists(context.Background(), "nginx:latest"); err == nil {
+		t.Error("expected an error for an image without a registry")
+	}
+}
+
+func TestLRUCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLRUCache[bool](2)
+	cache.Add("a", true, time.Minute)
+	cache.Add("b", true, time.Minute)
+	cache.Get("a")
+	cache.Add("c", false, time.Minute)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Error("expected b to be evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Error("expected a to be retained")
+	}
+	if value, ok := cache.Get("c"); !ok || value {
+		t.Errorf("expected c to be cached as false, got %v, %v", value, ok)
+	}
+}
+
+func TestLRUCache_ExpiresEntries(t *testing.T) {
+	now := time.Now()
+	cache := newLRUCache[bool](2)
+	cache.now = func() time.Time { return now }
+	cache.Add("a", true, time.Second)
+
+	now = now.Add(2 * time.Second)
+	if _, ok := cache.Get("a"); ok {
+		t.Error("expected entry to expire")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenTrial(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(1, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	breaker.Failure()
+	if breaker.Allow() {
+		t.Fatal("expected breaker to be open")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !breaker.Allow() {
+		t.Fatal("expected a trial request after the cooldown")
+	}
+	if breaker.Allow() {
+		t.Error("expected only one trial request while half-open")
+	}
+
+	breaker.Success()
+	if !breaker.Allow() {
+		t.Error("expected breaker to close after a successful trial")
+	}
+}
+
+func TestCircuitBreaker_AbandonedTrialIsRetried(t *testing.T) {
+	now := time.Now()
+	breaker := newCircuitBreaker(1, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	breaker.Failure()
+	now = now.Add(2 * time.Minute)
+	if !breaker.Allow() {
+		t.Fatal("expected a trial request after the cooldown")
+	}
+
+	breaker.Abandon()
+	if !breaker.Allow() {
+		t.Error("expected an abandoned trial to let the next request through")
+	}
+}
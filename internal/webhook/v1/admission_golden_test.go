@@ -0,0 +1,147 @@
+// PURPOSE: Golden-file tests sending raw AdmissionReview fixtures through the webhook's HTTP handler
+package v1
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+var update = flag.Bool("update", false, "regenerate the testdata/*.response.json golden files")
+
+// goldenResponse is the part of an AdmissionReview response compared with a golden file. The patch is
+// decoded and sorted so the files are readable and independent of operation order.
+type goldenResponse struct {
+	HTTPStatus int              `json:"httpStatus"`
+	Allowed    bool             `json:"allowed"`
+	PatchType  string           `json:"patchType,omitempty"`
+	Patch      []map[string]any `json:"patch,omitempty"`
+	Warnings   []string         `json:"warnings,omitempty"`
+	Status     *goldenStatus    `json:"status,omitempty"`
+}
+
+type goldenStatus struct {
+	Code    int32  `json:"code,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// newGoldenHandler returns the admission handler the manager registers, for a defaulter that reads
+// the namespaces of testdata/namespaces.yaml. In verified namespaces only the images listed below exist.
+func newGoldenHandler(t *testing.T) http.Handler {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "namespaces.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to read namespaces: %v", err)
+	}
+	namespaces := &corev1.NamespaceList{}
+	if err := yaml.UnmarshalStrict(data, namespaces); err != nil {
+		t.Fatalf("Failed to parse namespaces: %v", err)
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	builder := fake.NewClientBuilder().WithScheme(scheme)
+	for i := range namespaces.Items {
+		builder = builder.WithObjects(&namespaces.Items[i])
+	}
+	defaulter := &PodCustomDefaulter{
+		Client: builder.Build(),
+		Rewriter: &registry.Rewriter{Verifier: knownImageVerifier{
+			"eu.mirror.io/nginx:1.25":    true,
+			"global.mirror.io/redis:7.2": true,
+		}},
+	}
+	return admission.WithCustomDefaulter(scheme, &corev1.Pod{}, defaulter)
+}
+
+// review posts a raw AdmissionReview to handler and returns the compared part of the response.
+func review(t *testing.T, handler http.Handler, body []byte) goldenResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/mutate--v1-pod", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+
+	got := goldenResponse{HTTPStatus: recorder.Code}
+	var response admissionv1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Response == nil {
+		t.Fatalf("Expected an AdmissionReview response, got %q: %v", recorder.Body.String(), err)
+	}
+	got.Allowed = response.Response.Allowed
+	got.Warnings = response.Response.Warnings
+	if response.Response.PatchType != nil {
+		got.PatchType = string(*response.Response.PatchType)
+	}
+	if len(response.Response.Patch) > 0 {
+		if err := json.Unmarshal(response.Response.Patch, &got.Patch); err != nil {
+			t.Fatalf("Expected a JSON patch, got %q: %v", response.Response.Patch, err)
+		}
+		slices.SortFunc(got.Patch, func(a, b map[string]any) int {
+			return cmp.Or(cmp.Compare(a["path"].(string), b["path"].(string)),
+				cmp.Compare(a["op"].(string), b["op"].(string)))
+		})
+	}
+	if result := response.Response.Result; result != nil {
+		got.Status = &goldenStatus{Code: result.Code, Reason: string(result.Reason), Message: result.Message}
+	}
+	return got
+}
+
+// TestAdmissionGolden sends each testdata/*.request.json through the webhook's HTTP handler and
+// compares the response with the matching *.response.json. Run with -update to regenerate them.
+func TestAdmissionGolden(t *testing.T) {
+	requests, err := filepath.Glob(filepath.Join("testdata", "*.request.json"))
+	if err != nil || len(requests) == 0 {
+		t.Fatalf("Expected request fixtures in testdata, got %v: %v", requests, err)
+	}
+	handler := newGoldenHandler(t)
+
+	for _, requestFile := range requests {
+		name := strings.TrimSuffix(filepath.Base(requestFile), ".request.json")
+		t.Run(name, func(t *testing.T) {
+			body, err := os.ReadFile(requestFile)
+			if err != nil {
+				t.Fatalf("Failed to read request: %v", err)
+			}
+			got, err := json.MarshalIndent(review(t, handler, body), "", "  ")
+			if err != nil {
+				t.Fatalf("Failed to encode response: %v", err)
+			}
+			got = append(got, '\n')
+
+			responseFile := strings.TrimSuffix(requestFile, ".request.json") + ".response.json"
+			if *update {
+				if err := os.WriteFile(responseFile, got, 0o644); err != nil {
+					t.Fatalf("Failed to write golden file: %v", err)
+				}
+				return
+			}
+			want, err := os.ReadFile(responseFile)
+			if err != nil {
+				t.Fatalf("Failed to read golden file, run with -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Response differs from %s, run with -update if the change is intended:\ngot:\n%s\nwant:\n%s",
+					responseFile, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// PURPOSE: Records the audit trail for image rewrite decisions (NFR-012)
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// AuditRecord is one image rewrite decision as written to audit sinks.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Container string    `json:"container"`
+	Original  string    `json:"originalImage"`
+	Rewritten string    `json:"rewrittenImage,omitempty"`
+	Target    string    `json:"targetRegistry,omitempty"`
+	// Result is rewritten, kept_original, dry_run, skipped or error, as in image_rewrites_total.
+	Result   string `json:"result"`
+	Fallback bool   `json:"fallback,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// AuditSink receives every audited decision in addition to the log. Write must be safe for concurrent use.
+type AuditSink interface {
+	Write(record AuditRecord)
+}
+
+// auditSinks holds the configured sinks, swapped as a whole on reload.
+var auditSinks atomic.Pointer[[]AuditSink]
+
+// SetAuditSinks replaces the sinks that receive audited decisions. Decisions are always logged.
+func SetAuditSinks(sinks ...AuditSink) {
+	auditSinks.Store(&sinks)
+}
+
+// JSONAuditSink writes each record as a line of JSON.
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns a sink writing JSON lines to w.
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// Write appends record to the sink. Records that cannot be written are logged and dropped, so audit
+// sinks never fail admission.
+func (s *JSONAuditSink) Write(record AuditRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		podlog.Error(err, "failed to encode audit record")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		podlog.Error(err, "failed to write audit record")
+	}
+}
+
+// emitAudit records the decision on the image's span and passes record to every configured sink.
+func emitAudit(ctx context.Context, pod *corev1.Pod, containerName, original string, record AuditRecord) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attrResult.String(record.Result))
+	if record.Rewritten != "" {
+		span.SetAttributes(attrRewritten.String(record.Rewritten), attrTarget.String(record.Target))
+	}
+
+	sinks := auditSinks.Load()
+	if sinks == nil {
+		return
+	}
+	record.Time = time.Now().UTC()
+	record.Namespace = pod.Namespace
+	record.Pod = podName(pod)
+	record.Container = containerName
+	record.Original = original
+	for _, sink := range *sinks {
+		sink.Write(record)
+	}
+}
+
+// podName returns the pod name, or its generateName prefix when the API server has not assigned one yet.
+func podName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
+
+// auditOutcome logs the decision for one container image and updates the rewrite metrics. Dry-run
+// decisions are logged and counted separately since the pod is left unchanged.
+func auditOutcome(ctx context.Context, pod *corev1.Pod, containerName, original string, outcome registry.Outcome, dryRun bool) {
+	switch {
+	case dryRun:
+		logFor(ctx).Info("image rewrite dry run",
+			"namespace", pod.Namespace, "pod_name", podName(pod), "container_name", containerName,
+			"original_image", original, "rewritten_image", outcome.Image, "target_registry", outcome.Target,
+			"fallback", outcome.Fallback, "reason", outcome.Reason)
+		imageRewritesTotal.WithLabelValues(pod.Namespace, resultDryRun).Inc()
+		emitAudit(ctx, pod, containerName, original, AuditRecord{Result: resultDryRun, Rewritten: outcome.Image,
+			Target: outcome.Target, Fallback: outcome.Fallback, Reason: outcome.Reason})
+	case outcome.Target != "":
+		logFor(ctx).Info("image rewritten",
+			"namespace", pod.Namespace, "pod_name", podName(pod), "container_name", containerName,
+			"original_image", original, "rewritten_image", outcome.Image, "target_registry", outcome.Target,
+			"fallback", outcome.Fallback)
+		imageRewritesTotal.WithLabelValues(pod.Namespace, resultRewritten).Inc()
+		emitAudit(ctx, pod, containerName, original, AuditRecord{Result: resultRewritten, Rewritten: outcome.Image,
+			Target: outcome.Target, Fallback: outcome.Fallback})
+		if outcome.Fallback {
+			imageRewriteFallbacksTotal.WithLabelValues(pod.Namespace, resultRewritten).Inc()
+		}
+	default:
+		logFor(ctx).Info("image rewrite fell back to original image",
+			"namespace", pod.Namespace, "pod_name", podName(pod), "container_name", containerName,
+			"original_image", original, "reason", outcome.Reason)
+		imageRewritesTotal.WithLabelValues(pod.Namespace, resultKeptOriginal).Inc()
+		imageRewriteFallbacksTotal.WithLabelValues(pod.Namespace, resultKeptOriginal).Inc()
+		emitAudit(ctx, pod, containerName, original, AuditRecord{Result: resultKeptOriginal, Reason: outcome.Reason})
+	}
+}
+
+// auditSkipped logs an image the policy leaves alone.
+func auditSkipped(ctx context.Context, pod *corev1.Pod, containerName, original, reason string) {
+	logFor(ctx).Info("image rewrite skipped",
+		"namespace", pod.Namespace, "pod_name", podName(pod), "container_name", containerName,
+		"original_image", original, "reason", reason)
+	imageRewritesTotal.WithLabelValues(pod.Namespace, resultSkipped).Inc()
+	emitAudit(ctx, pod, containerName, original, AuditRecord{Result: resultSkipped, Reason: reason})
+}
+
+// auditError logs an image that could not be processed.
+func auditError(ctx context.Context, pod *corev1.Pod, containerName, original string, err error) {
+	trace.SpanFromContext(ctx).RecordError(err)
+	logFor(ctx).Error(err, "failed to rewrite image",
+		"namespace", pod.Namespace, "pod_name", podName(pod), "container_name", containerName,
+		"original", original)
+	imageRewritesTotal.WithLabelValues(pod.Namespace, resultError).Inc()
+	emitAudit(ctx, pod, containerName, original, AuditRecord{Result: resultError, Reason: err.Error()})
+}
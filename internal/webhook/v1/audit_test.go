@@ -0,0 +1,41 @@
+// PURPOSE: Unit tests for writing rewrite decisions to audit sinks
+package v1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodDefaulter_WritesAuditSinks(t *testing.T) {
+	var out bytes.Buffer
+	SetAuditSinks(NewJSONAuditSink(&out))
+	t.Cleanup(func() { SetAuditSinks() })
+
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "web-", Namespace: "test-namespace"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: testNginxImage}}},
+	}
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one audit record, got %q", out.String())
+	}
+	var record AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("Expected a JSON line, got: %v", err)
+	}
+	if record.Namespace != "test-namespace" || record.Pod != "web-" || record.Container != "nginx" ||
+		record.Original != testNginxImage || record.Rewritten != testMyRegistryNginx || record.Result != resultRewritten {
+		t.Errorf("Unexpected audit record: %+v", record)
+	}
+}
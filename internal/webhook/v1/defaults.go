@@ -0,0 +1,168 @@
+// PURPOSE: Cluster-wide default rewrite settings, read from a ConfigMap and applied where namespaces set nothing
+package v1
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// DefaultsKey is the ConfigMap data key holding the defaults document.
+const DefaultsKey = "defaults.yaml"
+
+// Failure modes for images that cannot be rewritten, named after the webhook failurePolicy values.
+const (
+	// FailureModeIgnore keeps the original image, the default.
+	FailureModeIgnore = "Ignore"
+	// FailureModeFail rejects the pod.
+	FailureModeFail = "Fail"
+)
+
+// Defaults are the cluster-wide settings for namespaces with rewriting enabled. Namespace annotations
+// take precedence over them.
+type Defaults struct {
+	// TargetRegistries are used by enabled namespaces without a target registry annotation.
+	TargetRegistries []string `json:"targetRegistries,omitempty"`
+	// Verify applies to the default targets. Several targets always verify.
+	Verify bool `json:"verify,omitempty"`
+	// Mappings send the images of a source registry to their own target when the default targets apply.
+	Mappings map[string]string `json:"mappings,omitempty"`
+	// PreserveRegistries are added to the preserved registries of every namespace.
+	PreserveRegistries []string `json:"preserveRegistries,omitempty"`
+	// RewriteLocalRegistries applies to namespaces without the rewrite-local-registries annotation.
+	// Unset, local registries are rewritten.
+	RewriteLocalRegistries *bool `json:"rewriteLocalRegistries,omitempty"`
+	// FailureMode is Ignore or Fail. Defaults to Ignore.
+	FailureMode string `json:"failureMode,omitempty"`
+	// PathTemplate lays out rewritten images on the targets of every namespace. It is checked when
+	// read by rendering sample images.
+	PathTemplate *registry.PathTemplate `json:"pathTemplate,omitempty"`
+	// RewriteRules are tried in order on the images of every namespace before its targets. Each is
+	// compiled and checked against its tests when read.
+	RewriteRules RewriteRules `json:"rewriteRules,omitempty"`
+	// TagPolicy applies to namespaces without the tag-policy annotation. Defaults to default-latest.
+	TagPolicy string `json:"tagPolicy,omitempty"`
+	// ArchitecturePolicy applies to namespaces without the architecture-policy annotation. Defaults
+	// to fallback.
+	ArchitecturePolicy string `json:"architecturePolicy,omitempty"`
+	// Overrides are target entries for some namespaces or source registries, layered over the
+	// defaults and namespace annotations by priority and specificity.
+	Overrides []Override `json:"overrides,omitempty"`
+	// Tenants limits the settings namespaces may make through their annotations and labels. Without
+	// it namespaces may make any.
+	Tenants *TenantPolicy `json:"tenants,omitempty"`
+}
+
+// ParseDefaults reads and validates a defaults document. Unknown fields are rejected. An empty
+// document means no defaults.
+func ParseDefaults(data []byte) (*Defaults, error) {
+	defaults := &Defaults{}
+	if err := yaml.UnmarshalStrict(data, defaults); err != nil {
+		return nil, fmt.Errorf("parsing defaults: %w", err)
+	}
+	if errs := defaults.Validate(nil); len(errs) > 0 {
+		return nil, errs.ToAggregate()
+	}
+	defaults.Normalize()
+	return defaults, nil
+}
+
+// Validate returns the invalid settings, with field paths below fldPath.
+func (d *Defaults) Validate(fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, target := range d.TargetRegistries {
+		if err := validateTarget(target); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("targetRegistries").Index(i), target, err.Error()))
+		}
+	}
+	for _, source := range slices.Sorted(maps.Keys(d.Mappings)) {
+		path := fldPath.Child("mappings").Key(source)
+		if err := registry.ValidateHost(strings.ToLower(source)); err != nil {
+			errs = append(errs, field.Invalid(path, source, "source must be a registry host: "+err.Error()))
+		}
+		if err := validateTarget(d.Mappings[source]); err != nil {
+			errs = append(errs, field.Invalid(path, d.Mappings[source], err.Error()))
+		}
+	}
+	for i, entry := range d.PreserveRegistries {
+		if strings.TrimSpace(entry) == "" {
+			errs = append(errs, field.Required(fldPath.Child("preserveRegistries").Index(i), "must not be empty"))
+		}
+	}
+	if d.FailureMode != "" && d.FailureMode != FailureModeIgnore && d.FailureMode != FailureModeFail {
+		errs = append(errs, field.NotSupported(fldPath.Child("failureMode"), d.FailureMode,
+			[]string{FailureModeIgnore, FailureModeFail}))
+	}
+	if !validTagPolicy(d.TagPolicy) {
+		errs = append(errs, field.NotSupported(fldPath.Child("tagPolicy"), d.TagPolicy, tagPolicies))
+	}
+	if !validArchitecturePolicy(d.ArchitecturePolicy) {
+		errs = append(errs, field.NotSupported(fldPath.Child("architecturePolicy"), d.ArchitecturePolicy,
+			architecturePolicies))
+	}
+	errs = append(errs, validateOverrides(d.Overrides, fldPath.Child("overrides"))...)
+	errs = append(errs, d.Tenants.validate(fldPath.Child("tenants"))...)
+	return errs
+}
+
+// validateTarget rejects targets that RewriteImage would turn into invalid image references.
+func validateTarget(target string) error {
+	_, err := registry.NormalizeTarget(target)
+	return err
+}
+
+// Normalize rewrites the targets, mapping sources and tenant limits in canonical form, as by
+// registry.NormalizeTarget, so they compare equal to the registries of images and pull secrets. Invalid
+// values, which Validate reports, are left as they are.
+func (d *Defaults) Normalize() {
+	d.TargetRegistries = normalizeTargets(d.TargetRegistries)
+	d.Mappings = normalizeMappings(d.Mappings)
+	d.Overrides = normalizeOverrides(d.Overrides)
+	d.Tenants.normalize()
+}
+
+// entries returns the default targets and each mapping as entries of the cluster layer.
+func (d *Defaults) entries() []Override {
+	var entries []Override
+	if len(d.TargetRegistries) > 0 {
+		entries = append(entries, Override{Name: "global defaults", Targets: d.TargetRegistries, Verify: d.Verify})
+	}
+	for _, source := range slices.Sorted(maps.Keys(d.Mappings)) {
+		entries = append(entries, Override{Name: "global defaults mapping " + source, Source: source,
+			Targets: []string{d.Mappings[source]}, Verify: d.Verify || len(d.TargetRegistries) > 1})
+	}
+	return entries
+}
+
+// normalizeTargets returns targets in canonical form, keeping those that cannot be normalized.
+func normalizeTargets(targets []string) []string {
+	normalized := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if canonical, err := registry.NormalizeTarget(target); err == nil {
+			target = canonical
+		}
+		normalized = append(normalized, target)
+	}
+	return normalized
+}
+
+// normalizeMappings returns mappings with lowercase sources and targets in canonical form.
+func normalizeMappings(mappings map[string]string) map[string]string {
+	if mappings == nil {
+		return nil
+	}
+	normalized := make(map[string]string, len(mappings))
+	for source, target := range mappings {
+		if canonical, err := registry.NormalizeTarget(target); err == nil {
+			target = canonical
+		}
+		normalized[strings.ToLower(source)] = target
+	}
+	return normalized
+}
@@ -0,0 +1,295 @@
+// PURPOSE: Unit tests for parsing global defaults and applying them where namespaces set nothing
+package v1
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+func TestParseDefaults(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(`
+targetRegistries: [mirror.corp.io]
+mappings:
+  ghcr.io: ghcr-mirror.corp.io
+preserveRegistries: [registry.k8s.io]
+failureMode: Fail
+pathTemplate: '{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}'
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if defaults.TargetRegistries[0] != "mirror.corp.io" || defaults.Mappings["ghcr.io"] != "ghcr-mirror.corp.io" ||
+		defaults.FailureMode != FailureModeFail || defaults.PathTemplate == nil {
+		t.Errorf("Unexpected defaults: %+v", defaults)
+	}
+
+	defaults, err = ParseDefaults([]byte("targetRegistries: [Mirror.Corp.io/]\nmappings:\n  GHCR.io: '[FD00::1]:5000'\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if defaults.TargetRegistries[0] != "mirror.corp.io" || defaults.Mappings["ghcr.io"] != "[fd00::1]:5000" {
+		t.Errorf("Expected normalized targets and mapping sources, got %+v", defaults)
+	}
+
+	if defaults, err := ParseDefaults(nil); err != nil || len(defaults.TargetRegistries) != 0 {
+		t.Errorf("Expected an empty document to mean no defaults, got %+v, %v", defaults, err)
+	}
+}
+
+func TestParseDefaults_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []string
+	}{
+		{
+			name: "unknown field",
+			data: "targetRegistry: mirror.corp.io\n",
+			want: []string{`unknown field "targetRegistry"`},
+		},
+		{
+			name: "field paths",
+			data: "targetRegistries: [mirror.corp.io, 'https://other.io']\nmappings:\n  ghcr.io: ''\n",
+			want: []string{`targetRegistries[1]: Invalid value: "https://other.io": target must not have a scheme`,
+				`mappings[ghcr.io]: Invalid value: "": target must not be empty`},
+		},
+		{
+			name: "failure mode",
+			data: "failureMode: Reject\n",
+			want: []string{`failureMode: Unsupported value: "Reject"`},
+		},
+		{
+			name: "tag policy",
+			data: "tagPolicy: latest\n",
+			want: []string{`tagPolicy: Unsupported value: "latest"`},
+		},
+		{
+			name: "architecture policy",
+			data: "architecturePolicy: reject\n",
+			want: []string{`architecturePolicy: Unsupported value: "reject"`},
+		},
+		{
+			name: "path template",
+			data: "pathTemplate: '{{.Repository}}'\n",
+			want: []string{`path template "{{.Repository}}" renders`, "which is not on registry"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseDefaults([]byte(tt.data))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error to contain %q, got: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestResolvePolicy_Defaults(t *testing.T) {
+	defaults := &Defaults{
+		TargetRegistries:   []string{"mirror.corp.io"},
+		Mappings:           map[string]string{"ghcr.io": "ghcr-mirror.corp.io"},
+		PreserveRegistries: []string{"registry.k8s.io"},
+		FailureMode:        FailureModeFail,
+	}
+	namespace := func(annotations map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Annotations: annotations}}
+	}
+
+	policy, ok := resolvePolicy(namespace(nil), defaults, nil)
+	if !ok {
+		t.Fatal("Expected the defaults to configure the namespace")
+	}
+	if got := policy.TargetsFor("ghcr.io/org/app:1.0"); !slices.Equal(got, []string{"ghcr-mirror.corp.io"}) {
+		t.Errorf("Expected the mapped target for ghcr.io, got %v", got)
+	}
+	if got := policy.TargetsFor(testNginxImage); !slices.Equal(got, []string{"mirror.corp.io"}) {
+		t.Errorf("Expected the default target for docker.io, got %v", got)
+	}
+	if _, excluded := policy.Excludes("registry.k8s.io/pause:3.9"); !excluded || policy.FailureMode != FailureModeFail {
+		t.Errorf("Expected preserved registries and failure mode from the defaults, got %+v", policy)
+	}
+
+	policy, _ = resolvePolicy(namespace(map[string]string{
+		AnnotationTargetRegistry:         "team.mirror.io",
+		AnnotationPreserveRegistries:     "quay.io",
+		AnnotationRewriteLocalRegistries: "false",
+	}), defaults, nil)
+	if got := policy.TargetsFor("ghcr.io/org/app:1.0"); !slices.Equal(got, []string{"team.mirror.io"}) {
+		t.Errorf("Expected the namespace target to take precedence over mappings, got %v", got)
+	}
+	if !slices.Equal(policy.PreserveRegistries, []string{"quay.io", "registry.k8s.io"}) || policy.rewritesLocalRegistries() {
+		t.Errorf("Expected namespace and default settings combined, got %+v", policy)
+	}
+
+	if _, ok := resolvePolicy(namespace(nil), nil, nil); ok {
+		t.Error("Expected a namespace without targets or defaults to be unconfigured")
+	}
+}
+
+func TestPodDefaulter_FailureModeFail(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "test-namespace",
+		Labels: map[string]string{LabelRegistryRewrite: LabelValueEnabled},
+	}}
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-namespace"},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: testNginxImage}}},
+		}
+	}
+	defaulterWith := func(defaults *Defaults, verifier registry.ManifestVerifier) *PodCustomDefaulter {
+		defaulter, _ := newResolvedDefaulter(namespace)
+		defaulter.Policies.SetDefaults(defaults)
+		defaulter.Rewriter = &registry.Rewriter{Verifier: verifier}
+		return defaulter
+	}
+
+	failing := &Defaults{TargetRegistries: []string{"myregistry.io"}, Verify: true, FailureMode: FailureModeFail}
+	if err := defaulterWith(failing, missingImageVerifier{}).Default(context.Background(), newPod()); err == nil {
+		t.Error("Expected the pod to be rejected when no target has the image")
+	}
+	if err := defaulterWith(failing, failingVerifier{}).Default(context.Background(), newPod()); err == nil {
+		t.Error("Expected the pod to be rejected when the registry lookup fails")
+	}
+
+	ignoring := &Defaults{TargetRegistries: []string{"myregistry.io"}, Verify: true}
+	pod := newPod()
+	if err := defaulterWith(ignoring, missingImageVerifier{}).Default(context.Background(), pod); err != nil ||
+		pod.Spec.Containers[0].Image != testNginxImage {
+		t.Errorf("Expected the original image to be kept, got %s, %v", pod.Spec.Containers[0].Image, err)
+	}
+
+	dryRun := namespace.DeepCopy()
+	dryRun.Annotations = map[string]string{AnnotationDryRun: "true"}
+	defaulter := defaulterWith(failing, missingImageVerifier{})
+	defaulter.Policies.Set(dryRun)
+	if err := defaulter.Default(context.Background(), newPod()); err != nil {
+		t.Errorf("Expected dry-run namespaces never to reject, got: %v", err)
+	}
+}
+
+// failingVerifier fails every registry lookup.
+type failingVerifier struct{}
+
+func (failingVerifier) ManifestExists(_ context.Context, _ string) (bool, error) {
+	return false, errors.New("registry unavailable")
+}
+
+func TestPolicyResolver_SetDefaultsRecompiles(t *testing.T) {
+	resolver := NewPolicyResolver(nil)
+	resolver.synced.Store(true)
+	resolver.Set(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   "team-a",
+		Labels: map[string]string{LabelRegistryRewrite: LabelValueEnabled},
+	}})
+	if compiled, _ := resolver.Resolve("team-a"); compiled.Configured {
+		t.Fatal("Expected the namespace to be unconfigured without defaults")
+	}
+
+	resolver.SetDefaults(&Defaults{TargetRegistries: []string{"mirror.corp.io"}})
+	if compiled, _ := resolver.Resolve("team-a"); !compiled.Configured ||
+		compiled.Policy.TargetRegistries[0] != "mirror.corp.io" {
+		t.Errorf("Expected the defaults to configure the namespace, got %+v", compiled)
+	}
+
+	resolver.SetDefaults(nil)
+	if compiled, _ := resolver.Resolve("team-a"); compiled.Configured {
+		t.Error("Expected removing the defaults to unconfigure the namespace")
+	}
+}
+
+func TestPodDefaulter_PathTemplateKeepsSourceRegistries(t *testing.T) {
+	defaults, err := ParseDefaults([]byte("pathTemplate: '{{.TargetRegistry}}/{{.SourceRegistry}}/{{.Repository}}'\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+	defaulter.Policies.SetDefaults(defaults)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "gcr", Image: "gcr.io/team/app:v1"},
+			{Name: "hub", Image: "team/app:v1"},
+			{Name: "mirrored", Image: "myregistry.io/quay.io/team/app:v1"},
+		}},
+	}
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	want := []string{"myregistry.io/gcr.io/team/app:v1", "myregistry.io/docker.io/team/app:v1",
+		"myregistry.io/quay.io/team/app:v1"}
+	for i, container := range pod.Spec.Containers {
+		if container.Image != want[i] {
+			t.Errorf("Expected %s, got %s", want[i], container.Image)
+		}
+	}
+}
+
+func TestPodDefaulter_RewriteRulesPrecedeTargets(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: 'quay\.io/org/([^:@]+)(.*)'
+  replace: mirror.corp.io/quay-org-$1$2
+  tests:
+  - {image: quay.io/org/x:1.0, want: mirror.corp.io/quay-org-x:1.0}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+	defaulter.Policies.SetDefaults(defaults)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "quay", Image: "quay.io/org/x:2.0"},
+			{Name: "hub", Image: testNginxImage},
+		}},
+	}
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if got := pod.Spec.Containers[0].Image; got != "mirror.corp.io/quay-org-x:2.0" {
+		t.Errorf("Expected the rule to rewrite the quay image, got %s", got)
+	}
+	if got := pod.Spec.Containers[1].Image; got != testMyRegistryNginx {
+		t.Errorf("Expected the namespace target for unmatched images, got %s", got)
+	}
+
+	trace, err := defaulter.Explain(context.Background(), "test-namespace", "quay.io/org/x:2.0")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !slices.ContainsFunc(trace.Steps, func(step TraceStep) bool {
+		return step.Step == stepRules && step.Outcome == outcomeMatched
+	}) {
+		t.Errorf("Expected the explain trace to name the matching rule, got %+v", trace.Steps)
+	}
+}
+
+func TestParseDefaults_RejectsFailingRuleTests(t *testing.T) {
+	_, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: 'quay\.io/org/([^:@]+)(.*)'
+  replace: mirror.corp.io/$1$2
+  tests:
+  - {image: quay.io/org/x:1.0, want: mirror.corp.io/quay-org-x:1.0}
+`))
+	if err == nil || !strings.Contains(err.Error(), "rewritten to mirror.corp.io/x:1.0, want mirror.corp.io/quay-org-x:1.0") {
+		t.Errorf("Expected the failing test vector to reject the defaults, got: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+// PURPOSE: Compares the images of existing pods with what the current policy would admit them with
+package v1
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Drift is a container or image volume whose image differs from the image the policy would give it.
+type Drift struct {
+	// Container is the name of the container or image volume.
+	Container string
+	Image     string
+	Expected  string
+}
+
+// DriftOf returns the containers and image volumes of pod that the policy would rewrite if the pod were
+// admitted now. The decision runs through the admission pipeline, including verification, without side effects:
+// nothing is audited, counted or queued for mirroring, and pod is not modified.
+func (d *PodCustomDefaulter) DriftOf(ctx context.Context, pod *corev1.Pod, policy Policy) ([]Drift, error) {
+	policy.DryRun = false
+	admitted := pod.DeepCopy()
+	if err := d.ApplyPolicy(withTrace(ctx, &Trace{}), admitted, policy); err != nil {
+		return nil, err
+	}
+
+	expected := podImages(admitted)
+	var drift []Drift
+	for location := range ImageLocations(pod) {
+		if image := *location.Image; image != expected[location.String()] {
+			drift = append(drift, Drift{Container: location.Name, Image: image, Expected: expected[location.String()]})
+		}
+	}
+	return drift, nil
+}
@@ -0,0 +1,80 @@
+// PURPOSE: Serves the effective merged rewrite configuration of a namespace on the debug endpoint
+package v1
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// ConfigPath is where the manager serves the effective configuration of a namespace.
+const ConfigPath = "/debug/config"
+
+// EffectiveConfig is the configuration a namespace's pods are admitted with, merged from its
+// annotations, the overrides and the global defaults, and where its targets came from.
+type EffectiveConfig struct {
+	Namespace  string `json:"namespace"`
+	Enabled    bool   `json:"enabled"`
+	Configured bool   `json:"configured"`
+	// Policy is the merged policy, when configured.
+	Policy *Policy `json:"policy,omitempty"`
+	// TargetsFrom names the entry supplying Policy.TargetRegistries.
+	TargetsFrom string `json:"targetsFrom,omitempty"`
+	// MappingsFrom names the entry supplying each of Policy.Mappings, by source registry.
+	MappingsFrom map[string]string `json:"mappingsFrom,omitempty"`
+	Conflicts    []Conflict        `json:"conflicts,omitempty"`
+	// Steps are the decisions of the merge, as in the policy steps of an explain trace.
+	Steps []TraceStep `json:"steps"`
+}
+
+// Effective returns the effective configuration of the named namespace compiled as c.
+func (c NamespacePolicy) Effective(namespace string) EffectiveConfig {
+	effective := EffectiveConfig{Namespace: namespace, Enabled: c.Enabled, Configured: c.Configured,
+		Conflicts: c.Conflicts, Steps: c.steps}
+	if !c.Configured {
+		return effective
+	}
+	policy := c.Policy
+	effective.Policy = &policy
+	if c.layers.targets != nil {
+		effective.TargetsFrom = c.layers.targets.Name
+	}
+	for _, source := range slices.Sorted(maps.Keys(c.layers.mappings)) {
+		if effective.MappingsFrom == nil {
+			effective.MappingsFrom = map[string]string{}
+		}
+		effective.MappingsFrom[source] = c.layers.mappings[source].Name
+	}
+	return effective
+}
+
+// ConfigHandler serves GET ?namespace=.. with the effective configuration of that namespace as JSON.
+func ConfigHandler(d *PodCustomDefaulter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		namespace := r.URL.Query().Get("namespace")
+		if namespace == "" {
+			http.Error(w, "namespace query parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		compiled, err := d.ResolveNamespace(r.Context(), namespace)
+		if apierrors.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(compiled.Effective(namespace))
+	})
+}
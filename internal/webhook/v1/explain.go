@@ -0,0 +1,191 @@
+// PURPOSE: Traces the rewrite decision for one image step by step, for the explain command and debug endpoint
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Steps of the decision pipeline, in the order they run.
+const (
+	stepNamespace      = "namespace"
+	stepNamespaceLabel = "namespace-label"
+	stepPolicy         = "policy"
+	stepPlatforms      = "platforms"
+	stepExclusions     = "exclusions"
+	stepLocalRegistry  = "local-registry"
+	stepRules          = "rules"
+	stepTagPolicy      = "tag-policy"
+	stepIdempotency    = "idempotency"
+	stepCandidate      = "candidate"
+	stepRewrite        = "rewrite"
+	stepResult         = "result"
+)
+
+// Outcomes of a step.
+const (
+	outcomeMatched = "matched"
+	outcomeNotSet  = "not-set"
+	outcomePassed  = "passed"
+	outcomeSkipped = "skipped"
+	outcomeFailed  = "failed"
+)
+
+// ExplainPath is where the manager serves decision traces.
+const ExplainPath = "/debug/explain"
+
+// explainContainerName names the container of the pod an image is explained with.
+const explainContainerName = "explain"
+
+// TraceStep is one step of a rewrite decision.
+type TraceStep struct {
+	Step    string `json:"step"`
+	Outcome string `json:"outcome"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Trace records how the webhook decided what to do with an image.
+type Trace struct {
+	Namespace string      `json:"namespace"`
+	Image     string      `json:"image"`
+	Steps     []TraceStep `json:"steps"`
+	// Result is the image the pod would run with.
+	Result    string `json:"result"`
+	Rewritten bool   `json:"rewritten"`
+	// Target is the target registry chosen for the image, if any.
+	Target string `json:"target,omitempty"`
+}
+
+// record appends a step. It does nothing on a nil Trace, so the admission path can call it unconditionally.
+func (t *Trace) record(step, outcome, detail string) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{Step: step, Outcome: outcome, Detail: detail})
+}
+
+// WriteText writes the trace as numbered lines.
+func (t *Trace) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "Image %s in namespace %s\n", t.Image, t.Namespace); err != nil {
+		return err
+	}
+	for i, step := range t.Steps {
+		line := fmt.Sprintf("%2d. %-16s %s", i+1, step.Step, step.Outcome)
+		if step.Detail != "" {
+			line += ": " + step.Detail
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exclusion returns the reason the image was excluded from rewriting by a preserved or local
+// registry rule, if it was.
+func (t *Trace) Exclusion() (string, bool) {
+	for _, step := range t.Steps {
+		if (step.Step == stepExclusions || step.Step == stepLocalRegistry) && step.Outcome == outcomeSkipped {
+			return step.Detail, true
+		}
+	}
+	return "", false
+}
+
+// Reason returns the detail of the last step that decided the result.
+func (t *Trace) Reason() string {
+	for i := len(t.Steps) - 1; i >= 0; i-- {
+		if step := t.Steps[i]; step.Step != stepResult && step.Detail != "" {
+			return step.Detail
+		}
+	}
+	return ""
+}
+
+type traceKey struct{}
+
+func withTrace(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+func traceFrom(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceKey{}).(*Trace)
+	return trace
+}
+
+// Explain runs the full admission decision for image in namespace and returns its trace. Explaining
+// has no side effects: nothing is audited, counted or queued for mirroring.
+func (d *PodCustomDefaulter) Explain(ctx context.Context, namespace, image string) (*Trace, error) {
+	trace, pod := newExplainPod(namespace, image)
+	if _, err := d.mutate(withTrace(ctx, trace), pod); err != nil {
+		return nil, err
+	}
+	trace.finish(pod)
+	return trace, nil
+}
+
+// ExplainPolicy traces the decision for image under policy, skipping the namespace lookup.
+func (d *PodCustomDefaulter) ExplainPolicy(ctx context.Context, namespace, image string, policy Policy) (*Trace, error) {
+	trace, pod := newExplainPod(namespace, image)
+	trace.record(stepPolicy, outcomeMatched, fmt.Sprintf("policy file: %v", policy.TargetRegistries))
+	if err := d.ApplyPolicy(withTrace(ctx, trace), pod, policy); err != nil {
+		return nil, err
+	}
+	trace.finish(pod)
+	return trace, nil
+}
+
+func newExplainPod(namespace, image string) (*Trace, *corev1.Pod) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, GenerateName: explainContainerName + "-"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: explainContainerName, Image: image}}},
+	}
+	return &Trace{Namespace: namespace, Image: image}, pod
+}
+
+// finish records the image the pod ended up with.
+func (t *Trace) finish(pod *corev1.Pod) {
+	t.Result = pod.Spec.Containers[0].Image
+	t.Rewritten = t.Result != t.Image
+	if t.Rewritten {
+		t.record(stepResult, "rewritten", t.Result)
+	} else {
+		t.record(stepResult, "unchanged", t.Result)
+	}
+}
+
+// ExplainHandler serves GET ?namespace=..&image=.. with the trace of that decision, as JSON or, with
+// format=text, as numbered lines.
+func ExplainHandler(d *PodCustomDefaulter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		namespace, image := r.URL.Query().Get("namespace"), r.URL.Query().Get("image")
+		if namespace == "" || image == "" {
+			http.Error(w, "namespace and image query parameters are required", http.StatusBadRequest)
+			return
+		}
+
+		trace, err := d.Explain(r.Context(), namespace, image)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_ = trace.WriteText(w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(trace)
+	})
+}
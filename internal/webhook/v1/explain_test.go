@@ -0,0 +1,178 @@
+// PURPOSE: Unit tests for decision traces, exclusions and local-registry rules
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newExplainDefaulter(annotations map[string]string) *PodCustomDefaulter {
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-namespace",
+			Labels:      map[string]string{LabelRegistryRewrite: LabelValueEnabled},
+			Annotations: annotations,
+		},
+	}
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	return &PodCustomDefaulter{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()}
+}
+
+// steps returns the step and outcome pairs of a trace.
+func steps(trace *Trace) []string {
+	var out []string
+	for _, step := range trace.Steps {
+		out = append(out, step.Step+"="+step.Outcome)
+	}
+	return out
+}
+
+func TestExplain_TracesRewrite(t *testing.T) {
+	defaulter := newExplainDefaulter(map[string]string{AnnotationTargetRegistry: "myregistry.io"})
+
+	trace, err := defaulter.Explain(context.Background(), "test-namespace", testNginxImage)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := []string{"namespace-label=matched", "policy=not-set", "policy=matched", "exclusions=passed",
+		"local-registry=passed", "idempotency=passed", "rewrite=matched", "result=rewritten"}
+	if got := steps(trace); !equalStrings(got, expected) {
+		t.Errorf("Expected steps %v, got %v", expected, got)
+	}
+	if trace.Result != testMyRegistryNginx || !trace.Rewritten {
+		t.Errorf("Expected result %s, got %+v", testMyRegistryNginx, trace)
+	}
+}
+
+func TestExplain_DisabledNamespace(t *testing.T) {
+	defaulter := newExplainDefaulter(nil)
+
+	trace, err := defaulter.Explain(context.Background(), "other-namespace", testNginxImage)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expected := []string{"namespace=failed", "result=unchanged"}
+	if got := steps(trace); !equalStrings(got, expected) {
+		t.Errorf("Expected steps %v, got %v", expected, got)
+	}
+}
+
+func TestExplain_AlreadyOnTarget(t *testing.T) {
+	defaulter := newExplainDefaulter(map[string]string{AnnotationTargetRegistry: "myregistry.io"})
+
+	trace, _ := defaulter.Explain(context.Background(), "test-namespace", testMyRegistryNginx)
+	if last := trace.Steps[len(trace.Steps)-2]; last.Step != stepIdempotency || last.Outcome != outcomeSkipped {
+		t.Errorf("Expected the idempotency check to stop the rewrite, got %v", steps(trace))
+	}
+}
+
+func TestPodDefaulter_PreservedRegistriesAreNotRewritten(t *testing.T) {
+	defaulter := newExplainDefaulter(map[string]string{
+		AnnotationTargetRegistry:     "myregistry.io",
+		AnnotationPreserveRegistries: "gcr.io/distroless, quay.io",
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "a", Image: "gcr.io/distroless/static:nonroot"},
+			{Name: "b", Image: "gcr.io/project/app:v1"},
+			{Name: "c", Image: "quay.io/prometheus/node-exporter:v1"},
+		}},
+	}
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := []string{"gcr.io/distroless/static:nonroot", "myregistry.io/project/app:v1",
+		"quay.io/prometheus/node-exporter:v1"}
+	for i, container := range pod.Spec.Containers {
+		if container.Image != expected[i] {
+			t.Errorf("Expected container %s to use %s, got %s", container.Name, expected[i], container.Image)
+		}
+	}
+}
+
+func TestPodDefaulter_LocalRegistries(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			name:        "rewritten by default",
+			annotations: map[string]string{AnnotationTargetRegistry: "myregistry.io"},
+			expected:    "myregistry.io/app:dev",
+		},
+		{
+			name: "skipped when opted out",
+			annotations: map[string]string{
+				AnnotationTargetRegistry:         "myregistry.io",
+				AnnotationRewriteLocalRegistries: "false",
+			},
+			expected: "localhost:5000/app:dev",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaulter := newExplainDefaulter(tt.annotations)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-namespace"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "localhost:5000/app:dev"}}},
+			}
+			if err := defaulter.Default(context.Background(), pod); err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if pod.Spec.Containers[0].Image != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, pod.Spec.Containers[0].Image)
+			}
+		})
+	}
+}
+
+func TestExplainHandler(t *testing.T) {
+	handler := ExplainHandler(newExplainDefaulter(map[string]string{AnnotationTargetRegistry: "myregistry.io"}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet,
+		ExplainPath+"?namespace=test-namespace&image=nginx", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	trace := &Trace{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), trace); err != nil {
+		t.Fatalf("Expected a JSON trace, got: %v", err)
+	}
+	if trace.Result != testMyRegistryNginx {
+		t.Errorf("Expected result %s, got %s", testMyRegistryNginx, trace.Result)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ExplainPath+"?image=nginx", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a namespace, got %d", recorder.Code)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+// PURPOSE: Merges cluster defaults, override entries and namespace annotations into the targets of a namespace
+package v1
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// Override is a configuration entry layered over the cluster defaults: the targets of every image, or
+// of the images of one source registry, in all namespaces or the listed ones.
+type Override struct {
+	// Name identifies the entry in conflicts, events and the effective configuration.
+	Name string `json:"name"`
+	// Namespaces the entry applies to. Empty applies to every namespace.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Source is the registry whose images the entry applies to. Empty applies to every image.
+	Source string `json:"source,omitempty"`
+	// Targets are the candidate registries, in order of preference. An entry with a Source has one.
+	Targets []string `json:"targets"`
+	// Verify requires the rewritten image to exist on the target. Several targets always verify.
+	Verify bool `json:"verify,omitempty"`
+	// Priority orders entries before specificity; the highest wins. Defaults and annotations have 0.
+	Priority int32 `json:"priority,omitempty"`
+}
+
+// namespaced reports whether the entry is limited to some namespaces.
+func (o Override) namespaced() bool {
+	return len(o.Namespaces) > 0
+}
+
+// appliesTo reports whether the entry applies to the named namespace.
+func (o Override) appliesTo(namespace string) bool {
+	return !o.namespaced() || slices.Contains(o.Namespaces, namespace)
+}
+
+// verifies reports whether the entry's targets are verified.
+func (o Override) verifies() bool {
+	return o.Verify || len(o.Targets) > 1
+}
+
+// outranks reports whether o takes precedence over other: a higher priority, then a namespace scope
+// over a cluster one, then a source registry over every image. Equal entries rank the same.
+func (o Override) outranks(other Override) bool {
+	if o.Priority != other.Priority {
+		return o.Priority > other.Priority
+	}
+	if o.namespaced() != other.namespaced() {
+		return o.namespaced()
+	}
+	return o.Source != "" && other.Source == ""
+}
+
+// validateOverrides returns the invalid entries, with field paths below fldPath.
+func validateOverrides(overrides []Override, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	names := map[string]bool{}
+	for i, override := range overrides {
+		path := fldPath.Index(i)
+		switch {
+		case override.Name == "":
+			errs = append(errs, field.Required(path.Child("name"), "entries are named in conflicts and events"))
+		case names[override.Name]:
+			errs = append(errs, field.Duplicate(path.Child("name"), override.Name))
+		}
+		names[override.Name] = true
+		for j, namespace := range override.Namespaces {
+			if namespace == "" {
+				errs = append(errs, field.Required(path.Child("namespaces").Index(j), "must not be empty"))
+			}
+		}
+		if override.Source != "" {
+			if err := registry.ValidateHost(strings.ToLower(override.Source)); err != nil {
+				errs = append(errs, field.Invalid(path.Child("source"), override.Source,
+					"source must be a registry host: "+err.Error()))
+			}
+			if len(override.Targets) > 1 {
+				errs = append(errs, field.TooMany(path.Child("targets"), len(override.Targets), 1))
+			}
+		}
+		if len(override.Targets) == 0 {
+			errs = append(errs, field.Required(path.Child("targets"), "at least one target is required"))
+		}
+		for j, target := range override.Targets {
+			if err := validateTarget(target); err != nil {
+				errs = append(errs, field.Invalid(path.Child("targets").Index(j), target, err.Error()))
+			}
+		}
+	}
+	return errs
+}
+
+// normalizeOverrides puts the sources and targets of overrides in canonical form.
+func normalizeOverrides(overrides []Override) []Override {
+	normalized := slices.Clone(overrides)
+	for i := range normalized {
+		normalized[i].Source = strings.ToLower(normalized[i].Source)
+		normalized[i].Targets = normalizeTargets(normalized[i].Targets)
+	}
+	return normalized
+}
+
+// Conflict is a pair of entries of the same priority and specificity giving the same images different
+// targets. The entry listed first wins.
+type Conflict struct {
+	// Source is the registry of the conflicting entries, empty for every image.
+	Source        string   `json:"source,omitempty"`
+	Winner        string   `json:"winner"`
+	WinnerTargets []string `json:"winnerTargets"`
+	Loser         string   `json:"loser"`
+	LoserTargets  []string `json:"loserTargets"`
+}
+
+// String describes the conflict in events and traces.
+func (c Conflict) String() string {
+	images := "every image"
+	if c.Source != "" {
+		images = "images of " + c.Source
+	}
+	return fmt.Sprintf("entries %q and %q give %s different targets (%s, %s); using %q", c.Winner, c.Loser,
+		images, strings.Join(c.WinnerTargets, ","), strings.Join(c.LoserTargets, ","), c.Winner)
+}
+
+// layered is the result of merging the entries of a namespace.
+type layered struct {
+	// targets is the entry for every image, if any.
+	targets *Override
+	// mappings are the entries for the images of a source registry that outrank targets, by source.
+	mappings  map[string]Override
+	conflicts []Conflict
+}
+
+// mergeLayers merges the entries applying to namespace, listed in layer order: namespace annotations,
+// then overrides in document order, then the cluster defaults. The entry that outranks the others
+// decides; among equals the first listed wins, and any with other targets is a conflict.
+func mergeLayers(namespace string, entries []Override) layered {
+	var applicable []Override
+	for _, entry := range entries {
+		if entry.appliesTo(namespace) {
+			applicable = append(applicable, entry)
+		}
+	}
+
+	var result layered
+	if best, conflicts := bestOf(applicable, ""); best != nil {
+		result.targets = best
+		result.conflicts = append(result.conflicts, conflicts...)
+	}
+	sources := map[string]bool{}
+	for _, entry := range applicable {
+		if entry.Source != "" {
+			sources[entry.Source] = true
+		}
+	}
+	for _, source := range slices.Sorted(maps.Keys(sources)) {
+		best, conflicts := bestOf(applicable, source)
+		if best == nil || best.Source == "" {
+			continue // the entry for every image outranks those of the source
+		}
+		if result.mappings == nil {
+			result.mappings = map[string]Override{}
+		}
+		result.mappings[source] = *best
+		result.conflicts = append(result.conflicts, conflicts...)
+	}
+	return result
+}
+
+// bestOf returns the entry deciding the images of source, empty for entries of every image, and the
+// entries ranking the same with other targets.
+func bestOf(entries []Override, source string) (*Override, []Conflict) {
+	best := -1
+	for i, entry := range entries {
+		if entry.Source != "" && entry.Source != source {
+			continue
+		}
+		if best < 0 || entry.outranks(entries[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, nil
+	}
+
+	winner := entries[best]
+	var conflicts []Conflict
+	for i, entry := range entries {
+		if i == best || entry.Source != winner.Source || entry.outranks(winner) || winner.outranks(entry) {
+			continue
+		}
+		if !slices.Equal(entry.Targets, winner.Targets) {
+			conflicts = append(conflicts, Conflict{Source: source, Winner: winner.Name, WinnerTargets: winner.Targets,
+				Loser: entry.Name, LoserTargets: entry.Targets})
+		}
+	}
+	return &winner, conflicts
+}
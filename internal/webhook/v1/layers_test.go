@@ -0,0 +1,220 @@
+// PURPOSE: Unit tests for layering defaults, overrides and annotations, conflict reporting and the config endpoint
+package v1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const layeredDefaults = `
+targetRegistries: [mirror.corp.io]
+mappings:
+  ghcr.io: ghcr-mirror.corp.io
+overrides:
+- name: team-a
+  namespaces: [team-a]
+  targets: [team-a.mirror.io]
+- name: quay-everywhere
+  source: quay.io
+  targets: [quay-mirror.corp.io]
+- name: team-b-ghcr
+  namespaces: [team-b]
+  source: GHCR.io
+  targets: [team-b-ghcr.mirror.io]
+- name: platform-pin
+  namespaces: [pinned]
+  targets: [pinned.mirror.io]
+  priority: 10
+`
+
+func TestResolvePolicy_LayersByPriorityAndSpecificity(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(layeredDefaults))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	namespace := func(name, target string) *corev1.Namespace {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{}}}
+		if target != "" {
+			ns.Annotations[AnnotationTargetRegistry] = target
+		}
+		return ns
+	}
+
+	tests := []struct {
+		name      string
+		namespace *corev1.Namespace
+		image     string
+		want      string
+	}{
+		{"cluster defaults", namespace("other", ""), testNginxImage, "mirror.corp.io"},
+		{"cluster mapping", namespace("other", ""), "ghcr.io/org/app:1.0", "ghcr-mirror.corp.io"},
+		{"cluster source override", namespace("other", ""), "quay.io/org/app:1.0", "quay-mirror.corp.io"},
+		{"namespace override", namespace("team-a", ""), testNginxImage, "team-a.mirror.io"},
+		{"namespace override beats cluster source entries", namespace("team-a", ""), "quay.io/org/app:1.0",
+			"team-a.mirror.io"},
+		{"annotation beats cluster entries", namespace("other", "own.mirror.io"), "ghcr.io/org/app:1.0",
+			"own.mirror.io"},
+		{"namespace source entry beats annotation", namespace("team-b", "own.mirror.io"), "ghcr.io/org/app:1.0",
+			"team-b-ghcr.mirror.io"},
+		{"priority beats annotation", namespace("pinned", "own.mirror.io"), testNginxImage, "pinned.mirror.io"},
+	}
+	for _, tt := range tests {
+		policy, ok := resolvePolicy(tt.namespace, defaults, nil)
+		if !ok {
+			t.Fatalf("%s: expected the namespace to be configured", tt.name)
+		}
+		if got := policy.TargetsFor(tt.image); !slices.Equal(got, []string{tt.want}) {
+			t.Errorf("%s: expected %s for %s, got %v", tt.name, tt.want, tt.image, got)
+		}
+	}
+}
+
+func TestMergeLayers_Conflicts(t *testing.T) {
+	entries := []Override{
+		{Name: "annotation", Namespaces: []string{"team-a"}, Targets: []string{"a.mirror.io"}},
+		{Name: "platform", Namespaces: []string{"team-a", "team-b"}, Targets: []string{"platform.mirror.io"}},
+		{Name: "same-targets", Namespaces: []string{"team-a"}, Targets: []string{"a.mirror.io"}},
+		{Name: "quay-1", Source: "quay.io", Targets: []string{"q1.mirror.io"}},
+		{Name: "quay-2", Source: "quay.io", Targets: []string{"q2.mirror.io"}},
+		{Name: "quay-pinned", Source: "quay.io", Targets: []string{"q3.mirror.io"}, Priority: 1},
+		{Name: "defaults", Targets: []string{"mirror.corp.io"}},
+	}
+
+	merged := mergeLayers("team-a", entries)
+	if merged.targets == nil || merged.targets.Name != "annotation" {
+		t.Fatalf("Expected the first of the equal entries to win, got %+v", merged.targets)
+	}
+	if len(merged.conflicts) != 1 || merged.conflicts[0].Loser != "platform" {
+		t.Fatalf("Expected one conflict with platform, got %+v", merged.conflicts)
+	}
+	if got := merged.conflicts[0].String(); got != `entries "annotation" and "platform" give every image different `+
+		`targets (a.mirror.io, platform.mirror.io); using "annotation"` {
+		t.Errorf("Unexpected conflict description: %s", got)
+	}
+	if len(merged.mappings) != 1 || merged.mappings["quay.io"].Name != "quay-pinned" {
+		t.Errorf("Expected only the higher priority source entry to outrank the namespace entry, got %+v", merged.mappings)
+	}
+
+	// Elsewhere the quay.io entries decide, and the higher priority settles their disagreement
+	merged = mergeLayers("team-c", entries)
+	if merged.mappings["quay.io"].Name != "quay-pinned" || len(merged.conflicts) != 0 {
+		t.Errorf("Expected quay-pinned without conflicts, got %+v, %+v", merged.mappings, merged.conflicts)
+	}
+	merged = mergeLayers("team-c", slices.Delete(slices.Clone(entries), 5, 6))
+	if merged.mappings["quay.io"].Name != "quay-1" || len(merged.conflicts) != 1 || merged.conflicts[0].Source != "quay.io" {
+		t.Errorf("Expected quay-1 to win a conflict with quay-2, got %+v, %+v", merged.mappings, merged.conflicts)
+	}
+}
+
+func TestParseDefaults_RejectsInvalidOverrides(t *testing.T) {
+	for _, tt := range []struct {
+		overrides string
+		want      string
+	}{
+		{"[{targets: [a.io]}]", "overrides[0].name: Required value"},
+		{"[{name: a, targets: [a.io]}, {name: a, targets: [b.io]}]", `overrides[1].name: Duplicate value: "a"`},
+		{"[{name: a}]", "overrides[0].targets: Required value"},
+		{"[{name: a, source: quay.io, targets: [a.io, b.io]}]", "overrides[0].targets: Too many"},
+		{"[{name: a, source: 'quay.io/org', targets: [a.io]}]", "overrides[0].source: Invalid value"},
+		{"[{name: a, targets: ['https://a.io']}]", "overrides[0].targets[0]: Invalid value"},
+		{"[{name: a, namespaces: [''], targets: [a.io]}]", "overrides[0].namespaces[0]: Required value"},
+	} {
+		_, err := ParseDefaults([]byte("overrides: " + tt.overrides))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected %s to be rejected with %q, got: %v", tt.overrides, tt.want, err)
+		}
+	}
+}
+
+func TestPolicyResolver_ReportsConflicts(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(`
+overrides:
+- name: platform
+  namespaces: [team-a]
+  targets: [platform.mirror.io]
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	recorder := record.NewFakeRecorder(10)
+	resolver := NewPolicyResolver(nil)
+	resolver.Recorder = recorder
+	resolver.SetDefaults(defaults)
+
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team-a",
+		Labels:      map[string]string{LabelRegistryRewrite: LabelValueEnabled},
+		Annotations: map[string]string{AnnotationTargetRegistry: "own.mirror.io"},
+	}}
+	resolver.Set(namespace)
+	resolver.Set(namespace.DeepCopy()) // unchanged conflicts are not reported again
+
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected one event, got %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning "+EventReasonConfigConflict) ||
+		!strings.Contains(event, `entries "annotation image-rewriter.example.com/target-registry" and "platform"`) {
+		t.Errorf("Unexpected event: %s", event)
+	}
+	if got := testutil.ToFloat64(configConflicts.WithLabelValues("team-a")); got != 1 {
+		t.Errorf("Expected 1 conflict counted, got %v", got)
+	}
+
+	// Agreeing resolves the conflict
+	series := testutil.CollectAndCount(configConflicts)
+	resolver.SetDefaults(&Defaults{Overrides: []Override{
+		{Name: "platform", Namespaces: []string{"team-a"}, Targets: []string{"own.mirror.io"}},
+	}})
+	if got := testutil.CollectAndCount(configConflicts); got != series-1 {
+		t.Errorf("Expected the team-a series to be removed, got %d series of %d", got, series)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+	defaults, err := ParseDefaults([]byte(`
+mappings:
+  quay.io: quay-mirror.corp.io
+overrides:
+- name: platform
+  namespaces: [test-namespace]
+  targets: [platform.mirror.io]
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defaulter.Policies.SetDefaults(defaults)
+	handler := ConfigHandler(defaulter)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ConfigPath+"?namespace=test-namespace", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", recorder.Code, recorder.Body)
+	}
+	var effective EffectiveConfig
+	if err := json.Unmarshal(recorder.Body.Bytes(), &effective); err != nil {
+		t.Fatalf("Expected JSON, got: %v", err)
+	}
+	if !effective.Enabled || effective.Policy == nil || !slices.Equal(effective.Policy.TargetRegistries, []string{"myregistry.io"}) ||
+		effective.TargetsFrom != "annotation "+AnnotationTargetRegistry {
+		t.Errorf("Expected the annotation's target, got %+v", effective)
+	}
+	if len(effective.Conflicts) != 1 || effective.Conflicts[0].Loser != "platform" || len(effective.MappingsFrom) != 0 {
+		t.Errorf("Expected the conflict with platform and no mappings, got %+v", effective)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, ConfigPath, nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a namespace, got %d", recorder.Code)
+	}
+}
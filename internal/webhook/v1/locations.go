@@ -0,0 +1,170 @@
+// PURPOSE: Typed locations of the images of a pod: its containers of every kind and its image volumes
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"path"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ContainerKind is the kind of place in a pod spec an image is referenced from.
+type ContainerKind string
+
+// Container kinds, in the order ImageLocations visits them.
+const (
+	// ContainerKindContainers are the pod's regular containers.
+	ContainerKindContainers ContainerKind = "containers"
+	// ContainerKindInitContainers are init containers that run to completion before the others start.
+	ContainerKindInitContainers ContainerKind = "initContainers"
+	// ContainerKindSidecars are native sidecars: init containers with restartPolicy Always, which
+	// keep running alongside the regular containers.
+	ContainerKindSidecars ContainerKind = "sidecars"
+	// ContainerKindEphemeralContainers are debug containers added to running pods.
+	ContainerKindEphemeralContainers ContainerKind = "ephemeralContainers"
+	// ContainerKindImageVolumes are volumes whose content is an OCI image.
+	ContainerKindImageVolumes ContainerKind = "imageVolumes"
+)
+
+var containerKinds = []ContainerKind{ContainerKindContainers, ContainerKindInitContainers, ContainerKindSidecars,
+	ContainerKindEphemeralContainers, ContainerKindImageVolumes}
+
+// containerKindNames describe each kind in messages.
+var containerKindNames = map[ContainerKind]string{
+	ContainerKindContainers:          "container",
+	ContainerKindInitContainers:      "init container",
+	ContainerKindSidecars:            "sidecar",
+	ContainerKindEphemeralContainers: "ephemeral container",
+	ContainerKindImageVolumes:        "image volume",
+}
+
+// ImageLocation is an image reference of a pod: the image of a container, or the reference of an
+// image volume.
+type ImageLocation struct {
+	Kind ContainerKind
+	// Name is the name of the container or volume.
+	Name string
+	// Image points at the reference in the pod spec, so it can be rewritten in place.
+	Image *string
+}
+
+// String describes the location in messages, such as "init container setup".
+func (l ImageLocation) String() string {
+	return containerKindNames[l.Kind] + " " + l.Name
+}
+
+// ImageLocations visits every image reference of pod: its containers, its init containers and native
+// sidecars in their order, its ephemeral containers, then its image volumes.
+func ImageLocations(pod *corev1.Pod) iter.Seq[ImageLocation] {
+	return func(yield func(ImageLocation) bool) {
+		for i := range pod.Spec.Containers {
+			container := &pod.Spec.Containers[i]
+			if !yield(ImageLocation{Kind: ContainerKindContainers, Name: container.Name, Image: &container.Image}) {
+				return
+			}
+		}
+		for i := range pod.Spec.InitContainers {
+			container := &pod.Spec.InitContainers[i]
+			kind := ContainerKindInitContainers
+			if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+				kind = ContainerKindSidecars
+			}
+			if !yield(ImageLocation{Kind: kind, Name: container.Name, Image: &container.Image}) {
+				return
+			}
+		}
+		for i := range pod.Spec.EphemeralContainers {
+			container := &pod.Spec.EphemeralContainers[i]
+			if !yield(ImageLocation{Kind: ContainerKindEphemeralContainers, Name: container.Name,
+				Image: &container.Image}) {
+				return
+			}
+		}
+		for i := range pod.Spec.Volumes {
+			volume := &pod.Spec.Volumes[i]
+			if volume.Image == nil {
+				continue
+			}
+			if !yield(ImageLocation{Kind: ContainerKindImageVolumes, Name: volume.Name, Image: &volume.Image.Reference}) {
+				return
+			}
+		}
+	}
+}
+
+// podImages returns every image of pod by the description of its location.
+func podImages(pod *corev1.Pod) map[string]string {
+	images := map[string]string{}
+	for location := range ImageLocations(pod) {
+		images[location.String()] = *location.Image
+	}
+	return images
+}
+
+// ContainerSelector selects the image locations of a pod a rule applies to. Every field that is set
+// must match; a selector with no fields selects every location.
+type ContainerSelector struct {
+	// ContainerKinds lists the kinds of location selected: containers, initContainers, sidecars,
+	// ephemeralContainers or imageVolumes.
+	ContainerKinds []ContainerKind `json:"containerKinds,omitempty"`
+	// ContainerNames are glob patterns, such as "istio-*", of which the container or volume name must
+	// match one.
+	ContainerNames []string `json:"containerNames,omitempty"`
+}
+
+// containerSelectorFields are the JSON fields of ContainerSelector.
+var containerSelectorFields = []string{"containerKinds", "containerNames"}
+
+// compile checks the kinds and name patterns.
+func (s *ContainerSelector) compile() error {
+	for _, kind := range s.ContainerKinds {
+		if !slices.Contains(containerKinds, kind) {
+			return fmt.Errorf("containerKinds: unsupported kind %q, must be one of %v", kind, containerKinds)
+		}
+	}
+	for _, pattern := range s.ContainerNames {
+		if pattern == "" {
+			return errors.New("containerNames must not contain an empty pattern")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("containerNames: pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Includes reports whether location is selected.
+func (s ContainerSelector) Includes(location ImageLocation) bool {
+	if len(s.ContainerKinds) > 0 && !slices.Contains(s.ContainerKinds, location.Kind) {
+		return false
+	}
+	if len(s.ContainerNames) == 0 {
+		return true
+	}
+	for _, pattern := range s.ContainerNames {
+		if matched, _ := path.Match(pattern, location.Name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// descriptions summarize the selector for traces.
+func (s ContainerSelector) descriptions() []string {
+	var parts []string
+	if len(s.ContainerKinds) > 0 {
+		kinds := make([]string, len(s.ContainerKinds))
+		for i, kind := range s.ContainerKinds {
+			kinds[i] = string(kind)
+		}
+		parts = append(parts, "kinds "+strings.Join(kinds, ","))
+	}
+	if len(s.ContainerNames) > 0 {
+		parts = append(parts, "names "+strings.Join(s.ContainerNames, ","))
+	}
+	return parts
+}
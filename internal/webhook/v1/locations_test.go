@@ -0,0 +1,147 @@
+// PURPOSE: Unit tests for the typed image locations of a pod and rules scoped to container kinds and names
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// everyKindPod returns a pod with an image in every kind of location, all nginx:latest.
+func everyKindPod() *corev1.Pod {
+	always := corev1.ContainerRestartPolicyAlways
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: testNginxImage}},
+			InitContainers: []corev1.Container{
+				{Name: "migrate", Image: testNginxImage},
+				{Name: "istio-proxy", Image: testNginxImage, RestartPolicy: &always},
+			},
+			EphemeralContainers: []corev1.EphemeralContainer{
+				{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: testNginxImage}},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: "models", VolumeSource: corev1.VolumeSource{
+					Image: &corev1.ImageVolumeSource{Reference: testNginxImage},
+				}},
+			},
+		},
+	}
+}
+
+func TestImageLocations(t *testing.T) {
+	pod := everyKindPod()
+	var got []string
+	for location := range ImageLocations(pod) {
+		got = append(got, location.String())
+		*location.Image = "rewritten/" + location.Name
+	}
+	want := []string{"container app", "init container migrate", "sidecar istio-proxy",
+		"ephemeral container debugger", "image volume models"}
+	if strings.Join(got, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Expected locations %v, got %v", want, got)
+	}
+
+	if pod.Spec.InitContainers[1].Image != "rewritten/istio-proxy" || pod.Spec.Volumes[1].Image.Reference != "rewritten/models" {
+		t.Errorf("Expected images to be rewritten through their locations, got %+v", pod.Spec)
+	}
+
+	// Stopping early visits nothing more
+	visited := 0
+	for range ImageLocations(pod) {
+		visited++
+		break
+	}
+	if visited != 1 {
+		t.Errorf("Expected the iteration to stop, got %d locations", visited)
+	}
+}
+
+func TestContainerSelector_Includes(t *testing.T) {
+	sidecar := ImageLocation{Kind: ContainerKindSidecars, Name: "istio-proxy"}
+	debugger := ImageLocation{Kind: ContainerKindEphemeralContainers, Name: "debugger"}
+	tests := []struct {
+		selector ContainerSelector
+		location ImageLocation
+		want     bool
+	}{
+		{ContainerSelector{}, debugger, true},
+		{ContainerSelector{ContainerKinds: []ContainerKind{ContainerKindEphemeralContainers}}, debugger, true},
+		{ContainerSelector{ContainerKinds: []ContainerKind{ContainerKindInitContainers}}, sidecar, false},
+		{ContainerSelector{ContainerNames: []string{"istio-*", "linkerd-*"}}, sidecar, true},
+		{ContainerSelector{ContainerNames: []string{"istio-*"}}, debugger, false},
+		{ContainerSelector{ContainerKinds: []ContainerKind{ContainerKindContainers}, ContainerNames: []string{"istio-*"}},
+			sidecar, false},
+	}
+	for _, tt := range tests {
+		if got := tt.selector.Includes(tt.location); got != tt.want {
+			t.Errorf("Expected %+v to include %s: %t, got %t", tt.selector, tt.location, tt.want, got)
+		}
+	}
+}
+
+func TestPodDefaulter_RewriteRulesScopedToContainerKinds(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: '.*'
+  keep: true
+  containerKinds: [ephemeralContainers]
+  tests:
+  - {image: nginx:latest, want: nginx:latest}
+- match: 'docker\.io/(.*)'
+  replace: mesh-mirror.corp.io/$1
+  containerNames: ['istio-*']
+  tests:
+  - {image: nginx:latest, want: mesh-mirror.corp.io/library/nginx:latest}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+	defaulter.Policies.SetDefaults(defaults)
+
+	pod := everyKindPod()
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	want := map[string]string{
+		"container app":                testMyRegistryNginx,
+		"init container migrate":       testMyRegistryNginx,
+		"sidecar istio-proxy":          "mesh-mirror.corp.io/library/nginx:latest",
+		"ephemeral container debugger": testNginxImage,
+		"image volume models":          testMyRegistryNginx,
+	}
+	for location, image := range podImages(pod) {
+		if image != want[location] {
+			t.Errorf("Expected %s to have image %s, got %s", location, want[location], image)
+		}
+	}
+}
+
+func TestParseDefaults_RejectsInvalidContainerSelectors(t *testing.T) {
+	for _, tt := range []struct {
+		rule string
+		want string
+	}{
+		{"containerKinds: [sidecarContainers]", `unsupported kind "sidecarContainers"`},
+		{"containerNames: ['istio-[']", `pattern "istio-["`},
+		{"containerNames: ['']", "containerNames must not contain an empty pattern"},
+	} {
+		_, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: 'docker\.io/(.*)'
+  replace: mirror.corp.io/$1
+  ` + tt.rule + `
+  tests:
+  - {image: quay.io/app:v1}
+`))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected %s to be rejected with %q, got: %v", tt.rule, tt.want, err)
+		}
+	}
+}
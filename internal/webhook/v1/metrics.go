@@ -0,0 +1,39 @@
+// PURPOSE: Registers Prometheus metrics describing image rewrite decisions made by the webhook
+package v1
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	resultRewritten    = "rewritten"
+	resultKeptOriginal = "kept_original"
+	resultError        = "error"
+	resultDryRun       = "dry_run"
+	resultSkipped      = "skipped"
+)
+
+var (
+	// imageRewritesTotal counts per-image decisions by namespace and result.
+	imageRewritesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_rewrites_total",
+		Help: "Number of container images processed by the rewrite webhook, by result.",
+	}, []string{"namespace", "result"})
+
+	// imageRewriteFallbacksTotal counts images where verification rejected a candidate target.
+	imageRewriteFallbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "image_rewrite_fallbacks_total",
+		Help: "Number of images where a candidate target failed verification, by what was used instead.",
+	}, []string{"namespace", "result"})
+
+	// configConflicts is the number of conflicting target entries in effect per namespace.
+	configConflicts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "image_rewrite_config_conflicts",
+		Help: "Number of target entries of the same rank giving a namespace's images different targets.",
+	}, []string{"namespace"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(imageRewritesTotal, imageRewriteFallbacksTotal, configConflicts)
+}
@@ -0,0 +1,109 @@
+// PURPOSE: Implements a validating webhook that holds namespace rewrite settings to the platform's tenant policy
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// namespacelog is for logging in this package.
+var namespacelog = logf.Log.WithName("namespace-resource")
+
+// DefaultsSource supplies the global defaults in use, as PolicyResolver does.
+type DefaultsSource interface {
+	Defaults() *Defaults
+	DefaultsLoaded() bool
+}
+
+// SetupNamespaceWebhookWithManager registers the webhook for Namespace in the manager. It reads the
+// tenant policy from the defaults of opts.Policies, which must be set. It is only registered with
+// tenant limits enabled, since its configuration in config/tenant-limits fails closed.
+func SetupNamespaceWebhookWithManager(mgr ctrl.Manager, opts WebhookOptions) error {
+	if opts.Policies == nil {
+		return errors.New("the Namespace webhook needs the namespace policies of the Pod webhook")
+	}
+	return ctrl.NewWebhookManagedBy(mgr).For(&corev1.Namespace{}).
+		WithValidator(&NamespaceCustomValidator{Defaults: opts.Policies}).
+		Complete()
+}
+
+// The webhook configuration is not generated from a marker but kept in config/tenant-limits, which is
+// only deployed with tenant limits. Its failurePolicy is Fail, since tenant limits that lapse whenever
+// the operator is unavailable do not limit anyone; its namespaceSelector leaves out the system
+// namespaces and the operator's own, so they can still be changed while it is down.
+
+// NamespaceCustomValidator rejects namespace rewrite settings outside the tenant policy of the global
+// defaults. Without a tenant policy every namespace is allowed. Until the defaults are loaded, and it
+// is not known whether there is one, changes are rejected as the webhook being unavailable would be.
+type NamespaceCustomValidator struct {
+	Defaults DefaultsSource
+}
+
+var _ webhook.CustomValidator = &NamespaceCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type Namespace.
+func (v *NamespaceCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings,
+	error) {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace object but got %T", obj)
+	}
+	return v.validate(ctx, namespace, nil)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Namespace.
+func (v *NamespaceCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (
+	admission.Warnings, error) {
+	namespace, ok := newObj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace object for the newObj but got %T", newObj)
+	}
+	old, ok := oldObj.(*corev1.Namespace)
+	if !ok {
+		return nil, fmt.Errorf("expected a Namespace object for the oldObj but got %T", oldObj)
+	}
+	// Only settings changed by the update are rejected, so existing namespaces can still be updated
+	return v.validate(ctx, namespace, old)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Namespace.
+func (v *NamespaceCustomValidator) ValidateDelete(context.Context, runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validate checks namespace against the tenant policy, unless the requesting user is an admin or the
+// namespace is being deleted.
+func (v *NamespaceCustomValidator) validate(ctx context.Context, namespace, old *corev1.Namespace) (
+	admission.Warnings, error) {
+	if v.Defaults == nil || namespace.DeletionTimestamp != nil {
+		return nil, nil
+	}
+	if !v.Defaults.DefaultsLoaded() {
+		return nil, apierrors.NewServiceUnavailable("the tenant policy has not been loaded yet, retry shortly")
+	}
+	defaults := v.Defaults.Defaults()
+	if defaults == nil || defaults.Tenants == nil {
+		return nil, nil
+	}
+	tenants := defaults.Tenants
+	if req, err := admission.RequestFromContext(ctx); err == nil && tenants.isAdmin(req.UserInfo.Groups) {
+		return nil, nil
+	}
+
+	errs, warnings := tenants.Check(namespace, old, defaults)
+	if len(errs) > 0 {
+		namespacelog.Info("rejected namespace settings outside the tenant policy", "namespace", namespace.Name,
+			"violations", errs.ToAggregate().Error())
+		return warnings, apierrors.NewForbidden(corev1.Resource("namespaces"), namespace.Name, errs.ToAggregate())
+	}
+	return warnings, nil
+}
@@ -0,0 +1,95 @@
+// PURPOSE: Tracks the CPU architectures of the cluster's Nodes from a metadata-only informer
+package v1
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// NodeArchitectures keeps the kubernetes.io/arch label of every Node. Only Node metadata is cached.
+type NodeArchitectures struct {
+	informers cache.Informers
+
+	mu    sync.RWMutex
+	nodes map[string]string
+}
+
+// NewNodeArchitectures returns a tracker fed by informers. It must be added to the manager to start.
+func NewNodeArchitectures(informers cache.Informers) *NodeArchitectures {
+	return &NodeArchitectures{informers: informers, nodes: map[string]string{}}
+}
+
+// Start registers the event handlers and waits for the initial list. Until then, Architectures
+// returns nothing and only the pod's own scheduling constraints are considered.
+func (n *NodeArchitectures) Start(ctx context.Context) error {
+	nodes := &metav1.PartialObjectMetadata{}
+	nodes.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Node"))
+	informer, err := n.informers.GetInformer(ctx, nodes)
+	if err != nil {
+		return err
+	}
+	registration, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    n.update,
+		UpdateFunc: func(_, obj any) { n.update(obj) },
+		DeleteFunc: n.delete,
+	})
+	if err != nil {
+		return err
+	}
+	if !toolscache.WaitForCacheSync(ctx.Done(), registration.HasSynced) {
+		return errors.New("node informer did not sync")
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection returns false so every replica serving admission keeps its own view.
+func (n *NodeArchitectures) NeedLeaderElection() bool {
+	return false
+}
+
+// Architectures returns the distinct architectures of the known Nodes, sorted.
+func (n *NodeArchitectures) Architectures() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	seen := map[string]bool{}
+	for _, architecture := range n.nodes {
+		seen[architecture] = true
+	}
+	return slices.Sorted(maps.Keys(seen))
+}
+
+// Set records the architecture of the named Node. Nodes without the label are not counted.
+func (n *NodeArchitectures) Set(name, architecture string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if architecture == "" {
+		delete(n.nodes, name)
+		return
+	}
+	n.nodes[name] = architecture
+}
+
+func (n *NodeArchitectures) update(obj any) {
+	if node, ok := obj.(*metav1.PartialObjectMetadata); ok {
+		n.Set(node.Name, node.Labels[corev1.LabelArchStable])
+	}
+}
+
+func (n *NodeArchitectures) delete(obj any) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if node, ok := obj.(*metav1.PartialObjectMetadata); ok {
+		n.Set(node.Name, "")
+	}
+}
@@ -0,0 +1,233 @@
+// PURPOSE: Architecture policy: which architectures a pod can run on and what to do when a target lacks one
+package v1
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
+)
+
+// AnnotationArchitecturePolicy sets what a namespace does when a verified target lacks an architecture
+// its pods can be scheduled on.
+const AnnotationArchitecturePolicy = "image-rewriter.example.com/architecture-policy"
+
+// Architecture policies, applied when images are verified.
+const (
+	// ArchitecturePolicyFallback rejects targets lacking a needed architecture, trying the next
+	// target or keeping the original image. The default.
+	ArchitecturePolicyFallback = "fallback"
+	// ArchitecturePolicyWarn rewrites anyway and returns an admission warning naming the missing
+	// architectures.
+	ArchitecturePolicyWarn = "warn"
+	// ArchitecturePolicyIgnore only checks that the image exists.
+	ArchitecturePolicyIgnore = "ignore"
+)
+
+var architecturePolicies = []string{ArchitecturePolicyFallback, ArchitecturePolicyWarn, ArchitecturePolicyIgnore}
+
+// validArchitecturePolicy reports whether value is an architecture policy, the empty default included.
+func validArchitecturePolicy(value string) bool {
+	return value == "" || sets.New(architecturePolicies...).Has(value)
+}
+
+// architecturePolicy returns the effective architecture policy of p.
+func (p Policy) architecturePolicy() string {
+	if p.ArchitecturePolicy == "" {
+		return ArchitecturePolicyFallback
+	}
+	return p.ArchitecturePolicy
+}
+
+// ArchitectureLister lists the architectures of the cluster's Nodes, as NodeArchitectures does.
+type ArchitectureLister interface {
+	Architectures() []string
+}
+
+// PlatformWarner returns admission warnings for images of a pod that lack an architecture it needs.
+type PlatformWarner interface {
+	PlatformWarnings(ctx context.Context, pod, old *corev1.Pod) admission.Warnings
+}
+
+// requiredArchitectures returns the architectures pod may be scheduled on: those of the cluster's
+// Nodes its kubernetes.io/arch nodeSelector and required node affinity allow. Without known Nodes,
+// the architectures the constraints name are used, so an unconstrained pod requires none.
+func (d *PodCustomDefaulter) requiredArchitectures(pod *corev1.Pod) []string {
+	var candidates []string
+	if d.Nodes != nil {
+		candidates = d.Nodes.Architectures()
+	}
+	if len(candidates) == 0 {
+		candidates = namedArchitectures(pod)
+	}
+	var required []string
+	for _, architecture := range candidates {
+		if allowsArchitecture(pod, architecture) {
+			required = append(required, architecture)
+		}
+	}
+	return required
+}
+
+// namedArchitectures returns the architectures named by the kubernetes.io/arch constraints of pod.
+func namedArchitectures(pod *corev1.Pod) []string {
+	named := sets.New[string]()
+	if architecture, ok := pod.Spec.NodeSelector[corev1.LabelArchStable]; ok {
+		named.Insert(architecture)
+	}
+	for _, term := range requiredNodeSelectorTerms(pod) {
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == corev1.LabelArchStable && expression.Operator == corev1.NodeSelectorOpIn {
+				named.Insert(expression.Values...)
+			}
+		}
+	}
+	return sets.List(named)
+}
+
+// allowsArchitecture reports whether the scheduling constraints of pod allow a Node of architecture.
+// Expressions on other labels are assumed to be satisfiable.
+func allowsArchitecture(pod *corev1.Pod, architecture string) bool {
+	if selected, ok := pod.Spec.NodeSelector[corev1.LabelArchStable]; ok && selected != architecture {
+		return false
+	}
+	terms := requiredNodeSelectorTerms(pod)
+	if len(terms) == 0 {
+		return true
+	}
+	// Terms are ORed, the expressions of a term ANDed
+	for _, term := range terms {
+		if termAllowsArchitecture(term, architecture) {
+			return true
+		}
+	}
+	return false
+}
+
+func termAllowsArchitecture(term corev1.NodeSelectorTerm, architecture string) bool {
+	for _, expression := range term.MatchExpressions {
+		if expression.Key != corev1.LabelArchStable {
+			continue
+		}
+		switch expression.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !slices.Contains(expression.Values, architecture) {
+				return false
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if slices.Contains(expression.Values, architecture) {
+				return false
+			}
+		case corev1.NodeSelectorOpDoesNotExist:
+			return false
+		}
+	}
+	return true
+}
+
+func requiredNodeSelectorTerms(pod *corev1.Pod) []corev1.NodeSelectorTerm {
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.NodeAffinity == nil ||
+		affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return nil
+	}
+	return affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+}
+
+// withArchitectures asks verification in ctx to reject targets lacking an architecture pod needs, under
+// the fallback policy. It records the architectures when explaining.
+func (d *PodCustomDefaulter) withArchitectures(ctx context.Context, pod *corev1.Pod, policy Policy) context.Context {
+	trace := traceFrom(ctx)
+	mode := policy.architecturePolicy()
+	if mode == ArchitecturePolicyIgnore {
+		trace.record(stepPlatforms, outcomeSkipped, "architecture policy "+mode)
+		return ctx
+	}
+	required := d.requiredArchitectures(pod)
+	if len(required) == 0 {
+		trace.record(stepPlatforms, outcomeNotSet, "no node architectures known and none required by the pod")
+		return ctx
+	}
+	trace.record(stepPlatforms, outcomeMatched, fmt.Sprintf("requires %s, %s", strings.Join(required, ", "), mode))
+	if mode != ArchitecturePolicyFallback {
+		return ctx
+	}
+	return registry.WithArchitectures(ctx, required)
+}
+
+// PlatformWarnings implements PlatformWarner for namespaces with the warn architecture policy. Images
+// already on one of their targets and changed from old are checked against the architectures the pod
+// needs. Registry errors are logged and do not warn.
+func (d *PodCustomDefaulter) PlatformWarnings(ctx context.Context, pod, old *corev1.Pod) admission.Warnings {
+	compiled, err := d.ResolveNamespace(ctx, pod.Namespace)
+	if err != nil || !compiled.Enabled || !compiled.Configured {
+		return nil
+	}
+	policy := compiled.Policy
+	if !policy.Verify || policy.architecturePolicy() != ArchitecturePolicyWarn || d.Rewriter == nil {
+		return nil
+	}
+	verifier, ok := d.Rewriter.Verifier.(registry.PlatformVerifier)
+	if !ok {
+		return nil
+	}
+	required := d.requiredArchitectures(pod)
+	if len(required) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.verifyBudget())
+	defer cancel()
+	if d.Credentials != nil {
+		ctx = auth.WithKeyring(ctx, d.Credentials.Resolve(ctx, pod))
+	}
+
+	previous := map[string]string{}
+	if old != nil {
+		previous = podImages(old)
+	}
+	var warnings admission.Warnings
+	for location := range ImageLocations(pod) {
+		image := *location.Image
+		if previous[location.String()] == image || !policy.onTarget(pod, location) {
+			continue
+		}
+		available, exists, err := verifier.ManifestArchitectures(ctx, image)
+		if err != nil {
+			logFor(ctx).Error(err, "failed to read image architectures", "namespace", pod.Namespace,
+				"pod_name", podName(pod), "container_name", location.Name, "image", image)
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if missing := registry.MissingArchitectures(available, required); len(missing) > 0 {
+			logFor(ctx).Info("image lacks architectures the pod can be scheduled on", "namespace", pod.Namespace,
+				"pod_name", podName(pod), "container_name", location.Name, "image", image, "missing", missing)
+			warnings = append(warnings, fmt.Sprintf("%s image %s lacks architecture %s",
+				location, image, strings.Join(missing, ", ")))
+		}
+	}
+	return warnings
+}
+
+// onTarget reports whether the image at location of pod is where the policy would rewrite it to.
+func (p Policy) onTarget(pod *corev1.Pod, location ImageLocation) bool {
+	candidates, _, err := p.Candidates(pod, location)
+	if err != nil {
+		return false
+	}
+	for _, candidate := range candidates {
+		if candidate.Image == *location.Image {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+// PURPOSE: Unit tests for the architectures a pod needs and the architecture policy of verified targets
+package v1
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/registrytest"
+)
+
+// archAffinity returns a required node affinity with one term per list of In values.
+func archAffinity(operator corev1.NodeSelectorOperator, terms ...[]string) *corev1.Affinity {
+	selector := &corev1.NodeSelector{}
+	for _, values := range terms {
+		selector.NodeSelectorTerms = append(selector.NodeSelectorTerms, corev1.NodeSelectorTerm{
+			MatchExpressions: []corev1.NodeSelectorRequirement{
+				{Key: "topology.kubernetes.io/zone", Operator: corev1.NodeSelectorOpExists},
+				{Key: corev1.LabelArchStable, Operator: operator, Values: values},
+			},
+		})
+	}
+	return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: selector}}
+}
+
+func TestPodDefaulter_RequiredArchitectures(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodes    []string
+		selector map[string]string
+		affinity *corev1.Affinity
+		want     []string
+	}{
+		{name: "all node architectures", nodes: []string{"amd64", "arm64"}, want: []string{"amd64", "arm64"}},
+		{name: "nodeSelector", nodes: []string{"amd64", "arm64"},
+			selector: map[string]string{corev1.LabelArchStable: "arm64"}, want: []string{"arm64"}},
+		{name: "affinity In", nodes: []string{"amd64", "arm64", "s390x"},
+			affinity: archAffinity(corev1.NodeSelectorOpIn, []string{"amd64", "s390x"}), want: []string{"amd64", "s390x"}},
+		{name: "affinity NotIn", nodes: []string{"amd64", "arm64"},
+			affinity: archAffinity(corev1.NodeSelectorOpNotIn, []string{"arm64"}), want: []string{"amd64"}},
+		{name: "terms are ORed", nodes: []string{"amd64", "arm64", "s390x"},
+			affinity: archAffinity(corev1.NodeSelectorOpIn, []string{"amd64"}, []string{"arm64"}),
+			want:     []string{"amd64", "arm64"}},
+		{name: "no nodes known", selector: map[string]string{corev1.LabelArchStable: "arm64"}, want: []string{"arm64"}},
+		{name: "unconstrained without nodes"},
+	}
+	for _, tt := range tests {
+		nodes := NewNodeArchitectures(nil)
+		for i, architecture := range tt.nodes {
+			nodes.Set("node-"+string(rune('a'+i)), architecture)
+		}
+		defaulter := &PodCustomDefaulter{Nodes: nodes}
+		pod := &corev1.Pod{Spec: corev1.PodSpec{NodeSelector: tt.selector, Affinity: tt.affinity}}
+
+		if got := defaulter.requiredArchitectures(pod); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestNodeArchitectures_TracksNodeLabels(t *testing.T) {
+	nodes := NewNodeArchitectures(nil)
+	node := func(name, architecture string) *metav1.PartialObjectMetadata {
+		return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Labels: map[string]string{corev1.LabelArchStable: architecture},
+		}}
+	}
+	nodes.update(node("a", "amd64"))
+	nodes.update(node("b", "arm64"))
+	nodes.update(node("c", "arm64"))
+	nodes.delete(node("b", "arm64"))
+	if got := nodes.Architectures(); !slices.Equal(got, []string{"amd64", "arm64"}) {
+		t.Errorf("Expected amd64 and arm64, got %v", got)
+	}
+
+	nodes.delete(node("c", "arm64"))
+	if got := nodes.Architectures(); !slices.Equal(got, []string{"amd64"}) {
+		t.Errorf("Expected only amd64 once the arm64 nodes are gone, got %v", got)
+	}
+}
+
+// newPlatformDefaulter returns a defaulter of test-namespace verifying against two targets, where only
+// the second has an arm64 nginx, on a cluster with amd64 and arm64 nodes.
+func newPlatformDefaulter(t *testing.T, mode string) (*PodCustomDefaulter, string, string) {
+	t.Helper()
+	first := registrytest.New(t)
+	second := registrytest.New(t)
+	first.PushImage("nginx", "latest", "linux/amd64")
+	second.PushImage("nginx", "latest", "linux/amd64", "linux/arm64")
+
+	namespace := resolverNamespace()
+	namespace.Annotations[AnnotationTargetRegistries] = first.Host() + "," + second.Host()
+	if mode != "" {
+		namespace.Annotations[AnnotationArchitecturePolicy] = mode
+	}
+	defaulter, _ := newResolvedDefaulter(namespace)
+	defaulter.Rewriter = &registry.Rewriter{Verifier: registry.NewVerifier(registry.VerifierOptions{Client: first.Client()})}
+	nodes := NewNodeArchitectures(nil)
+	nodes.Set("node-a", "amd64")
+	nodes.Set("node-b", "arm64")
+	defaulter.Nodes = nodes
+	return defaulter, first.Host(), second.Host()
+}
+
+func TestPodDefaulter_ArchitecturePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		mode     string
+		selector map[string]string
+		want     int // index of the expected target
+	}{
+		{mode: "", want: 1},
+		{mode: ArchitecturePolicyFallback, want: 1},
+		{mode: ArchitecturePolicyFallback, selector: map[string]string{corev1.LabelArchStable: "amd64"}, want: 0},
+		{mode: ArchitecturePolicyWarn, want: 0},
+		{mode: ArchitecturePolicyIgnore, want: 0},
+	} {
+		defaulter, first, second := newPlatformDefaulter(t, tt.mode)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-namespace"},
+			Spec: corev1.PodSpec{
+				NodeSelector: tt.selector,
+				Containers:   []corev1.Container{{Name: "nginx", Image: testNginxImage}},
+			},
+		}
+		if err := defaulter.Default(context.Background(), pod); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		want := []string{first, second}[tt.want] + "/nginx:latest"
+		if got := pod.Spec.Containers[0].Image; got != want {
+			t.Errorf("Expected %s with architecture policy %q and node selector %v, got %s", want, tt.mode, tt.selector, got)
+		}
+	}
+}
+
+func TestPodCustomValidator_WarnsAboutMissingArchitectures(t *testing.T) {
+	for _, tt := range []struct {
+		mode     string
+		warnings int
+	}{
+		{ArchitecturePolicyWarn, 1},
+		{ArchitecturePolicyFallback, 0},
+		{ArchitecturePolicyIgnore, 0},
+	} {
+		defaulter, first, second := newPlatformDefaulter(t, tt.mode)
+		validator := &PodCustomValidator{Namespaces: defaulter, Platforms: defaulter}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-namespace"},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "amd64-only", Image: first + "/nginx:latest"},
+				{Name: "multi-arch", Image: second + "/nginx:latest"},
+				{Name: "elsewhere", Image: "docker.io/library/redis:7.2"},
+			}},
+		}
+
+		warnings, err := validator.ValidateCreate(context.Background(), pod)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if len(warnings) != tt.warnings {
+			t.Fatalf("Expected %d warnings with architecture policy %s, got %v", tt.warnings, tt.mode, warnings)
+		}
+		if tt.warnings > 0 && !strings.Contains(warnings[0], "container amd64-only image "+first+"/nginx:latest lacks architecture arm64") {
+			t.Errorf("Expected a warning naming the container and the missing architecture, got %q", warnings[0])
+		}
+
+		// Unchanged images are not checked again on update
+		warnings, _ = validator.ValidateUpdate(context.Background(), pod.DeepCopy(), pod)
+		if len(warnings) != 0 {
+			t.Errorf("Expected no warnings for unchanged images, got %v", warnings)
+		}
+	}
+}
@@ -19,9 +19,13 @@ package v1
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -31,6 +35,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
 )
 
 // nolint:unused
@@ -38,21 +43,116 @@ import (
 var podlog = logf.Log.WithName("pod-resource")
 
 const (
-	LabelRegistryRewrite     = "registry-rewrite"
-	LabelValueEnabled        = "enabled"
-	AnnotationTargetRegistry = "image-rewriter.example.com/target-registry"
+	LabelRegistryRewrite       = "registry-rewrite"
+	LabelValueEnabled          = "enabled"
+	AnnotationTargetRegistry   = "image-rewriter.example.com/target-registry"
+	AnnotationTargetRegistries = "image-rewriter.example.com/target-registries"
+	AnnotationVerify           = "image-rewriter.example.com/verify"
+	AnnotationDryRun           = "image-rewriter.example.com/dry-run"
+	// AnnotationPreserveRegistries lists registries whose images are never rewritten.
+	AnnotationPreserveRegistries = "image-rewriter.example.com/preserve-registry"
+	// AnnotationRewriteLocalRegistries set to "false" leaves localhost and private-network registries alone.
+	AnnotationRewriteLocalRegistries = "image-rewriter.example.com/rewrite-local-registries"
+
+	// DefaultVerifyBudget is the time allowed for verifying the images of a single pod.
+	DefaultVerifyBudget = time.Second
 )
 
+// WebhookOptions holds the operator-level settings of the Pod webhook.
+type WebhookOptions struct {
+	// RegistryCredentialsSecret names a dockerconfigjson Secret used for registry lookups
+	// in addition to the pod's own pull secrets. Optional.
+	RegistryCredentialsSecret types.NamespacedName
+	// PullSecrets are injected into pods rewritten to their registry.
+	PullSecrets []PullSecret
+	// Mirrors, when set, is told about every rewrite decision so the image can be copied to the target.
+	Mirrors MirrorEnqueuer
+	// Policies serves namespace policies to every defaulter built from these options. The webhook
+	// creates its own when nil.
+	Policies *PolicyResolver
+}
+
 // SetupPodWebhookWithManager registers the webhook for Pod in the manager.
-func SetupPodWebhookWithManager(mgr ctrl.Manager) error {
+func SetupPodWebhookWithManager(mgr ctrl.Manager, opts WebhookOptions) error {
+	defaulter, err := NewPodCustomDefaulter(mgr, opts)
+	if err != nil {
+		return err
+	}
+	nodes := NewNodeArchitectures(mgr.GetCache())
+	if err := mgr.Add(nodes); err != nil {
+		return err
+	}
+	defaulter.Nodes = nodes
+	if defaulter.Policies == nil {
+		defaulter.Policies = NewPolicyResolver(mgr.GetCache())
+		if err := mgr.Add(defaulter.Policies); err != nil {
+			return err
+		}
+	}
+	if defaulter.Policies.Recorder == nil {
+		defaulter.Policies.Recorder = mgr.GetEventRecorderFor("image-rewriter-config")
+	}
+
+	// Served by the metrics server, behind the same authentication and authorization as /metrics
+	if err := mgr.AddMetricsServerExtraHandler(ExplainPath, ExplainHandler(defaulter)); err != nil {
+		return err
+	}
+	if err := mgr.AddMetricsServerExtraHandler(ConfigPath, ConfigHandler(defaulter)); err != nil {
+		return err
+	}
+
 	return ctrl.NewWebhookManagedBy(mgr).For(&corev1.Pod{}).
-		WithValidator(&PodCustomValidator{}).
-		WithDefaulter(&PodCustomDefaulter{
-			Client: mgr.GetClient(),
-		}).
+		WithValidator(&PodCustomValidator{Namespaces: defaulter, Platforms: defaulter}).
+		WithDefaulter(defaulter).
 		Complete()
 }
 
+// NewPodCustomDefaulter returns a defaulter that verifies images with the manager's registry credentials
+// and skips unhealthy targets.
+func NewPodCustomDefaulter(mgr ctrl.Manager, opts WebhookOptions) (*PodCustomDefaulter, error) {
+	// The prober refreshes target registry health in the background while the manager runs
+	prober := registry.NewHealthProber(registry.HealthProberOptions{})
+	if err := mgr.Add(prober); err != nil {
+		return nil, err
+	}
+
+	verifier := registry.NewVerifier(registry.VerifierOptions{
+		Client: &http.Client{
+			Transport: auth.NewTransport(NewTracedTransport(nil)),
+			Timeout:   registry.DefaultVerifyTimeout,
+		},
+		CredentialKey: auth.CredentialKey,
+	})
+
+	return &PodCustomDefaulter{
+		Client: mgr.GetClient(),
+		Rewriter: &registry.Rewriter{
+			Verifier: verifier,
+			Health:   prober,
+		},
+		// Secrets are read directly rather than through the cache, which would otherwise
+		// hold every Secret in the cluster
+		Credentials: &auth.Provider{
+			Reader:         mgr.GetAPIReader(),
+			OperatorSecret: opts.RegistryCredentialsSecret,
+		},
+		PullSecrets: PullSecretNames(opts.PullSecrets),
+		Mirrors:     opts.Mirrors,
+		Policies:    opts.Policies,
+	}, nil
+}
+
+// CredentialResolver supplies the registry credentials available to a pod.
+type CredentialResolver interface {
+	Resolve(ctx context.Context, pod *corev1.Pod) auth.Keyring
+}
+
+// MirrorEnqueuer accepts original and rewritten image pairs to copy to the target registry.
+// Enqueue must not block admission.
+type MirrorEnqueuer interface {
+	Enqueue(source, target string)
+}
+
 // TODO(user): EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 
 // +kubebuilder:webhook:path=/mutate--v1-pod,mutating=true,failurePolicy=Ignore,sideEffects=None,groups="",resources=pods,verbs=create;update,versions=v1,name=mpod-v1.kb.io,admissionReviewVersions=v1
@@ -64,6 +164,23 @@ func SetupPodWebhookWithManager(mgr ctrl.Manager) error {
 // as it is used only for temporary operations and does not need to be deeply copied.
 type PodCustomDefaulter struct {
 	Client client.Client
+	// Policies, when set, serves namespace policies from memory instead of reading the Namespace.
+	Policies *PolicyResolver
+
+	// Rewriter chooses between candidate targets. A Rewriter without a verifier is used when nil.
+	Rewriter *registry.Rewriter
+	// VerifyBudget bounds the time spent verifying all images of one pod. Defaults to DefaultVerifyBudget.
+	VerifyBudget time.Duration
+	// Credentials, when set, authenticates verification requests with the pod's pull secrets.
+	Credentials CredentialResolver
+	// PullSecrets maps target registry hosts to the Secret appended to spec.imagePullSecrets
+	// when an image is rewritten to that registry.
+	PullSecrets map[string]string
+	// Mirrors, when set, receives the image pairs of rewrite decisions for pre-warming.
+	Mirrors MirrorEnqueuer
+	// Nodes, when set, lists the architectures of the cluster's Nodes, which verified targets must
+	// provide unless the pod's scheduling constraints exclude them.
+	Nodes ArchitectureLister
 }
 
 var _ webhook.CustomDefaulter = &PodCustomDefaulter{}
@@ -75,60 +192,259 @@ func (d *PodCustomDefaulter) Default(ctx context.Context, obj runtime.Object) er
 	if !ok {
 		return fmt.Errorf("expected an Pod object but got %T", obj)
 	}
-	podlog.Info("Defaulting for Pod", "name", pod.GetName())
 
-	// Get the namespace
-	namespace := &corev1.Namespace{}
-	if err := d.Client.Get(ctx, types.NamespacedName{Name: pod.Namespace}, namespace); err != nil {
-		podlog.Error(err, "failed to get namespace", "namespace", pod.Namespace)
-		return nil // fail-safe: don't block pod creation
+	ctx, span := startSpan(ctx, spanAdmission, attrNamespace.String(pod.Namespace), attrPod.String(podName(pod)))
+	if req, err := admission.RequestFromContext(ctx); err == nil {
+		span.SetAttributes(attrUID.String(string(req.UID)), attrOperation.String(string(req.Operation)))
 	}
+	logFor(ctx).Info("Defaulting for Pod", "name", pod.GetName())
+
+	decision, err := d.mutate(ctx, pod)
+	span.SetAttributes(attrDecision.String(decision))
+	endSpan(span, err)
+	return err
+}
 
-	// Check for label
-	if namespace.Labels[LabelRegistryRewrite] != LabelValueEnabled {
-		return nil // not enabled for this namespace
+// mutate resolves the policy of the pod's namespace and applies it, recording each step to the
+// trace in ctx when explaining. It returns the decision recorded on the admission span.
+func (d *PodCustomDefaulter) mutate(ctx context.Context, pod *corev1.Pod) (string, error) {
+	trace := traceFrom(ctx)
+
+	resolveCtx, span := startSpan(ctx, spanResolvePolicy, attrNamespace.String(pod.Namespace))
+	compiled, err := d.ResolveNamespace(resolveCtx, pod.Namespace)
+	span.SetAttributes(attrEnabled.Bool(compiled.Enabled), attrConfigured.Bool(compiled.Configured))
+	endSpan(span, err)
+	if err != nil {
+		logFor(ctx).Error(err, "failed to get namespace", "namespace", pod.Namespace)
+		trace.record(stepNamespace, outcomeFailed, err.Error())
+		return decisionSkipped, nil // fail-safe: don't block pod creation
+	}
+	if trace != nil {
+		trace.Steps = append(trace.Steps, compiled.steps...)
 	}
 
-	// Check for annotation
-	targetRegistry, ok := namespace.Annotations[AnnotationTargetRegistry]
-	if !ok || targetRegistry == "" {
-		podlog.Info("skipping pod - missing target registry annotation", "namespace", pod.Namespace)
-		return nil
+	if !compiled.Enabled {
+		return decisionSkipped, nil // not enabled for this namespace
+	}
+	if !compiled.Configured {
+		logFor(ctx).Info("skipping pod - missing target registry annotation", "namespace", pod.Namespace)
+		return decisionSkipped, nil
 	}
 
-	// Rewrite images for all container types
-	for i := range pod.Spec.Containers {
-		rewritten, err := registry.RewriteImage(pod.Spec.Containers[i].Image, targetRegistry)
-		if err != nil {
-			podlog.Error(err, "failed to rewrite image", "original", pod.Spec.Containers[i].Image)
-			continue // fail-safe: skip this container
+	admitted := pod.DeepCopy()
+	if err := d.ApplyPolicy(ctx, pod, compiled.Policy); err != nil {
+		return decisionRejected, err
+	}
+	if apiequality.Semantic.DeepEqual(admitted, pod) {
+		return decisionUnchanged, nil
+	}
+	return decisionMutated, nil
+}
+
+// ResolveNamespace returns the compiled policy of the named namespace from the resolver, falling back
+// to reading the Namespace while the resolver has not synced or has not seen it yet.
+func (d *PodCustomDefaulter) ResolveNamespace(ctx context.Context, name string) (NamespacePolicy, error) {
+	if d.Policies != nil {
+		if compiled, ok := d.Policies.Resolve(name); ok {
+			return compiled, nil
 		}
-		pod.Spec.Containers[i].Image = rewritten
 	}
 
-	// Rewrite init container images
-	for i := range pod.Spec.InitContainers {
-		rewritten, err := registry.RewriteImage(pod.Spec.InitContainers[i].Image, targetRegistry)
-		if err != nil {
-			podlog.Error(err, "failed to rewrite init container image", "original", pod.Spec.InitContainers[i].Image)
-			continue // fail-safe: skip this container
+	namespace := &corev1.Namespace{}
+	if err := d.Client.Get(ctx, types.NamespacedName{Name: name}, namespace); err != nil {
+		return NamespacePolicy{}, err
+	}
+	var defaults *Defaults
+	if d.Policies != nil {
+		defaults = d.Policies.Defaults()
+	}
+	return CompileNamespacePolicy(namespace, defaults), nil
+}
+
+// ApplyPolicy rewrites the images of pod according to policy. It is the part of Default that does
+// not depend on the cluster, shared with the offline rewrite CLI so both make the same decisions.
+func (d *PodCustomDefaulter) ApplyPolicy(ctx context.Context, pod *corev1.Pod, policy Policy) error {
+	if policy.Verify {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.verifyBudget())
+		defer cancel()
+
+		if d.Credentials != nil {
+			ctx = auth.WithKeyring(ctx, d.Credentials.Resolve(ctx, pod))
 		}
-		pod.Spec.InitContainers[i].Image = rewritten
+		ctx = d.withArchitectures(ctx, pod, policy)
 	}
 
-	// Rewrite ephemeral container images
-	for i := range pod.Spec.EphemeralContainers {
-		rewritten, err := registry.RewriteImage(pod.Spec.EphemeralContainers[i].Image, targetRegistry)
+	// Rewrite the images of containers of every kind and of image volumes
+	for location := range ImageLocations(pod) {
+		rewritten, ok, err := d.rewrite(ctx, pod, location, policy)
 		if err != nil {
-			podlog.Error(err, "failed to rewrite ephemeral container image", "original", pod.Spec.EphemeralContainers[i].Image)
-			continue // fail-safe: skip this container
+			return err
+		}
+		if ok {
+			*location.Image = rewritten
 		}
-		pod.Spec.EphemeralContainers[i].Image = rewritten
 	}
-
 	return nil
 }
 
+// rewrite applies the policy to the image at location, returning false when the image should be left
+// untouched. It returns an error only when the policy's failure mode rejects pods with images that
+// cannot be rewritten. While explaining, the decision is traced instead of audited and has no side effects.
+func (d *PodCustomDefaulter) rewrite(ctx context.Context, pod *corev1.Pod, location ImageLocation,
+	policy Policy) (rewritten string, ok bool, err error) {
+	containerName, image := location.Name, *location.Image
+	trace := traceFrom(ctx)
+	ctx, span := startSpan(ctx, spanRewriteImage, attrContainer.String(containerName), attrImage.String(image))
+	defer func() { endSpan(span, err) }()
+
+	if entry, ok := policy.Excludes(image); ok {
+		reason := fmt.Sprintf("registry %s is preserved", entry)
+		trace.record(stepExclusions, outcomeSkipped, reason)
+		if trace == nil {
+			auditSkipped(ctx, pod, containerName, image, reason)
+		}
+		return "", false, nil
+	}
+	trace.record(stepExclusions, outcomePassed, fmt.Sprintf("no match in %v", policy.PreserveRegistries))
+
+	host := registry.ImageRegistry(image)
+	if !policy.rewritesLocalRegistries() && registry.IsLocalRegistry(host) {
+		reason := fmt.Sprintf("registry %s is local", host)
+		trace.record(stepLocalRegistry, outcomeSkipped, reason)
+		if trace == nil {
+			auditSkipped(ctx, pod, containerName, image, reason)
+		}
+		return "", false, nil
+	}
+	trace.record(stepLocalRegistry, outcomePassed, "")
+
+	candidates, rule, err := policy.Candidates(pod, location)
+	if err == nil && rule >= 0 && policy.RewriteRules[rule].Keep {
+		reason := fmt.Sprintf("kept by rule %d %q for %s", rule, policy.RewriteRules[rule].Match,
+			policy.RewriteRules[rule].describe())
+		trace.record(stepRules, outcomeSkipped, reason)
+		if trace == nil {
+			auditSkipped(ctx, pod, containerName, image, reason)
+		}
+		return "", false, nil
+	}
+	if err == nil && len(candidates) == 0 {
+		reason := fmt.Sprintf("no target for registry %s", host)
+		trace.record(stepRewrite, outcomeSkipped, reason)
+		if trace == nil {
+			auditSkipped(ctx, pod, containerName, image, reason)
+		}
+		return "", false, nil
+	}
+	if rule >= 0 {
+		trace.record(stepRules, outcomeMatched, fmt.Sprintf("rule %d %q for %s", rule, policy.RewriteRules[rule].Match,
+			policy.RewriteRules[rule].describe()))
+	} else if len(policy.RewriteRules) > 0 {
+		trace.record(stepRules, outcomePassed, fmt.Sprintf("none of %d rules matched", len(policy.RewriteRules)))
+	}
+	if registry.HasImplicitTag(image) {
+		kept := policy.keepsTagless(image)
+		trace.record(stepTagPolicy, outcomeMatched, fmt.Sprintf("no tag or digest, %s: appending latest=%t",
+			policy.tagPolicy(), !kept))
+		if trace == nil {
+			logFor(ctx).Info("image has no tag or digest", "namespace", pod.Namespace, "pod_name", podName(pod),
+				"container_name", containerName, "original_image", image, "tag_policy", policy.tagPolicy(),
+				"appended_latest", !kept)
+		}
+	}
+
+	rewriter := d.Rewriter
+	if rewriter == nil {
+		rewriter = &registry.Rewriter{}
+	}
+
+	var outcome registry.Outcome
+	if err == nil {
+		outcome, err = rewriter.Choose(ctx, image, candidates, policy.Verify)
+	}
+	if err != nil {
+		trace.record(stepRewrite, outcomeFailed, err.Error())
+		if trace == nil {
+			auditError(ctx, pod, containerName, image, err)
+		}
+		return "", false, failClosed(trace, policy, containerName, image, err) // fail-safe unless failing closed
+	}
+	if trace != nil {
+		traceOutcome(trace, image, outcome, policy)
+		if outcome.Target == "" {
+			_ = failClosed(trace, policy, containerName, image, errors.New(outcome.Reason))
+		}
+		return outcome.Image, !policy.DryRun, nil
+	}
+
+	auditOutcome(ctx, pod, containerName, image, outcome, policy.DryRun)
+	d.enqueueMirror(image, outcome, candidates[0])
+	if policy.DryRun {
+		return "", false, nil
+	}
+	if outcome.Target == "" {
+		return "", false, failClosed(trace, policy, containerName, image, errors.New(outcome.Reason))
+	}
+	d.injectPullSecret(pod, outcome.Target)
+	return outcome.Image, true, nil
+}
+
+// failClosed returns the error rejecting the pod when policy fails closed, and records it when
+// explaining. Dry-run policies never reject.
+func failClosed(trace *Trace, policy Policy, containerName, image string, cause error) error {
+	if policy.FailureMode != FailureModeFail || policy.DryRun {
+		return nil
+	}
+	err := fmt.Errorf("image %s of container %s cannot be rewritten: %w", image, containerName, cause)
+	trace.record(stepResult, "rejected", fmt.Sprintf("failure mode %s: %v", FailureModeFail, err))
+	return err
+}
+
+// traceOutcome records the candidate targets the rewriter tried.
+func traceOutcome(trace *Trace, image string, outcome registry.Outcome, policy Policy) {
+	trace.Target = outcome.Target
+	if outcome.Target != "" && outcome.Image == image {
+		trace.record(stepIdempotency, outcomeSkipped, "image is already on target "+outcome.Target)
+		return
+	}
+	trace.record(stepIdempotency, outcomePassed, "image is not on a target registry")
+
+	for _, rejection := range outcome.Rejections {
+		trace.record(stepCandidate, "rejected", rejection)
+	}
+	switch {
+	case outcome.Target == "":
+		trace.record(stepRewrite, outcomeSkipped, "no target has the image, keeping the original")
+	case policy.DryRun:
+		trace.record(stepRewrite, "dry-run", fmt.Sprintf("would rewrite to %s, pod left unchanged", outcome.Image))
+	default:
+		trace.record(stepRewrite, outcomeMatched, fmt.Sprintf("target %s, verified=%t", outcome.Target, policy.Verify))
+	}
+}
+
+// enqueueMirror hands the image to the mirror queue when it was, or would have been, rewritten.
+// An image kept because no target had it is queued for the preferred candidate.
+func (d *PodCustomDefaulter) enqueueMirror(image string, outcome registry.Outcome, preferred registry.Candidate) {
+	if d.Mirrors == nil {
+		return
+	}
+	target := outcome.Image
+	if outcome.Target == "" {
+		target = preferred.Image
+	}
+	if target != image {
+		d.Mirrors.Enqueue(image, target)
+	}
+}
+
+func (d *PodCustomDefaulter) verifyBudget() time.Duration {
+	if d.VerifyBudget > 0 {
+		return d.VerifyBudget
+	}
+	return DefaultVerifyBudget
+}
+
 // TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
 // NOTE: The 'path' attribute must follow a specific pattern and should not be modified directly here.
 // Modifying the path for an invalid path can cause API server errors; failing to locate the webhook.
@@ -140,35 +456,45 @@ func (d *PodCustomDefaulter) Default(ctx context.Context, obj runtime.Object) er
 // NOTE: The +kubebuilder:object:generate=false marker prevents controller-gen from generating DeepCopy methods,
 // as this struct is used only for temporary operations and does not need to be deeply copied.
 type PodCustomValidator struct {
-	// TODO(user): Add more fields as needed for validation
+	// Namespaces resolves the tag policy of the pod's namespace. Pods are always allowed when nil.
+	Namespaces NamespaceResolver
+	// Platforms, when set, warns about images lacking an architecture the pod needs.
+	Platforms PlatformWarner
 }
 
 var _ webhook.CustomValidator = &PodCustomValidator{}
 
 // ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type Pod.
-func (v *PodCustomValidator) ValidateCreate(_ context.Context, obj runtime.Object) (admission.Warnings, error) {
+func (v *PodCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
 	pod, ok := obj.(*corev1.Pod)
 	if !ok {
 		return nil, fmt.Errorf("expected a Pod object but got %T", obj)
 	}
 	podlog.Info("Validation for Pod upon creation", "name", pod.GetName())
 
-	// TODO(user): fill in your validation logic upon object creation.
-
-	return nil, nil
+	return v.validate(ctx, pod, nil)
 }
 
 // ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Pod.
-func (v *PodCustomValidator) ValidateUpdate(_ context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+func (v *PodCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
 	pod, ok := newObj.(*corev1.Pod)
 	if !ok {
 		return nil, fmt.Errorf("expected a Pod object for the newObj but got %T", newObj)
 	}
 	podlog.Info("Validation for Pod upon update", "name", pod.GetName())
 
-	// TODO(user): fill in your validation logic upon object update.
+	// Only images changed by the update are checked, so existing pods can still be updated
+	old, _ := oldObj.(*corev1.Pod)
+	return v.validate(ctx, pod, old)
+}
 
-	return nil, nil
+// validate applies the tag policy and adds the architecture warnings of pod's images that differ from old.
+func (v *PodCustomValidator) validate(ctx context.Context, pod, old *corev1.Pod) (admission.Warnings, error) {
+	warnings, err := validateTags(ctx, v.Namespaces, pod, old)
+	if err != nil || v.Platforms == nil {
+		return warnings, err
+	}
+	return append(warnings, v.Platforms.PlatformWarnings(ctx, pod, old)...), nil
 }
 
 // ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Pod.
@@ -3,12 +3,15 @@ package v1
 
 import (
 	"context"
+	"reflect"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"mutating-registry-hook/internal/registry"
 )
 
 const (
@@ -435,3 +438,379 @@ func TestPodDefaulter_NamespaceNotFound(t *testing.T) {
 		t.Errorf("Expected image to remain testNginxImage, got: %s", pod.Spec.Containers[0].Image)
 	}
 }
+
+// missingImageVerifier reports every image as absent from its registry.
+type missingImageVerifier struct{}
+
+func (missingImageVerifier) ManifestExists(_ context.Context, _ string) (bool, error) {
+	return false, nil
+}
+
+func TestPodDefaulter_VerifyKeepsOriginalWhenImageMissing(t *testing.T) {
+	// Create a namespace that requires verification
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-namespace",
+			Labels: map[string]string{
+				LabelRegistryRewrite: LabelValueEnabled,
+			},
+			Annotations: map[string]string{
+				AnnotationTargetRegistry: "myregistry.io",
+				AnnotationVerify:         "true",
+			},
+		},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "app",
+					Image: testNginxImage,
+				},
+			},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+
+	// Create defaulter with a verifier that never finds the image
+	defaulter := PodCustomDefaulter{
+		Client:   fakeClient,
+		Rewriter: &registry.Rewriter{Verifier: missingImageVerifier{}},
+	}
+
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	// Verify the original image was kept
+	if pod.Spec.Containers[0].Image != testNginxImage {
+		t.Errorf("Expected image to remain testNginxImage, got: %s", pod.Spec.Containers[0].Image)
+	}
+}
+
+// knownImageVerifier reports only the listed images as present.
+type knownImageVerifier map[string]bool
+
+func (k knownImageVerifier) ManifestExists(_ context.Context, image string) (bool, error) {
+	return k[image], nil
+}
+
+func TestPodDefaulter_TargetListPicksFirstTargetWithImage(t *testing.T) {
+	// Create a namespace with an ordered list of targets
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-namespace",
+			Labels: map[string]string{
+				LabelRegistryRewrite: LabelValueEnabled,
+			},
+			Annotations: map[string]string{
+				AnnotationTargetRegistries: "eu.mirror.io, global.mirror.io",
+			},
+		},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: testNginxImage,
+				},
+				{
+					Name:  "redis",
+					Image: "redis:7.0",
+				},
+			},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+
+	// Only the regional mirror has nginx; only the global mirror has redis
+	defaulter := PodCustomDefaulter{
+		Client: fakeClient,
+		Rewriter: &registry.Rewriter{Verifier: knownImageVerifier{
+			"eu.mirror.io/nginx:latest":  true,
+			"global.mirror.io/redis:7.0": true,
+		}},
+	}
+
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	if pod.Spec.Containers[0].Image != "eu.mirror.io/nginx:latest" {
+		t.Errorf("Container 0: expected image 'eu.mirror.io/nginx:latest', got '%s'", pod.Spec.Containers[0].Image)
+	}
+	if pod.Spec.Containers[1].Image != "global.mirror.io/redis:7.0" {
+		t.Errorf("Container 1: expected image 'global.mirror.io/redis:7.0', got '%s'", pod.Spec.Containers[1].Image)
+	}
+}
+
+func TestPolicyFromNamespace(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        Policy
+		ok          bool
+	}{
+		{"no annotations", nil, Policy{}, false},
+		{"single target", map[string]string{AnnotationTargetRegistry: "a.io"},
+			Policy{TargetRegistries: []string{"a.io"}}, true},
+		{"single target with verify", map[string]string{AnnotationTargetRegistry: "a.io", AnnotationVerify: "true"},
+			Policy{TargetRegistries: []string{"a.io"}, Verify: true}, true},
+		{"target list wins", map[string]string{AnnotationTargetRegistry: "a.io", AnnotationTargetRegistries: "b.io,,c.io "},
+			Policy{TargetRegistries: []string{"b.io", "c.io"}, Verify: true}, true},
+		{"uppercase path", map[string]string{AnnotationTargetRegistry: "A.io/Mirror/"}, Policy{}, false},
+		{"target normalized", map[string]string{AnnotationTargetRegistry: " A.io/mirror/"},
+			Policy{TargetRegistries: []string{"a.io/mirror"}}, true},
+		{"IPv6 target", map[string]string{AnnotationTargetRegistry: "[FD00::1]:5000"},
+			Policy{TargetRegistries: []string{"[fd00::1]:5000"}}, true},
+		{"invalid target", map[string]string{AnnotationTargetRegistry: "https://a.io"}, Policy{}, false},
+		{"invalid targets dropped", map[string]string{AnnotationTargetRegistries: "https://a.io,b.io"},
+			Policy{TargetRegistries: []string{"b.io"}, Verify: true}, true},
+	}
+
+	for _, tt := range tests {
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}}
+		got, ok := PolicyFromNamespace(namespace)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: PolicyFromNamespace() = %+v, %v; want %+v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPodDefaulter_InjectsPullSecretForTargetRegistry(t *testing.T) {
+	// Create a namespace with both label and annotation
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-namespace",
+			Labels: map[string]string{
+				LabelRegistryRewrite: LabelValueEnabled,
+			},
+			Annotations: map[string]string{
+				AnnotationTargetRegistry: "myregistry.io/mirror",
+			},
+		},
+	}
+
+	// Create a pod with two containers and an existing pull secret
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+		Spec: corev1.PodSpec{
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "team-secret"}},
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: testNginxImage,
+				},
+				{
+					Name:  "redis",
+					Image: "redis:7.0",
+				},
+			},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+
+	defaulter := PodCustomDefaulter{
+		Client:      fakeClient,
+		PullSecrets: map[string]string{"myregistry.io": "mirror-pull"},
+	}
+
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	// Verify the pull secret was appended exactly once
+	expected := []corev1.LocalObjectReference{{Name: "team-secret"}, {Name: "mirror-pull"}}
+	if !reflect.DeepEqual(pod.Spec.ImagePullSecrets, expected) {
+		t.Errorf("Expected imagePullSecrets %v, got %v", expected, pod.Spec.ImagePullSecrets)
+	}
+}
+
+func TestParsePullSecret(t *testing.T) {
+	pullSecret, err := ParsePullSecret("mirror.example.com/team=operator/mirror-pull")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pullSecret.Registry != "mirror.example.com" || pullSecret.Source.String() != "operator/mirror-pull" {
+		t.Errorf("unexpected pull secret: %+v", pullSecret)
+	}
+
+	if pullSecret, err := ParsePullSecret("Mirror.Example.com/=operator/mirror-pull"); err != nil ||
+		pullSecret.Registry != "mirror.example.com" {
+		t.Errorf("Expected the registry host to be normalized, got %+v, %v", pullSecret, err)
+	}
+
+	for _, value := range []string{"", "mirror.example.com", "mirror.example.com=name", "=operator/name",
+		"https://mirror.example.com=operator/name"} {
+		if _, err := ParsePullSecret(value); err == nil {
+			t.Errorf("ParsePullSecret(%q) should return an error", value)
+		}
+	}
+}
+
+// recordingMirrors records the image pairs handed to the mirror queue.
+type recordingMirrors struct {
+	pairs [][2]string
+}
+
+func (r *recordingMirrors) Enqueue(source, target string) {
+	r.pairs = append(r.pairs, [2]string{source, target})
+}
+
+func TestPodDefaulter_DryRunEnqueuesWithoutRewriting(t *testing.T) {
+	// Create a namespace in dry-run mode
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-namespace",
+			Labels: map[string]string{
+				LabelRegistryRewrite: LabelValueEnabled,
+			},
+			Annotations: map[string]string{
+				AnnotationTargetRegistry: "myregistry.io",
+				AnnotationDryRun:         "true",
+			},
+		},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: testNginxImage,
+				},
+			},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+
+	mirrors := &recordingMirrors{}
+	defaulter := PodCustomDefaulter{
+		Client:      fakeClient,
+		PullSecrets: map[string]string{"myregistry.io": "mirror-pull"},
+		Mirrors:     mirrors,
+	}
+
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	// Verify the pod is unchanged and the decision was queued for mirroring
+	if pod.Spec.Containers[0].Image != testNginxImage || len(pod.Spec.ImagePullSecrets) != 0 {
+		t.Errorf("Expected dry run to leave the pod unchanged, got %+v", pod.Spec)
+	}
+	expected := [][2]string{{testNginxImage, "myregistry.io/" + testNginxImage}}
+	if !reflect.DeepEqual(mirrors.pairs, expected) {
+		t.Errorf("Expected mirror pairs %v, got %v", expected, mirrors.pairs)
+	}
+}
+
+func TestPodDefaulter_EnqueuesMissingImageForPreferredTarget(t *testing.T) {
+	// Create a namespace with an ordered target list
+	namespace := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test-namespace",
+			Labels: map[string]string{
+				LabelRegistryRewrite: LabelValueEnabled,
+			},
+			Annotations: map[string]string{
+				AnnotationTargetRegistries: "eu.example.com,us.example.com",
+			},
+		},
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pod",
+			Namespace: "test-namespace",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:  "nginx",
+					Image: testNginxImage,
+				},
+			},
+		},
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+
+	mirrors := &recordingMirrors{}
+	defaulter := PodCustomDefaulter{
+		Client:   fakeClient,
+		Rewriter: &registry.Rewriter{Verifier: missingImageVerifier{}},
+		Mirrors:  mirrors,
+	}
+
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+
+	// Verify the original image is kept and queued for the first target
+	if pod.Spec.Containers[0].Image != testNginxImage {
+		t.Errorf("Expected original image to be kept, got %s", pod.Spec.Containers[0].Image)
+	}
+	expected := [][2]string{{testNginxImage, "eu.example.com/" + testNginxImage}}
+	if !reflect.DeepEqual(mirrors.pairs, expected) {
+		t.Errorf("Expected mirror pairs %v, got %v", expected, mirrors.pairs)
+	}
+}
+
+func TestParsePolicyFile(t *testing.T) {
+	policy, err := ParsePolicyFile([]byte("targetRegistries:\n- a.example.com\n- b.example.com\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(policy.TargetRegistries, []string{"a.example.com", "b.example.com"}) || !policy.Verify {
+		t.Errorf("Expected two verified targets, got %+v", policy)
+	}
+
+	policy, err = ParsePolicyFile([]byte("targetRegistries: [A.example.com/]\nmappings:\n  GHCR.io: '[fd00::1]:5000'\n"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if policy.TargetRegistries[0] != "a.example.com" || policy.TargetsFor("ghcr.io/team/app")[0] != "[fd00::1]:5000" {
+		t.Errorf("Expected normalized targets and mappings, got %+v", policy)
+	}
+
+	for _, invalid := range []string{"", "targetRegistries: []", "targetRegistries: [a.example.com]\nverfiy: true",
+		"targetRegistries: ['https://a.example.com']", "mappings:\n  ghcr.io/team: a.example.com\n",
+		"targetRegistries: [a.example.com]\nfailureMode: fail"} {
+		if _, err := ParsePolicyFile([]byte(invalid)); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// PURPOSE: Rewrite rules limited to pods selected by labels, ServiceAccount or owner kind, and to container kinds
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// PodSelector selects the pods a rule applies to. Every field that is set must match; a selector
+// with no fields selects every pod.
+type PodSelector struct {
+	// LabelSelector matches the pod's labels, which for controller-created pods are those of the
+	// pod template.
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+	// ServiceAccountNames lists the ServiceAccounts whose pods are selected. A pod naming none runs
+	// as "default".
+	ServiceAccountNames []string `json:"serviceAccountNames,omitempty"`
+	// OwnerKinds lists the kinds of the controller owning the pod, such as ReplicaSet, Job,
+	// StatefulSet or DaemonSet. Deployments own their pods through ReplicaSets and CronJobs through
+	// Jobs.
+	OwnerKinds []string `json:"ownerKinds,omitempty"`
+
+	selector labels.Selector
+}
+
+// podSelectorFields are the JSON fields of PodSelector.
+var podSelectorFields = []string{"labelSelector", "serviceAccountNames", "ownerKinds"}
+
+// compile converts the label selector and checks the lists.
+func (s *PodSelector) compile() error {
+	s.selector = labels.Everything()
+	if s.LabelSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(s.LabelSelector)
+		if err != nil {
+			return fmt.Errorf("labelSelector: %w", err)
+		}
+		s.selector = selector
+	}
+	if slices.Contains(s.ServiceAccountNames, "") {
+		return errors.New("serviceAccountNames must not contain an empty name")
+	}
+	if slices.Contains(s.OwnerKinds, "") {
+		return errors.New("ownerKinds must not contain an empty kind")
+	}
+	return nil
+}
+
+// Selects reports whether pod is selected. A nil pod is selected only by an empty selector.
+func (s PodSelector) Selects(pod *corev1.Pod) bool {
+	if s.empty() {
+		return true
+	}
+	if pod == nil {
+		return false
+	}
+	if s.LabelSelector != nil {
+		selector := s.selector
+		if selector == nil {
+			var err error
+			if selector, err = metav1.LabelSelectorAsSelector(s.LabelSelector); err != nil {
+				return false
+			}
+		}
+		if !selector.Matches(labels.Set(pod.Labels)) {
+			return false
+		}
+	}
+	if len(s.ServiceAccountNames) > 0 {
+		name := pod.Spec.ServiceAccountName
+		if name == "" {
+			name = "default"
+		}
+		if !slices.Contains(s.ServiceAccountNames, name) {
+			return false
+		}
+	}
+	if len(s.OwnerKinds) > 0 {
+		owner := metav1.GetControllerOf(pod)
+		if owner == nil || !slices.Contains(s.OwnerKinds, owner.Kind) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s PodSelector) empty() bool {
+	return s.LabelSelector == nil && len(s.ServiceAccountNames) == 0 && len(s.OwnerKinds) == 0
+}
+
+// descriptions summarize the selector for traces.
+func (s PodSelector) descriptions() []string {
+	var parts []string
+	if s.LabelSelector != nil {
+		parts = append(parts, "labels "+metav1.FormatLabelSelector(s.LabelSelector))
+	}
+	if len(s.ServiceAccountNames) > 0 {
+		parts = append(parts, "serviceAccounts "+strings.Join(s.ServiceAccountNames, ","))
+	}
+	if len(s.OwnerKinds) > 0 {
+		parts = append(parts, "owners "+strings.Join(s.OwnerKinds, ","))
+	}
+	return parts
+}
+
+// RewriteRule is a regular expression rule of a policy, applied only to the pods its PodSelector
+// selects and the image locations its ContainerSelector includes.
+type RewriteRule struct {
+	registry.RewriteRule
+	PodSelector
+	ContainerSelector
+}
+
+// applies reports whether the rule is to be tried on location of pod.
+func (r RewriteRule) applies(pod *corev1.Pod, location ImageLocation) bool {
+	return r.Selects(pod) && r.Includes(location)
+}
+
+// describe summarizes the pods and locations of the rule for traces.
+func (r RewriteRule) describe() string {
+	parts := append(r.PodSelector.descriptions(), r.ContainerSelector.descriptions()...)
+	if len(parts) == 0 {
+		return "all pods"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The selector fields are decoded here and the others by
+// registry.RewriteRule, which compiles the rule and runs its tests.
+func (r *RewriteRule) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	selectorFields := map[string]json.RawMessage{}
+	for _, name := range append(podSelectorFields, containerSelectorFields...) {
+		if value, ok := fields[name]; ok {
+			selectorFields[name] = value
+			delete(fields, name)
+		}
+	}
+
+	var rule RewriteRule
+	selectors := struct {
+		*PodSelector
+		*ContainerSelector
+	}{&rule.PodSelector, &rule.ContainerSelector}
+	if err := decodeStrict(selectorFields, &selectors); err != nil {
+		return err
+	}
+	if err := decodeStrict(fields, &rule.RewriteRule); err != nil {
+		return err
+	}
+	if err := errors.Join(rule.PodSelector.compile(), rule.ContainerSelector.compile()); err != nil {
+		return fmt.Errorf("rewrite rule %q: %w", rule.Match, err)
+	}
+	*r = rule
+	return nil
+}
+
+// decodeStrict decodes fields into out, rejecting unknown fields.
+func decodeStrict(fields map[string]json.RawMessage, out any) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(out)
+}
+
+// RewriteRules are tried in order on the images of the pods and locations they select; the first
+// match decides.
+type RewriteRules []RewriteRule
+
+// Apply returns the rewrite of the image at location of pod by the first rule selecting both and
+// matching the image, and the rule's index.
+func (rules RewriteRules) Apply(pod *corev1.Pod, location ImageLocation) (string, int, bool, error) {
+	for i, rule := range rules {
+		if !rule.applies(pod, location) {
+			continue
+		}
+		rewritten, ok, err := rule.RewriteRule.Apply(*location.Image)
+		if err != nil {
+			return "", i, false, err
+		}
+		if ok {
+			return rewritten, i, true, nil
+		}
+	}
+	return "", -1, false, nil
+}
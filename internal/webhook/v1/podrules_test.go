@@ -0,0 +1,155 @@
+// PURPOSE: Unit tests for rewrite rules limited by label selector, ServiceAccount and owner kind
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// ownedPod returns a pod as a controller of kind creates it, with only generateName set, as admission
+// sees it before the API server names it.
+func ownedPod(kind, owner string, labels map[string]string, serviceAccount string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: owner + "-",
+			Namespace:    "test-namespace",
+			Labels:       labels,
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: serviceAccount,
+			Containers:         []corev1.Container{{Name: "app", Image: testNginxImage}},
+		},
+	}
+	if kind != "" {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1", Kind: kind, Name: owner, UID: types.UID("uid-" + owner), Controller: &controller,
+		}}
+	}
+	return pod
+}
+
+func TestPodSelector_Selects(t *testing.T) {
+	replicaSetPod := ownedPod("ReplicaSet", "web-7d9f8b6c5", map[string]string{
+		"app": "web", "pod-template-hash": "7d9f8b6c5",
+	}, "")
+	jobPod := ownedPod("Job", "report-28391040", map[string]string{
+		"batch.kubernetes.io/job-name": "report-28391040", "job-name": "report-28391040",
+	}, "reporter")
+	vendorPod := ownedPod("DaemonSet", "vendor-agent", map[string]string{"app": "vendor-agent"}, "vendor-agent")
+	barePod := ownedPod("", "debug", nil, "")
+
+	tests := []struct {
+		name     string
+		selector PodSelector
+		selected []*corev1.Pod
+	}{
+		{"empty selects all", PodSelector{}, []*corev1.Pod{replicaSetPod, jobPod, vendorPod, barePod}},
+		{"owner kind Job", PodSelector{OwnerKinds: []string{"Job"}}, []*corev1.Pod{jobPod}},
+		{"owner kinds", PodSelector{OwnerKinds: []string{"ReplicaSet", "DaemonSet"}},
+			[]*corev1.Pod{replicaSetPod, vendorPod}},
+		{"job-name label exists", PodSelector{LabelSelector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "batch.kubernetes.io/job-name", Operator: metav1.LabelSelectorOpExists},
+			},
+		}}, []*corev1.Pod{jobPod}},
+		{"match labels", PodSelector{LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+			[]*corev1.Pod{replicaSetPod}},
+		{"ServiceAccount", PodSelector{ServiceAccountNames: []string{"vendor-agent"}}, []*corev1.Pod{vendorPod}},
+		{"default ServiceAccount", PodSelector{ServiceAccountNames: []string{"default"}},
+			[]*corev1.Pod{replicaSetPod, barePod}},
+		{"all fields must match", PodSelector{
+			OwnerKinds:          []string{"ReplicaSet", "Job"},
+			ServiceAccountNames: []string{"reporter"},
+		}, []*corev1.Pod{jobPod}},
+	}
+	for _, tt := range tests {
+		for _, pod := range []*corev1.Pod{replicaSetPod, jobPod, vendorPod, barePod} {
+			want := false
+			for _, selected := range tt.selected {
+				want = want || selected == pod
+			}
+			if got := tt.selector.Selects(pod); got != want {
+				t.Errorf("%s: expected Selects(%s) to be %t, got %t", tt.name, pod.GenerateName, want, got)
+			}
+		}
+	}
+}
+
+func TestPodDefaulter_RewriteRulesSelectPods(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: 'docker\.io/library/nginx:.*'
+  keep: true
+  serviceAccountNames: [vendor-agent]
+  tests:
+  - {image: nginx:latest, want: nginx:latest}
+- match: 'docker\.io/(.*)'
+  replace: batch-mirror.corp.io/$1
+  ownerKinds: [Job]
+  labelSelector:
+    matchExpressions:
+    - {key: batch.kubernetes.io/job-name, operator: Exists}
+  tests:
+  - {image: nginx:latest, want: batch-mirror.corp.io/library/nginx:latest}
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+	defaulter.Policies.SetDefaults(defaults)
+
+	tests := []struct {
+		name string
+		pod  *corev1.Pod
+		want string
+	}{
+		{"Job pod", ownedPod("Job", "report-28391040", map[string]string{
+			"batch.kubernetes.io/job-name": "report-28391040",
+		}, ""), "batch-mirror.corp.io/library/nginx:latest"},
+		{"ReplicaSet pod", ownedPod("ReplicaSet", "web-7d9f8b6c5", map[string]string{
+			"pod-template-hash": "7d9f8b6c5",
+		}, ""), testMyRegistryNginx},
+		{"vendor Job pod", ownedPod("Job", "vendor-scan", map[string]string{
+			"batch.kubernetes.io/job-name": "vendor-scan",
+		}, "vendor-agent"), testNginxImage},
+	}
+	for _, tt := range tests {
+		if err := defaulter.Default(context.Background(), tt.pod); err != nil {
+			t.Fatalf("%s: expected no error, got: %v", tt.name, err)
+		}
+		if got := tt.pod.Spec.Containers[0].Image; got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestParseDefaults_RejectsInvalidPodSelectors(t *testing.T) {
+	for _, tt := range []struct {
+		rule string
+		want string
+	}{
+		{"labelSelector: {matchExpressions: [{key: app, operator: Within}]}", `"Within" is not a valid label selector operator`},
+		{`serviceAccountNames: [""]`, "serviceAccountNames must not contain an empty name"},
+		{"ownerKinds: [Job, '']", "ownerKinds must not contain an empty kind"},
+		{"podSelector: {app: web}", `unknown field "podSelector"`},
+		{"labelSelector: {app: web}", `unknown field "app"`},
+		{"keep: true\n  replace: x/$1", "keeps images and cannot have a replacement"},
+	} {
+		_, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: 'docker\.io/(.*)'
+  ` + tt.rule + `
+  tests:
+  - {image: quay.io/app:v1}
+`))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected %s to be rejected with %q, got: %v", tt.rule, tt.want, err)
+		}
+	}
+}
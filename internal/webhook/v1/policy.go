@@ -0,0 +1,324 @@
+// PURPOSE: Derives the rewrite policy for a pod from its namespace's annotations
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// Policy is the rewrite configuration that applies to a pod.
+type Policy struct {
+	// TargetRegistries are the candidate registries, in order of preference.
+	TargetRegistries []string `json:"targetRegistries"`
+	// Verify requires the rewritten image to exist on the target before it is used.
+	Verify bool `json:"verify,omitempty"`
+	// DryRun records and pre-warms rewrite decisions without applying them to the pod.
+	DryRun bool `json:"dryRun,omitempty"`
+	// PreserveRegistries lists registries, or registry/repository prefixes, whose images are never rewritten.
+	PreserveRegistries []string `json:"preserveRegistries,omitempty"`
+	// RewriteLocalRegistries set to false leaves images from localhost and private-network
+	// registries alone as local development builds. Unset, they are rewritten like any other.
+	RewriteLocalRegistries *bool `json:"rewriteLocalRegistries,omitempty"`
+	// Mappings send the images of a source registry to their own target instead of TargetRegistries.
+	Mappings map[string]string `json:"mappings,omitempty"`
+	// FailureMode Fail rejects pods with an image that cannot be rewritten. With Ignore, the default,
+	// the original image is kept.
+	FailureMode string `json:"failureMode,omitempty"`
+	// PathTemplate lays out rewritten images on the target. Without it the original repository path
+	// is kept below the target.
+	PathTemplate *registry.PathTemplate `json:"pathTemplate,omitempty"`
+	// RewriteRules rewrite the images they match to their own location, or keep them, before any
+	// target applies. Each applies only to the pods it selects.
+	RewriteRules RewriteRules `json:"rewriteRules,omitempty"`
+	// TagPolicy handles images without a tag or digest: default-latest, the default, preserve, warn
+	// or deny.
+	TagPolicy string `json:"tagPolicy,omitempty"`
+	// ArchitecturePolicy handles verified targets lacking an architecture the pod can be scheduled on:
+	// fallback, the default, warn or ignore.
+	ArchitecturePolicy string `json:"architecturePolicy,omitempty"`
+}
+
+// PolicyFromNamespace reads the rewrite policy from namespace annotations. It returns false when no
+// target registry is configured.
+//
+// An ordered target-registries list takes precedence over target-registry and always verifies,
+// since choosing between candidates requires knowing which of them has the image.
+func PolicyFromNamespace(namespace *corev1.Namespace) (Policy, bool) {
+	return resolvePolicy(namespace, nil, nil)
+}
+
+// resolvePolicy implements PolicyFromNamespace, falling back to defaults, which may be nil, for
+// settings the namespace does not make.
+func resolvePolicy(namespace *corev1.Namespace, defaults *Defaults, trace *Trace) (Policy, bool) {
+	policy, _, ok := resolveLayers(namespace, defaults, trace)
+	return policy, ok
+}
+
+// resolveLayers implements resolvePolicy. The targets are merged from the namespace's annotations and
+// the overrides and mappings of defaults by mergeLayers, whose result is returned with the policy; it
+// records which entries supplied them and any conflicts.
+func resolveLayers(namespace *corev1.Namespace, defaults *Defaults, trace *Trace) (Policy, layered, bool) {
+	if defaults == nil {
+		defaults = &Defaults{}
+	}
+	policy := Policy{
+		DryRun:                 namespace.Annotations[AnnotationDryRun] == "true",
+		PreserveRegistries:     append(splitList(namespace.Annotations[AnnotationPreserveRegistries]), defaults.PreserveRegistries...),
+		RewriteLocalRegistries: defaults.RewriteLocalRegistries,
+		FailureMode:            defaults.FailureMode,
+		PathTemplate:           defaults.PathTemplate,
+		RewriteRules:           defaults.RewriteRules,
+		TagPolicy:              defaults.TagPolicy,
+		ArchitecturePolicy:     defaults.ArchitecturePolicy,
+	}
+	if value, ok := namespace.Annotations[AnnotationRewriteLocalRegistries]; ok {
+		rewrite := value == "true"
+		policy.RewriteLocalRegistries = &rewrite
+	}
+	if value, ok := namespace.Annotations[AnnotationTagPolicy]; ok {
+		if validTagPolicy(value) {
+			policy.TagPolicy = value
+		} else {
+			trace.record(stepPolicy, outcomeFailed, fmt.Sprintf("annotation %s: unknown value %q, using %s",
+				AnnotationTagPolicy, value, policy.tagPolicy()))
+		}
+	}
+	if value, ok := namespace.Annotations[AnnotationArchitecturePolicy]; ok {
+		if validArchitecturePolicy(value) {
+			policy.ArchitecturePolicy = value
+		} else {
+			trace.record(stepPolicy, outcomeFailed, fmt.Sprintf("annotation %s: unknown value %q, using %s",
+				AnnotationArchitecturePolicy, value, policy.architecturePolicy()))
+		}
+	}
+
+	// Target entries in layer order: the namespace's annotation, the overrides, then the defaults
+	var entries []Override
+	if entry, ok := annotationEntry(namespace, trace); ok {
+		entries = append(entries, entry)
+	}
+	entries = append(entries, defaults.Overrides...)
+	entries = append(entries, defaults.entries()...)
+
+	merged := mergeLayers(namespace.Name, entries)
+	for _, conflict := range merged.conflicts {
+		trace.record(stepPolicy, outcomeFailed, "conflict: "+conflict.String())
+	}
+	if merged.targets == nil && len(merged.mappings) == 0 && len(defaults.RewriteRules) == 0 {
+		trace.record(stepPolicy, outcomeNotSet, "overrides and global defaults")
+		return Policy{}, merged, false
+	}
+	if entry := merged.targets; entry != nil {
+		policy.TargetRegistries = entry.Targets
+		policy.Verify = entry.verifies()
+		trace.record(stepPolicy, outcomeMatched, fmt.Sprintf("%s: %s, verify=%t", entry.Name,
+			strings.Join(entry.Targets, ", "), entry.verifies()))
+	} else {
+		policy.Verify = defaults.Verify
+	}
+	for _, source := range slices.Sorted(maps.Keys(merged.mappings)) {
+		entry := merged.mappings[source]
+		if policy.Mappings == nil {
+			policy.Mappings = map[string]string{}
+		}
+		policy.Mappings[source] = entry.Targets[0]
+		policy.Verify = policy.Verify || entry.verifies()
+		trace.record(stepPolicy, outcomeMatched, fmt.Sprintf("%s: images of %s to %s, verify=%t", entry.Name,
+			source, entry.Targets[0], entry.verifies()))
+	}
+	if len(defaults.RewriteRules) > 0 {
+		trace.record(stepPolicy, outcomeMatched, fmt.Sprintf("global defaults: %d rules", len(defaults.RewriteRules)))
+	}
+	return policy, merged, true
+}
+
+// annotationEntry returns the target entry the annotations of namespace make, if any. An ordered
+// target-registries list takes precedence over target-registry and always verifies.
+func annotationEntry(namespace *corev1.Namespace, trace *Trace) (Override, bool) {
+	entry := Override{Namespaces: []string{namespace.Name}}
+	if targets := annotationTargets(namespace, AnnotationTargetRegistries, trace); len(targets) > 0 {
+		entry.Name, entry.Targets, entry.Verify = "annotation "+AnnotationTargetRegistries, targets, true
+		return entry, true
+	}
+	trace.record(stepPolicy, outcomeNotSet, "annotation "+AnnotationTargetRegistries)
+
+	if target, ok := annotationTarget(AnnotationTargetRegistry, namespace.Annotations[AnnotationTargetRegistry],
+		trace); ok {
+		entry.Name, entry.Targets = "annotation "+AnnotationTargetRegistry, []string{target}
+		entry.Verify = namespace.Annotations[AnnotationVerify] == "true"
+		return entry, true
+	}
+	trace.record(stepPolicy, outcomeNotSet, "annotation "+AnnotationTargetRegistry)
+	return Override{}, false
+}
+
+// annotationTargets returns the targets listed by annotation of namespace in canonical form, leaving
+// out invalid ones.
+func annotationTargets(namespace *corev1.Namespace, annotation string, trace *Trace) []string {
+	var targets []string
+	for _, target := range splitList(namespace.Annotations[annotation]) {
+		if normalized, ok := annotationTarget(annotation, target, trace); ok {
+			targets = append(targets, normalized)
+		}
+	}
+	return targets
+}
+
+// annotationTarget returns target, set by annotation, in canonical form. An invalid target is recorded
+// and not used; an empty one is ignored.
+func annotationTarget(annotation, target string, trace *Trace) (string, bool) {
+	if target == "" {
+		return "", false
+	}
+	normalized, err := registry.NormalizeTarget(target)
+	if err != nil {
+		trace.record(stepPolicy, outcomeFailed, fmt.Sprintf("annotation %s: invalid target %q: %v",
+			annotation, target, err))
+		return "", false
+	}
+	return normalized, true
+}
+
+// Rewrite returns image rewritten to target with the policy's layout.
+func (p Policy) Rewrite(image, target string) (string, error) {
+	return p.PathTemplate.Rewrite(image, target)
+}
+
+// Candidates returns the rewrites of the image at location of pod to try in order: the rewrite of the
+// first rule selecting both and matching the image alone, none when that rule keeps images, otherwise
+// one per target of TargetsFor. The index of the matching rule is -1 when none does.
+func (p Policy) Candidates(pod *corev1.Pod, location ImageLocation) ([]registry.Candidate, int, error) {
+	image := *location.Image
+	rewritten, rule, ok, err := p.RewriteRules.Apply(pod, location)
+	if err != nil {
+		return nil, rule, err
+	}
+	var candidates []registry.Candidate
+	if ok && p.RewriteRules[rule].Keep {
+		return nil, rule, nil
+	}
+	if ok {
+		candidates = []registry.Candidate{{Target: registry.ImageRegistry(rewritten), Image: rewritten}}
+	} else {
+		rule = -1
+		for _, target := range p.TargetsFor(image) {
+			rewritten, err := p.Rewrite(image, target)
+			if err != nil {
+				return nil, rule, err
+			}
+			// Rewriting adds the :latest tag runtimes imply, unless the tag policy keeps images as
+			// they are. What a rule produces is used as written.
+			if p.keepsTagless(image) {
+				rewritten = strings.TrimSuffix(rewritten, ":latest")
+			}
+			candidates = append(candidates, registry.Candidate{Target: target, Image: rewritten})
+		}
+	}
+	return candidates, rule, nil
+}
+
+// TargetsFor returns the candidate targets for image: the mapped target of its registry, if any,
+// otherwise TargetRegistries.
+func (p Policy) TargetsFor(image string) []string {
+	if target, ok := p.Mappings[strings.ToLower(registry.ImageRegistry(image))]; ok {
+		return []string{target}
+	}
+	return p.TargetRegistries
+}
+
+// rewritesLocalRegistries reports whether images from local registries are rewritten, the default.
+func (p Policy) rewritesLocalRegistries() bool {
+	return p.RewriteLocalRegistries == nil || *p.RewriteLocalRegistries
+}
+
+// Excludes returns the PreserveRegistries entry matching the registry of image, if any. An entry
+// matches the registry host or a registry/repository path prefix; short names belong to docker.io.
+func (p Policy) Excludes(image string) (string, bool) {
+	if len(p.PreserveRegistries) == 0 {
+		return "", false
+	}
+	host := registry.ImageRegistry(image)
+	name := host + "/" + image
+	if ref, err := registry.ParseReference(image); err == nil {
+		name = host + "/" + ref.Repository
+	}
+	for _, entry := range p.PreserveRegistries {
+		entry = strings.TrimSuffix(strings.ToLower(entry), "/")
+		if entry == host || strings.HasPrefix(name, entry+"/") {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// ParsePolicyFile reads a policy from YAML or JSON, as used by tools that apply the webhook's rules
+// outside the cluster. Unknown fields are rejected. As with the namespace annotations, a list of
+// several targets always verifies.
+func ParsePolicyFile(data []byte) (Policy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return Policy{}, fmt.Errorf("parsing policy: %w", err)
+	}
+	if err := policy.normalize(); err != nil {
+		return Policy{}, err
+	}
+	return policy, nil
+}
+
+// normalize checks a policy read from a file, puts its targets in canonical form and makes a list of
+// several targets verify.
+func (p *Policy) normalize() error {
+	if len(p.TargetRegistries) == 0 && len(p.Mappings) == 0 && len(p.RewriteRules) == 0 {
+		return errors.New("policy has no targetRegistries, mappings or rewriteRules")
+	}
+	for _, target := range p.TargetRegistries {
+		if err := validateTarget(target); err != nil {
+			return fmt.Errorf("policy has an invalid target registry %q: %w", target, err)
+		}
+	}
+	for source, target := range p.Mappings {
+		if err := registry.ValidateHost(strings.ToLower(source)); err != nil {
+			return fmt.Errorf("policy has an invalid mapping source %q: %w", source, err)
+		}
+		if err := validateTarget(target); err != nil {
+			return fmt.Errorf("policy has an invalid target registry %q for %s: %w", target, source, err)
+		}
+	}
+	p.TargetRegistries = normalizeTargets(p.TargetRegistries)
+	p.Mappings = normalizeMappings(p.Mappings)
+	if !validTagPolicy(p.TagPolicy) {
+		return fmt.Errorf("policy has unknown tagPolicy %q, expected one of %s", p.TagPolicy,
+			strings.Join(tagPolicies, ", "))
+	}
+	if !validArchitecturePolicy(p.ArchitecturePolicy) {
+		return fmt.Errorf("policy has unknown architecturePolicy %q, expected one of %s", p.ArchitecturePolicy,
+			strings.Join(architecturePolicies, ", "))
+	}
+	if p.FailureMode != "" && p.FailureMode != FailureModeIgnore && p.FailureMode != FailureModeFail {
+		return fmt.Errorf("policy has unknown failureMode %q, expected %s or %s", p.FailureMode,
+			FailureModeIgnore, FailureModeFail)
+	}
+	if len(p.TargetRegistries) > 1 {
+		p.Verify = true
+	}
+	return nil
+}
+
+// splitList parses a comma-separated annotation value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
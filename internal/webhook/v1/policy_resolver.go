@@ -0,0 +1,211 @@
+// PURPOSE: Keeps the compiled rewrite policy of every namespace up to date from Namespace informer events
+package v1
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+)
+
+// EventReasonConfigConflict is the reason of the events reporting conflicting target entries.
+const EventReasonConfigConflict = "ConfigConflict"
+
+// NamespacePolicy is the rewrite configuration of a namespace, compiled once per Namespace change.
+type NamespacePolicy struct {
+	// Enabled is set when the namespace carries the registry-rewrite=enabled label.
+	Enabled bool
+	// Configured is set when the namespace names at least one target registry.
+	Configured bool
+	Policy     Policy
+	// Conflicts are the target entries of the same rank that disagree, resolved by layer order.
+	Conflicts []Conflict
+	// layers is the merge of the namespace's target entries.
+	layers layered
+	// steps are the trace steps of the compilation, replayed when explaining.
+	steps []TraceStep
+}
+
+// CompileNamespacePolicy derives the rewrite configuration of namespace, with defaults, which may be
+// nil, for the settings the namespace does not make.
+func CompileNamespacePolicy(namespace *corev1.Namespace, defaults *Defaults) NamespacePolicy {
+	trace := &Trace{}
+	compiled := NamespacePolicy{Enabled: namespace.Labels[LabelRegistryRewrite] == LabelValueEnabled}
+	if !compiled.Enabled {
+		trace.record(stepNamespaceLabel, outcomeSkipped,
+			fmt.Sprintf("label %s=%s is not set", LabelRegistryRewrite, LabelValueEnabled))
+		compiled.steps = trace.Steps
+		return compiled
+	}
+	trace.record(stepNamespaceLabel, outcomeMatched, LabelRegistryRewrite+"="+LabelValueEnabled)
+
+	compiled.Policy, compiled.layers, compiled.Configured = resolveLayers(namespace, defaults, trace)
+	compiled.Conflicts = compiled.layers.conflicts
+	compiled.steps = trace.Steps
+	return compiled
+}
+
+// PolicyResolver serves the compiled policy of every namespace from memory, so admission makes no API
+// calls and does no parsing. It is updated by the events of a Namespace informer, which requires
+// get, list and watch on namespaces, and recompiled whenever the global defaults change. Conflicting
+// target entries are counted per namespace and reported as events on the Namespace when they change.
+type PolicyResolver struct {
+	// Recorder, when set, receives the conflict events.
+	Recorder record.EventRecorder
+
+	informers cache.Informers
+
+	mu         sync.RWMutex
+	defaults   *Defaults
+	loaded     bool
+	namespaces map[string]*corev1.Namespace
+	policies   map[string]NamespacePolicy
+	synced     atomic.Bool
+
+	// static resolvers resolve the namespaces they do not list to unlisted.
+	static   bool
+	unlisted NamespacePolicy
+}
+
+// NewPolicyResolver returns a resolver fed by the Namespace informer of informers. It serves lookups
+// once added to a manager and synced.
+func NewPolicyResolver(informers cache.Informers) *PolicyResolver {
+	return &PolicyResolver{
+		informers:  informers,
+		namespaces: map[string]*corev1.Namespace{},
+		policies:   map[string]NamespacePolicy{},
+	}
+}
+
+// Start registers the event handlers and waits for the initial list before serving lookups.
+func (r *PolicyResolver) Start(ctx context.Context) error {
+	informer, err := r.informers.GetInformer(ctx, &corev1.Namespace{})
+	if err != nil {
+		return err
+	}
+	registration, err := informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    r.update,
+		UpdateFunc: func(_, obj any) { r.update(obj) },
+		DeleteFunc: r.delete,
+	})
+	if err != nil {
+		return err
+	}
+	if !toolscache.WaitForCacheSync(ctx.Done(), registration.HasSynced) {
+		return errors.New("namespace informer did not sync")
+	}
+	r.synced.Store(true)
+
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection returns false so every replica serving admission keeps its own map.
+func (r *PolicyResolver) NeedLeaderElection() bool {
+	return false
+}
+
+// Resolve returns the compiled policy of the named namespace. It returns false before the initial
+// sync and for namespaces the informer has not seen yet.
+func (r *PolicyResolver) Resolve(name string) (NamespacePolicy, bool) {
+	if !r.synced.Load() {
+		return NamespacePolicy{}, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	compiled, ok := r.policies[name]
+	if !ok && r.static {
+		return r.unlisted, true
+	}
+	return compiled, ok
+}
+
+// Set compiles and stores the policy of namespace.
+func (r *PolicyResolver) Set(namespace *corev1.Namespace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.namespaces[namespace.Name] = namespace
+	compiled := CompileNamespacePolicy(namespace, r.defaults)
+	r.reportConflicts(namespace, r.policies[namespace.Name].Conflicts, compiled.Conflicts)
+	r.policies[namespace.Name] = compiled
+}
+
+// Defaults returns the global defaults in use, or nil.
+func (r *PolicyResolver) Defaults() *Defaults {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.defaults
+}
+
+// DefaultsLoaded reports whether SetDefaults has been called, even with nil, so that Defaults tells
+// the settings in use rather than that none have been read yet.
+func (r *PolicyResolver) DefaultsLoaded() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.loaded
+}
+
+// SetDefaults replaces the global defaults, nil for none, and recompiles the policy of every namespace.
+// Lookups see either the old or the new defaults for all namespaces, never a mix. Static resolvers
+// have no defaults and ignore it.
+func (r *PolicyResolver) SetDefaults(defaults *Defaults) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.static {
+		return
+	}
+	policies := make(map[string]NamespacePolicy, len(r.namespaces))
+	for name, namespace := range r.namespaces {
+		policies[name] = CompileNamespacePolicy(namespace, defaults)
+		r.reportConflicts(namespace, r.policies[name].Conflicts, policies[name].Conflicts)
+	}
+	r.defaults = defaults
+	r.loaded = true
+	r.policies = policies
+}
+
+func (r *PolicyResolver) update(obj any) {
+	if namespace, ok := obj.(*corev1.Namespace); ok {
+		r.Set(namespace)
+	}
+}
+
+func (r *PolicyResolver) delete(obj any) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.namespaces, namespace.Name)
+	delete(r.policies, namespace.Name)
+	configConflicts.DeleteLabelValues(namespace.Name)
+}
+
+// reportConflicts updates the conflict count of namespace and, when its conflicts changed, records
+// each of them as a warning event on it.
+func (r *PolicyResolver) reportConflicts(namespace *corev1.Namespace, previous, conflicts []Conflict) {
+	if len(conflicts) == 0 {
+		configConflicts.DeleteLabelValues(namespace.Name)
+	} else {
+		configConflicts.WithLabelValues(namespace.Name).Set(float64(len(conflicts)))
+	}
+	if r.Recorder == nil || slices.EqualFunc(previous, conflicts, func(a, b Conflict) bool {
+		return a.String() == b.String()
+	}) {
+		return
+	}
+	for _, conflict := range conflicts {
+		r.Recorder.Event(namespace, corev1.EventTypeWarning, EventReasonConfigConflict, conflict.String())
+	}
+}
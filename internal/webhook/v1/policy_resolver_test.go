@@ -0,0 +1,255 @@
+// PURPOSE: Unit tests and admission latency benchmark for the in-memory namespace policy resolver
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// Admission latency targets from the SRS: NFR-005 at the NFR-008 concurrency.
+const (
+	nfrConcurrency = 50
+	nfrP95         = 100 * time.Millisecond
+	nfrMax         = 500 * time.Millisecond
+)
+
+// newResolvedDefaulter returns a defaulter whose resolver knows namespace and whose client counts,
+// and fails, every Get.
+func newResolvedDefaulter(namespace *corev1.Namespace) (*PodCustomDefaulter, *atomic.Int64) {
+	var gets atomic.Int64
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(interceptor.Funcs{
+		Get: func(context.Context, client.WithWatch, client.ObjectKey, client.Object, ...client.GetOption) error {
+			gets.Add(1)
+			return errors.New("unexpected API call")
+		},
+	}).Build()
+
+	resolver := NewPolicyResolver(nil)
+	resolver.Set(namespace)
+	resolver.synced.Store(true)
+	return &PodCustomDefaulter{Client: c, Policies: resolver}, &gets
+}
+
+func resolverNamespace() *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test-namespace",
+		Labels:      map[string]string{LabelRegistryRewrite: LabelValueEnabled},
+		Annotations: map[string]string{AnnotationTargetRegistry: "myregistry.io"},
+	}}
+}
+
+func TestPolicyResolver_AdmissionMakesNoAPICalls(t *testing.T) {
+	defaulter, gets := newResolvedDefaulter(resolverNamespace())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-namespace"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: testNginxImage}}},
+	}
+	if err := defaulter.Default(context.Background(), pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if pod.Spec.Containers[0].Image != testMyRegistryNginx {
+		t.Errorf("Expected %s, got %s", testMyRegistryNginx, pod.Spec.Containers[0].Image)
+	}
+	if gets.Load() != 0 {
+		t.Errorf("Expected no API calls, got %d", gets.Load())
+	}
+}
+
+func TestPolicyResolver_ExplainReplaysCompiledSteps(t *testing.T) {
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+
+	trace, err := defaulter.Explain(context.Background(), "test-namespace", testNginxImage)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	got := steps(trace)
+	if !slices.Contains(got, "namespace-label=matched") || !slices.Contains(got, "policy=matched") ||
+		trace.Result != testMyRegistryNginx {
+		t.Errorf("Expected the compiled steps in the trace, got %v", got)
+	}
+}
+
+func TestPolicyResolver_FallsBackToClientUntilSynced(t *testing.T) {
+	namespace := resolverNamespace()
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	resolver := NewPolicyResolver(nil)
+	resolver.Set(namespace)
+	defaulter := &PodCustomDefaulter{
+		Client:   fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build(),
+		Policies: resolver,
+	}
+
+	if _, ok := resolver.Resolve("test-namespace"); ok {
+		t.Error("Expected no lookups before the initial sync")
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-namespace"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: testNginxImage}}},
+	}
+	_ = defaulter.Default(context.Background(), pod)
+	if pod.Spec.Containers[0].Image != testMyRegistryNginx {
+		t.Errorf("Expected the client fallback to rewrite the image, got %s", pod.Spec.Containers[0].Image)
+	}
+}
+
+func TestPolicyResolver_HandlesInformerEvents(t *testing.T) {
+	resolver := NewPolicyResolver(nil)
+	resolver.synced.Store(true)
+	namespace := resolverNamespace()
+
+	resolver.update(namespace)
+	if compiled, ok := resolver.Resolve("test-namespace"); !ok || !compiled.Enabled || !compiled.Configured ||
+		compiled.Policy.TargetRegistries[0] != "myregistry.io" {
+		t.Fatalf("Expected a compiled policy after an add event, got %+v", compiled)
+	}
+
+	updated := namespace.DeepCopy()
+	delete(updated.Labels, LabelRegistryRewrite)
+	resolver.update(updated)
+	if compiled, _ := resolver.Resolve("test-namespace"); compiled.Enabled {
+		t.Error("Expected the update event to disable the namespace")
+	}
+
+	resolver.delete(toolscache.DeletedFinalStateUnknown{Key: "test-namespace", Obj: updated})
+	if _, ok := resolver.Resolve("test-namespace"); ok {
+		t.Error("Expected the namespace to be removed after a delete event")
+	}
+}
+
+// admissionLatencies sends rounds of nfrConcurrency simultaneous pod creations through the admission
+// handler, as NFR-008 describes, and returns the sorted latency of each request.
+func admissionLatencies(tb testing.TB, rounds int) []time.Duration {
+	tb.Helper()
+	defaulter, gets := newResolvedDefaulter(resolverNamespace())
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	handler := admission.WithCustomDefaulter(scheme, &corev1.Pod{}, defaulter)
+
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox:1.36"}},
+			Containers:     []corev1.Container{{Name: "nginx", Image: testNginxImage}, {Name: "app", Image: "team/app:v1"}},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Operation: admissionv1.Create,
+		Namespace: "test-namespace",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+
+	latencies := make([]time.Duration, 0, rounds*nfrConcurrency)
+	round := make([]time.Duration, nfrConcurrency)
+	for range rounds {
+		var wg sync.WaitGroup
+		for i := range nfrConcurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				start := time.Now()
+				resp := handler.Handle(context.Background(), req)
+				round[i] = time.Since(start)
+				if !resp.Allowed || len(resp.Patches) == 0 {
+					tb.Errorf("Expected an allowed response with patches, got %+v", resp.Result)
+				}
+			}()
+		}
+		wg.Wait()
+		latencies = append(latencies, round...)
+	}
+
+	if gets.Load() != 0 {
+		tb.Errorf("Expected no API calls during admission, got %d", gets.Load())
+	}
+	slices.Sort(latencies)
+	return latencies
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func checkNFRLatency(tb testing.TB, latencies []time.Duration) {
+	tb.Helper()
+	if p95 := percentile(latencies, 0.95); p95 > nfrP95 {
+		tb.Errorf("NFR-005: p95 latency %v exceeds %v at %d concurrent requests", p95, nfrP95, nfrConcurrency)
+	}
+	if worst := latencies[len(latencies)-1]; worst > nfrMax {
+		tb.Errorf("NFR-005: slowest request took %v, more than %v", worst, nfrMax)
+	}
+}
+
+// BenchmarkAdmission_Concurrent50 measures admission through the real handler in rounds of 50
+// simultaneous requests and reports the latency percentiles NFR-005 and NFR-008 set limits for.
+func BenchmarkAdmission_Concurrent50(b *testing.B) {
+	rounds := max(b.N/nfrConcurrency, 1)
+	b.ResetTimer()
+	latencies := admissionLatencies(b, rounds)
+	b.StopTimer()
+
+	for _, p := range []float64{0.5, 0.95, 0.99} {
+		b.ReportMetric(float64(percentile(latencies, p).Microseconds()), fmt.Sprintf("p%.0f-µs", p*100))
+	}
+	b.ReportMetric(float64(latencies[len(latencies)-1].Microseconds()), "max-µs")
+	checkNFRLatency(b, latencies)
+}
+
+func TestStaticPolicyResolver(t *testing.T) {
+	policies, err := ParseStaticPolicies([]byte(`
+namespaces:
+  team-a:
+    targetRegistries: [eu.mirror.io, global.mirror.io]
+`))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resolver := NewStaticPolicyResolver(policies)
+
+	compiled, ok := resolver.Resolve("team-a")
+	if !ok || !compiled.Enabled || !compiled.Policy.Verify {
+		t.Errorf("Expected a verified policy for the listed namespace, got %+v", compiled)
+	}
+	if compiled, ok := resolver.Resolve("team-b"); !ok || compiled.Enabled {
+		t.Errorf("Expected unlisted namespaces to resolve as disabled, got %+v, %t", compiled, ok)
+	}
+
+	resolver = NewStaticPolicyResolver(StaticPolicies{Default: &Policy{TargetRegistries: []string{"mirror.corp.io"}}})
+	if compiled, _ := resolver.Resolve("team-b"); !compiled.Enabled || compiled.Policy.TargetRegistries[0] != "mirror.corp.io" {
+		t.Errorf("Expected the default policy for unlisted namespaces, got %+v", compiled)
+	}
+
+	if _, err := ParseStaticPolicies([]byte("namespaces:\n  team-a:\n    verify: true\n")); err == nil ||
+		!strings.HasPrefix(err.Error(), "namespaces[team-a]:") {
+		t.Errorf("Expected an error naming the namespace, got: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+// PURPOSE: Appends the configured pull Secret of a target registry to pods whose images are rewritten to it
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// PullSecret names the Secret granting access to a target registry. Source is the Secret the
+// operator replicates into opted-in namespaces under the same name.
+type PullSecret struct {
+	Registry string
+	Source   types.NamespacedName
+}
+
+// ParsePullSecret parses a flag value of the form <registry>=<namespace>/<name>.
+func ParsePullSecret(value string) (PullSecret, error) {
+	host, secret, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return PullSecret{}, fmt.Errorf("invalid pull secret %q, expected <registry>=<namespace>/<name>", value)
+	}
+	namespace, name, ok := strings.Cut(secret, "/")
+	if !ok || namespace == "" || name == "" {
+		return PullSecret{}, fmt.Errorf("invalid pull secret %q, expected <registry>=<namespace>/<name>", value)
+	}
+	target, err := registry.NormalizeTarget(host)
+	if err != nil {
+		return PullSecret{}, fmt.Errorf("invalid pull secret %q: %w", value, err)
+	}
+	return PullSecret{
+		Registry: registry.TargetHost(target),
+		Source:   types.NamespacedName{Namespace: namespace, Name: name},
+	}, nil
+}
+
+// PullSecretNames maps each registry host to the name of its Secret.
+func PullSecretNames(secrets []PullSecret) map[string]string {
+	names := make(map[string]string, len(secrets))
+	for _, secret := range secrets {
+		names[secret.Registry] = secret.Source.Name
+	}
+	return names
+}
+
+// injectPullSecret appends the pull Secret configured for target to the pod unless it is already listed.
+func (d *PodCustomDefaulter) injectPullSecret(pod *corev1.Pod, target string) {
+	name, ok := d.PullSecrets[registry.TargetHost(target)]
+	if !ok {
+		return
+	}
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		if ref.Name == name {
+			return
+		}
+	}
+	pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+	podlog.Info("added image pull secret", "namespace", pod.Namespace, "pod_name", podName(pod),
+		"secret", name, "target_registry", target)
+}
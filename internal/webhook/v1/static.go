@@ -0,0 +1,68 @@
+// PURPOSE: Namespace policies given in a file, for serving admission without reading Namespaces from an API server
+package v1
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// StaticPolicies assign a policy to namespaces by name.
+type StaticPolicies struct {
+	// Namespaces have rewriting enabled with their policy.
+	Namespaces map[string]Policy `json:"namespaces"`
+	// Default, when set, applies to the namespaces not listed. Without it they are not rewritten.
+	Default *Policy `json:"default,omitempty"`
+}
+
+// ParseStaticPolicies reads static policies from YAML or JSON. Unknown fields are rejected and each
+// policy is checked as by ParsePolicyFile.
+func ParseStaticPolicies(data []byte) (StaticPolicies, error) {
+	var policies StaticPolicies
+	if err := yaml.UnmarshalStrict(data, &policies); err != nil {
+		return StaticPolicies{}, fmt.Errorf("parsing static policies: %w", err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(policies.Namespaces)) {
+		policy := policies.Namespaces[name]
+		if err := policy.normalize(); err != nil {
+			return StaticPolicies{}, fmt.Errorf("namespaces[%s]: %w", name, err)
+		}
+		policies.Namespaces[name] = policy
+	}
+	if policies.Default != nil {
+		if err := policies.Default.normalize(); err != nil {
+			return StaticPolicies{}, fmt.Errorf("default: %w", err)
+		}
+	}
+	return policies, nil
+}
+
+// NewStaticPolicyResolver returns a resolver serving policies without an informer. It resolves every
+// namespace, so the defaulter never reads Namespaces and needs no client.
+func NewStaticPolicyResolver(policies StaticPolicies) *PolicyResolver {
+	resolver := NewPolicyResolver(nil)
+	for name, policy := range policies.Namespaces {
+		resolver.policies[name] = staticNamespacePolicy(policy, "namespace "+name)
+	}
+	if policies.Default != nil {
+		resolver.unlisted = staticNamespacePolicy(*policies.Default, "default")
+	} else {
+		trace := &Trace{}
+		trace.record(stepNamespaceLabel, outcomeSkipped, "namespace is not in the static configuration")
+		resolver.unlisted = NamespacePolicy{steps: trace.Steps}
+	}
+	resolver.static = true
+	resolver.synced.Store(true)
+	return resolver
+}
+
+func staticNamespacePolicy(policy Policy, source string) NamespacePolicy {
+	trace := &Trace{}
+	trace.record(stepNamespaceLabel, outcomeMatched, "static configuration")
+	trace.record(stepPolicy, outcomeMatched, fmt.Sprintf("static configuration, %s: %s, verify=%t",
+		source, strings.Join(policy.TargetRegistries, ", "), policy.Verify))
+	return NamespacePolicy{Enabled: true, Configured: true, Policy: policy, steps: trace.Steps}
+}
@@ -0,0 +1,112 @@
+// PURPOSE: Tag policy for images without a tag or digest: keep them, default to latest, warn or reject the pod
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// AnnotationTagPolicy sets how a namespace's images without a tag or digest are handled.
+const AnnotationTagPolicy = "image-rewriter.example.com/tag-policy"
+
+// Tag policies for images without a tag or digest.
+const (
+	// TagPolicyDefaultLatest appends :latest when rewriting, the default.
+	TagPolicyDefaultLatest = "default-latest"
+	// TagPolicyPreserve rewrites the registry only, leaving the image without a tag.
+	TagPolicyPreserve = "preserve"
+	// TagPolicyWarn preserves the image and returns an admission warning.
+	TagPolicyWarn = "warn"
+	// TagPolicyDeny rejects the pod in the validating webhook.
+	TagPolicyDeny = "deny"
+)
+
+var tagPolicies = []string{TagPolicyDefaultLatest, TagPolicyPreserve, TagPolicyWarn, TagPolicyDeny}
+
+// validTagPolicy reports whether value is a tag policy, the empty default included.
+func validTagPolicy(value string) bool {
+	return value == "" || sets.New(tagPolicies...).Has(value)
+}
+
+// tagPolicy returns the effective tag policy of p.
+func (p Policy) tagPolicy() string {
+	if p.TagPolicy == "" {
+		return TagPolicyDefaultLatest
+	}
+	return p.TagPolicy
+}
+
+// keepsTagless reports whether image has neither tag nor digest and is to be rewritten without one.
+func (p Policy) keepsTagless(image string) bool {
+	return p.tagPolicy() != TagPolicyDefaultLatest && registry.HasImplicitTag(image)
+}
+
+// NamespaceResolver resolves the policy of a namespace, as PodCustomDefaulter does.
+type NamespaceResolver interface {
+	ResolveNamespace(ctx context.Context, name string) (NamespacePolicy, error)
+}
+
+// tagless returns the image locations of pod whose image has neither a tag nor a digest, skipping
+// those whose image is the same in old.
+func tagless(pod, old *corev1.Pod) []ImageLocation {
+	previous := map[string]string{}
+	if old != nil {
+		previous = podImages(old)
+	}
+	var found []ImageLocation
+	for location := range ImageLocations(pod) {
+		if image := *location.Image; registry.HasImplicitTag(image) && previous[location.String()] != image {
+			found = append(found, location)
+		}
+	}
+	return found
+}
+
+// validateTags applies the warn and deny tag policies to the images of pod that have no tag or digest
+// and differ from old. The decision for each image is logged.
+func validateTags(ctx context.Context, namespaces NamespaceResolver, pod, old *corev1.Pod) (admission.Warnings, error) {
+	if namespaces == nil {
+		return nil, nil
+	}
+	images := tagless(pod, old)
+	if len(images) == 0 {
+		return nil, nil
+	}
+	compiled, err := namespaces.ResolveNamespace(ctx, pod.Namespace)
+	if err != nil {
+		logFor(ctx).Error(err, "failed to get namespace", "namespace", pod.Namespace)
+		return nil, nil // fail-safe: don't block pod creation
+	}
+	if !compiled.Enabled || !compiled.Configured {
+		return nil, nil
+	}
+	mode := compiled.Policy.tagPolicy()
+	if mode != TagPolicyWarn && mode != TagPolicyDeny {
+		return nil, nil
+	}
+
+	var warnings admission.Warnings
+	var denied []string
+	for _, location := range images {
+		image := *location.Image
+		logFor(ctx).Info("image has no tag or digest", "namespace", pod.Namespace, "pod_name", podName(pod),
+			"container_name", location.Name, "original_image", image, "tag_policy", mode)
+		message := fmt.Sprintf("%s image %s has no tag or digest", location, image)
+		if mode == TagPolicyDeny {
+			denied = append(denied, message)
+			continue
+		}
+		warnings = append(warnings, message)
+	}
+	if len(denied) > 0 {
+		return nil, fmt.Errorf("tag policy %s of namespace %s: %s", mode, pod.Namespace, strings.Join(denied, "; "))
+	}
+	return warnings, nil
+}
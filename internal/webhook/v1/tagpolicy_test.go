@@ -0,0 +1,152 @@
+// PURPOSE: Unit tests for the tag policy of images without a tag or digest
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// tagPolicyPod returns a pod of test-namespace with a tag-less, a tagged and a digest image.
+func tagPolicyPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "nginx"},
+				{Name: "tagged", Image: "redis:7.2"},
+				{Name: "pinned", Image: "gcr.io/team/app@sha256:abc"},
+			},
+		},
+	}
+}
+
+func TestPodDefaulter_TagPolicyRewrite(t *testing.T) {
+	tests := map[string]string{
+		"":                     "myregistry.io/nginx:latest",
+		TagPolicyDefaultLatest: "myregistry.io/nginx:latest",
+		TagPolicyPreserve:      "myregistry.io/nginx",
+		TagPolicyWarn:          "myregistry.io/nginx",
+		TagPolicyDeny:          "myregistry.io/nginx",
+		"Deny":                 "myregistry.io/nginx:latest",
+	}
+	for mode, want := range tests {
+		namespace := resolverNamespace()
+		if mode != "" {
+			namespace.Annotations[AnnotationTagPolicy] = mode
+		}
+		defaulter, _ := newResolvedDefaulter(namespace)
+		pod := tagPolicyPod()
+		if err := defaulter.Default(context.Background(), pod); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if got := pod.Spec.Containers[0].Image; got != want {
+			t.Errorf("Expected %s with tag policy %q, got %s", want, mode, got)
+		}
+		if got := pod.Spec.Containers[1].Image; got != "myregistry.io/redis:7.2" {
+			t.Errorf("Expected tagged images to keep their tag with tag policy %q, got %s", mode, got)
+		}
+	}
+}
+
+func TestPodCustomValidator_TagPolicy(t *testing.T) {
+	tests := []struct {
+		mode     string
+		warnings int
+		denied   bool
+	}{
+		{TagPolicyDefaultLatest, 0, false},
+		{TagPolicyPreserve, 0, false},
+		{TagPolicyWarn, 2, false},
+		{TagPolicyDeny, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			namespace := resolverNamespace()
+			namespace.Annotations[AnnotationTagPolicy] = tt.mode
+			defaulter, _ := newResolvedDefaulter(namespace)
+			validator := &PodCustomValidator{Namespaces: defaulter}
+
+			pod := tagPolicyPod()
+			if err := defaulter.Default(context.Background(), pod); err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			warnings, err := validator.ValidateCreate(context.Background(), pod)
+			if len(warnings) != tt.warnings {
+				t.Errorf("Expected %d warnings, got %v", tt.warnings, warnings)
+			}
+			if tt.denied != (err != nil) {
+				t.Fatalf("Expected denied=%t, got: %v", tt.denied, err)
+			}
+			if tt.denied && !strings.Contains(err.Error(), "container app image myregistry.io/nginx has no tag or digest") {
+				t.Errorf("Expected the error to name the container, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestPodCustomValidator_UpdateChecksChangedImagesOnly(t *testing.T) {
+	namespace := resolverNamespace()
+	namespace.Annotations[AnnotationTagPolicy] = TagPolicyDeny
+	defaulter, _ := newResolvedDefaulter(namespace)
+	validator := &PodCustomValidator{Namespaces: defaulter}
+
+	old := tagPolicyPod()
+	updated := old.DeepCopy()
+	updated.Labels = map[string]string{"version": "2"}
+	if _, err := validator.ValidateUpdate(context.Background(), old, updated); err != nil {
+		t.Errorf("Expected an update leaving images alone to be allowed, got: %v", err)
+	}
+
+	updated.Spec.Containers[1].Image = "redis"
+	if _, err := validator.ValidateUpdate(context.Background(), old, updated); err == nil ||
+		!strings.Contains(err.Error(), "container tagged") || strings.Contains(err.Error(), "container app") {
+		t.Errorf("Expected only the changed image to be denied, got: %v", err)
+	}
+}
+
+func TestPodCustomValidator_IgnoresDisabledNamespaces(t *testing.T) {
+	namespace := resolverNamespace()
+	namespace.Annotations[AnnotationTagPolicy] = TagPolicyDeny
+	delete(namespace.Labels, LabelRegistryRewrite)
+	defaulter, _ := newResolvedDefaulter(namespace)
+
+	validator := &PodCustomValidator{Namespaces: defaulter}
+	if _, err := validator.ValidateCreate(context.Background(), tagPolicyPod()); err != nil {
+		t.Errorf("Expected pods of disabled namespaces to be allowed, got: %v", err)
+	}
+	if _, err := (&PodCustomValidator{}).ValidateCreate(context.Background(), tagPolicyPod()); err != nil {
+		t.Errorf("Expected a validator without a resolver to allow pods, got: %v", err)
+	}
+}
+
+func TestPolicy_CandidatesKeepTheTagRulesWrite(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(`
+rewriteRules:
+- match: 'docker\.io/library/nginx:latest'
+  replace: mirror.corp.io/pinned/nginx:latest
+  tests:
+  - {image: nginx, want: mirror.corp.io/pinned/nginx:latest}
+`))
+	if err != nil {
+		t.Fatalf("Expected valid defaults, got: %v", err)
+	}
+	policy := Policy{TargetRegistries: []string{"myregistry.io"}, RewriteRules: defaults.RewriteRules,
+		TagPolicy: TagPolicyPreserve}
+	pod := tagPolicyPod()
+
+	want := map[string]string{"app": "mirror.corp.io/pinned/nginx:latest", "init": "myregistry.io/busybox"}
+	for location := range ImageLocations(pod) {
+		if _, ok := want[location.Name]; !ok {
+			continue
+		}
+		candidates, _, err := policy.Candidates(pod, location)
+		if err != nil || len(candidates) != 1 || candidates[0].Image != want[location.Name] {
+			t.Errorf("Expected %s for %s, got %+v, %v", want[location.Name], *location.Image, candidates, err)
+		}
+	}
+}
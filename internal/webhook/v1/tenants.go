@@ -0,0 +1,237 @@
+// PURPOSE: Limits the rewrite settings tenants make on their namespaces to those the platform allows
+package v1
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"mutating-registry-hook/internal/registry"
+)
+
+// TenantPolicy declares which namespace settings tenants may change. The Namespace webhook rejects
+// changes outside it, so tenants can narrow the platform's settings but not redirect images to other
+// registries or switch rewriting off where the platform requires it.
+type TenantPolicy struct {
+	// AllowedTargets are the registries, or registry/path prefixes, the target-registry and
+	// target-registries annotations may name. Empty allows none.
+	AllowedTargets []string `json:"allowedTargets,omitempty"`
+	// PermittedExclusions are the registries, or registry/repository prefixes, the preserve-registry
+	// annotation may list. Empty allows none.
+	PermittedExclusions []string `json:"permittedExclusions,omitempty"`
+	// RequiredNamespaces are glob patterns, such as "prod-*", of namespaces that must keep the
+	// registry-rewrite label enabled and may not dry-run.
+	RequiredNamespaces []string `json:"requiredNamespaces,omitempty"`
+	// AdminGroups are the user groups whose changes are not limited.
+	AdminGroups []string `json:"adminGroups,omitempty"`
+}
+
+// Tag and architecture policies from the most lenient to the strictest. Tenants may only choose one
+// at least as strict as the platform's.
+var (
+	tagPolicyStrictness          = []string{TagPolicyPreserve, TagPolicyDefaultLatest, TagPolicyWarn, TagPolicyDeny}
+	architecturePolicyStrictness = []string{ArchitecturePolicyIgnore, ArchitecturePolicyWarn, ArchitecturePolicyFallback}
+)
+
+// tenantAnnotations are the namespace annotations a tenant policy limits, in the order they are checked.
+var tenantAnnotations = []string{AnnotationTargetRegistry, AnnotationTargetRegistries, AnnotationVerify,
+	AnnotationPreserveRegistries, AnnotationDryRun, AnnotationRewriteLocalRegistries, AnnotationTagPolicy,
+	AnnotationArchitecturePolicy}
+
+// validate returns the invalid settings, with field paths below fldPath. A nil policy is valid.
+func (t *TenantPolicy) validate(fldPath *field.Path) field.ErrorList {
+	if t == nil {
+		return nil
+	}
+	var errs field.ErrorList
+	for i, target := range t.AllowedTargets {
+		if err := validateTarget(target); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("allowedTargets").Index(i), target, err.Error()))
+		}
+	}
+	for i, entry := range t.PermittedExclusions {
+		if strings.TrimSpace(entry) == "" {
+			errs = append(errs, field.Required(fldPath.Child("permittedExclusions").Index(i), "must not be empty"))
+		}
+	}
+	for i, pattern := range t.RequiredNamespaces {
+		patternPath := fldPath.Child("requiredNamespaces").Index(i)
+		if pattern == "" {
+			errs = append(errs, field.Required(patternPath, "must not be empty"))
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, field.Invalid(patternPath, pattern, err.Error()))
+		}
+	}
+	for i, group := range t.AdminGroups {
+		if group == "" {
+			errs = append(errs, field.Required(fldPath.Child("adminGroups").Index(i), "must not be empty"))
+		}
+	}
+	return errs
+}
+
+// normalize puts the allowed targets and permitted exclusions in the form they are compared in.
+func (t *TenantPolicy) normalize() {
+	if t == nil {
+		return
+	}
+	t.AllowedTargets = normalizeTargets(t.AllowedTargets)
+	for i, entry := range t.PermittedExclusions {
+		t.PermittedExclusions[i] = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(entry)), "/")
+	}
+}
+
+// requires reports whether the named namespace must keep rewriting on.
+func (t *TenantPolicy) requires(namespace string) bool {
+	for _, pattern := range t.RequiredNamespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether a user in groups may change any setting.
+func (t *TenantPolicy) isAdmin(groups []string) bool {
+	for _, group := range groups {
+		if slices.Contains(t.AdminGroups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// underAny reports whether entry, a registry or a path below one, is one of prefixes or below one.
+func underAny(entry string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if entry == prefix || strings.HasPrefix(entry, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the rewrite settings of namespace that tenants may not make, with field paths below
+// metadata, given the platform's defaults. Settings that differ from old, which is nil on creation,
+// are errors. The others were made before the policy or by an admin and are returned as warnings, so
+// the namespace can still be updated.
+func (t *TenantPolicy) Check(namespace, old *corev1.Namespace, defaults *Defaults) (field.ErrorList,
+	admission.Warnings) {
+	if defaults == nil {
+		defaults = &Defaults{}
+	}
+	var errs field.ErrorList
+	var warnings admission.Warnings
+	report := func(changed bool, violations field.ErrorList) {
+		if changed {
+			errs = append(errs, violations...)
+			return
+		}
+		for _, violation := range violations {
+			warnings = append(warnings, "unchanged setting outside the tenant policy: "+violation.Error())
+		}
+	}
+
+	var oldAnnotations, oldLabels map[string]string
+	if old != nil {
+		oldAnnotations, oldLabels = old.Annotations, old.Labels
+	}
+
+	annotations := field.NewPath("metadata", "annotations")
+	for _, key := range tenantAnnotations {
+		value, ok := namespace.Annotations[key]
+		previous, existed := oldAnnotations[key]
+		report(old == nil || value != previous || ok != existed,
+			t.checkAnnotation(annotations.Key(key), key, value, ok, namespace.Name, defaults))
+	}
+
+	if t.requires(namespace.Name) {
+		value, ok := namespace.Labels[LabelRegistryRewrite]
+		previous, existed := oldLabels[LabelRegistryRewrite]
+		if value != LabelValueEnabled {
+			report(old == nil || value != previous || ok != existed, field.ErrorList{field.Forbidden(
+				field.NewPath("metadata", "labels").Key(LabelRegistryRewrite),
+				fmt.Sprintf("namespace %s requires rewriting; the label must be %s", namespace.Name,
+					LabelValueEnabled))})
+		}
+	}
+	return errs, warnings
+}
+
+// checkAnnotation returns the violations of the annotation key with value, if present, on the named
+// namespace. Removing an annotation falls back to the platform's settings and is always allowed.
+func (t *TenantPolicy) checkAnnotation(fldPath *field.Path, key, value string, present bool, namespace string,
+	defaults *Defaults) field.ErrorList {
+	if !present {
+		return nil
+	}
+	platform := Policy{TagPolicy: defaults.TagPolicy, ArchitecturePolicy: defaults.ArchitecturePolicy,
+		RewriteLocalRegistries: defaults.RewriteLocalRegistries}
+	var errs field.ErrorList
+	switch key {
+	case AnnotationTargetRegistry, AnnotationTargetRegistries:
+		for _, target := range splitList(value) {
+			normalized, err := registry.NormalizeTarget(target)
+			if err != nil {
+				errs = append(errs, field.Invalid(fldPath, target, err.Error()))
+			} else if !underAny(normalized, t.AllowedTargets) {
+				errs = append(errs, field.Forbidden(fldPath, fmt.Sprintf("target %s is not allowed, allowed targets: %s",
+					target, describeList(t.AllowedTargets))))
+			}
+		}
+	case AnnotationPreserveRegistries:
+		for _, entry := range splitList(value) {
+			if !underAny(strings.TrimSuffix(strings.ToLower(entry), "/"), t.PermittedExclusions) {
+				errs = append(errs, field.Forbidden(fldPath, fmt.Sprintf(
+					"excluding %s is not permitted, permitted exclusions: %s", entry,
+					describeList(t.PermittedExclusions))))
+			}
+		}
+	case AnnotationVerify:
+		if defaults.Verify && value != "true" {
+			errs = append(errs, field.Forbidden(fldPath, "the platform verifies targets; verify may only be true"))
+		}
+	case AnnotationRewriteLocalRegistries:
+		if platform.rewritesLocalRegistries() && value != "true" {
+			errs = append(errs, field.Forbidden(fldPath,
+				"the platform rewrites local registries; rewrite-local-registries may only be true"))
+		}
+	case AnnotationDryRun:
+		if value == "true" && t.requires(namespace) {
+			errs = append(errs, field.Forbidden(fldPath, fmt.Sprintf("namespace %s requires rewriting; dry-run is "+
+				"not allowed", namespace)))
+		}
+	case AnnotationTagPolicy:
+		errs = append(errs, checkStricter(fldPath, value, platform.tagPolicy(), tagPolicyStrictness)...)
+	case AnnotationArchitecturePolicy:
+		errs = append(errs, checkStricter(fldPath, value, platform.architecturePolicy(),
+			architecturePolicyStrictness)...)
+	}
+	return errs
+}
+
+// checkStricter rejects a mode less strict than the platform's, by its position in strictness.
+func checkStricter(fldPath *field.Path, value, platform string, strictness []string) field.ErrorList {
+	rank := slices.Index(strictness, value)
+	if rank < 0 {
+		return field.ErrorList{field.NotSupported(fldPath, value, strictness)}
+	}
+	if base := slices.Index(strictness, platform); rank < base {
+		return field.ErrorList{field.Forbidden(fldPath, fmt.Sprintf("%s is less strict than the platform's %s, "+
+			"allowed: %s", value, platform, strings.Join(strictness[base:], ", ")))}
+	}
+	return nil
+}
+
+// describeList joins entries for messages, naming an empty list.
+func describeList(entries []string) string {
+	if len(entries) == 0 {
+		return "none"
+	}
+	return strings.Join(entries, ", ")
+}
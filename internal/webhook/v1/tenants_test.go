@@ -0,0 +1,190 @@
+// PURPOSE: Unit tests for the tenant policy and the Namespace webhook enforcing it
+package v1
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const tenantDefaults = `
+targetRegistries: [mirror.corp.io]
+verify: true
+tagPolicy: warn
+tenants:
+  allowedTargets: [team-mirror.corp.io, 'Mirror.corp.io/teams/']
+  permittedExclusions: [registry.k8s.io, 'quay.io/org/']
+  requiredNamespaces: ['prod-*']
+  adminGroups: [platform-admins]
+`
+
+// tenantNamespace returns an enabled namespace with the given annotations.
+func tenantNamespace(name string, annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Labels:      map[string]string{LabelRegistryRewrite: LabelValueEnabled},
+		Annotations: annotations,
+	}}
+}
+
+func TestTenantPolicy_Check(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(tenantDefaults))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		want        string // a substring of the errors, empty when allowed
+	}{
+		{"no settings", "team-a", nil, ""},
+		{"allowed target", "team-a", map[string]string{AnnotationTargetRegistry: "team-mirror.corp.io",
+			AnnotationVerify: "true"}, ""},
+		{"allowed target prefix", "team-a", map[string]string{
+			AnnotationTargetRegistries: "mirror.corp.io/teams/a, team-mirror.corp.io/a"}, ""},
+		{"other target", "team-a", map[string]string{AnnotationTargetRegistry: "evil.io", AnnotationVerify: "true"},
+			"target evil.io is not allowed"},
+		{"sibling of an allowed prefix", "team-a", map[string]string{
+			AnnotationTargetRegistries: "mirror.corp.io/teamsx"}, "target mirror.corp.io/teamsx is not allowed"},
+		{"unverified target", "team-a", map[string]string{AnnotationTargetRegistry: "team-mirror.corp.io",
+			AnnotationVerify: "false"}, "verify may only be true"},
+		{"permitted exclusions", "team-a", map[string]string{
+			AnnotationPreserveRegistries: "registry.k8s.io, quay.io/org/app"}, ""},
+		{"other exclusion", "team-a", map[string]string{AnnotationPreserveRegistries: "docker.io"},
+			"excluding docker.io is not permitted"},
+		{"stricter tag policy", "team-a", map[string]string{AnnotationTagPolicy: TagPolicyDeny}, ""},
+		{"more lenient tag policy", "team-a", map[string]string{AnnotationTagPolicy: TagPolicyDefaultLatest},
+			"default-latest is less strict than the platform's warn, allowed: warn, deny"},
+		{"unknown tag policy", "team-a", map[string]string{AnnotationTagPolicy: "strict"}, "Unsupported value"},
+		{"architecture policy at the platform's", "team-a", map[string]string{
+			AnnotationArchitecturePolicy: ArchitecturePolicyFallback}, ""},
+		{"more lenient architecture policy", "team-a", map[string]string{
+			AnnotationArchitecturePolicy: ArchitecturePolicyIgnore}, "ignore is less strict"},
+		{"dry-run where not required", "team-a", map[string]string{AnnotationDryRun: "true"}, ""},
+		{"dry-run where required", "prod-eu", map[string]string{AnnotationDryRun: "true"}, "dry-run is not allowed"},
+	}
+	for _, tt := range tests {
+		errs, _ := defaults.Tenants.Check(tenantNamespace(tt.namespace, tt.annotations), nil, defaults)
+		got := errs.ToAggregate()
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("%s: expected no errors, got: %v", tt.name, got)
+		case tt.want != "" && (got == nil || !strings.Contains(got.Error(), tt.want)):
+			t.Errorf("%s: expected an error containing %q, got: %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestTenantPolicy_CheckOnlyRejectsChanges(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(tenantDefaults))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// A setting made before the policy is a warning while it stays the same
+	old := tenantNamespace("team-a", map[string]string{AnnotationPreserveRegistries: "docker.io"})
+	updated := old.DeepCopy()
+	updated.Labels["team"] = "a"
+	errs, warnings := defaults.Tenants.Check(updated, old, defaults)
+	if len(errs) != 0 || len(warnings) != 1 || !strings.Contains(warnings[0], "excluding docker.io") {
+		t.Errorf("Expected one warning about docker.io, got %v, %v", errs, warnings)
+	}
+
+	// Removing a setting is always allowed
+	delete(updated.Annotations, AnnotationPreserveRegistries)
+	if errs, warnings := defaults.Tenants.Check(updated, old, defaults); len(errs) != 0 || len(warnings) != 0 {
+		t.Errorf("Expected the removal to be allowed, got %v, %v", errs, warnings)
+	}
+
+	// Switching rewriting off where it is required is rejected, keeping it off is not
+	old = tenantNamespace("prod-eu", nil)
+	updated = old.DeepCopy()
+	delete(updated.Labels, LabelRegistryRewrite)
+	errs, _ = defaults.Tenants.Check(updated, old, defaults)
+	if len(errs) != 1 || errs[0].Field != "metadata.labels[registry-rewrite]" {
+		t.Errorf("Expected the label removal to be rejected, got %v", errs)
+	}
+	if errs, warnings := defaults.Tenants.Check(updated, updated.DeepCopy(), defaults); len(errs) != 0 ||
+		len(warnings) != 1 {
+		t.Errorf("Expected a warning for the unchanged label, got %v, %v", errs, warnings)
+	}
+	if errs, _ := defaults.Tenants.Check(updated, nil, defaults); len(errs) != 1 {
+		t.Errorf("Expected a required namespace to be created with rewriting enabled, got %v", errs)
+	}
+}
+
+func TestNamespaceCustomValidator(t *testing.T) {
+	defaults, err := ParseDefaults([]byte(tenantDefaults))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	resolver := NewPolicyResolver(nil)
+	resolver.SetDefaults(defaults)
+	validator := &NamespaceCustomValidator{Defaults: resolver}
+
+	old := tenantNamespace("team-a", nil)
+	redirected := tenantNamespace("team-a", map[string]string{AnnotationTargetRegistry: "evil.io"})
+	_, err = validator.ValidateUpdate(context.Background(), old, redirected)
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "metadata.annotations["+AnnotationTargetRegistry+"]") {
+		t.Errorf("Expected the redirect to be forbidden, got: %v", err)
+	}
+
+	// Admins are not limited
+	ctx := admission.NewContextWithRequest(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			UserInfo: authenticationv1.UserInfo{Username: "alice", Groups: []string{"platform-admins"}},
+		},
+	})
+	if _, err := validator.ValidateUpdate(ctx, old, redirected); err != nil {
+		t.Errorf("Expected an admin's change to be allowed, got: %v", err)
+	}
+
+	// Without a tenant policy every setting is allowed
+	resolver.SetDefaults(&Defaults{})
+	if _, err := validator.ValidateUpdate(context.Background(), old, redirected); err != nil {
+		t.Errorf("Expected no tenant policy to allow the change, got: %v", err)
+	}
+}
+
+func TestNamespaceCustomValidator_RejectsUntilDefaultsAreLoaded(t *testing.T) {
+	resolver := NewPolicyResolver(nil)
+	validator := &NamespaceCustomValidator{Defaults: resolver}
+	namespace := tenantNamespace("team-a", map[string]string{AnnotationTargetRegistry: "evil.io"})
+
+	if _, err := validator.ValidateCreate(context.Background(), namespace); !apierrors.IsServiceUnavailable(err) {
+		t.Errorf("Expected changes to be rejected as unavailable before the defaults are loaded, got: %v", err)
+	}
+
+	// Loaded defaults without a tenant policy, none at all included, allow every setting
+	resolver.SetDefaults(nil)
+	if _, err := validator.ValidateCreate(context.Background(), namespace); err != nil {
+		t.Errorf("Expected no defaults to allow the change once loaded, got: %v", err)
+	}
+}
+
+func TestParseDefaults_RejectsInvalidTenantPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		tenants string
+		want    string
+	}{
+		{"{allowedTargets: ['https://a.io']}", "tenants.allowedTargets[0]: Invalid value"},
+		{"{permittedExclusions: ['']}", "tenants.permittedExclusions[0]: Required value"},
+		{"{requiredNamespaces: ['prod-[']}", "tenants.requiredNamespaces[0]: Invalid value"},
+		{"{adminGroups: ['']}", "tenants.adminGroups[0]: Required value"},
+		{"{allowedRegistries: [a.io]}", "unknown field"},
+	} {
+		_, err := ParseDefaults([]byte("tenants: " + tt.tenants))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Expected %s to be rejected with %q, got: %v", tt.tenants, tt.want, err)
+		}
+	}
+}
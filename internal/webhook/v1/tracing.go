@@ -0,0 +1,88 @@
+// PURPOSE: OpenTelemetry spans for the admission path and the trace context added to its log lines
+package v1
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the instrumentation scope of the webhook's spans.
+const TracerName = "mutating-registry-hook/internal/webhook/v1"
+
+// Span names of the admission path. Registry HTTP calls are children of spanRewriteImage.
+const (
+	spanAdmission     = "admission.pod"
+	spanResolvePolicy = "resolve-policy"
+	spanRewriteImage  = "rewrite-image"
+)
+
+// Decisions recorded on the admission span.
+const (
+	decisionMutated   = "mutated"
+	decisionUnchanged = "unchanged"
+	decisionSkipped   = "skipped"
+	decisionRejected  = "rejected"
+)
+
+// Span attributes.
+const (
+	attrUID        = attribute.Key("admission.uid")
+	attrOperation  = attribute.Key("admission.operation")
+	attrDecision   = attribute.Key("admission.decision")
+	attrNamespace  = attribute.Key("k8s.namespace.name")
+	attrPod        = attribute.Key("k8s.pod.name")
+	attrContainer  = attribute.Key("k8s.container.name")
+	attrImage      = attribute.Key("image.original")
+	attrRewritten  = attribute.Key("image.rewritten")
+	attrTarget     = attribute.Key("image.target_registry")
+	attrResult     = attribute.Key("image.result")
+	attrEnabled    = attribute.Key("policy.enabled")
+	attrConfigured = attribute.Key("policy.configured")
+)
+
+// tracer returns the webhook's tracer from the global provider, which cmd/main.go configures.
+// Without one spans are not recorded.
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// startSpan starts a span of the webhook's tracer as a child of the span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// NewTracedTransport wraps base so each registry HTTP call is a span of the request context's trace.
+func NewTracedTransport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base, otelhttp.WithSpanNameFormatter(func(_ string, req *http.Request) string {
+		return "registry " + req.Method
+	}))
+}
+
+// endSpan records err on span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// logFor returns the package logger with the trace and span IDs of ctx, so log lines of a request
+// can be found from its trace and the other way around.
+func logFor(ctx context.Context) logr.Logger {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsValid() {
+		return podlog
+	}
+	return podlog.WithValues("trace_id", spanContext.TraceID().String(), "span_id", spanContext.SpanID().String())
+}
@@ -0,0 +1,162 @@
+// PURPOSE: Unit tests for the spans recorded along the admission path, using an in-memory exporter
+package v1
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"mutating-registry-hook/internal/registry"
+	"mutating-registry-hook/internal/registry/auth"
+	"mutating-registry-hook/internal/registry/registrytest"
+)
+
+// recordSpans installs a tracer provider exporting to memory for the duration of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestPodDefaulter_RecordsAdmissionSpans(t *testing.T) {
+	exporter := recordSpans(t)
+
+	target := registrytest.New(t)
+	target.PushImage("nginx", "latest")
+	namespace := resolverNamespace()
+	namespace.Annotations[AnnotationTargetRegistry] = target.Host()
+	namespace.Annotations[AnnotationVerify] = "true"
+	namespace.Annotations[AnnotationRewriteLocalRegistries] = "false"
+	defaulter, _ := newResolvedDefaulter(namespace)
+	defaulter.Rewriter = &registry.Rewriter{Verifier: registry.NewVerifier(registry.VerifierOptions{
+		Client: &http.Client{Transport: auth.NewTransport(NewTracedTransport(target.Client().Transport))},
+	})}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "web-", Namespace: "test-namespace"},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "nginx", Image: testNginxImage},
+			{Name: "local", Image: "localhost:5000/app:v1"},
+		}},
+	}
+	ctx := admission.NewContextWithRequest(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{UID: "req-1", Operation: admissionv1.Create},
+	})
+	if err := defaulter.Default(ctx, pod); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	spans := map[string][]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	if len(spans[spanAdmission]) != 1 || len(spans[spanResolvePolicy]) != 1 || len(spans[spanRewriteImage]) != 2 ||
+		len(spans["registry HEAD"]) == 0 {
+		t.Fatalf("Expected one admission, one policy, two rewrite and registry spans, got %v", spans)
+	}
+
+	root := spans[spanAdmission][0]
+	for key, want := range map[attribute.Key]string{
+		attrUID: "req-1", attrOperation: "CREATE", attrNamespace: "test-namespace", attrDecision: decisionMutated,
+	} {
+		if got := spanAttribute(root, key); got != want {
+			t.Errorf("Expected admission span %s %q, got %q", key, want, got)
+		}
+	}
+	if spans[spanResolvePolicy][0].Parent.SpanID() != root.SpanContext.SpanID() {
+		t.Error("Expected policy resolution to be a child of the admission span")
+	}
+
+	results := map[string]string{}
+	for _, span := range spans[spanRewriteImage] {
+		if span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Error("Expected each image rewrite to be a child of the admission span")
+		}
+		results[spanAttribute(span, attrContainer)] = spanAttribute(span, attrResult)
+		if spanAttribute(span, attrContainer) == "nginx" {
+			for _, call := range spans["registry HEAD"] {
+				if call.Parent.SpanID() != span.SpanContext.SpanID() {
+					t.Error("Expected registry calls to be children of the image rewrite span")
+				}
+			}
+		}
+	}
+	if results["nginx"] != resultRewritten || results["local"] != resultSkipped {
+		t.Errorf("Expected the rewrite results on the image spans, got %v", results)
+	}
+}
+
+func TestPodDefaulter_AdmissionSpanDecision(t *testing.T) {
+	exporter := recordSpans(t)
+	defaulter, _ := newResolvedDefaulter(resolverNamespace())
+
+	for _, tt := range []struct {
+		namespace string
+		image     string
+		want      string
+	}{
+		{"test-namespace", "myregistry.io/nginx:1.25", decisionUnchanged},
+		{"other-namespace", testNginxImage, decisionSkipped},
+	} {
+		exporter.Reset()
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: tt.namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: tt.image}}},
+		}
+		_ = defaulter.Default(context.Background(), pod)
+
+		for _, span := range exporter.GetSpans() {
+			if span.Name == spanAdmission {
+				if got := spanAttribute(span, attrDecision); got != tt.want {
+					t.Errorf("Expected decision %q in %s, got %q", tt.want, tt.namespace, got)
+				}
+			}
+		}
+	}
+}
+
+func TestLogFor_AddsTraceContext(t *testing.T) {
+	recordSpans(t)
+	var out bytes.Buffer
+	previous := podlog
+	podlog = funcr.New(func(prefix, args string) { out.WriteString(args) }, funcr.Options{})
+	t.Cleanup(func() { podlog = previous })
+
+	ctx, span := startSpan(context.Background(), spanAdmission)
+	logFor(ctx).Info("decision")
+	span.End()
+
+	if want := `"trace_id"="` + span.SpanContext().TraceID().String() + `"`; !strings.Contains(out.String(), want) {
+		t.Errorf("Expected the log line to contain %s, got %s", want, out.String())
+	}
+	out.Reset()
+	logFor(context.Background()).Info("decision")
+	if strings.Contains(out.String(), "trace_id") {
+		t.Errorf("Expected no trace context without a span, got %s", out.String())
+	}
+}